@@ -6,6 +6,8 @@ package tlswrapper
 import (
 	"bytes"
 	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -24,6 +26,7 @@ import (
 	"github.com/hexian000/gosnippets/formats"
 	"github.com/hexian000/gosnippets/slog"
 	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/forwarder"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -225,6 +228,12 @@ func (h *apiStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fprintf(w, "%-20s: %d / %d (+%d)\n", "Sessions",
 		stats.NumSessions, int64(stats.NumSessionsCreated)-int64(stats.NumSessionsFinalized), stats.NumHalfOpen)
 	fprintf(w, "%-20s: %d (+%d)\n", "Streams", numStreams, stats.NumStreamsHalfOpen)
+	if stats.FlowBytesDropped > 0 {
+		fprintf(w, "%-20s: %d (%s dropped)\n", "UDP Flows", stats.NumFlows,
+			formats.IECBytes(float64(stats.FlowBytesDropped)))
+	} else {
+		fprintf(w, "%-20s: %d\n", "UDP Flows", stats.NumFlows)
+	}
 	fprintf(w, "%-20s: %d active, %d passive\n", "Stream Opens",
 		stats.StreamOpenActive, stats.StreamOpenPassive)
 	if stats.StreamLatency.Available {
@@ -247,6 +256,8 @@ func (h *apiStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		stats.Authorized, stats.Served-stats.Authorized)
 	fprintf(w, "%-20s: %d (%+d)\n", "Requests",
 		stats.ReqSuccess, stats.ReqTotal-stats.ReqSuccess)
+	fprintf(w, "%-20s: %d inbound, %d outbound\n", "Policy Denials",
+		stats.PolicyDeniedInbound, stats.PolicyDeniedOutbound)
 
 	if !stateless {
 		h.mu.Lock()
@@ -280,6 +291,9 @@ func (h *apiStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			status := "offline"
 			if ss.Active {
 				status = fmt.Sprintf("%d streams", ss.NumStreams)
+				if !ss.CertNotAfter.IsZero() {
+					status += ", cert " + formatTimeLeft(ss.CertNotAfter, now)
+				}
 			}
 			fprintf(w, "%-20s: %s %s\n", ss.PeerIdentity, ss.LastChanged.Format(slog.TimeLayout), status)
 		} else {
@@ -287,6 +301,58 @@ func (h *apiStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(stats.backends) > 0 {
+		fprintf(w, "\n> Pools\n")
+		for _, b := range stats.backends {
+			state := "up"
+			switch {
+			case !b.Healthy:
+				state = "down"
+			case b.Ejected:
+				state = "ejected"
+			}
+			fprintf(w, "%-20s: %s %s, %d conns, %d/%d dials failed\n",
+				b.Pool, b.Addr, state, b.Active, b.Failures, b.Dials)
+		}
+	}
+
+	if len(stats.bandwidth) > 0 {
+		fprintf(w, "\n> Bandwidth\n")
+		for _, b := range stats.bandwidth {
+			scope := b.Scope
+			if b.Name != "" {
+				scope += " " + b.Name
+			}
+			fprintf(w, "%-20s: send %s, receive %s\n", scope, formatRate(b.Send), formatRate(b.Receive))
+		}
+	}
+
+	if len(stats.quotas) > 0 {
+		fprintf(w, "\n> Quotas\n")
+		for _, q := range stats.quotas {
+			fprintf(w, "%-20s: %s\n", q.Peer, formatQuota(q))
+		}
+	}
+
+	if len(stats.certs) > 0 {
+		fprintf(w, "\n> Certificates\n")
+		for _, c := range stats.certs {
+			role := c.Role
+			if c.Identity != "" {
+				role += " " + c.Identity
+			}
+			fprintf(w, "%-20s: %s, %s (%s)\n", c.Subject, role,
+				formatTimeLeft(c.NotAfter, now), c.NotAfter.Format(slog.TimeLayout))
+		}
+	}
+
+	if len(stats.sourceRejects) > 0 {
+		fprintf(w, "\n> Source Rejects\n")
+		for _, r := range stats.sourceRejects {
+			fprintf(w, "%-20s: %s %d\n", r.Listener, r.Rule, r.Rejected)
+		}
+	}
+
 	if evlog > 0 {
 		fprintf(w, "\n> Recent Events\n")
 		if err := h.s.recentEvents.Format(w, evlog); err != nil {
@@ -307,6 +373,7 @@ type serverMetricsCollector struct {
 	authorizedDesc      *prometheus.Desc
 	requestsDesc        *prometheus.Desc
 	requestsSuccessDesc *prometheus.Desc
+	policyDeniedDesc    *prometheus.Desc
 	sessionUpDesc       *prometheus.Desc
 	sessionStreamsDesc  *prometheus.Desc
 
@@ -316,6 +383,21 @@ type serverMetricsCollector struct {
 	sessionStreamsFailedDesc    *prometheus.Desc
 	sessionWireBytesDesc        *prometheus.Desc
 	sessionPayloadBytesDesc     *prometheus.Desc
+
+	backendUpDesc           *prometheus.Desc
+	backendConnectionsDesc  *prometheus.Desc
+	backendDialsDesc        *prometheus.Desc
+	backendDialFailuresDesc *prometheus.Desc
+	sourceRejectedDesc      *prometheus.Desc
+	bandwidthLimitDesc      *prometheus.Desc
+	bandwidthWaitingDesc    *prometheus.Desc
+	bandwidthDelayedDesc    *prometheus.Desc
+	bandwidthDroppedDesc    *prometheus.Desc
+	bandwidthWaitDesc       *prometheus.Desc
+	quotaLimitDesc          *prometheus.Desc
+	quotaUsedDesc           *prometheus.Desc
+	quotaExhaustedDesc      *prometheus.Desc
+	certExpiryDesc          *prometheus.Desc
 }
 
 func newServerMetricsCollector(s *Server) prometheus.Collector {
@@ -353,6 +435,10 @@ func newServerMetricsCollector(s *Server) prometheus.Collector {
 			"tlswrapper_requests_success_total",
 			"Total successful requests.",
 			nil, nil),
+		policyDeniedDesc: prometheus.NewDesc(
+			"tlswrapper_policy_denied_total",
+			"Total streams denied by access policy (inbound=opened by a peer, outbound=toward a peer).",
+			[]string{"direction"}, nil),
 		sessionUpDesc: prometheus.NewDesc(
 			"tlswrapper_session_up",
 			"Whether the session is active (1=active, 0=offline).",
@@ -385,6 +471,62 @@ func newServerMetricsCollector(s *Server) prometheus.Collector {
 			"tlswrapper_session_payload_bytes_total",
 			"Total payload bytes transferred in the session.",
 			[]string{"identity", "direction"}, nil),
+		backendUpDesc: prometheus.NewDesc(
+			"tlswrapper_pool_backend_up",
+			"Whether the pool backend is available (1=healthy and not ejected, 0=otherwise).",
+			[]string{"pool", "backend"}, nil),
+		backendConnectionsDesc: prometheus.NewDesc(
+			"tlswrapper_pool_backend_connections",
+			"Number of connections forwarded to the pool backend.",
+			[]string{"pool", "backend"}, nil),
+		backendDialsDesc: prometheus.NewDesc(
+			"tlswrapper_pool_backend_dials_total",
+			"Total dials to the pool backend.",
+			[]string{"pool", "backend"}, nil),
+		backendDialFailuresDesc: prometheus.NewDesc(
+			"tlswrapper_pool_backend_dial_failures_total",
+			"Total failed dials to the pool backend.",
+			[]string{"pool", "backend"}, nil),
+		sourceRejectedDesc: prometheus.NewDesc(
+			"tlswrapper_source_rejected_total",
+			"Total connections refused by a source address rule.",
+			[]string{"listener", "rule"}, nil),
+		bandwidthLimitDesc: prometheus.NewDesc(
+			"tlswrapper_bandwidth_limit_bytes_per_second",
+			"Configured rate limit (0=unlimited).",
+			[]string{"scope", "name", "direction"}, nil),
+		bandwidthWaitingDesc: prometheus.NewDesc(
+			"tlswrapper_bandwidth_waiting",
+			"Number of stream copies currently waiting for the rate limit.",
+			[]string{"scope", "name", "direction"}, nil),
+		bandwidthDelayedDesc: prometheus.NewDesc(
+			"tlswrapper_bandwidth_delayed_bytes_total",
+			"Total bytes delayed by the rate limit.",
+			[]string{"scope", "name", "direction"}, nil),
+		bandwidthDroppedDesc: prometheus.NewDesc(
+			"tlswrapper_bandwidth_dropped_bytes_total",
+			"Total datagram bytes dropped while waiting for the rate limit.",
+			[]string{"scope", "name", "direction"}, nil),
+		bandwidthWaitDesc: prometheus.NewDesc(
+			"tlswrapper_bandwidth_wait_seconds_total",
+			"Total time stream copies waited for the rate limit.",
+			[]string{"scope", "name", "direction"}, nil),
+		quotaLimitDesc: prometheus.NewDesc(
+			"tlswrapper_quota_limit_bytes",
+			"Configured traffic quota per window (0=unlimited).",
+			[]string{"identity"}, nil),
+		quotaUsedDesc: prometheus.NewDesc(
+			"tlswrapper_quota_used_bytes",
+			"Traffic counted against the quota in the current window.",
+			[]string{"identity", "direction"}, nil),
+		quotaExhaustedDesc: prometheus.NewDesc(
+			"tlswrapper_quota_exhausted",
+			"Whether the traffic quota is used up (1=exhausted).",
+			[]string{"identity"}, nil),
+		certExpiryDesc: prometheus.NewDesc(
+			"tlswrapper_cert_expiry_seconds",
+			"Seconds until the certificate expires (negative once expired).",
+			[]string{"role", "subject"}, nil),
 	}
 }
 
@@ -397,6 +539,7 @@ func (c *serverMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.authorizedDesc
 	ch <- c.requestsDesc
 	ch <- c.requestsSuccessDesc
+	ch <- c.policyDeniedDesc
 	ch <- c.sessionUpDesc
 	ch <- c.sessionStreamsDesc
 	ch <- c.sessionStreamsOpenedDesc
@@ -405,6 +548,20 @@ func (c *serverMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.sessionStreamsFailedDesc
 	ch <- c.sessionWireBytesDesc
 	ch <- c.sessionPayloadBytesDesc
+	ch <- c.backendUpDesc
+	ch <- c.backendConnectionsDesc
+	ch <- c.backendDialsDesc
+	ch <- c.backendDialFailuresDesc
+	ch <- c.sourceRejectedDesc
+	ch <- c.bandwidthLimitDesc
+	ch <- c.bandwidthWaitingDesc
+	ch <- c.bandwidthDelayedDesc
+	ch <- c.bandwidthDroppedDesc
+	ch <- c.bandwidthWaitDesc
+	ch <- c.quotaLimitDesc
+	ch <- c.quotaUsedDesc
+	ch <- c.quotaExhaustedDesc
+	ch <- c.certExpiryDesc
 }
 
 func (c *serverMetricsCollector) Collect(ch chan<- prometheus.Metric) {
@@ -425,6 +582,10 @@ func (c *serverMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 		float64(stats.ReqTotal))
 	ch <- prometheus.MustNewConstMetric(c.requestsSuccessDesc, prometheus.CounterValue,
 		float64(stats.ReqSuccess))
+	ch <- prometheus.MustNewConstMetric(c.policyDeniedDesc, prometheus.CounterValue,
+		float64(stats.PolicyDeniedInbound), "inbound")
+	ch <- prometheus.MustNewConstMetric(c.policyDeniedDesc, prometheus.CounterValue,
+		float64(stats.PolicyDeniedOutbound), "outbound")
 
 	var numStreams uint32
 	for _, ss := range stats.sessions {
@@ -456,6 +617,73 @@ func (c *serverMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 	ch <- prometheus.MustNewConstMetric(c.streamsDesc, prometheus.GaugeValue,
 		float64(numStreams))
+
+	for _, b := range stats.backends {
+		up := 0.0
+		if b.Healthy && !b.Ejected {
+			up = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(c.backendUpDesc, prometheus.GaugeValue,
+			up, b.Pool, b.Addr)
+		ch <- prometheus.MustNewConstMetric(c.backendConnectionsDesc, prometheus.GaugeValue,
+			float64(b.Active), b.Pool, b.Addr)
+		ch <- prometheus.MustNewConstMetric(c.backendDialsDesc, prometheus.CounterValue,
+			float64(b.Dials), b.Pool, b.Addr)
+		ch <- prometheus.MustNewConstMetric(c.backendDialFailuresDesc, prometheus.CounterValue,
+			float64(b.Failures), b.Pool, b.Addr)
+	}
+
+	for _, r := range stats.sourceRejects {
+		ch <- prometheus.MustNewConstMetric(c.sourceRejectedDesc, prometheus.CounterValue,
+			float64(r.Rejected), r.Listener, r.Rule)
+	}
+
+	for _, b := range stats.bandwidth {
+		for _, d := range []struct {
+			direction string
+			r         forwarder.RateStats
+		}{{"tx", b.Send}, {"rx", b.Receive}} {
+			direction, r := d.direction, d.r
+			ch <- prometheus.MustNewConstMetric(c.bandwidthLimitDesc, prometheus.GaugeValue,
+				float64(r.BytesPerSec), b.Scope, b.Name, direction)
+			ch <- prometheus.MustNewConstMetric(c.bandwidthWaitingDesc, prometheus.GaugeValue,
+				float64(r.Waiting), b.Scope, b.Name, direction)
+			ch <- prometheus.MustNewConstMetric(c.bandwidthDelayedDesc, prometheus.CounterValue,
+				float64(r.Delayed), b.Scope, b.Name, direction)
+			ch <- prometheus.MustNewConstMetric(c.bandwidthDroppedDesc, prometheus.CounterValue,
+				float64(r.Dropped), b.Scope, b.Name, direction)
+			ch <- prometheus.MustNewConstMetric(c.bandwidthWaitDesc, prometheus.CounterValue,
+				r.Wait.Seconds(), b.Scope, b.Name, direction)
+		}
+	}
+
+	for _, q := range stats.quotas {
+		exhausted := 0.0
+		if q.Exhausted {
+			exhausted = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(c.quotaLimitDesc, prometheus.GaugeValue,
+			float64(q.Limit), q.Peer)
+		ch <- prometheus.MustNewConstMetric(c.quotaUsedDesc, prometheus.GaugeValue,
+			float64(q.Sent), q.Peer, "tx")
+		ch <- prometheus.MustNewConstMetric(c.quotaUsedDesc, prometheus.GaugeValue,
+			float64(q.Received), q.Peer, "rx")
+		ch <- prometheus.MustNewConstMetric(c.quotaExhaustedDesc, prometheus.GaugeValue,
+			exhausted, q.Peer)
+	}
+
+	// Certificates sharing a role and subject are reported by the one that
+	// expires first; stats.certs is sorted by expiry.
+	seen := make(map[[2]string]struct{})
+	for _, cert := range stats.certs {
+		key := [2]string{cert.Role, cert.Subject}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		ch <- prometheus.MustNewConstMetric(c.certExpiryDesc, prometheus.GaugeValue,
+			cert.NotAfter.Sub(now).Seconds(), cert.Role, cert.Subject)
+	}
 }
 
 func newAPIMetricsHandler(s *Server) http.Handler {
@@ -477,7 +705,105 @@ func newAPIMetricsHandler(s *Server) http.Handler {
 	})
 }
 
-// RunHTTPServer serves health, config, stats, metrics, gc, and stack endpoints.
+// apiQuotaHandler reports the traffic quotas of all tracked peers as a JSON
+// array, or the quota of ?peer=<identity> as an object.
+type apiQuotaHandler struct {
+	s *Server
+}
+
+func (h *apiQuotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var v any = h.s.QuotaStats()
+	if peer := r.URL.Query().Get("peer"); peer != "" {
+		stats, ok := h.s.PeerQuotaStats(peer)
+		if !ok {
+			http.Error(w, "no quota for peer", http.StatusNotFound)
+			return
+		}
+		v = stats
+	}
+	setRespHeader(w.Header(), "application/json", true)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debugf("quota: %s", formats.Error(err))
+	}
+}
+
+type apiEnrollTokenHandler struct {
+	s *Server
+}
+
+// ServeHTTP mints a one-time enrollment token. The "name" query parameter
+// fixes the name in the certificate issued for it; it may only be omitted
+// when enroll.allow_unnamed is set.
+func (h *apiEnrollTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	token, expires, err := h.s.MintEnrollToken(name)
+	if errors.Is(err, ErrEnrollDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrEnrollUnnamed) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.Errorf("enroll: %s", formats.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setRespHeader(w.Header(), "application/json", true)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Token   string    `json:"token"`
+		Name    string    `json:"name,omitempty"`
+		Expires time.Time `json:"expires"`
+	}{token, name, expires}); err != nil {
+		slog.Debugf("enroll: %s", formats.Error(err))
+	}
+}
+
+type apiEnrollIssuedHandler struct {
+	s *Server
+}
+
+// ServeHTTP lists the certificates issued through enrollment.
+func (h *apiEnrollIssuedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	issued, err := h.s.EnrolledCerts()
+	if errors.Is(err, ErrEnrollDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if issued == nil {
+		issued = []EnrolledCert{}
+	}
+	setRespHeader(w.Header(), "application/json", true)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(issued); err != nil {
+		slog.Debugf("enroll: %s", formats.Error(err))
+	}
+}
+
+// RunHTTPServer serves health, config, stats, metrics, quota, enroll, gc, and
+// stack endpoints.
 func RunHTTPServer(l net.Listener, s *Server) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthy", func(w http.ResponseWriter, r *http.Request) {
@@ -486,6 +812,9 @@ func RunHTTPServer(l net.Listener, s *Server) error {
 	mux.Handle("/config", &apiConfigHandler{s: s})
 	mux.Handle("/stats", &apiStatsHandler{s: s})
 	mux.Handle("/metrics", newAPIMetricsHandler(s))
+	mux.Handle("/quota", &apiQuotaHandler{s: s})
+	mux.Handle("/enroll/token", &apiEnrollTokenHandler{s: s})
+	mux.Handle("/enroll/issued", &apiEnrollIssuedHandler{s: s})
 	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -515,3 +844,30 @@ func RunHTTPServer(l net.Listener, s *Server) error {
 	}
 	return server.Serve(l)
 }
+
+// formatRate describes a rate limit and how much it has held streams back.
+func formatRate(r forwarder.RateStats) string {
+	limit := "unlimited"
+	if r.BytesPerSec > 0 {
+		limit = formats.IECBytes(float64(r.BytesPerSec)) + "/s"
+	}
+	if r.Delayed == 0 && r.Waiting == 0 && r.Dropped == 0 {
+		return limit
+	}
+	return fmt.Sprintf("%s (%d waiting, %s delayed for %s, %s dropped)", limit, r.Waiting,
+		formats.IECBytes(float64(r.Delayed)), formats.Duration(r.Wait), formats.IECBytes(float64(r.Dropped)))
+}
+
+// formatQuota describes a peer's usage of its traffic quota.
+func formatQuota(q QuotaStats) string {
+	used := formats.IECBytes(float64(q.Sent + q.Received))
+	if q.Limit <= 0 {
+		return fmt.Sprintf("%s %s, unlimited", used, q.Window)
+	}
+	state := fmt.Sprintf("%s remaining", formats.IECBytes(float64(q.Remaining)))
+	if q.Exhausted {
+		state = "exhausted, " + q.Action
+	}
+	return fmt.Sprintf("%s of %s %s, %s, resets %s", used,
+		formats.IECBytes(float64(q.Limit)), q.Window, state, q.WindowEnd.UTC().Format(time.RFC3339))
+}
@@ -112,6 +112,7 @@ func TestAPIStatsHandler(t *testing.T) {
 	s.stats.authorized.Store(3)
 	s.stats.request.Store(5)
 	s.stats.success.Store(4)
+	s.stats.deniedInbound.Store(6)
 	s.recentEvents.Add(time.Now(), "config loaded")
 	h := &apiStatsHandler{
 		s: s,
@@ -134,7 +135,7 @@ func TestAPIStatsHandler(t *testing.T) {
 			t.Fatalf("Cache-Control = %q, want %q", got, "no-store")
 		}
 		body := rec.Body.String()
-		for _, want := range []string{"Sessions", "Streams", "Requests", "Recent Events", "config loaded"} {
+		for _, want := range []string{"Sessions", "Streams", "Requests", "6 inbound, 0 outbound", "Recent Events", "config loaded"} {
 			if !strings.Contains(body, want) {
 				t.Fatalf("body %q does not contain %q", body, want)
 			}
@@ -179,7 +180,7 @@ func TestAPIMetricsHandler(t *testing.T) {
 			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
 		}
 		body := rec.Body.String()
-		for _, want := range []string{"tlswrapper_uptime_seconds", "tlswrapper_sessions", "tlswrapper_streams"} {
+		for _, want := range []string{"tlswrapper_uptime_seconds", "tlswrapper_sessions", "tlswrapper_streams", `tlswrapper_policy_denied_total{direction="inbound"}`} {
 			if !strings.Contains(body, want) {
 				t.Fatalf("body %q does not contain %q", body, want)
 			}
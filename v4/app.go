@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/hexian000/gosnippets/formats"
@@ -47,6 +48,21 @@ type AppFlags struct {
 	KeyType    string
 	KeySize    int
 	LogLevel   int
+	// Certificate profile for gencerts: "ca", "leaf", or "" for the
+	// historical self-signing certificate.
+	Profile         string
+	SANs            string // comma-separated DNS names, IP addresses and URIs
+	Days            int    // validity in days (0 = 10 years)
+	MaxPathLen      int    // ca profile: intermediate CAs allowed below (-1 = unlimited)
+	NameConstraints string // ca profile: comma-separated permitted DNS domains and CIDRs
+	ReuseKey        bool   // keep existing <name>-key.pem files
+	GenCSR          string // comma-separated names for <name>-csr.pem requests
+	SignCSR         string // comma-separated names of <name>-csr.pem requests to sign
+	Passphrase      string // "env:NAME", "file:PATH" or "credential:NAME" encrypting <name>-key.pem
+	Enroll          string // hub enrollment address, host:port or URL
+	Token           string // enrollment token minted by the hub
+	CheckCerts      bool   // print and check the certificates of Config
+	PeerCert        string // checkcerts: peer certificate chain to check
 }
 
 // Validate checks whether the supplied flag combination is actionable.
@@ -54,12 +70,30 @@ func (f *AppFlags) Validate() error {
 	if f.Help {
 		return nil
 	}
-	if f.GenCerts != "" {
+	if f.Enroll != "" {
+		switch {
+		case f.Token == "":
+			return errors.New("-enroll requires -token")
+		case strings.Contains(f.GenCerts, ","):
+			return errors.New("-enroll takes a single -gencerts name")
+		case f.Sign != "" || f.GenCSR != "" || f.SignCSR != "":
+			return errors.New("-enroll cannot be combined with -sign, -gencsr or -signcsr")
+		}
 		return nil
 	}
+	if f.GenCerts != "" || f.GenCSR != "" || f.SignCSR != "" {
+		if f.SignCSR != "" && f.Sign == "" {
+			return errors.New("-signcsr requires -sign")
+		}
+		_, err := newCertOptions(f)
+		return err
+	}
 	if f.DumpConfig {
 		return nil
 	}
+	if f.PeerCert != "" && !f.CheckCerts {
+		return errors.New("-peercert requires -checkcerts")
+	}
 	if f.Config == "" {
 		return errors.New("config file is not specified")
 	}
@@ -113,12 +147,18 @@ func AppMain(f *AppFlags) int {
 		flag.Usage()
 		return 1
 	}
-	if f.GenCerts != "" {
+	if f.Enroll != "" {
+		return enroll(f)
+	}
+	if f.GenCerts != "" || f.GenCSR != "" || f.SignCSR != "" {
 		return genCerts(f)
 	}
 	if f.DumpConfig {
 		return dumpConfig(f)
 	}
+	if f.CheckCerts {
+		return checkCerts(f)
+	}
 	var cfg *config.File
 	var err error
 	if f.Config == "-" {
@@ -26,7 +26,19 @@ func TestAppFlagsValidate(t *testing.T) {
 	}{
 		{name: "help", flags: AppFlags{Help: true}},
 		{name: "gencerts", flags: AppFlags{GenCerts: "peer"}},
+		{name: "gencsr", flags: AppFlags{GenCSR: "peer", Profile: "leaf"}},
+		{name: "signcsr", flags: AppFlags{SignCSR: "peer", Sign: "ca"}},
+		{name: "signcsr-without-signer", flags: AppFlags{SignCSR: "peer"}, wantErr: true},
+		{name: "gencerts-invalid-profile", flags: AppFlags{GenCerts: "peer", Profile: "root"}, wantErr: true},
+		{name: "enroll", flags: AppFlags{Enroll: "hub:8443", Token: "tw1.a.b"}},
+		{name: "enroll-named", flags: AppFlags{Enroll: "hub:8443", Token: "tw1.a.b", GenCerts: "node1"}},
+		{name: "enroll-without-token", flags: AppFlags{Enroll: "hub:8443"}, wantErr: true},
+		{name: "enroll-several-names", flags: AppFlags{Enroll: "hub:8443", Token: "tw1.a.b", GenCerts: "a,b"}, wantErr: true},
+		{name: "enroll-with-signer", flags: AppFlags{Enroll: "hub:8443", Token: "tw1.a.b", Sign: "ca"}, wantErr: true},
 		{name: "dumpconfig", flags: AppFlags{DumpConfig: true}},
+		{name: "checkcerts", flags: AppFlags{CheckCerts: true, Config: "cfg.json", PeerCert: "peer.pem"}},
+		{name: "checkcerts-without-config", flags: AppFlags{CheckCerts: true}, wantErr: true},
+		{name: "peercert-without-checkcerts", flags: AppFlags{Config: "cfg.json", PeerCert: "peer.pem"}, wantErr: true},
 		{name: "missing-config", flags: AppFlags{}, wantErr: true},
 		{name: "config-present", flags: AppFlags{Config: "server.json"}},
 	}
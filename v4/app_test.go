@@ -4,16 +4,27 @@
 package tlswrapper_test
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
 	"testing"
 	"time"
 
@@ -232,111 +243,1705 @@ func TestForwardIdentityListenMuxConnect(t *testing.T) {
 	}
 }
 
-func TestShutdownClosesServiceListeners(t *testing.T) {
+// TestForwardNamedService verifies that identity.listen "peer#service" keys
+// request a named service which the accepting side resolves via services,
+// and that requests for unknown services are refused:
+//
+//	[test conn] → [client identity.listen["server#echo"]] ──mux──> [server services["echo"]] → [echo server]
+func TestForwardNamedService(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+	echoListenAddr := freePort(t)
+	unknownListenAddr := freePort(t)
+
+	// Server: no default connect, only the named "echo" service.
+	srvCfg := newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"services":   map[string]any{"echo": echoAddr},
+		"identity":   map[string]any{"claim": "server"},
+	})
+	srv, err := tlswrapper.NewServer(srvCfg)
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	cliCfg := newPlaintextConfig(t, map[string]any{
+		"identity": map[string]any{
+			"claim":       "client",
+			"mux_connect": []string{muxAddr},
+			"listen": map[string]any{
+				"server#echo":    echoListenAddr,
+				"server#missing": unknownListenAddr,
+			},
+		},
+	})
+	cli, err := tlswrapper.NewServer(cliCfg)
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	t.Run("known-service", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", echoListenAddr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		want := []byte("hello named service")
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		got := make([]byte, len(want))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unknown-service", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", unknownListenAddr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("dropped"))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes from unknown service, want EOF", n)
+		}
+	})
+}
+
+// TestForwardRelay verifies that a hub relays streams between two peers that
+// both dial it, and only for permitted identities:
+//
+//	[test conn] → [alice routes carol via bob] ──mux──> [bob] ──mux──> [carol] → [echo server]
+func TestForwardRelay(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	hubAddr := freePort(t)
+	carolListen := freePort(t)
+	deniedListen := freePort(t)
+
+	hub, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": hubAddr,
+		"identity": map[string]any{
+			"claim":       "bob",
+			"allow_relay": map[string]any{"alice": []string{"carol"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal("hub create:", err)
+	}
+	if err := hub.Start(); err != nil {
+		t.Fatal("hub start:", err)
+	}
+	t.Cleanup(func() { _ = hub.Shutdown() })
+	for _, id := range []string{"carol", "dave"} {
+		peer, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+			"connect": echoAddr,
+			"identity": map[string]any{
+				"claim":       id,
+				"mux_connect": []string{hubAddr},
+			},
+		}))
+		if err != nil {
+			t.Fatal(id, "create:", err)
+		}
+		if err := peer.Start(); err != nil {
+			t.Fatal(id, "start:", err)
+		}
+		t.Cleanup(func() { _ = peer.Shutdown() })
+		waitFor(t, 5*time.Second, func() bool { return peer.Stats().NumSessions > 0 })
+	}
+	alice, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"identity": map[string]any{
+			"claim":       "alice",
+			"mux_connect": []string{hubAddr},
+			"routes":      map[string]any{"carol": "bob", "dave": "bob"},
+			"listen":      map[string]any{"carol": carolListen, "dave": deniedListen},
+		},
+	}))
+	if err != nil {
+		t.Fatal("alice create:", err)
+	}
+	if err := alice.Start(); err != nil {
+		t.Fatal("alice start:", err)
+	}
+	t.Cleanup(func() { _ = alice.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return alice.Stats().NumSessions > 0 })
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", carolListen, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		want := []byte("hello through the hub")
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		got := make([]byte, len(want))
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", deniedListen, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("dropped"))
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes through a denied relay, want EOF", n)
+		}
+	})
+}
+
+// TestForwardPolicy verifies that access policies limit which targets a peer
+// may open, how many streams it may keep open, and which peers our listeners
+// may reach:
+//
+//	[test conn] → [alice] ──mux──> [server: alice may open "echo", 1 stream] → [echo server]
+//	[test conn] → [bob: no rule for server] ✗
+func TestForwardPolicy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+	echoListen := freePort(t)
+	connectListen := freePort(t)
+	bobListen := freePort(t)
+
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    echoAddr,
+		"services":   map[string]any{"echo": echoAddr},
+		"identity":   map[string]any{"claim": "server"},
+		"policies": []map[string]any{
+			{"identities": []string{"alice"}, "services": []string{"echo"}, "max_streams": 1},
+		},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	newClient := func(claim string, listen map[string]any, policies []map[string]any) *tlswrapper.Server {
+		cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+			"identity": map[string]any{
+				"claim":       claim,
+				"mux_connect": []string{muxAddr},
+				"listen":      listen,
+			},
+			"policies": policies,
+		}))
+		if err != nil {
+			t.Fatal(claim, "create:", err)
+		}
+		if err := cli.Start(); err != nil {
+			t.Fatal(claim, "start:", err)
+		}
+		t.Cleanup(func() { _ = cli.Shutdown() })
+		waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+		return cli
+	}
+	newClient("alice", map[string]any{"server#echo": echoListen, "server": connectListen},
+		[]map[string]any{{"identities": []string{"server"}, "receive": true}})
+	bob := newClient("bob", map[string]any{"server#echo": bobListen},
+		[]map[string]any{{"identities": []string{"other"}, "receive": true}})
+
+	dial := func(t *testing.T, addr string) net.Conn {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	echo := func(conn net.Conn, msg string) error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		got := make([]byte, len(msg))
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := io.ReadFull(conn, got)
+		return err
+	}
+
+	held := dial(t, echoListen)
+	if err := echo(held, "allowed service"); err != nil {
+		t.Fatal("allowed service:", err)
+	}
+	if err := echo(dial(t, echoListen), "over the limit"); err == nil {
+		t.Fatal("second stream exceeded max_streams but was forwarded")
+	}
+	if err := echo(dial(t, connectListen), "default target"); err == nil {
+		t.Fatal("default target was forwarded without connect permission")
+	}
+	_ = held.Close()
+	waitFor(t, 5*time.Second, func() bool {
+		return echo(dial(t, echoListen), "after release") == nil
+	})
+	if got := srv.Stats().PolicyDeniedInbound; got < 2 {
+		t.Fatalf("PolicyDeniedInbound = %d, want at least 2", got)
+	}
+
+	if err := echo(dial(t, bobListen), "outbound denied"); err == nil {
+		t.Fatal("bob's listener reached a peer it may not send to")
+	}
+	if got := bob.Stats().PolicyDeniedOutbound; got != 1 {
+		t.Fatalf("PolicyDeniedOutbound = %d, want 1", got)
+	}
+}
+
+// TestForwardPolicyUDP verifies that UDP listeners open no flows toward a
+// peer our policies do not let receive them:
+//
+//	[udp client] → [bob: no rule for server] ✗
+func TestForwardPolicyUDP(t *testing.T) {
+	echoAddr := startUDPEchoServer(t)
+	muxAddr := freePort(t)
+	udpListen := freeUDPPort(t)
+
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen":  muxAddr,
+		"udp_connect": echoAddr,
+		"identity":    map[string]any{"claim": "server"},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	bob, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"identity": map[string]any{
+			"claim":       "bob",
+			"mux_connect": []string{muxAddr},
+			"udp_listen":  map[string]any{"server": udpListen},
+		},
+		"policies": []map[string]any{{"identities": []string{"other"}, "receive": true}},
+	}))
+	if err != nil {
+		t.Fatal("bob create:", err)
+	}
+	if err := bob.Start(); err != nil {
+		t.Fatal("bob start:", err)
+	}
+	t.Cleanup(func() { _ = bob.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return bob.Stats().NumSessions > 0 })
+
+	conn, err := net.Dial("udp", udpListen)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("outbound denied")); err != nil {
+		t.Fatal("write:", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("read %d bytes through a flow to a peer bob may not send to", n)
+	}
+	if got := bob.Stats().PolicyDeniedOutbound; got != 1 {
+		t.Fatalf("PolicyDeniedOutbound = %d, want 1", got)
+	}
+	if got := bob.Stats().NumFlows; got != 0 {
+		t.Fatalf("NumFlows = %d, want 0", got)
+	}
+}
+
+// TestForwardPool verifies that a connect target naming a pool skips a dead
+// backend and forwards every stream to the live one:
+//
+//	[test conn] → [client] ──mux──> [server connect "web"] → {dead, echo}
+func TestForwardPool(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	deadAddr := freePort(t)
+	muxAddr := freePort(t)
+	listenAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    "web",
+		"pools": map[string]any{
+			"web": map[string]any{"backends": []string{deadAddr, echoAddr}, "max_fails": 1},
+		},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_connect": muxAddr,
+		"listen":      listenAddr,
+	}))
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	for i := range 4 {
+		conn, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		want := []byte(fmt.Sprintf("pooled stream %d", i))
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		got := make([]byte, len(want))
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("stream %d: read: %v", i, err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+		_ = conn.Close()
+	}
+}
+
+// TestForwardBandwidth verifies that a listener rate limit throttles the
+// streams accepted on it and that a reload lifts it for the next transfer.
+func TestForwardBandwidth(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+	listenAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    echoAddr,
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	cliConfig := func(send int64) map[string]any {
+		return map[string]any{
+			"mux_connect": muxAddr,
+			"listen":      listenAddr,
+			"bandwidth": map[string]any{
+				"listeners": map[string]any{
+					listenAddr: map[string]any{"send": send, "burst": 8 * 1024},
+				},
+			},
+		}
+	}
+	cli, err := tlswrapper.NewServer(newPlaintextConfig(t, cliConfig(64*1024)))
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	conn, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	echo := func() time.Duration {
+		t.Helper()
+		want := bytes.Repeat([]byte("rate limited "), 4*1024)
+		start := time.Now()
+		go func() { _, _ = conn.Write(want) }()
+		got := make([]byte, len(want))
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("echo mismatch")
+		}
+		return time.Since(start)
+	}
+	// 52 KiB at 64 KiB/s with an 8 KiB burst takes at least 680ms.
+	if elapsed := echo(); elapsed < 500*time.Millisecond {
+		t.Fatalf("limited transfer took %v, want throttling", elapsed)
+	}
+	if err := cli.ReloadConfig(newPlaintextConfig(t, cliConfig(0))); err != nil {
+		t.Fatal("reload:", err)
+	}
+	if elapsed := echo(); elapsed > 400*time.Millisecond {
+		t.Fatalf("transfer took %v after the limit was lifted", elapsed)
+	}
+}
+
+// TestForwardQuota verifies that once a peer used up its traffic quota, the
+// stream in progress completes but new streams are refused.
+func TestForwardQuota(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
 	listenAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    echoAddr,
+		"quotas":     map[string]any{"*": map[string]any{"bytes": 1024}},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_connect": muxAddr,
+		"listen":      listenAddr,
+	}))
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	conn, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	want := bytes.Repeat([]byte("quota "), 256)
+	go func() { _, _ = conn.Write(want) }()
+	got := make([]byte, len(want))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echo mismatch")
+	}
+	stats := srv.QuotaStats()
+	if len(stats) != 1 || !stats[0].Exhausted || stats[0].Sent != uint64(len(want)) {
+		t.Fatalf("quota stats = %+v, want an exhausted quota", stats)
+	}
+
+	conn2, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = conn2.Close() })
+	_, _ = conn2.Write([]byte("refused"))
+	_ = conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn2.Read(make([]byte, 16)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %d bytes, %v; want the stream refused", n, err)
+	}
+}
+
+// TestForwardPerPeerConnect verifies that the accepting side selects the
+// forwarding target from identity.connect by the opening peer's identity:
+//
+//	[test conn] → [client "alice"] ──mux──> [server identity.connect["alice"]] → [echo server]
+//	[test conn] → [client "bob"]   ──mux──> [server: no target for "bob"]
+func TestForwardPerPeerConnect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+
+	srvCfg := newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"identity": map[string]any{
+			"claim":   "server",
+			"connect": map[string]any{"alice": echoAddr},
+		},
+	})
+	srv, err := tlswrapper.NewServer(srvCfg)
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	startClient := func(claim string) string {
+		listenAddr := freePort(t)
+		cliCfg := newPlaintextConfig(t, map[string]any{
+			"identity": map[string]any{
+				"claim":       claim,
+				"mux_connect": []string{muxAddr},
+				"listen":      map[string]any{"server": listenAddr},
+			},
+		})
+		cli, err := tlswrapper.NewServer(cliCfg)
+		if err != nil {
+			t.Fatal("client create:", err)
+		}
+		if err := cli.Start(); err != nil {
+			t.Fatal("client start:", err)
+		}
+		t.Cleanup(func() { _ = cli.Shutdown() })
+		waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+		return listenAddr
+	}
+	aliceAddr := startClient("alice")
+	bobAddr := startClient("bob")
+
+	t.Run("mapped-peer", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", aliceAddr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		want := []byte("hello per-peer connect")
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		got := make([]byte, len(want))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unmapped-peer", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", bobAddr, 3*time.Second)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("dropped"))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes without a target for peer, want EOF", n)
+		}
+	})
+}
+
+func TestShutdownClosesServiceListeners(t *testing.T) {
+	listenAddr := freePort(t)
+
+	cfg := newPlaintextConfig(t, map[string]any{
+		"identity": map[string]any{
+			"listen": map[string]any{
+				"peer-a": listenAddr,
+			},
+		},
+	})
+	srv, err := tlswrapper.NewServer(cfg)
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("server shutdown:", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server shutdown blocked with service listener active")
+	}
+}
+
+// freeUDPPort returns an available UDP address on localhost by briefly
+// binding to :0 and immediately closing the listener.
+func freeUDPPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().String()
+	_ = l.Close()
+	return addr
+}
+
+// newH3TLSPair generates a self-signed ECDSA P256 certificate for each side
+// (server and client), both with IP SAN 127.0.0.1.
+// Returns the PEM-encoded cert and key for each side.
+func newH3TLSPair(t *testing.T) (serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM string) {
+	t.Helper()
+	makeCert := func(cn string) (certPEM, keyPEM string) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatalf("x509.CreateCertificate: %v", err)
+		}
+		privDER, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+		}
+		certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+		keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER}))
+		return
+	}
+	serverCertPEM, serverKeyPEM = makeCert("h3mux-server")
+	clientCertPEM, clientKeyPEM = makeCert("h3mux-client")
+	return
+}
+
+// TestForwardH3MuxBidirectional verifies end-to-end bidirectional TCP
+// forwarding through an h3mux (QUIC+TLS) session using self-signed certificates:
+//
+//	[test conn] → [client Listen] ──h3mux/QUIC──> [server MuxListen] → [echo server]
+func TestForwardH3MuxBidirectional(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	muxAddr := freeUDPPort(t)
+	clientListenAddr := freePort(t)
+	serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM := newH3TLSPair(t)
+
+	// Session server: accepts h3mux sessions, forwards streams to the echo server.
+	srvCfg := newPlaintextConfig(t, map[string]any{
+		"mux_protocol": "h3mux",
+		"mux_listen":   muxAddr,
+		"connect":      echoAddr,
+		"tls": map[string]any{
+			"cert":      serverCertPEM,
+			"key":       serverKeyPEM,
+			"authcerts": []string{clientCertPEM},
+			"sni":       "127.0.0.1", // test certs carry an IP SAN only
+		},
+	})
+	srv, err := tlswrapper.NewServer(srvCfg)
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	// Session client: dials the h3mux server, exposes a local TCP listener.
+	cliCfg := newPlaintextConfig(t, map[string]any{
+		"mux_protocol": "h3mux",
+		"mux_connect":  muxAddr,
+		"listen":       clientListenAddr,
+		"identity":     map[string]any{"claim": "test-client"},
+		"tls": map[string]any{
+			"cert":      clientCertPEM,
+			"key":       clientKeyPEM,
+			"authcerts": []string{serverCertPEM},
+			"sni":       "127.0.0.1", // test certs carry an IP SAN only
+		},
+	})
+	cli, err := tlswrapper.NewServer(cliCfg)
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+
+	// Wait for the outbound h3mux session to be established (up to 5 s).
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	// Connect through the session and verify bidirectional forwarding.
+	conn, err := net.DialTimeout("tcp", clientListenAddr, 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer conn.Close()
+
+	want := []byte("hello h3mux bidirectional forwarding")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal("write:", err)
+	}
+	got := make([]byte, len(want))
+	if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("echo mismatch: got %q, want %q", got, want)
+	}
+}
+
+// TestVerifyIdentityH3Mux verifies that a server with tls.verify_identity
+// rejects sessions whose identity claim does not match the client certificate
+// CN, and accepts those that do.
+func TestVerifyIdentityH3Mux(t *testing.T) {
+	serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM := newH3TLSPair(t)
+
+	for _, tc := range []struct {
+		claim  string
+		accept bool
+	}{
+		{"h3mux-client", true},
+		{"impostor", false},
+	} {
+		t.Run(tc.claim, func(t *testing.T) {
+			muxAddr := freeUDPPort(t)
+			srvCfg := newPlaintextConfig(t, map[string]any{
+				"mux_protocol": "h3mux",
+				"mux_listen":   muxAddr,
+				"connect":      startEchoServer(t),
+				"tls": map[string]any{
+					"cert":            serverCertPEM,
+					"key":             serverKeyPEM,
+					"authcerts":       []string{clientCertPEM},
+					"sni":             "127.0.0.1",
+					"verify_identity": true,
+				},
+			})
+			srv, err := tlswrapper.NewServer(srvCfg)
+			if err != nil {
+				t.Fatal("server create:", err)
+			}
+			if err := srv.Start(); err != nil {
+				t.Fatal("server start:", err)
+			}
+			t.Cleanup(func() { _ = srv.Shutdown() })
+
+			cliCfg := newPlaintextConfig(t, map[string]any{
+				"mux_protocol": "h3mux",
+				"mux_connect":  muxAddr,
+				"identity":     map[string]any{"claim": tc.claim},
+				"tls": map[string]any{
+					"cert":      clientCertPEM,
+					"key":       clientKeyPEM,
+					"authcerts": []string{serverCertPEM},
+					"sni":       "127.0.0.1",
+				},
+			})
+			cli, err := tlswrapper.NewServer(cliCfg)
+			if err != nil {
+				t.Fatal("client create:", err)
+			}
+			if err := cli.Start(); err != nil {
+				t.Fatal("client start:", err)
+			}
+			t.Cleanup(func() { _ = cli.Shutdown() })
+
+			if tc.accept {
+				waitFor(t, 5*time.Second, func() bool { return srv.Stats().NumSessions > 0 })
+				return
+			}
+			time.Sleep(time.Second)
+			if n := srv.Stats().NumSessions; n != 0 {
+				t.Fatalf("server NumSessions = %d, want 0 for mismatched claim", n)
+			}
+			if n := cli.Stats().NumSessions; n != 0 {
+				t.Fatalf("client NumSessions = %d, want 0 for mismatched claim", n)
+			}
+		})
+	}
+}
+
+// testCA is a certificate authority issuing test peer certificates and CRLs.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{t: t, cert: cert, key: key,
+		pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))}
+}
+
+// issue returns a peer certificate for cn with the given serial number.
+func (ca *testCA) issue(cn string, serial int64) (certPEM, keyPEM string) {
+	t := ca.t
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// revoke returns a CRL listing the serial numbers.
+func (ca *testCA) revoke(serials ...int64) string {
+	t := ca.t
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("x509.CreateRevocationList: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}))
+}
+
+// TestRevokedPeerCertificate verifies that a CRL added on reload closes the
+// session of the revoked peer only, and that the peer cannot reconnect:
+//
+//	[client "alice" (revoked)] ──mux──X [server authcerts: CA]
+//	[client "bob"]             ──mux──> [server authcerts: CA]
+func TestRevokedPeerCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCertPEM, serverKeyPEM := ca.issue("server", 100)
+	muxAddr := freePort(t)
+	echoAddr := startEchoServer(t)
+	srvConfig := func(crl ...string) map[string]any {
+		return map[string]any{
+			"mux_listen": muxAddr,
+			"connect":    echoAddr,
+			"tls": map[string]any{
+				"cert":      serverCertPEM,
+				"key":       serverKeyPEM,
+				"authcerts": []string{ca.pem},
+				"crl":       crl,
+				"sni":       "127.0.0.1", // test certs carry an IP SAN only
+			},
+		}
+	}
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, srvConfig()))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	clients := make(map[string]*tlswrapper.Server)
+	for i, name := range []string{"alice", "bob"} {
+		certPEM, keyPEM := ca.issue(name, int64(i+1))
+		cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+			"mux_connect": muxAddr,
+			"identity":    map[string]any{"claim": name},
+			"tls": map[string]any{
+				"cert":      certPEM,
+				"key":       keyPEM,
+				"authcerts": []string{ca.pem},
+				"sni":       "127.0.0.1",
+			},
+		}))
+		if err != nil {
+			t.Fatal("client create:", err)
+		}
+		if err := cli.Start(); err != nil {
+			t.Fatal("client start:", err)
+		}
+		t.Cleanup(func() { _ = cli.Shutdown() })
+		clients[name] = cli
+	}
+	waitFor(t, 5*time.Second, func() bool { return srv.Stats().NumSessions == 2 })
+
+	if err := srv.ReloadConfig(newPlaintextConfig(t, srvConfig(ca.revoke(1)))); err != nil {
+		t.Fatal("reload:", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return srv.Stats().NumSessions == 1 })
+	// The client redials, but the handshake fails.
+	time.Sleep(time.Second)
+	if n := clients["alice"].Stats().NumSessions; n != 0 {
+		t.Fatalf("revoked client NumSessions = %d, want 0", n)
+	}
+	stats := clients["bob"].Stats()
+	if stats.NumSessions != 1 || stats.NumSessionsCreated != 1 {
+		t.Fatalf("bob: %d sessions, %d created; want the session undisturbed", stats.NumSessions, stats.NumSessionsCreated)
+	}
+}
+
+// certSums returns the SPKI pin and the certificate fingerprint of certPEM.
+func certSums(t *testing.T, certPEM string) (spkiPin, fingerprint string) {
+	t.Helper()
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo), sha256.Sum256(cert.Raw)
+	return "sha256/" + base64.StdEncoding.EncodeToString(spki[:]), hex.EncodeToString(sum[:])
+}
+
+// TestPinnedPeerCertificate verifies pins mixed with a CA in authcerts. The
+// server pins alice by key while her certificate comes from an unlisted CA,
+// as if it were re-signed; bob chains to the listed CA; the clients pin the
+// server certificate by fingerprint:
+//
+//	[client "alice" (pinned key)]   ──mux──> [server authcerts: pin, CA]
+//	[client "bob" (CA signed)]      ──mux──> [server authcerts: pin, CA]
+//	[client "carol" (unlisted CA)]  ──mux──X [server authcerts: pin, CA]
+func TestPinnedPeerCertificate(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	serverCertPEM, serverKeyPEM := ca.issue("server", 100)
+	_, serverFingerprint := certSums(t, serverCertPEM)
+	aliceCertPEM, aliceKeyPEM := other.issue("alice", 1)
+	alicePin, _ := certSums(t, aliceCertPEM)
+	bobCertPEM, bobKeyPEM := ca.issue("bob", 2)
+	carolCertPEM, carolKeyPEM := other.issue("carol", 3)
+
+	muxAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    startEchoServer(t),
+		"tls": map[string]any{
+			"cert":      serverCertPEM,
+			"key":       serverKeyPEM,
+			"authcerts": []string{alicePin, ca.pem},
+		},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	clients := make(map[string]*tlswrapper.Server)
+	for name, pair := range map[string][2]string{
+		"alice": {aliceCertPEM, aliceKeyPEM},
+		"bob":   {bobCertPEM, bobKeyPEM},
+		"carol": {carolCertPEM, carolKeyPEM},
+	} {
+		cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+			"mux_connect": muxAddr,
+			"identity":    map[string]any{"claim": name},
+			"tls": map[string]any{
+				"cert":      pair[0],
+				"key":       pair[1],
+				"authcerts": []string{serverFingerprint},
+			},
+		}))
+		if err != nil {
+			t.Fatal("client create:", err)
+		}
+		if err := cli.Start(); err != nil {
+			t.Fatal("client start:", err)
+		}
+		t.Cleanup(func() { _ = cli.Shutdown() })
+		clients[name] = cli
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return clients["alice"].Stats().NumSessions == 1 && clients["bob"].Stats().NumSessions == 1
+	})
+	time.Sleep(time.Second)
+	if n := clients["carol"].Stats().NumSessions; n != 0 {
+		t.Fatalf("unpinned client NumSessions = %d, want 0", n)
+	}
+	if n := srv.Stats().NumSessions; n != 2 {
+		t.Fatalf("server NumSessions = %d, want 2", n)
+	}
+	peers := make(map[string]string)
+	for _, v := range srv.CertExpiry() {
+		if v.Role == "peer" {
+			peers[v.Identity] = v.Subject
+		}
+	}
+	if len(peers) != 2 || peers["alice"] != "alice" || peers["bob"] != "bob" {
+		t.Fatalf("peer certificates = %v, want alice and bob", peers)
+	}
+}
+
+// TestForwardPSK verifies that h2mux sessions authenticated with pre-shared
+// keys are established for clients holding any configured key, and refused
+// for a client with a key the server does not know.
+func TestForwardPSK(t *testing.T) {
+	newKey := func() string {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	oldKey, curKey := newKey(), newKey()
+	echoAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen": muxAddr,
+		"connect":    echoAddr,
+		"psk":        map[string]any{"keys": map[string]string{"2025": oldKey, "2026": curKey}, "key_id": "2026"},
+	}))
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	clients := make(map[string]*tlswrapper.Server)
+	listenAddrs := make(map[string]string)
+	for name, keys := range map[string]map[string]string{
+		"old":     {"2025": oldKey},
+		"current": {"2026": curKey},
+		"forged":  {"2026": newKey()},
+	} {
+		listenAddrs[name] = freePort(t)
+		cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+			"mux_connect": muxAddr,
+			"listen":      listenAddrs[name],
+			"identity":    map[string]any{"claim": name},
+			"psk":         map[string]any{"keys": keys},
+		}))
+		if err != nil {
+			t.Fatal("client create:", err)
+		}
+		if err := cli.Start(); err != nil {
+			t.Fatal("client start:", err)
+		}
+		t.Cleanup(func() { _ = cli.Shutdown() })
+		clients[name] = cli
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return clients["old"].Stats().NumSessions == 1 && clients["current"].Stats().NumSessions == 1
+	})
+	time.Sleep(time.Second)
+	if n := clients["forged"].Stats().NumSessions; n != 0 {
+		t.Fatalf("client with unknown key NumSessions = %d, want 0", n)
+	}
+	if n := srv.Stats().NumSessions; n != 2 {
+		t.Fatalf("server NumSessions = %d, want 2", n)
+	}
+
+	conn, err := net.DialTimeout("tcp", listenAddrs["current"], 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer conn.Close()
+	want := []byte("hello pre-shared key")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal("write:", err)
+	}
+	got := make([]byte, len(want))
+	if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("echo mismatch: got %q, want %q", got, want)
+	}
+}
+
+// startUDPEchoServer starts a UDP server that echoes every datagram back to
+// its sender and returns its address.
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// TestForwardUDP verifies end-to-end UDP forwarding over both mux protocols,
+// with one flow per client source address:
+//
+//	[udp client] → [client udp_listen] ──mux──> [server udp_connect] → [udp echo]
+func TestForwardUDP(t *testing.T) {
+	serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM := newH3TLSPair(t)
+	for _, proto := range []string{"h2mux", "h3mux"} {
+		t.Run(proto, func(t *testing.T) {
+			echoAddr := startUDPEchoServer(t)
+			udpListenAddr := freeUDPPort(t)
+			srvOverrides := map[string]any{
+				"mux_protocol": proto,
+				"udp_connect":  echoAddr,
+			}
+			cliOverrides := map[string]any{
+				"mux_protocol": proto,
+				"udp_listen":   udpListenAddr,
+			}
+			if proto == "h3mux" {
+				muxAddr := freeUDPPort(t)
+				srvOverrides["mux_listen"] = muxAddr
+				srvOverrides["tls"] = map[string]any{
+					"cert":      serverCertPEM,
+					"key":       serverKeyPEM,
+					"authcerts": []string{clientCertPEM},
+					"sni":       "127.0.0.1", // test certs carry an IP SAN only
+				}
+				cliOverrides["mux_connect"] = muxAddr
+				cliOverrides["tls"] = map[string]any{
+					"cert":      clientCertPEM,
+					"key":       clientKeyPEM,
+					"authcerts": []string{serverCertPEM},
+					"sni":       "127.0.0.1",
+				}
+			} else {
+				muxAddr := freePort(t)
+				srvOverrides["mux_listen"] = muxAddr
+				cliOverrides["mux_connect"] = muxAddr
+			}
+			srv, err := tlswrapper.NewServer(newPlaintextConfig(t, srvOverrides))
+			if err != nil {
+				t.Fatal("server create:", err)
+			}
+			if err := srv.Start(); err != nil {
+				t.Fatal("server start:", err)
+			}
+			t.Cleanup(func() { _ = srv.Shutdown() })
+			cli, err := tlswrapper.NewServer(newPlaintextConfig(t, cliOverrides))
+			if err != nil {
+				t.Fatal("client create:", err)
+			}
+			if err := cli.Start(); err != nil {
+				t.Fatal("client start:", err)
+			}
+			t.Cleanup(func() { _ = cli.Shutdown() })
+			waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
 
-	cfg := newPlaintextConfig(t, map[string]any{
-		"identity": map[string]any{
-			"listen": map[string]any{
-				"peer-a": listenAddr,
-			},
-		},
+			clients := make([]net.Conn, 2)
+			for i := range clients {
+				conn, err := net.Dial("udp", udpListenAddr)
+				if err != nil {
+					t.Fatal("dial:", err)
+				}
+				defer conn.Close()
+				clients[i] = conn
+			}
+			buf := make([]byte, 2048)
+			for round := 0; round < 3; round++ {
+				for i, conn := range clients {
+					want := []byte{byte('a' + i), byte('0' + round)}
+					if _, err := conn.Write(want); err != nil {
+						t.Fatal("write:", err)
+					}
+					if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+						t.Fatal(err)
+					}
+					n, err := conn.Read(buf)
+					if err != nil {
+						t.Fatalf("client %d round %d: read: %v", i, round, err)
+					}
+					if string(buf[:n]) != string(want) {
+						t.Fatalf("client %d got %q, want %q", i, buf[:n], want)
+					}
+				}
+			}
+			if got := cli.Stats().NumFlows; got != uint32(len(clients)) {
+				t.Fatalf("client NumFlows = %d, want %d", got, len(clients))
+			}
+		})
+	}
+}
+
+// socks5Connect performs a no-auth SOCKS5 CONNECT to dest ("ip:port") through
+// the SOCKS5 server at proxyAddr and returns the connection and reply code.
+func socks5Connect(t *testing.T, proxyAddr, dest string) (net.Conn, byte) {
+	t.Helper()
+	ap, err := netip.ParseAddrPort(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, 3*time.Second)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	ip := ap.Addr().As4()
+	req := []byte{5, 1, 0, 5, 1, 0, 1}
+	req = append(req, ip[:]...)
+	req = append(req, byte(ap.Port()>>8), byte(ap.Port()))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal("write:", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("read reply:", err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		t.Fatalf("method reply = %v", reply[:2])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, reply[3]
+}
+
+// TestForwardSOCKS5 verifies that destinations requested on a SOCKS5 listener
+// are dialed by the peer, subject to its allow_destinations:
+//
+//	[socks5 client] → [client socks5_listen] ──h2mux──> [server] → [destination]
+func TestForwardSOCKS5(t *testing.T) {
+	allowedAddr := startEchoServer(t)
+	deniedAddr := startEchoServer(t)
+	muxAddr := freePort(t)
+	socksAddr := freePort(t)
+
+	srvCfg := newPlaintextConfig(t, map[string]any{
+		"mux_listen":         muxAddr,
+		"allow_destinations": []string{allowedAddr},
 	})
-	srv, err := tlswrapper.NewServer(cfg)
+	srv, err := tlswrapper.NewServer(srvCfg)
 	if err != nil {
 		t.Fatal("server create:", err)
 	}
 	if err := srv.Start(); err != nil {
 		t.Fatal("server start:", err)
 	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
 
-	done := make(chan error, 1)
-	go func() {
-		done <- srv.Shutdown()
-	}()
+	cliCfg := newPlaintextConfig(t, map[string]any{
+		"mux_connect":   muxAddr,
+		"socks5_listen": socksAddr,
+	})
+	cli, err := tlswrapper.NewServer(cliCfg)
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
 
-	select {
-	case err := <-done:
-		if err != nil {
-			t.Fatal("server shutdown:", err)
+	t.Run("allowed", func(t *testing.T) {
+		conn, rep := socks5Connect(t, socksAddr, allowedAddr)
+		if rep != 0 {
+			t.Fatalf("reply = %#x, want succeeded", rep)
 		}
-	case <-time.After(3 * time.Second):
-		t.Fatal("server shutdown blocked with service listener active")
-	}
+		want := []byte("hello socks5")
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		got := make([]byte, len(want))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		conn, rep := socks5Connect(t, socksAddr, deniedAddr)
+		if rep != 0x02 {
+			t.Fatalf("reply = %#x, want connection not allowed", rep)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes after a refused request, want EOF", n)
+		}
+	})
 }
 
-// freeUDPPort returns an available UDP address on localhost by briefly
-// binding to :0 and immediately closing the listener.
-func freeUDPPort(t *testing.T) string {
+// httpConnect sends an HTTP CONNECT for dest through the proxy at proxyAddr
+// and returns the connection and response status code.
+func httpConnect(t *testing.T, proxyAddr, dest string) (net.Conn, int) {
 	t.Helper()
-	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	conn, err := net.DialTimeout("tcp", proxyAddr, 3*time.Second)
 	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
 		t.Fatal(err)
 	}
-	addr := l.LocalAddr().String()
-	_ = l.Close()
-	return addr
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest); err != nil {
+		t.Fatal("write:", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal("read response:", err)
+	}
+	if br.Buffered() > 0 {
+		t.Fatalf("%d unexpected bytes after the response", br.Buffered())
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, resp.StatusCode
 }
 
-// newH3TLSPair generates a self-signed ECDSA P256 certificate for each side
-// (server and client), both with IP SAN 127.0.0.1.
-// Returns the PEM-encoded cert and key for each side.
-func newH3TLSPair(t *testing.T) (serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM string) {
-	t.Helper()
-	makeCert := func(cn string) (certPEM, keyPEM string) {
-		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			t.Fatalf("ecdsa.GenerateKey: %v", err)
+// TestForwardHTTPConnect verifies the HTTP CONNECT front-end on "listen" and
+// the status codes it reports for each kind of failure.
+func TestForwardHTTPConnect(t *testing.T) {
+	allowedAddr := startEchoServer(t)
+	deniedAddr := startEchoServer(t)
+	closedAddr := freePort(t)
+	muxAddr := freePort(t)
+	listenAddr := freePort(t)
+
+	srvCfg := newPlaintextConfig(t, map[string]any{
+		"mux_listen":         muxAddr,
+		"allow_destinations": []string{allowedAddr, closedAddr},
+	})
+	srv, err := tlswrapper.NewServer(srvCfg)
+	if err != nil {
+		t.Fatal("server create:", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal("server start:", err)
+	}
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	cliCfg := newPlaintextConfig(t, map[string]any{
+		"mux_connect":  muxAddr,
+		"listen":       listenAddr,
+		"listen_proxy": "http",
+	})
+	cli, err := tlswrapper.NewServer(cliCfg)
+	if err != nil {
+		t.Fatal("client create:", err)
+	}
+	if err := cli.Start(); err != nil {
+		t.Fatal("client start:", err)
+	}
+	t.Cleanup(func() { _ = cli.Shutdown() })
+	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, code := httpConnect(t, listenAddr, allowedAddr)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
 		}
-		tmpl := &x509.Certificate{
-			SerialNumber: big.NewInt(1),
-			Subject:      pkix.Name{CommonName: cn},
-			NotBefore:    time.Now().Add(-time.Hour),
-			NotAfter:     time.Now().Add(time.Hour),
-			KeyUsage:     x509.KeyUsageDigitalSignature,
-			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		want := []byte("hello http connect")
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal("write:", err)
 		}
-		certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
-		if err != nil {
-			t.Fatalf("x509.CreateCertificate: %v", err)
+		got := make([]byte, len(want))
+		if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
 		}
-		privDER, err := x509.MarshalECPrivateKey(priv)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("echo mismatch: got %q, want %q", got, want)
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		dest string
+		want int
+	}{
+		{"denied", deniedAddr, http.StatusForbidden},
+		{"dial-failed", closedAddr, http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, code := httpConnect(t, listenAddr, tt.dest); code != tt.want {
+				t.Fatalf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	t.Run("no-session", func(t *testing.T) {
+		addr := freePort(t)
+		cfg := newPlaintextConfig(t, map[string]any{
+			"mux_connect":  freePort(t), // nothing listens here
+			"listen":       addr,
+			"listen_proxy": "http",
+		})
+		s, err := tlswrapper.NewServer(cfg)
 		if err != nil {
-			t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+			t.Fatal("create:", err)
 		}
-		certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
-		keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER}))
-		return
+		if err := s.Start(); err != nil {
+			t.Fatal("start:", err)
+		}
+		t.Cleanup(func() { _ = s.Shutdown() })
+		if _, code := httpConnect(t, addr, allowedAddr); code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", code, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// startProxyHeaderServer accepts one connection, reads a PROXY v2 header from
+// it and delivers the header (signature excluded), then echoes the rest.
+func startProxyHeaderServer(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-	serverCertPEM, serverKeyPEM = makeCert("h3mux-server")
-	clientCertPEM, clientKeyPEM = makeCert("h3mux-client")
-	return
+	t.Cleanup(func() { _ = l.Close() })
+	ch := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		ch <- append(hdr[12:], body...)
+		_, _ = io.Copy(conn, conn)
+	}()
+	return l.Addr().String(), ch
 }
 
-// TestForwardH3MuxBidirectional verifies end-to-end bidirectional TCP
-// forwarding through an h3mux (QUIC+TLS) session using self-signed certificates:
-//
-//	[test conn] → [client Listen] ──h3mux/QUIC──> [server MuxListen] → [echo server]
-func TestForwardH3MuxBidirectional(t *testing.T) {
-	echoAddr := startEchoServer(t)
-	muxAddr := freeUDPPort(t)
-	clientListenAddr := freePort(t)
+// TestForwardProxyProtocol verifies that the accepting side announces the
+// original client address and the authenticated peer to its connect target
+// with a PROXY v2 header.
+func TestForwardProxyProtocol(t *testing.T) {
 	serverCertPEM, serverKeyPEM, clientCertPEM, clientKeyPEM := newH3TLSPair(t)
+	block, _ := pem.Decode([]byte(clientCertPEM))
+	clientFingerprint := sha256.Sum256(block.Bytes)
+	for _, proto := range []string{"h2mux", "h3mux"} {
+		t.Run(proto, func(t *testing.T) {
+			backendAddr, headers := startProxyHeaderServer(t)
+			muxAddr := freePort(t)
+			if proto == "h3mux" {
+				muxAddr = freeUDPPort(t)
+			}
+			listenAddr := freePort(t)
+			srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+				"mux_protocol":   proto,
+				"mux_listen":     muxAddr,
+				"connect":        backendAddr,
+				"proxy_protocol": "v2",
+				"tls": map[string]any{
+					"cert":      serverCertPEM,
+					"key":       serverKeyPEM,
+					"authcerts": []string{clientCertPEM},
+					"sni":       "127.0.0.1", // test certs carry an IP SAN only
+				},
+			}))
+			if err != nil {
+				t.Fatal("server create:", err)
+			}
+			if err := srv.Start(); err != nil {
+				t.Fatal("server start:", err)
+			}
+			t.Cleanup(func() { _ = srv.Shutdown() })
+			cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+				"mux_protocol": proto,
+				"mux_connect":  muxAddr,
+				"listen":       listenAddr,
+				"identity":     map[string]any{"claim": "test-client"},
+				"tls": map[string]any{
+					"cert":      clientCertPEM,
+					"key":       clientKeyPEM,
+					"authcerts": []string{serverCertPEM},
+					"sni":       "127.0.0.1",
+				},
+			}))
+			if err != nil {
+				t.Fatal("client create:", err)
+			}
+			if err := cli.Start(); err != nil {
+				t.Fatal("client start:", err)
+			}
+			t.Cleanup(func() { _ = cli.Shutdown() })
+			waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
 
-	// Session server: accepts h3mux sessions, forwards streams to the echo server.
-	srvCfg := newPlaintextConfig(t, map[string]any{
-		"mux_protocol": "h3mux",
-		"mux_listen":   muxAddr,
-		"connect":      echoAddr,
-		"tls": map[string]any{
-			"cert":      serverCertPEM,
-			"key":       serverKeyPEM,
-			"authcerts": []string{clientCertPEM},
-			"sni":       "127.0.0.1", // test certs carry an IP SAN only
+			conn, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
+			if err != nil {
+				t.Fatal("dial:", err)
+			}
+			defer conn.Close()
+			want := []byte("after the header")
+			if _, err := conn.Write(want); err != nil {
+				t.Fatal("write:", err)
+			}
+			var hdr []byte
+			select {
+			case hdr = <-headers:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no PROXY header received")
+			}
+			if hdr[0] != 0x21 || hdr[1] != 0x11 {
+				t.Fatalf("command/family = %#x/%#x, want PROXY TCP4", hdr[0], hdr[1])
+			}
+			client := conn.LocalAddr().(*net.TCPAddr)
+			if src := net.IP(hdr[4:8]); !src.Equal(client.IP) || int(binary.BigEndian.Uint16(hdr[12:14])) != client.Port {
+				t.Fatalf("source = %v:%d, want %v", src, binary.BigEndian.Uint16(hdr[12:14]), client)
+			}
+			tlvs := map[byte][]byte{}
+			for b := hdr[16:]; len(b) >= 3; {
+				n := int(binary.BigEndian.Uint16(b[1:3]))
+				tlvs[b[0]] = b[3 : 3+n]
+				b = b[3+n:]
+			}
+			if got := string(tlvs[0xe0]); got != "test-client" {
+				t.Fatalf("identity TLV = %q, want %q", got, "test-client")
+			}
+			if got := tlvs[0xe1]; !bytes.Equal(got, clientFingerprint[:]) {
+				t.Fatalf("fingerprint TLV = %x, want %x", got, clientFingerprint)
+			}
+			got := make([]byte, len(want))
+			if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal("read:", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("echo mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// startProxyHeaderRelay relays each accepted connection to target, sending a
+// PROXY v1 header that announces client first, like a load balancer would.
+func startProxyHeaderRelay(t *testing.T, target, client string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				host, port, _ := net.SplitHostPort(client)
+				if _, err := fmt.Fprintf(upstream, "PROXY TCP4 %s 127.0.0.1 %s 80\r\n", host, port); err != nil {
+					return
+				}
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestAcceptProxyProtocol verifies that PROXY protocol headers from trusted
+// load balancers are consumed on both the mux listener and a local listener,
+// that source rules apply to the client addresses in the headers, and that the
+// client address from the local listener's header is what the peer announces
+// to its connect target:
+//
+//	[test conn + header] → [client Listen] ──mux──> [relay + header] → [server MuxListen] → [backend]
+func TestAcceptProxyProtocol(t *testing.T) {
+	backendAddr, headers := startProxyHeaderServer(t)
+	muxAddr := freePort(t)
+	listenAddr := freePort(t)
+	srv, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_listen":     muxAddr,
+		"connect":        backendAddr,
+		"proxy_protocol": "v2",
+		"accept_proxy":   map[string]any{"mux_listen": true, "trusted": []string{"127.0.0.1"}},
+		"source_acl": map[string]any{
+			"mux_listen": map[string]any{"allow": []string{"198.51.100.0/24"}},
 		},
-	})
-	srv, err := tlswrapper.NewServer(srvCfg)
+	}))
 	if err != nil {
 		t.Fatal("server create:", err)
 	}
@@ -345,20 +1950,15 @@ func TestForwardH3MuxBidirectional(t *testing.T) {
 	}
 	t.Cleanup(func() { _ = srv.Shutdown() })
 
-	// Session client: dials the h3mux server, exposes a local TCP listener.
-	cliCfg := newPlaintextConfig(t, map[string]any{
-		"mux_protocol": "h3mux",
-		"mux_connect":  muxAddr,
-		"listen":       clientListenAddr,
-		"identity":     map[string]any{"claim": "test-client"},
-		"tls": map[string]any{
-			"cert":      clientCertPEM,
-			"key":       clientKeyPEM,
-			"authcerts": []string{serverCertPEM},
-			"sni":       "127.0.0.1", // test certs carry an IP SAN only
+	relayAddr := startProxyHeaderRelay(t, muxAddr, "198.51.100.9:5555")
+	cli, err := tlswrapper.NewServer(newPlaintextConfig(t, map[string]any{
+		"mux_connect":  relayAddr,
+		"listen":       listenAddr,
+		"accept_proxy": map[string]any{"listen": true, "trusted": []string{"127.0.0.0/8"}},
+		"source_acl": map[string]any{
+			"listen": map[string]any{"allow": []string{"203.0.113.0/24"}},
 		},
-	})
-	cli, err := tlswrapper.NewServer(cliCfg)
+	}))
 	if err != nil {
 		t.Fatal("client create:", err)
 	}
@@ -366,21 +1966,26 @@ func TestForwardH3MuxBidirectional(t *testing.T) {
 		t.Fatal("client start:", err)
 	}
 	t.Cleanup(func() { _ = cli.Shutdown() })
-
-	// Wait for the outbound h3mux session to be established (up to 5 s).
 	waitFor(t, 5*time.Second, func() bool { return cli.Stats().NumSessions > 0 })
 
-	// Connect through the session and verify bidirectional forwarding.
-	conn, err := net.DialTimeout("tcp", clientListenAddr, 3*time.Second)
+	conn, err := net.DialTimeout("tcp", listenAddr, 3*time.Second)
 	if err != nil {
 		t.Fatal("dial:", err)
 	}
 	defer conn.Close()
-
-	want := []byte("hello h3mux bidirectional forwarding")
-	if _, err := conn.Write(want); err != nil {
+	want := []byte("after the header")
+	if _, err := io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 4242 80\r\n"+string(want)); err != nil {
 		t.Fatal("write:", err)
 	}
+	var hdr []byte
+	select {
+	case hdr = <-headers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PROXY header received")
+	}
+	if src, port := net.IP(hdr[4:8]), binary.BigEndian.Uint16(hdr[12:14]); !src.Equal(net.IPv4(203, 0, 113, 7)) || port != 4242 {
+		t.Fatalf("source = %v:%d, want 203.0.113.7:4242", src, port)
+	}
 	got := make([]byte, len(want))
 	if err := conn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
 		t.Fatal(err)
@@ -388,7 +1993,7 @@ func TestForwardH3MuxBidirectional(t *testing.T) {
 	if _, err := io.ReadFull(conn, got); err != nil {
 		t.Fatal("read:", err)
 	}
-	if string(got) != string(want) {
+	if !bytes.Equal(got, want) {
 		t.Fatalf("echo mismatch: got %q, want %q", got, want)
 	}
 }
@@ -0,0 +1,150 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/forwarder"
+)
+
+// rateLimiter is a pair of token buckets for the two directions of the mux
+// link.
+type rateLimiter struct {
+	send, receive *forwarder.Bucket
+}
+
+func newRateLimiter(l config.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		send:    forwarder.NewBucket(forwarder.NewRate(l.Send, l.Burst)),
+		receive: forwarder.NewBucket(forwarder.NewRate(l.Receive, l.Burst)),
+	}
+}
+
+func (r *rateLimiter) set(l config.RateLimit) {
+	r.send.Rate().Set(l.Send, l.Burst)
+	r.receive.Rate().Set(l.Receive, l.Burst)
+}
+
+// bandwidth owns the buckets of config.Bandwidth. Buckets for peers and
+// listeners are created on first use and live as long as the server, so that
+// reloads adjust the rates of streams already running.
+type bandwidth struct {
+	mu        sync.Mutex
+	total     *rateLimiter
+	peers     map[string]*rateLimiter
+	listeners map[string]*rateLimiter
+	// Each stream gets its own buckets refilled at these shared rates.
+	streamSend, streamReceive *forwarder.Rate
+}
+
+func newBandwidth(cfg *config.Bandwidth) *bandwidth {
+	return &bandwidth{
+		total:         newRateLimiter(cfg.Total),
+		peers:         make(map[string]*rateLimiter),
+		listeners:     make(map[string]*rateLimiter),
+		streamSend:    forwarder.NewRate(cfg.Stream.Send, cfg.Stream.Burst),
+		streamReceive: forwarder.NewRate(cfg.Stream.Receive, cfg.Stream.Burst),
+	}
+}
+
+// reload applies cfg to every bucket.
+func (bw *bandwidth) reload(cfg *config.Bandwidth) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.total.set(cfg.Total)
+	for peer, r := range bw.peers {
+		r.set(cfg.PeerLimit(peer))
+	}
+	for addr, r := range bw.listeners {
+		r.set(cfg.Listeners[addr])
+	}
+	bw.streamSend.Set(cfg.Stream.Send, cfg.Stream.Burst)
+	bw.streamReceive.Set(cfg.Stream.Receive, cfg.Stream.Burst)
+}
+
+// linkLimits are the buckets throttling one stream: send applies to data
+// written to the mux stream, receive to data read from it.
+type linkLimits struct {
+	send, receive []*forwarder.Bucket
+}
+
+// streamLimits returns the buckets for a stream with peer, accepted on the
+// local listener at listenAddr ("" = opened by the peer). Buckets are attached
+// even while unlimited, so that limits added by a reload throttle the stream
+// too. The config is read under bw.mu so that a concurrent reload also
+// updates any bucket created here.
+func (s *Server) streamLimits(peer, listenAddr string) linkLimits {
+	bw := s.bandwidth
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	cfg, _ := s.getConfig()
+	limits := linkLimits{
+		send:    []*forwarder.Bucket{bw.total.send},
+		receive: []*forwarder.Bucket{bw.total.receive},
+	}
+	add := func(r *rateLimiter) {
+		limits.send = append(limits.send, r.send)
+		limits.receive = append(limits.receive, r.receive)
+	}
+	r, ok := bw.peers[peer]
+	if !ok {
+		r = newRateLimiter(cfg.Bandwidth.PeerLimit(peer))
+		bw.peers[peer] = r
+	}
+	add(r)
+	if listenAddr != "" {
+		r, ok := bw.listeners[listenAddr]
+		if !ok {
+			r = newRateLimiter(cfg.Bandwidth.Listeners[listenAddr])
+			bw.listeners[listenAddr] = r
+		}
+		add(r)
+	}
+	// A peer's quota throttles its streams in both directions together.
+	if a := s.quotaAccount(peer); a != nil {
+		limits.send = append(limits.send, a.throttle)
+		limits.receive = append(limits.receive, a.throttle)
+	}
+	limits.send = append(limits.send, forwarder.NewBucket(bw.streamSend))
+	limits.receive = append(limits.receive, forwarder.NewBucket(bw.streamReceive))
+	return limits
+}
+
+// BandwidthStats is a snapshot of one rate limit of config.Bandwidth.
+type BandwidthStats struct {
+	Scope   string // "total", "peer", "listener" or "stream"
+	Name    string // peer identity or listen address
+	Send    forwarder.RateStats
+	Receive forwarder.RateStats
+}
+
+// Stats snapshots the configured limits, and any that have throttled streams
+// since they were removed.
+func (bw *bandwidth) Stats() []BandwidthStats {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	var stats []BandwidthStats
+	add := func(scope, name string, send, recv *forwarder.Rate) {
+		v := BandwidthStats{Scope: scope, Name: name, Send: send.Stats(), Receive: recv.Stats()}
+		if v.Send.BytesPerSec > 0 || v.Receive.BytesPerSec > 0 || v.Send.Delayed > 0 || v.Receive.Delayed > 0 ||
+			v.Send.Dropped > 0 || v.Receive.Dropped > 0 {
+			stats = append(stats, v)
+		}
+	}
+	add("total", "", bw.total.send.Rate(), bw.total.receive.Rate())
+	for _, name := range slices.Sorted(maps.Keys(bw.peers)) {
+		r := bw.peers[name]
+		add("peer", name, r.send.Rate(), r.receive.Rate())
+	}
+	for _, name := range slices.Sorted(maps.Keys(bw.listeners)) {
+		r := bw.listeners[name]
+		add("listener", name, r.send.Rate(), r.receive.Rate())
+	}
+	add("stream", "", bw.streamSend, bw.streamReceive)
+	return stats
+}
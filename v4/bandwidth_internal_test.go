@@ -0,0 +1,158 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/forwarder"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestStreamLimits(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"listen":        "127.0.0.1:8080",
+		"socks5_listen": "127.0.0.1:8081",
+		"bandwidth": map[string]any{
+			"peers": map[string]any{
+				"alice": map[string]any{"send": 1000},
+				"*":     map[string]any{"receive": 2000},
+			},
+			"listeners": map[string]any{
+				"127.0.0.1:8080": map[string]any{"send": 3000, "receive": 3000},
+			},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	limits := s.streamLimits("alice", "127.0.0.1:8080")
+	if len(limits.send) != 4 || len(limits.receive) != 4 {
+		t.Fatalf("limits = %+v, want total, peer, listener and stream buckets", limits)
+	}
+	if limits.send[0] != s.bandwidth.total.send || limits.send[1] != s.bandwidth.peers["alice"].send {
+		t.Fatal("buckets are not shared with the server")
+	}
+	if again := s.streamLimits("alice", ""); len(again.send) != 3 || again.send[1] != limits.send[1] {
+		t.Fatal("peer bucket was not reused")
+	}
+	if bytesPerSec, _ := s.streamLimits("bob", "").receive[1].Rate().Limit(); bytesPerSec != 2000 {
+		t.Fatalf("bob receive limit = %d, want the \"*\" entry", bytesPerSec)
+	}
+	// Streams without limits get buckets that a reload may limit.
+	unlimited := s.streamLimits("carol", "127.0.0.1:8081")
+	if len(unlimited.send) != 4 {
+		t.Fatalf("limits = %+v, want total, peer, listener and stream buckets", unlimited)
+	}
+
+	// Reloads adjust and add limits to buckets in use.
+	cfg := newTestConfig(t, map[string]any{
+		"listen":        "127.0.0.1:8080",
+		"socks5_listen": "127.0.0.1:8081",
+		"bandwidth": map[string]any{
+			"total": map[string]any{"send": 5000},
+			"peers": map[string]any{
+				"alice": map[string]any{"send": 4000},
+				"carol": map[string]any{"receive": 7000},
+			},
+			"listeners": map[string]any{
+				"127.0.0.1:8081": map[string]any{"send": 8000},
+			},
+			"stream": map[string]any{"receive": 6000},
+		},
+	})
+	if err := s.ReloadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		got  int64
+		want int64
+	}{
+		{"total send", rateOf(limits.send[0]), 5000},
+		{"alice send", rateOf(limits.send[1]), 4000},
+		{"listener send", rateOf(limits.send[2]), 0},
+		{"bob receive", rateOf(s.bandwidth.peers["bob"].receive), 0},
+		{"carol receive", rateOf(unlimited.receive[1]), 7000},
+		{"added listener send", rateOf(unlimited.send[2]), 8000},
+		{"added stream receive", rateOf(unlimited.receive[3]), 6000},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %d after reload, want %d", tc.name, tc.got, tc.want)
+		}
+	}
+	limits = s.streamLimits("dave", "")
+	if len(limits.receive) != 3 || rateOf(limits.receive[2]) != 6000 {
+		t.Fatalf("limits = %+v, want total, peer and stream buckets", limits)
+	}
+	if other := s.streamLimits("dave", ""); other.receive[2] == limits.receive[2] {
+		t.Fatal("streams share a per-stream bucket")
+	}
+}
+
+func TestBandwidthDatagram(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	s := newTestServer(t, map[string]any{
+		"udp_connect": pc.LocalAddr().String(),
+		"bandwidth": map[string]any{
+			"total": map[string]any{"receive": 1000, "burst": 100},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	stream, peer := net.Pipe()
+	t.Cleanup(func() { _ = peer.Close() })
+	s.handleInboundStream(nil, "alice", &headerStream{Conn: stream, hdr: mux.StreamHeader{Datagram: true}})
+	if _, err := mux.NewFramedPacketConn(peer).Write(make([]byte, 500)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		return s.bandwidth.total.receive.Rate().Stats().Delayed == 500
+	})
+}
+
+func rateOf(b *forwarder.Bucket) int64 {
+	bytesPerSec, _ := b.Rate().Limit()
+	return bytesPerSec
+}
+
+func TestAPIBandwidthStats(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"bandwidth": map[string]any{
+			"total":  map[string]any{"send": 1024},
+			"stream": map[string]any{"receive": 2048},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	s.streamLimits("alice", "")
+
+	rec := httptest.NewRecorder()
+	(&apiStatsHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?nobanner=true", nil))
+	body := rec.Body.String()
+	for _, want := range []string{"> Bandwidth", "total               : send ", "receive unlimited", "stream              : send unlimited"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("stats missing %q:\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	newAPIMetricsHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		`tlswrapper_bandwidth_limit_bytes_per_second{direction="tx",name="",scope="total"} 1024`,
+		`tlswrapper_bandwidth_limit_bytes_per_second{direction="rx",name="",scope="stream"} 2048`,
+		`tlswrapper_bandwidth_delayed_bytes_total{direction="tx",name="",scope="total"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
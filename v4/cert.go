@@ -4,6 +4,8 @@
 package tlswrapper
 
 import (
+	"cmp"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
@@ -14,7 +16,10 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math/big"
+	"net"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -22,65 +27,222 @@ import (
 	"github.com/hexian000/gosnippets/formats"
 	"github.com/hexian000/gosnippets/routines"
 	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
 )
 
 type keyGenerator func() (pubKey any, key any, err error)
 
-// newCertificate returns a leaf pair, or a self-signed CA when parent is nil.
-func newCertificate(parent *x509.Certificate, signKey any, sni string, pubKey any, key any) (certPEM []byte, keyPEM []byte, err error) {
-	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
-	if err != nil {
-		err = fmt.Errorf("PKCS8 private key: %s", formats.Error(err))
-		return
+// certNames are the subject common name and the subject alternative names of
+// a certificate.
+type certNames struct {
+	commonName  string
+	dnsNames    []string
+	ipAddresses []net.IP
+	uris        []*url.URL
+}
+
+// parseSANs sorts a comma-separated list into IP addresses, URIs (anything
+// with a scheme) and DNS names.
+func parseSANs(list string) (names certNames, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case net.ParseIP(s) != nil:
+			names.ipAddresses = append(names.ipAddresses, net.ParseIP(s))
+		case strings.Contains(s, "://"):
+			u, err := url.Parse(s)
+			if err != nil {
+				return certNames{}, fmt.Errorf("SAN %q: %s", s, formats.Error(err))
+			}
+			names.uris = append(names.uris, u)
+		default:
+			names.dnsNames = append(names.dnsNames, s)
+		}
 	}
-	keyPEM = pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: rawKey,
-	})
+	return names, nil
+}
+
+// certOptions shape a generated certificate.
+type certOptions struct {
+	// profile is "ca", "leaf", or "" for the historical gencerts certificate:
+	// a self-signed one may also sign others and every one is valid for both
+	// server and client authentication.
+	profile string
+	days    int // 0 = defaultCertDays
+	// CA profile only: maximum number of intermediate CAs below the
+	// certificate (-1 = unlimited), and the permitted name subtrees.
+	maxPathLen        int
+	permittedDNS      []string
+	permittedIPRanges []*net.IPNet
+}
+
+// defaultCertDays is the validity of a certificate when -days is omitted.
+const defaultCertDays = 3652 // 10 years
 
+// parseNameConstraints sorts a comma-separated list into permitted IP ranges
+// (CIDR) and DNS domains.
+func (o *certOptions) parseNameConstraints(list string) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(s); err == nil {
+			o.permittedIPRanges = append(o.permittedIPRanges, ipNet)
+			continue
+		}
+		o.permittedDNS = append(o.permittedDNS, s)
+	}
+}
+
+// newCertOptions builds the certificate options from the gencerts flags.
+func newCertOptions(f *AppFlags) (certOptions, error) {
+	o := certOptions{profile: f.Profile, days: f.Days, maxPathLen: f.MaxPathLen}
+	switch f.Profile {
+	case "", "ca", "leaf":
+	default:
+		return o, fmt.Errorf("invalid certificate profile %q", f.Profile)
+	}
+	if f.Days < 0 {
+		return o, errors.New("invalid validity period")
+	}
+	if f.MaxPathLen < -1 {
+		return o, errors.New("invalid path length")
+	}
+	if f.NameConstraints != "" && f.Profile != "ca" {
+		return o, errors.New("name constraints require the ca profile")
+	}
+	o.parseNameConstraints(f.NameConstraints)
+	return o, nil
+}
+
+// template returns the certificate template for names.
+func (o *certOptions) template(names certNames, selfSigned bool) (*x509.Certificate, error) {
 	// Use a random 128-bit serial number: random serials are the X.509 norm and
 	// avoid collisions when a batch of certificates is generated concurrently.
 	serialMax := new(big.Int).Lsh(big.NewInt(1), 128)
 	serial, err := rand.Int(rand.Reader, serialMax)
 	if err != nil {
-		err = fmt.Errorf("serial number: %s", formats.Error(err))
-		return
+		return nil, fmt.Errorf("serial number: %s", formats.Error(err))
 	}
 
 	now := time.Now()
-	tmpl := x509.Certificate{
+	tmpl := &x509.Certificate{
 		NotBefore:    now,
-		NotAfter:     now.AddDate(0, 0, 3652), // 10 years
+		NotAfter:     now.AddDate(0, 0, cmp.Or(o.days, defaultCertDays)),
 		SerialNumber: serial,
-		// The subject carries only the common name (the SNI); organization,
-		// locality and similar attributes are left empty.
+		// The subject carries only the common name; organization, locality
+		// and similar attributes are left empty.
 		Subject: pkix.Name{
-			CommonName: sni,
-		},
-		DNSNames: []string{sni},
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageServerAuth,
-			x509.ExtKeyUsageClientAuth,
+			CommonName: names.commonName,
 		},
+		DNSNames:    names.dnsNames,
+		IPAddresses: names.ipAddresses,
+		URIs:        names.uris,
 	}
-	if parent == nil {
-		// parent == nil means the generated certificate becomes its own signer.
-		parent = &tmpl
+	switch o.profile {
+	case "ca":
 		tmpl.BasicConstraintsValid = true
 		tmpl.IsCA = true
-		signKey = key
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+		tmpl.MaxPathLen = o.maxPathLen
+		tmpl.MaxPathLenZero = o.maxPathLen == 0
+		tmpl.PermittedDNSDomains = o.permittedDNS
+		tmpl.PermittedIPRanges = o.permittedIPRanges
+		tmpl.PermittedDNSDomainsCritical = len(o.permittedDNS) > 0 || len(o.permittedIPRanges) > 0
+	case "leaf":
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	default:
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		if selfSigned {
+			tmpl.BasicConstraintsValid = true
+			tmpl.IsCA = true
+		}
 	}
-	rawCert, err := x509.CreateCertificate(rand.Reader, &tmpl, parent, pubKey, signKey)
+	return tmpl, nil
+}
+
+// signCertificate issues a certificate for pubKey, signed by parent, or
+// self-signed by key when parent is nil.
+func signCertificate(parent *x509.Certificate, signKey any, opts certOptions, names certNames, pubKey any) (certPEM []byte, err error) {
+	tmpl, err := opts.template(names, parent == nil)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if parent == nil {
+		// parent == nil means the generated certificate becomes its own signer.
+		parent = tmpl
 	}
-	certPEM = pem.EncodeToMemory(&pem.Block{
+	rawCert, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pubKey, signKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: rawCert,
-	})
+	}), nil
+}
+
+// marshalPrivateKey returns key as PKCS #8 PEM, encrypted when passphrase is
+// not nil.
+func marshalPrivateKey(key any, passphrase []byte) ([]byte, error) {
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS8 private key: %s", formats.Error(err))
+	}
+	if passphrase != nil {
+		rawKey, err = config.EncryptPKCS8PrivateKey(rawKey, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS8 private key: %s", formats.Error(err))
+		}
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "ENCRYPTED PRIVATE KEY",
+			Bytes: rawKey,
+		}), nil
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: rawKey,
+	}), nil
+}
+
+// newCertificate returns a leaf pair, or a self-signed CA when parent is nil.
+// The certificate has the historical gencerts profile with sni as its only
+// name.
+func newCertificate(parent *x509.Certificate, signKey any, sni string, pubKey any, key any) (certPEM []byte, keyPEM []byte, err error) {
+	keyPEM, err = marshalPrivateKey(key, nil)
+	if err != nil {
+		return
+	}
+	if parent == nil {
+		signKey = key
+	}
+	names := certNames{commonName: sni, dnsNames: []string{sni}}
+	certPEM, err = signCertificate(parent, signKey, certOptions{}, names, pubKey)
 	return
 }
 
+// newCSR returns a certificate signing request for names, signed by key.
+func newCSR(names certNames, key any) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: names.commonName},
+		DNSNames:    names.dnsNames,
+		IPAddresses: names.ipAddresses,
+		URIs:        names.uris,
+	}
+	raw, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: raw,
+	}), nil
+}
+
 func makeKeyGenerator(keytype string, keysize int) (keyGenerator, error) {
 	switch keytype {
 	case "rsa":
@@ -145,7 +307,7 @@ func parsePEM(data []byte, blockType string) []byte {
 	}
 }
 
-func readKeyPair(name string) (*x509.Certificate, any, error) {
+func readKeyPair(name string, passphrase []byte) (*x509.Certificate, any, error) {
 	certFile, keyFile := name+"-cert.pem", name+"-key.pem"
 	certPEM, err := os.ReadFile(certFile)
 	if err != nil {
@@ -159,20 +321,58 @@ func readKeyPair(name string) (*x509.Certificate, any, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	keyPEM, err := os.ReadFile(keyFile)
+	key, err := readPrivateKey(keyFile, passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
+	slog.Noticef("gencerts: read %q, %q", certFile, keyFile)
+	return cert, key, nil
+}
+
+// readPrivateKey reads a PKCS #8 key, decrypting it with passphrase when it
+// is encrypted.
+func readPrivateKey(keyFile string, passphrase []byte) (any, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
 	keyDER := parsePEM(keyPEM, "PRIVATE KEY")
 	if keyDER == nil {
-		return nil, nil, fmt.Errorf("%s: private key not found", keyFile)
+		keyDER = parsePEM(keyPEM, "ENCRYPTED PRIVATE KEY")
+		if keyDER == nil {
+			return nil, fmt.Errorf("%s: private key not found", keyFile)
+		}
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s: private key is encrypted, use -passphrase", keyFile)
+		}
+		keyDER, err = config.DecryptPKCS8PrivateKey(keyDER, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFile, err)
+		}
 	}
-	key, err := x509.ParsePKCS8PrivateKey(keyDER)
-	if err != nil {
-		return nil, nil, err
+	return x509.ParsePKCS8PrivateKey(keyDER)
+}
+
+// loadOrGenerateKey returns the key in <name>-key.pem when reuse is set and
+// the file exists, so that a renewed certificate keeps its SPKI pin, and a new
+// key otherwise.
+func loadOrGenerateKey(name string, reuse bool, keygen keyGenerator, passphrase []byte) (pubKey any, key any, err error) {
+	keyFile := name + "-key.pem"
+	if reuse {
+		key, err := readPrivateKey(keyFile, passphrase)
+		if err == nil {
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: unsupported private key", keyFile)
+			}
+			slog.Noticef("gencerts: reuse %q", keyFile)
+			return signer.Public(), key, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
 	}
-	slog.Noticef("gencerts: read %q, %q", certFile, keyFile)
-	return cert, key, nil
+	return keygen()
 }
 
 func writeKeyPair(name string, certPEM, keyPEM []byte) error {
@@ -187,30 +387,180 @@ func writeKeyPair(name string, certPEM, keyPEM []byte) error {
 	return nil
 }
 
+// readCSR reads <name>-csr.pem and checks its signature.
+func readCSR(name string) (*x509.CertificateRequest, error) {
+	csrFile := name + "-csr.pem"
+	csrPEM, err := os.ReadFile(csrFile)
+	if err != nil {
+		return nil, err
+	}
+	csrDER := parsePEM(csrPEM, "CERTIFICATE REQUEST")
+	if csrDER == nil {
+		return nil, fmt.Errorf("%s: certificate request not found", csrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%s: %s", csrFile, formats.Error(err))
+	}
+	slog.Noticef("gencerts: read %q", csrFile)
+	return csr, nil
+}
+
+// genCertNames returns the names for certificates and requests made from the
+// flags: the -sni common name, with the -san list or else -sni as SANs. The
+// ca profile only gets SANs when -san is given.
+func genCertNames(f *AppFlags) (certNames, error) {
+	names, err := parseSANs(f.SANs)
+	if err != nil {
+		return certNames{}, err
+	}
+	names.commonName = f.ServerName
+	if f.SANs == "" && f.Profile != "ca" {
+		names.dnsNames = []string{f.ServerName}
+	}
+	return names, nil
+}
+
+// keyPassphrase reads the -passphrase source; nil means keys are written
+// unencrypted.
+func keyPassphrase(f *AppFlags) ([]byte, error) {
+	if f.Passphrase == "" {
+		return nil, nil
+	}
+	return config.ReadPassphrase(f.Passphrase)
+}
+
+// genCSR writes <name>-csr.pem and <name>-key.pem for each name.
+func genCSR(f *AppFlags, keygen keyGenerator, passphrase []byte) error {
+	names, err := genCertNames(f)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(f.GenCSR, ",") {
+		_, key, err := loadOrGenerateKey(name, f.ReuseKey, keygen, passphrase)
+		if err != nil {
+			return fmt.Errorf("generate key: %s", formats.Error(err))
+		}
+		csrPEM, err := newCSR(names, key)
+		if err != nil {
+			return fmt.Errorf("gencsr %q: %s", name, formats.Error(err))
+		}
+		keyPEM, err := marshalPrivateKey(key, passphrase)
+		if err != nil {
+			return fmt.Errorf("gencsr %q: %s", name, formats.Error(err))
+		}
+		csrFile, keyFile := name+"-csr.pem", name+"-key.pem"
+		if err := os.WriteFile(csrFile, csrPEM, 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return err
+		}
+		slog.Noticef("gencerts: write %q, %q", csrFile, keyFile)
+	}
+	return nil
+}
+
+// signCSR writes <name>-cert.pem for each <name>-csr.pem, signed by parent.
+// The names come from the request; the profile defaults to leaf.
+func signCSR(f *AppFlags, opts certOptions, parent *x509.Certificate, signKey any) error {
+	if opts.profile == "" {
+		opts.profile = "leaf"
+	}
+	for _, name := range strings.Split(f.SignCSR, ",") {
+		csr, err := readCSR(name)
+		if err != nil {
+			return err
+		}
+		names := certNames{
+			commonName:  csr.Subject.CommonName,
+			dnsNames:    csr.DNSNames,
+			ipAddresses: csr.IPAddresses,
+			uris:        csr.URIs,
+		}
+		certPEM, err := signCertificate(parent, signKey, opts, names, csr.PublicKey)
+		if err != nil {
+			return fmt.Errorf("signcsr %q: %s", name, formats.Error(err))
+		}
+		certFile := name + "-cert.pem"
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return err
+		}
+		slog.Noticef("gencerts: write %q", certFile)
+	}
+	return nil
+}
+
 func genCerts(f *AppFlags) int {
+	opts, err := newCertOptions(f)
+	if err != nil {
+		slog.Fatalf("gencerts: %s", formats.Error(err))
+		return 1
+	}
+	names, err := genCertNames(f)
+	if err != nil {
+		slog.Fatalf("gencerts: %s", formats.Error(err))
+		return 1
+	}
 	keygen, err := makeKeyGenerator(f.KeyType, f.KeySize)
 	if err != nil {
 		slog.Fatalf("gencerts: %s", formats.Error(err))
 		return 1
 	}
+	passphrase, err := keyPassphrase(f)
+	if err != nil {
+		slog.Fatalf("gencerts: %s", formats.Error(err))
+		return 1
+	}
 	var parent *x509.Certificate
 	var signKey any
 	if f.Sign != "" {
-		parent, signKey, err = readKeyPair(f.Sign)
+		parent, signKey, err = readKeyPair(f.Sign, passphrase)
 		if err != nil {
 			slog.Fatalf("gencerts: read certificate: %s", formats.Error(err))
 			return 1
 		}
 	}
+	if f.GenCSR != "" {
+		if err := genCSR(f, keygen, passphrase); err != nil {
+			slog.Fatalf("gencerts: %s", formats.Error(err))
+			return 1
+		}
+	}
+	if f.SignCSR != "" {
+		if parent == nil {
+			slog.Fatal("gencerts: -signcsr requires -sign")
+			return 1
+		}
+		if err := signCSR(f, opts, parent, signKey); err != nil {
+			slog.Fatalf("gencerts: %s", formats.Error(err))
+			return 1
+		}
+	}
+	if f.GenCerts == "" {
+		slog.Notice("gencerts: ok")
+		return 0
+	}
 	g := routines.NewGroup()
 	for _, name := range strings.Split(f.GenCerts, ",") {
 		name := name
 		if err := g.Go(func() {
-			pubKey, key, err := keygen()
+			pubKey, key, err := loadOrGenerateKey(name, f.ReuseKey, keygen, passphrase)
 			if err != nil {
 				panic(fmt.Sprintf("generate key: %s", formats.Error(err)))
 			}
-			certPEM, keyPEM, err := newCertificate(parent, signKey, f.ServerName, pubKey, key)
+			certSignKey := signKey
+			if parent == nil {
+				certSignKey = key
+			}
+			keyPEM, err := marshalPrivateKey(key, passphrase)
+			if err != nil {
+				panic(fmt.Sprintf("gencerts %q: %s", name, formats.Error(err)))
+			}
+			certPEM, err := signCertificate(parent, certSignKey, opts, names, pubKey)
 			if err != nil {
 				panic(fmt.Sprintf("gencerts %q: %s", name, formats.Error(err)))
 			}
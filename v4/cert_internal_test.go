@@ -4,9 +4,14 @@
 package tlswrapper
 
 import (
+	"crypto"
 	"crypto/x509"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/hexian000/tlswrapper/v4/config"
 )
 
 func TestReadWriteKeyPairRoundTrip(t *testing.T) {
@@ -27,7 +32,7 @@ func TestReadWriteKeyPairRoundTrip(t *testing.T) {
 	if err := writeKeyPair("peer", certPEM, keyPEM); err != nil {
 		t.Fatal(err)
 	}
-	cert, parsedKey, err := readKeyPair("peer")
+	cert, parsedKey, err := readKeyPair("peer", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,15 +53,15 @@ func TestGenCertsCreatesSignedCertificates(t *testing.T) {
 	if code := genCerts(&AppFlags{GenCerts: "leaf-a,leaf-b", Sign: "ca", ServerName: "leaf.example.com", KeyType: "ecdsa", KeySize: 256}); code != 0 {
 		t.Fatalf("genCerts(leaves) = %d, want 0", code)
 	}
-	caCert, _, err := readKeyPair("ca")
+	caCert, _, err := readKeyPair("ca", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	leafCert, _, err := readKeyPair("leaf-a")
+	leafCert, _, err := readKeyPair("leaf-a", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, _, err := readKeyPair("leaf-b"); err != nil {
+	if _, _, err := readKeyPair("leaf-b", nil); err != nil {
 		t.Fatal(err)
 	}
 	pool := x509.NewCertPool()
@@ -76,7 +81,7 @@ func TestReadKeyPairErrors(t *testing.T) {
 	chdirTemp(t, dir)
 
 	t.Run("cert-file-missing", func(t *testing.T) {
-		_, _, err := readKeyPair("missing")
+		_, _, err := readKeyPair("missing", nil)
 		if err == nil {
 			t.Fatal("expected error for missing cert file, got nil")
 		}
@@ -86,7 +91,7 @@ func TestReadKeyPairErrors(t *testing.T) {
 		if err := os.WriteFile("nocert-cert.pem", []byte("not pem\n"), 0644); err != nil {
 			t.Fatal(err)
 		}
-		_, _, err := readKeyPair("nocert")
+		_, _, err := readKeyPair("nocert", nil)
 		if err == nil {
 			t.Fatal("expected error when cert PEM has no CERTIFICATE block, got nil")
 		}
@@ -109,7 +114,7 @@ func TestReadKeyPairErrors(t *testing.T) {
 		if err := os.WriteFile("nokey-cert.pem", certPEM, 0644); err != nil {
 			t.Fatal(err)
 		}
-		_, _, err = readKeyPair("nokey")
+		_, _, err = readKeyPair("nokey", nil)
 		if err == nil {
 			t.Fatal("expected error for missing key file, got nil")
 		}
@@ -134,7 +139,7 @@ func TestReadKeyPairErrors(t *testing.T) {
 		if err := os.WriteFile("badkey-key.pem", []byte("not pem\n"), 0644); err != nil {
 			t.Fatal(err)
 		}
-		_, _, err = readKeyPair("badkey")
+		_, _, err = readKeyPair("badkey", nil)
 		if err == nil {
 			t.Fatal("expected error when key PEM has no PRIVATE KEY block, got nil")
 		}
@@ -161,9 +166,198 @@ func TestReadKeyPairErrors(t *testing.T) {
 		if err := os.WriteFile("badder-key.pem", []byte(invalidKeyPEM), 0644); err != nil {
 			t.Fatal(err)
 		}
-		_, _, err = readKeyPair("badder")
+		_, _, err = readKeyPair("badder", nil)
 		if err == nil {
 			t.Fatal("expected error for invalid PKCS8 DER, got nil")
 		}
 	})
 }
+
+func TestGenCertsProfiles(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	if code := genCerts(&AppFlags{
+		GenCerts: "ca", ServerName: "Test CA", KeyType: "ecdsa",
+		Profile: "ca", NameConstraints: "example.com,10.0.0.0/8",
+	}); code != 0 {
+		t.Fatalf("genCerts(ca) = %d, want 0", code)
+	}
+	if code := genCerts(&AppFlags{
+		GenCerts: "leaf", Sign: "ca", ServerName: "leaf", KeyType: "ecdsa",
+		Profile: "leaf", Days: 90, SANs: "leaf.example.com,10.1.2.3,spiffe://example.com/leaf",
+	}); code != 0 {
+		t.Fatalf("genCerts(leaf) = %d, want 0", code)
+	}
+	if code := genCerts(&AppFlags{
+		GenCerts: "outside", Sign: "ca", ServerName: "outside.example.org", KeyType: "ecdsa", Profile: "leaf",
+	}); code != 0 {
+		t.Fatalf("genCerts(outside) = %d, want 0", code)
+	}
+	ca, _, err := readKeyPair("ca", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA || ca.MaxPathLen != 0 || !ca.MaxPathLenZero || ca.KeyUsage&x509.KeyUsageCRLSign == 0 || len(ca.DNSNames) != 0 {
+		t.Fatalf("ca: IsCA=%v MaxPathLen=%d KeyUsage=%v DNSNames=%v", ca.IsCA, ca.MaxPathLen, ca.KeyUsage, ca.DNSNames)
+	}
+	leaf, _, err := readKeyPair("leaf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.IsCA || len(leaf.DNSNames) != 1 || len(leaf.IPAddresses) != 1 || len(leaf.URIs) != 1 {
+		t.Fatalf("leaf: IsCA=%v DNSNames=%v IPAddresses=%v URIs=%v", leaf.IsCA, leaf.DNSNames, leaf.IPAddresses, leaf.URIs)
+	}
+	if days := leaf.NotAfter.Sub(leaf.NotBefore).Hours() / 24; days != 90 {
+		t.Fatalf("leaf validity = %v days, want 90", days)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "10.1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	outside, _, err := readKeyPair("outside", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outside.Verify(x509.VerifyOptions{Roots: pool}); err == nil {
+		t.Fatal("leaf outside the name constraints verified")
+	}
+	// A leaf cannot sign.
+	if code := genCerts(&AppFlags{GenCerts: "sub", Sign: "leaf", KeyType: "ecdsa", Profile: "leaf"}); code != 0 {
+		t.Fatalf("genCerts(sub) = %d, want 0", code)
+	}
+	sub, _, err := readKeyPair("sub", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(leaf)
+	if _, err := sub.Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates}); err == nil {
+		t.Fatal("certificate signed by a leaf verified")
+	}
+}
+
+func TestGenCertsReuseKey(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	spki := func() string {
+		t.Helper()
+		cert, _, err := readKeyPair("peer", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(cert.RawSubjectPublicKeyInfo)
+	}
+	f := &AppFlags{GenCerts: "peer", KeyType: "ed25519", ReuseKey: true}
+	// Without an existing key, one is generated.
+	if code := genCerts(f); code != 0 {
+		t.Fatalf("genCerts() = %d, want 0", code)
+	}
+	first := spki()
+	if code := genCerts(f); code != 0 {
+		t.Fatalf("genCerts() = %d, want 0", code)
+	}
+	if spki() != first {
+		t.Fatal("renewed certificate has a new key despite ReuseKey")
+	}
+	f.ReuseKey = false
+	if code := genCerts(f); code != 0 {
+		t.Fatalf("genCerts() = %d, want 0", code)
+	}
+	if spki() == first {
+		t.Fatal("key reused without ReuseKey")
+	}
+}
+
+func TestGenCSRAndSignCSR(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	if code := genCerts(&AppFlags{GenCerts: "ca", ServerName: "Test CA", KeyType: "ecdsa", Profile: "ca"}); code != 0 {
+		t.Fatalf("genCerts(ca) = %d, want 0", code)
+	}
+	if code := genCerts(&AppFlags{GenCSR: "device", ServerName: "device", SANs: "device.example.com", KeyType: "ecdsa"}); code != 0 {
+		t.Fatalf("genCerts(gencsr) = %d, want 0", code)
+	}
+	if _, err := os.Stat("device-cert.pem"); err == nil {
+		t.Fatal("gencsr wrote a certificate")
+	}
+	if code := genCerts(&AppFlags{SignCSR: "device", KeyType: "ecdsa"}); code == 0 {
+		t.Fatal("signcsr succeeded without a signer")
+	}
+	// The profile of the signing flags applies, the names come from the
+	// request.
+	if code := genCerts(&AppFlags{SignCSR: "device", Sign: "ca", ServerName: "ignored", KeyType: "ecdsa", Days: 30}); code != 0 {
+		t.Fatalf("genCerts(signcsr) = %d, want 0", code)
+	}
+	cert, key, err := readKeyPair("device", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "device" || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "device.example.com" || cert.IsCA {
+		t.Fatalf("signed certificate: CN=%q DNSNames=%v IsCA=%v", cert.Subject.CommonName, cert.DNSNames, cert.IsCA)
+	}
+	if !key.(crypto.Signer).Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.PublicKey) {
+		t.Fatal("signed certificate does not carry the requested key")
+	}
+	if err := os.WriteFile("bad-csr.pem", []byte("not pem\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := genCerts(&AppFlags{SignCSR: "bad", Sign: "ca", KeyType: "ecdsa"}); code == 0 {
+		t.Fatal("signcsr succeeded without a request")
+	}
+}
+
+func TestGenCertsEncryptedKey(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	t.Setenv("TLSWRAPPER_TEST_PASSPHRASE", "secret")
+	const source = "env:TLSWRAPPER_TEST_PASSPHRASE"
+	if code := genCerts(&AppFlags{GenCerts: "ca", ServerName: "Test CA", KeyType: "ecdsa", Profile: "ca", Passphrase: source}); code != 0 {
+		t.Fatalf("genCerts(ca) = %d, want 0", code)
+	}
+	keyPEM, err := os.ReadFile("ca-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsePEM(keyPEM, "ENCRYPTED PRIVATE KEY") == nil || parsePEM(keyPEM, "PRIVATE KEY") != nil {
+		t.Fatalf("ca-key.pem is not encrypted:\n%s", keyPEM)
+	}
+	if _, _, err := readKeyPair("ca", nil); err == nil || !strings.Contains(err.Error(), "-passphrase") {
+		t.Fatalf("readKeyPair() without passphrase = %v", err)
+	}
+	if _, _, err := readKeyPair("ca", []byte("wrong")); !errors.Is(err, config.ErrIncorrectPassphrase) {
+		t.Fatalf("readKeyPair() with wrong passphrase = %v", err)
+	}
+	if code := genCerts(&AppFlags{GenCerts: "peer", Sign: "ca", ServerName: "peer", KeyType: "ecdsa"}); code == 0 {
+		t.Fatal("signed with an encrypted key without a passphrase")
+	}
+	if code := genCerts(&AppFlags{GenCerts: "peer", Sign: "ca", ServerName: "peer", KeyType: "ecdsa", Passphrase: source}); code != 0 {
+		t.Fatalf("genCerts(peer) = %d, want 0", code)
+	}
+	ca, _, err := readKeyPair("ca", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, _, err := readKeyPair("peer", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.CheckSignatureFrom(ca); err != nil {
+		t.Fatal(err)
+	}
+
+	// The runtime config decrypts with the same passphrase source.
+	s := newTestServer(t, map[string]any{
+		"tls": map[string]any{
+			"cert":           "@peer-cert.pem",
+			"key":            "@peer-key.pem",
+			"key_passphrase": source,
+			"authcerts":      []string{"@ca-cert.pem"},
+		},
+	})
+	_ = s.Shutdown()
+	caPEM, err := os.ReadFile("ca-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &config.Enroll{CACert: string(caPEM), CAKey: string(keyPEM), CAKeyPassphrase: source}
+	if _, _, err := e.NewSigner(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@ package tlswrapper
 
 import (
 	"crypto/x509"
+	"net"
 	"testing"
 )
 
@@ -241,3 +242,49 @@ func TestParsePEM(t *testing.T) {
 		}
 	})
 }
+
+func TestParseSANs(t *testing.T) {
+	names, err := parseSANs("a.example.com, 10.0.0.1,::1,spiffe://example.com/peer,,b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names.dnsNames) != 2 || names.dnsNames[1] != "b.example.com" {
+		t.Fatalf("dnsNames = %v", names.dnsNames)
+	}
+	if len(names.ipAddresses) != 2 || !names.ipAddresses[1].Equal(net.IPv6loopback) {
+		t.Fatalf("ipAddresses = %v", names.ipAddresses)
+	}
+	if len(names.uris) != 1 || names.uris[0].Host != "example.com" {
+		t.Fatalf("uris = %v", names.uris)
+	}
+	if _, err := parseSANs("http://[::1"); err == nil {
+		t.Fatal("expected error for a malformed URI")
+	}
+}
+
+func TestNewCertOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   AppFlags
+		wantErr bool
+	}{
+		{name: "default", flags: AppFlags{}},
+		{name: "leaf", flags: AppFlags{Profile: "leaf", Days: 90}},
+		{name: "ca", flags: AppFlags{Profile: "ca", MaxPathLen: -1, NameConstraints: "example.com,10.0.0.0/8"}},
+		{name: "invalid-profile", flags: AppFlags{Profile: "intermediate"}, wantErr: true},
+		{name: "negative-days", flags: AppFlags{Days: -1}, wantErr: true},
+		{name: "invalid-pathlen", flags: AppFlags{Profile: "ca", MaxPathLen: -2}, wantErr: true},
+		{name: "constraints-on-leaf", flags: AppFlags{Profile: "leaf", NameConstraints: "example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := newCertOptions(&tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newCertOptions() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.name == "ca" && (len(opts.permittedDNS) != 1 || len(opts.permittedIPRanges) != 1) {
+				t.Fatalf("name constraints = %v, %v", opts.permittedDNS, opts.permittedIPRanges)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+// CertExpiryStats describes the validity of one monitored certificate.
+type CertExpiryStats struct {
+	Role     string // "local", "authcert" or "peer"
+	Subject  string // subject CN, or the whole subject when it has none
+	Identity string // peer identity, for role "peer"
+	NotAfter time.Time
+
+	fingerprint [sha256.Size]byte
+}
+
+// certRoles lists the roles of CertExpiryStats in the order a certificate
+// held in several roles is reported.
+var certRoles = []string{"local", "authcert", "peer"}
+
+// certSubject names cert in stats and logs.
+func certSubject(cert *x509.Certificate) string {
+	return cmp.Or(cert.Subject.CommonName, cert.Subject.String(), "serial "+cert.SerialNumber.Text(16))
+}
+
+// CertExpiry snapshots the expiry of the local certificate, the authorized
+// certificates and the leaf certificate of every connected peer, soonest
+// first. A certificate is listed once per role.
+func (s *Server) CertExpiry() []CertExpiryStats {
+	cfg, _ := s.getConfig()
+	var stats []CertExpiryStats
+	add := func(role, identity string, cert *x509.Certificate) {
+		stats = append(stats, CertExpiryStats{
+			Role:        role,
+			Subject:     certSubject(cert),
+			Identity:    identity,
+			NotAfter:    cert.NotAfter,
+			fingerprint: sha256.Sum256(cert.Raw),
+		})
+	}
+	if cert := cfg.LocalCertificate(); cert != nil {
+		add("local", "", cert)
+	}
+	for _, cert := range cfg.AuthCertificates() {
+		add("authcert", "", cert)
+	}
+	for _, t := range s.getAllTunnels() {
+		t.mu.RLock()
+		ss := t.ss
+		t.mu.RUnlock()
+		if ss == nil || ss.IsClosed() {
+			continue
+		}
+		if certs := mux.PeerCertificatesOf(ss); len(certs) > 0 {
+			add("peer", ss.PeerIdentity(), certs[0])
+		}
+	}
+	slices.SortFunc(stats, func(a, b CertExpiryStats) int {
+		return cmp.Or(
+			a.NotAfter.Compare(b.NotAfter),
+			bytes.Compare(a.fingerprint[:], b.fingerprint[:]),
+			cmp.Compare(slices.Index(certRoles, a.Role), slices.Index(certRoles, b.Role)),
+			cmp.Compare(a.Identity, b.Identity),
+		)
+	})
+	// Peers with several connections share one entry.
+	return slices.CompactFunc(stats, func(a, b CertExpiryStats) bool {
+		return a.Role == b.Role && a.fingerprint == b.fingerprint && a.Identity == b.Identity
+	})
+}
+
+// checkCertExpiry reports each certificate once when it comes within the
+// configured warning period and once more when it expires. Only called from
+// maintenanceLoop.
+func (s *Server) checkCertExpiry(now time.Time) {
+	cfg, _ := s.getConfig()
+	warning := cfg.CertExpiryWarning()
+	if warning <= 0 {
+		s.certWarned = nil
+		return
+	}
+	warned := make(map[[sha256.Size]byte]bool)
+	for _, v := range s.CertExpiry() {
+		left := v.NotAfter.Sub(now)
+		if _, ok := warned[v.fingerprint]; ok || left > warning {
+			continue
+		}
+		expired := left <= 0
+		if was, ok := s.certWarned[v.fingerprint]; !ok || was != expired {
+			var msg string
+			if expired {
+				msg = fmt.Sprintf("cert: %s expired at %s", formatCertExpiry(v), v.NotAfter.Format(slog.TimeLayout))
+			} else {
+				msg = fmt.Sprintf("cert: %s expires in %s (%s)", formatCertExpiry(v),
+					formats.Duration(left.Truncate(time.Minute)), v.NotAfter.Format(slog.TimeLayout))
+			}
+			slog.Warning(msg)
+			s.recentEvents.Add(now, msg)
+		}
+		warned[v.fingerprint] = expired
+	}
+	s.certWarned = warned
+}
+
+// formatCertExpiry describes the certificate of v for a log message.
+func formatCertExpiry(v CertExpiryStats) string {
+	switch v.Role {
+	case "local":
+		return fmt.Sprintf("local certificate %q", v.Subject)
+	case "peer":
+		return fmt.Sprintf("certificate %q of peer %q", v.Subject, v.Identity)
+	}
+	return fmt.Sprintf("authorized certificate %q", v.Subject)
+}
+
+// formatTimeLeft renders the time until notAfter for /stats.
+func formatTimeLeft(notAfter, now time.Time) string {
+	left := notAfter.Sub(now).Truncate(time.Second)
+	if left <= 0 {
+		return "expired " + formats.Duration(-left) + " ago"
+	}
+	return "expires in " + formats.Duration(left)
+}
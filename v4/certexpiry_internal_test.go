@@ -0,0 +1,128 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExpiringKeyPair returns a self-signed certificate for cn valid until
+// notAfter, and its key.
+func newExpiringKeyPair(t *testing.T, cn string, notAfter time.Time) (certPEM, keyPEM string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	now := time.Now()
+	certPEM, keyPEM := newExpiringKeyPair(t, "server", now.Add(10*24*time.Hour))
+	caPEM, _ := newExpiringKeyPair(t, "ca", now.Add(3650*24*time.Hour))
+	s := newTestServer(t, map[string]any{
+		"tls": map[string]any{
+			"cert":      certPEM,
+			"key":       keyPEM,
+			"authcerts": []string{certPEM, caPEM},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	certs := s.CertExpiry()
+	if len(certs) != 3 || certs[0].Subject != "server" || certs[2].Subject != "ca" {
+		t.Fatalf("CertExpiry() = %+v, want server (local and authcert) before ca", certs)
+	}
+	events := func() string {
+		var b strings.Builder
+		if err := s.recentEvents.Format(&b, 10); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	s.checkCertExpiry(now)
+	s.checkCertExpiry(now.Add(time.Hour))
+	if got := events(); strings.Count(got, "expires in") != 1 || !strings.Contains(got, `local certificate "server"`) {
+		t.Fatalf("recent events after two checks:\n%s", got)
+	}
+	s.checkCertExpiry(now.Add(11 * 24 * time.Hour))
+	if got := events(); strings.Count(got, "expired at") != 1 || strings.Contains(got, `"ca"`) {
+		t.Fatalf("recent events after expiry:\n%s", got)
+	}
+
+	// A negative threshold disables the warnings.
+	s.certWarned = nil
+	if err := s.ReloadConfig(newTestConfig(t, map[string]any{
+		"tls": map[string]any{
+			"cert":                certPEM,
+			"key":                 keyPEM,
+			"authcerts":           []string{certPEM, caPEM},
+			"expiry_warning_days": -1,
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	before := events()
+	s.checkCertExpiry(now.Add(11 * 24 * time.Hour))
+	if events() != before {
+		t.Fatal("expiry reported with warnings disabled")
+	}
+}
+
+func TestAPICertExpiry(t *testing.T) {
+	certPEM, keyPEM := newExpiringKeyPair(t, "server", time.Now().Add(48*time.Hour))
+	s := newTestServer(t, map[string]any{
+		"tls": map[string]any{
+			"cert":      certPEM,
+			"key":       keyPEM,
+			"authcerts": []string{certPEM},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	rec := httptest.NewRecorder()
+	(&apiStatsHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?nobanner=true", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "> Certificates") || !strings.Contains(body, "server              : local, expires in ") {
+		t.Fatalf("stats missing certificates:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	newAPIMetricsHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`tlswrapper_cert_expiry_seconds{role="local",subject="server"} 17`,
+		`tlswrapper_cert_expiry_seconds{role="authcert",subject="server"} 17`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+)
+
+const (
+	// certPollInterval is how often the files referenced by the TLS section are
+	// checked for changes, in case a change was not reported by the watcher.
+	certPollInterval = 10 * time.Second
+	// certSettleDelay lets a rotation finish writing the certificate and key
+	// before they are read.
+	certSettleDelay = 500 * time.Millisecond
+)
+
+// fileSums returns the SHA-256 of each readable file.
+func fileSums(files []string) map[string][sha256.Size]byte {
+	sums := make(map[string][sha256.Size]byte, len(files))
+	for _, name := range files {
+		if b, err := os.ReadFile(name); err == nil {
+			sums[name] = sha256.Sum256(b)
+		}
+	}
+	return sums
+}
+
+// certWatchLoop rebuilds the TLS config when a file referenced by "@path" in
+// the TLS section changes. Changes are noticed through the directory watcher
+// where available and by polling every certPollInterval. A rotation that
+// fails to load, such as a certificate written before its key, is retried once
+// the files change again.
+func (s *Server) certWatchLoop() {
+	w, err := newDirWatcher()
+	if err != nil {
+		slog.Debugf("certwatch: %s, polling only", formats.Error(err))
+	} else {
+		defer func() { _ = w.Close() }()
+	}
+	var events <-chan struct{}
+	if w != nil {
+		events = w.C
+	}
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	var settle <-chan time.Time
+
+	cfg, _ := s.getConfig()
+	sums := fileSums(cfg.TLSFiles())
+	var failed map[string][sha256.Size]byte
+	for {
+		files := cfg.TLSFiles()
+		if w != nil {
+			var dirs []string
+			for _, name := range files {
+				if dir := filepath.Dir(name); !slices.Contains(dirs, dir) {
+					dirs = append(dirs, dir)
+				}
+			}
+			w.set(dirs)
+		}
+		select {
+		case <-events:
+			if settle == nil {
+				settle = time.After(certSettleDelay)
+			}
+			continue
+		case <-settle:
+			settle = nil
+		case <-ticker.C:
+		case <-s.g.CloseC():
+			return
+		}
+		cfg, _ = s.getConfig()
+		current := fileSums(cfg.TLSFiles())
+		if maps.Equal(current, sums) || maps.Equal(current, failed) {
+			continue
+		}
+		if err := s.reloadTLSFiles(); err != nil {
+			slog.Errorf("certwatch: %s", formats.Error(err))
+			failed = current
+			continue
+		}
+		sums, failed = current, nil
+	}
+}
+
+// reloadTLSFiles reads the files referenced by the TLS section again and
+// applies the rebuilt TLS config to new handshakes. Unlike ReloadConfig, it
+// does not mark sessions stale; only the sessions of peers revoked by an
+// updated CRL are closed.
+func (s *Server) reloadTLSFiles() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old, _ := s.getConfig()
+	cfg, err := old.ReloadTLSFiles()
+	if err != nil {
+		return err
+	}
+	oldJSON, _ := json.Marshal(old.TLS)
+	newJSON, _ := json.Marshal(cfg.TLS)
+	if bytes.Equal(oldJSON, newJSON) {
+		return nil
+	}
+	tlscfg, err := cfg.NewTLSConfig()
+	if err != nil {
+		return err
+	}
+	clientTLSCfg, err := cfg.NewClientTLSConfig(tlscfg)
+	if err != nil {
+		return err
+	}
+	s.cfgMu.Lock()
+	s.cfg = cfg
+	s.tlscfg, s.clientTLSCfg = tlscfg, clientTLSCfg
+	s.muxDialer = s.buildMuxDialer(cfg, clientTLSCfg)
+	s.cfgMu.Unlock()
+	if b, err := json.Marshal(cfg); err == nil {
+		s.lastConfigJSON = b
+	}
+	s.closeRevokedSessions(cfg)
+	const msg = "certificate files reloaded"
+	s.recentEvents.Add(time.Now(), msg)
+	slog.Notice(msg)
+	return nil
+}
@@ -0,0 +1,107 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rotateKeyPair writes a new self-signed key pair to certFile and keyFile.
+func rotateKeyPair(t *testing.T, certFile, keyFile string) (certPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := newCertificate(nil, nil, "example.com", &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return certPEM
+}
+
+func newCertFileServer(t *testing.T) (s *Server, certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	rotateKeyPair(t, certFile, keyFile)
+	s = newTestServer(t, map[string]any{
+		"tls": map[string]any{
+			"cert":      "@" + certFile,
+			"key":       "@" + keyFile,
+			"authcerts": []string{"@" + certFile},
+		},
+	})
+	return s, certFile, keyFile
+}
+
+func TestReloadTLSFiles(t *testing.T) {
+	s, certFile, keyFile := newCertFileServer(t)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	cfg, oldTLS := s.getConfig()
+	if err := s.reloadTLSFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, tlscfg := s.getConfig(); tlscfg != oldTLS {
+		t.Fatal("TLS config rebuilt although the files did not change")
+	}
+
+	tun := newTunnel("", s)
+	s.mu.Lock()
+	s.identityTunnels = append(s.identityTunnels, tun)
+	s.mu.Unlock()
+	certPEM := rotateKeyPair(t, certFile, keyFile)
+	if err := s.reloadTLSFiles(); err != nil {
+		t.Fatal(err)
+	}
+	newCfg, tlscfg := s.getConfig()
+	if tlscfg == oldTLS || newCfg.TLS.Certificate != string(certPEM) {
+		t.Fatal("TLS config not rebuilt from the rotated files")
+	}
+	if newCfg.Listen != cfg.Listen || len(newCfg.TLSFiles()) != 2 {
+		t.Fatalf("reloaded config = %+v, want the rest kept", newCfg)
+	}
+	if tun.stale {
+		t.Fatal("session marked stale by a certificate rotation")
+	}
+
+	// A certificate written without its key is not applied.
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadTLSFiles(); err == nil {
+		t.Fatal("expected error for a mismatched key")
+	}
+	if _, current := s.getConfig(); current != tlscfg {
+		t.Fatal("TLS config replaced by a failed rotation")
+	}
+}
+
+func TestCertWatchLoop(t *testing.T) {
+	s, certFile, keyFile := newCertFileServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown() })
+	_, oldTLS := s.getConfig()
+	// Give the loop time to take its first snapshot of the files.
+	time.Sleep(100 * time.Millisecond)
+	certPEM := rotateKeyPair(t, certFile, keyFile)
+	waitFor(t, certPollInterval+5*time.Second, func() bool {
+		cfg, tlscfg := s.getConfig()
+		return tlscfg != oldTLS && cfg.TLS.Certificate == string(certPEM)
+	})
+}
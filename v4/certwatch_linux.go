@@ -0,0 +1,90 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build linux
+
+package tlswrapper
+
+import (
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+)
+
+// dirWatchMask covers files written in place as well as files and symlinks
+// renamed over the watched names.
+const dirWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// dirWatcher signals C when an entry of a watched directory changes, using
+// inotify.
+type dirWatcher struct {
+	C chan struct{}
+
+	f   *os.File
+	fd  int // f's descriptor; f.Fd() would make it blocking
+	mu  sync.Mutex
+	wds map[string]int // directory -> watch descriptor
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &dirWatcher{
+		C: make(chan struct{}, 1),
+		// A non-blocking fd is served by the runtime poller, so Close
+		// interrupts a pending Read.
+		f:   os.NewFile(uintptr(fd), "inotify"),
+		fd:  fd,
+		wds: make(map[string]int),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *dirWatcher) run() {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := w.f.Read(buf); err != nil {
+			return
+		}
+		select {
+		case w.C <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// set replaces the watched directories with dirs.
+func (w *dirWatcher) set(dirs []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for dir, wd := range w.wds {
+		if !slices.Contains(dirs, dir) {
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, dir)
+		}
+	}
+	for _, dir := range dirs {
+		if _, ok := w.wds[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, dirWatchMask)
+		if err != nil {
+			// Polling still notices changes in this directory.
+			slog.Debugf("certwatch: %s: %s", dir, formats.Error(err))
+			continue
+		}
+		w.wds[dir] = wd
+	}
+}
+
+func (w *dirWatcher) Close() error {
+	return w.f.Close()
+}
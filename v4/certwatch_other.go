@@ -0,0 +1,24 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build !linux
+
+package tlswrapper
+
+import "errors"
+
+// dirWatcher is not implemented on this platform; certificate files are only
+// polled.
+type dirWatcher struct {
+	C chan struct{}
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (w *dirWatcher) set([]string) {}
+
+func (w *dirWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,255 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// describeKey names the type and size of a public key.
+func describeKey(pub any) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+// certSANs lists the subject alternative names of cert.
+func certSANs(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	return names
+}
+
+// printCert prints the details of cert that matter to authcerts.
+func printCert(cert *x509.Certificate, now time.Time) {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	fingerprint := sha256.Sum256(cert.Raw)
+	fmt.Printf("    subject:     %s\n", cert.Subject)
+	if names := certSANs(cert); len(names) > 0 {
+		fmt.Printf("    SANs:        %s\n", strings.Join(names, ", "))
+	}
+	fmt.Printf("    issuer:      %s\n", cert.Issuer)
+	fmt.Printf("    key:         %s\n", describeKey(cert.PublicKey))
+	if cert.IsCA {
+		fmt.Printf("    CA:          yes\n")
+	}
+	fmt.Printf("    SPKI pin:    sha256/%s\n", base64.StdEncoding.EncodeToString(spki[:]))
+	fmt.Printf("    fingerprint: %s\n", hex.EncodeToString(fingerprint[:]))
+	validity := formatTimeLeft(cert.NotAfter, now)
+	if now.Before(cert.NotBefore) {
+		validity = "not valid before " + cert.NotBefore.Format(slog.TimeLayout)
+	}
+	fmt.Printf("    not after:   %s (%s)\n", cert.NotAfter.Format(slog.TimeLayout), validity)
+}
+
+// readCertChain reads the certificates in the PEM file name, leaf first.
+func readCertChain(name string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificate found", name)
+	}
+	return certs, nil
+}
+
+// verifyPeerChain checks certs, leaf first, the way crypto/tls does with
+// tlscfg: as the client dialing serverName, or as the server of an inbound
+// connection.
+func verifyPeerChain(tlscfg *tls.Config, certs []*x509.Certificate, serverName string, client bool) error {
+	cs := tls.ConnectionState{PeerCertificates: certs, ServerName: serverName}
+	verified := tlscfg.ClientAuth == tls.RequireAndVerifyClientCert
+	if client {
+		verified = !tlscfg.InsecureSkipVerify
+	}
+	if verified {
+		opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if client {
+			opts.Roots = tlscfg.RootCAs
+			opts.DNSName = serverName
+		} else {
+			opts.Roots = tlscfg.ClientCAs
+			opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}
+		chains, err := certs[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		cs.VerifiedChains = chains
+	}
+	if tlscfg.VerifyConnection != nil {
+		return tlscfg.VerifyConnection(cs)
+	}
+	return nil
+}
+
+// certChecker prints check results and remembers whether any failed.
+type certChecker struct {
+	cfg          *config.File
+	tlscfg       *tls.Config
+	clientTLSCfg *tls.Config
+	failed       bool
+}
+
+func (c *certChecker) report(err error, format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	if err != nil {
+		c.failed = true
+		fmt.Printf("  FAIL  %s: %s\n", msg, formats.Error(err))
+		return
+	}
+	fmt.Printf("  ok    %s\n", msg)
+}
+
+// checkChain reports whether a peer presenting certs passes authcerts
+// verification in both directions.
+func (c *certChecker) checkChain(certs []*x509.Certificate) {
+	c.report(verifyPeerChain(c.tlscfg, certs, "", false), "accepted on inbound connections")
+	sni := c.cfg.ServerName()
+	err := verifyPeerChain(c.clientTLSCfg, certs, sni, true)
+	var hostErr x509.HostnameError
+	if errors.As(err, &hostErr) {
+		if names := certSANs(certs[0]); len(names) > 0 {
+			err = fmt.Errorf("%w; it is valid for %s", err, strings.Join(names, ", "))
+		}
+	}
+	if c.cfg.Pinned(certs[0]) {
+		c.report(err, "accepted on outbound connections (pinned, sni is not checked)")
+		return
+	}
+	c.report(err, "accepted on outbound connections with sni %q", sni)
+}
+
+// checkCerts prints the certificates of the TLS section and checks them as a
+// handshake would; with -peercert, the peer certificate chain in that file as
+// well. Returns 1 if any check fails.
+func checkCerts(f *AppFlags) int {
+	var cfg *config.File
+	var err error
+	if f.Config == "-" {
+		cfg, err = config.LoadReader(os.Stdin)
+	} else {
+		cfg, err = config.LoadFile(f.Config)
+	}
+	if err != nil {
+		slog.Fatal("checkcerts: ", formats.Error(err))
+		return 1
+	}
+	if cfg.TLS == nil {
+		slog.Fatal("checkcerts: tls is not configured")
+		return 1
+	}
+	c := &certChecker{cfg: cfg}
+	c.tlscfg, err = cfg.NewTLSConfig()
+	if err == nil {
+		c.clientTLSCfg, err = cfg.NewClientTLSConfig(c.tlscfg)
+	}
+	var local []*x509.Certificate
+	if err == nil {
+		for _, der := range c.tlscfg.Certificates[0].Certificate {
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				local = append(local, cert)
+			}
+		}
+	} else if cert := cfg.LocalCertificate(); cert != nil {
+		local = append(local, cert)
+	}
+	now := time.Now()
+	fmt.Println("local certificate:")
+	for i, cert := range local {
+		fmt.Printf("  [%d]\n", i)
+		printCert(cert, now)
+	}
+	fmt.Println("authcerts:")
+	for i, cert := range cfg.AuthCertificates() {
+		fmt.Printf("  [%d]\n", i)
+		printCert(cert, now)
+	}
+	for _, s := range cfg.TLS.AuthCerts {
+		if block, _ := pem.Decode([]byte(s)); block == nil {
+			fmt.Printf("  pin %s\n", strings.TrimSpace(s))
+		}
+	}
+
+	fmt.Println("checks:")
+	c.report(err, "certificate matches its private key and authcerts load")
+	if err != nil {
+		return 1
+	}
+	// Our peers are assumed to share our authcerts and sni.
+	fmt.Println("  as seen by a peer with the same authcerts:")
+	c.checkChain(local)
+	if f.PeerCert != "" {
+		peer, err := readCertChain(f.PeerCert)
+		if err != nil {
+			slog.Fatal("checkcerts: ", formats.Error(err))
+			return 1
+		}
+		fmt.Printf("peer certificate %q:\n", f.PeerCert)
+		for i, cert := range peer {
+			fmt.Printf("  [%d]\n", i)
+			printCert(cert, now)
+		}
+		fmt.Println("checks:")
+		c.checkChain(peer)
+	}
+	if c.failed {
+		return 1
+	}
+	return 0
+}
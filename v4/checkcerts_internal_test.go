@@ -0,0 +1,112 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// writeCheckConfig writes a config using node-a's key pair and trusting
+// authcerts, and returns its path.
+func writeCheckConfig(t *testing.T, sni string, authCerts ...string) string {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"type": config.Type,
+		"log":  "discard",
+		"tls": map[string]any{
+			"cert":      "@node-a-cert.pem",
+			"key":       "@node-a-key.pem",
+			"authcerts": authCerts,
+			"sni":       sni,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("config.json", b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "config.json"
+}
+
+func TestCheckCerts(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	for _, f := range []*AppFlags{
+		{GenCerts: "ca", ServerName: "Test CA", KeyType: "ecdsa", Profile: "ca"},
+		{GenCerts: "node-a,node-b", Sign: "ca", ServerName: "node.example.com", KeyType: "ecdsa"},
+		{GenCerts: "stranger", ServerName: "node.example.com", KeyType: "ed25519"},
+	} {
+		if code := genCerts(f); code != 0 {
+			t.Fatalf("genCerts(%q) = %d, want 0", f.GenCerts, code)
+		}
+	}
+	check := func(f *AppFlags) (int, string) {
+		var code int
+		out := captureStdout(t, func() { code = checkCerts(f) })
+		return code, out
+	}
+
+	cfg := writeCheckConfig(t, "node.example.com", "@ca-cert.pem")
+	code, out := check(&AppFlags{Config: cfg, PeerCert: "node-b-cert.pem"})
+	if code != 0 || strings.Contains(out, "FAIL") {
+		t.Fatalf("checkCerts() = %d, want 0:\n%s", code, out)
+	}
+	for _, s := range []string{
+		"subject:     CN=node.example.com",
+		"SANs:        DNS:node.example.com",
+		"issuer:      CN=Test CA",
+		"key:         ECDSA P-",
+		"SPKI pin:    sha256/",
+		`accepted on outbound connections with sni "node.example.com"`,
+		`peer certificate "node-b-cert.pem"`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("output lacks %q:\n%s", s, out)
+		}
+	}
+
+	// A certificate not signed by the CA is rejected both ways.
+	code, out = check(&AppFlags{Config: cfg, PeerCert: "stranger-cert.pem"})
+	if code != 1 || strings.Count(out, "FAIL") != 2 || !strings.Contains(out, "key:         Ed25519") {
+		t.Fatalf("checkCerts() with an unknown peer = %d:\n%s", code, out)
+	}
+
+	// With another sni, dialing out fails and tells the names that would do.
+	cfg = writeCheckConfig(t, "other.example.com", "@ca-cert.pem")
+	code, out = check(&AppFlags{Config: cfg})
+	if code != 1 || !strings.Contains(out, "valid for DNS:node.example.com") {
+		t.Fatalf("checkCerts() with a mismatched sni = %d:\n%s", code, out)
+	}
+
+	// Pinned peers are not matched against the sni; the others still are.
+	pin := certSPKIPin(t, "stranger-cert.pem")
+	cfg = writeCheckConfig(t, "node.example.com", "@ca-cert.pem", pin)
+	code, out = check(&AppFlags{Config: cfg, PeerCert: "stranger-cert.pem"})
+	if code != 0 || !strings.Contains(out, "pin "+pin) || !strings.Contains(out, "sni is not checked") {
+		t.Fatalf("checkCerts() with a pinned peer = %d:\n%s", code, out)
+	}
+	cfg = writeCheckConfig(t, "other.example.com", "@ca-cert.pem", pin)
+	code, out = check(&AppFlags{Config: cfg})
+	if code != 1 || !strings.Contains(out, "valid for DNS:node.example.com") {
+		t.Fatalf("checkCerts() with pins and a mismatched sni = %d:\n%s", code, out)
+	}
+}
+
+// certSPKIPin returns the SPKI pin of the certificate in file name.
+func certSPKIPin(t *testing.T, name string) string {
+	t.Helper()
+	certs, err := readCertChain(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -28,6 +28,19 @@ func parseFlags(f *tlswrapper.AppFlags) {
 	flag.StringVar(&f.Sign, "sign", "", "gencerts: sign the certificate with <signer>-cert.pem, <signer>-key.pem")
 	flag.StringVar(&f.KeyType, "keytype", "rsa", "gencerts: one of rsa, ecdsa, ed25519")
 	flag.IntVar(&f.KeySize, "keysize", 0, "gencerts: specifies the size of the private key, depending on the key type")
+	flag.StringVar(&f.Profile, "profile", "", "gencerts: certificate profile, ca or leaf (default: self-signed certificates may also sign)")
+	flag.StringVar(&f.SANs, "san", "", "gencerts: comma-separated DNS names, IP addresses and URIs (default: the server name)")
+	flag.IntVar(&f.Days, "days", 0, "gencerts: validity period in days (default: 3652)")
+	flag.IntVar(&f.MaxPathLen, "pathlen", 0, "gencerts: with -profile ca, the number of intermediate CAs allowed below it, -1 for unlimited")
+	flag.StringVar(&f.NameConstraints, "nameconstraints", "", "gencerts: with -profile ca, comma-separated permitted DNS domains and IP ranges (CIDR)")
+	flag.BoolVar(&f.ReuseKey, "reusekey", false, "gencerts: reuse <name>-key.pem if it exists, keeping SPKI pins valid")
+	flag.StringVar(&f.GenCSR, "gencsr", "", "comma-separated name list, generate certificate requests as <name>-csr.pem, <name>-key.pem")
+	flag.StringVar(&f.SignCSR, "signcsr", "", "comma-separated name list, sign <name>-csr.pem with -sign as <name>-cert.pem")
+	flag.StringVar(&f.Passphrase, "passphrase", "", "gencerts: read and write encrypted <name>-key.pem files with the passphrase from env:NAME, file:PATH or credential:NAME (systemd)")
+	flag.StringVar(&f.Enroll, "enroll", "", "request <name>-cert.pem from the enrollment listener at host:port or URL, name from -gencerts (default: node)")
+	flag.StringVar(&f.Token, "token", "", "enroll: one-time token minted by the hub")
+	flag.BoolVar(&f.CheckCerts, "checkcerts", false, "print the certificates of the config file and check that peers would accept them")
+	flag.StringVar(&f.PeerCert, "peercert", "", "checkcerts: also check whether the certificate chain in this PEM file passes authcerts")
 	flag.IntVar(&f.LogLevel, "loglevel", -1, "set the logging level")
 	for from, to := range flagAlias {
 		flagSet := flag.Lookup(from)
@@ -110,3 +110,54 @@ func TestParseFlagsAliases(t *testing.T) {
 		t.Fatalf("Config = %q, want %q", got.Config, "alias.json")
 	}
 }
+
+func TestParseFlagsCertProfiles(t *testing.T) {
+	got := runParseFlagsForTest(t, []string{
+		"tlswrapper",
+		"-gencsr", "device",
+		"-signcsr", "device",
+		"-profile", "ca",
+		"-san", "a.example.com,10.0.0.1",
+		"-days", "90",
+		"-pathlen", "-1",
+		"-nameconstraints", "example.com",
+		"-reusekey",
+	})
+	if got.GenCSR != "device" || got.SignCSR != "device" || got.Profile != "ca" {
+		t.Fatalf("GenCSR/SignCSR/Profile = %q/%q/%q", got.GenCSR, got.SignCSR, got.Profile)
+	}
+	if got.SANs != "a.example.com,10.0.0.1" || got.NameConstraints != "example.com" {
+		t.Fatalf("SANs/NameConstraints = %q/%q", got.SANs, got.NameConstraints)
+	}
+	if got.Days != 90 || got.MaxPathLen != -1 || !got.ReuseKey {
+		t.Fatalf("Days/MaxPathLen/ReuseKey = %d/%d/%v", got.Days, got.MaxPathLen, got.ReuseKey)
+	}
+}
+
+func TestParseFlagsEnroll(t *testing.T) {
+	got := runParseFlagsForTest(t, []string{
+		"tlswrapper",
+		"-enroll", "hub.example.com:8443",
+		"-token", "tw1.secret.pin",
+		"-gencerts", "node1",
+		"-passphrase", "credential:node-key",
+	})
+	if got.Passphrase != "credential:node-key" {
+		t.Fatalf("Passphrase = %q", got.Passphrase)
+	}
+	if got.Enroll != "hub.example.com:8443" || got.Token != "tw1.secret.pin" || got.GenCerts != "node1" {
+		t.Fatalf("Enroll/Token/GenCerts = %q/%q/%q", got.Enroll, got.Token, got.GenCerts)
+	}
+}
+
+func TestParseFlagsCheckCerts(t *testing.T) {
+	got := runParseFlagsForTest(t, []string{
+		"tlswrapper",
+		"-checkcerts",
+		"-config", "cfg.json",
+		"-peercert", "peer-cert.pem",
+	})
+	if !got.CheckCerts || got.Config != "cfg.json" || got.PeerCert != "peer-cert.pem" {
+		t.Fatalf("CheckCerts/Config/PeerCert = %v/%q/%q", got.CheckCerts, got.Config, got.PeerCert)
+	}
+}
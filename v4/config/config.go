@@ -4,7 +4,10 @@
 package config
 
 import (
+	"encoding/json"
 	"mime"
+	"net/netip"
+	"strings"
 
 	"github.com/hexian000/gosnippets/slog"
 )
@@ -22,10 +25,18 @@ var (
 type TLS struct {
 	// PEM certificate (inline PEM or "@path" to read from file at startup)
 	Certificate string `json:"cert"`
-	// PEM private key (inline PEM or "@path" to read from file at startup)
+	// PEM private key (inline PEM or "@path" to read from file at startup),
+	// either PKCS #8 or encrypted PKCS #8
 	PrivateKey string `json:"key"`
+	// Where the passphrase of an encrypted key is read from: "env:NAME",
+	// "file:PATH" or "credential:NAME" (systemd credential)
+	KeyPassphrase string `json:"key_passphrase,omitempty"`
 	// Authorized peer certificates (inline PEM or "@path" entries)
 	AuthCerts []string `json:"authcerts"`
+	// Certificate revocation lists (inline PEM or "@path" entries). A peer is
+	// rejected when its leaf or an intermediate certificate is listed in a CRL
+	// signed by that certificate's issuer.
+	CRL []string `json:"crl,omitempty"`
 	// SNI sent on outbound TLS handshakes; the peer certificate must be valid
 	// for this name. Empty defaults to "example.com", matching the gencerts
 	// default server name.
@@ -33,6 +44,29 @@ type TLS struct {
 	// ALPN advertised in the TLS handshake. Empty uses the mux protocol's
 	// standard identifier ("h2" for h2mux, "h3" for h3mux).
 	ALPN string `json:"alpn,omitempty"`
+	// Require the peer's identity claim to match its leaf certificate: the
+	// subject CN, a DNS or URI SAN, or an entry in Identities.
+	VerifyIdentity bool `json:"verify_identity,omitempty"`
+	// SHA-256 fingerprint of a peer leaf certificate (hex, colons optional)
+	// -> the only identity that certificate may claim. Implies VerifyIdentity.
+	Identities map[string]string `json:"identities,omitempty"`
+	// Days before expiry at which the local, authorized and peer certificates
+	// are reported (0 = DefaultExpiryWarningDays, negative = never).
+	ExpiryWarningDays int `json:"expiry_warning_days,omitempty"`
+
+	// source is the section as written, before load resolved "@path"
+	// references, so that the files can be read again.
+	source *TLS
+}
+
+// PSK authenticates and encrypts h2mux connections with pre-shared keys
+// instead of certificates. Every holder of a key is trusted alike.
+type PSK struct {
+	// Key ID -> base64-encoded 32-byte key. Inbound connections may use any
+	// of them, so that a new key can be added before peers switch to it.
+	Keys map[string]string `json:"keys"`
+	// Key ID used on outbound connections; may be omitted with a single key
+	KeyID string `json:"key_id,omitempty"`
 }
 
 // Mux holds mux-agnostic transport settings.
@@ -60,6 +94,9 @@ type Mux struct {
 	SendTimeout int `json:"send_timeout"`
 	// Session idle eviction timeout in seconds (0 = disabled)
 	IdleTimeout int `json:"idle_timeout"`
+	// Policy for spreading streams over parallel sessions to one peer:
+	// "round-robin" (default), "least-streams" or "lowest-latency"
+	Balance string `json:"balance,omitempty"`
 }
 
 // TCP holds TCP socket options.
@@ -76,14 +113,226 @@ type TCP struct {
 	Backlog int `json:"backlog"`
 }
 
+// AcceptProxy selects the listeners that expect a PROXY protocol (v1 or v2)
+// header from a load balancer in front of them. Only connections from Trusted
+// sources are parsed; they must start with a header, and its client address
+// replaces the connection's remote address. Other sources are served as-is.
+type AcceptProxy struct {
+	// Parse headers on Listen, Identity.Listen and the SOCKS5 listeners
+	Listen bool `json:"listen,omitempty"`
+	// Parse headers on MuxListen before the TLS handshake (h2mux only)
+	MuxListen bool `json:"mux_listen,omitempty"`
+	// Source networks ("CIDR" or a single address) allowed to send a header
+	Trusted []string `json:"trusted,omitempty"`
+
+	// Trusted as parsed by Validate
+	trusted []netip.Prefix
+}
+
+// SourceRules restricts the source addresses a listener accepts connections
+// from. Deny entries are checked first; when Allow is non-empty, sources
+// matching none of its entries are refused as well.
+type SourceRules struct {
+	// Source networks ("CIDR" or a single address) accepted (empty = any)
+	Allow []string `json:"allow,omitempty"`
+	// Source networks refused even when they match an Allow entry
+	Deny []string `json:"deny,omitempty"`
+
+	// Allow and Deny as parsed by Validate
+	allow, deny []netip.Prefix
+}
+
+// SourceACL holds the source address rules of each kind of listener. They are
+// checked against the socket's remote address on accept, before the TLS
+// handshake. Connections from AcceptProxy.Trusted sources are checked against
+// the client address of their PROXY protocol header instead.
+type SourceACL struct {
+	// Rules for the local TCP and UDP listeners without an entry in
+	// Listeners
+	Listen SourceRules `json:"listen,omitempty"`
+	// Rules for single local listeners, keyed by listen address; they
+	// replace Listen for that listener
+	Listeners map[string]SourceRules `json:"listeners,omitempty"`
+	// Rules for MuxListen
+	MuxListen SourceRules `json:"mux_listen,omitempty"`
+	// Rules for APIListen
+	APIListen SourceRules `json:"api_listen,omitempty"`
+	// Rules for Enroll.Listen
+	EnrollListen SourceRules `json:"enroll_listen,omitempty"`
+}
+
+// RateLimit is a token bucket limit on the bytes forwarded through the mux in
+// each direction.
+type RateLimit struct {
+	// Bytes per second sent to peers (0 = unlimited)
+	Send int64 `json:"send,omitempty"`
+	// Bytes per second received from peers (0 = unlimited)
+	Receive int64 `json:"receive,omitempty"`
+	// Bytes that may pass at once (0 = one second of the rate)
+	Burst int64 `json:"burst,omitempty"`
+}
+
+// Bandwidth holds the rate limits of forwarded TCP streams and UDP flows. A
+// stream or flow is throttled by every limit that applies to it.
+type Bandwidth struct {
+	// Limit shared by all streams
+	Total RateLimit `json:"total,omitempty"`
+	// Limits shared by the streams of each peer, keyed by identity
+	// ("*" = each peer without an entry)
+	Peers map[string]RateLimit `json:"peers,omitempty"`
+	// Limits shared by the streams and flows accepted on each local listener,
+	// keyed by its listen address (TCP or UDP)
+	Listeners map[string]RateLimit `json:"listeners,omitempty"`
+	// Limit of each stream
+	Stream RateLimit `json:"stream,omitempty"`
+}
+
+// Quota is a peer's transfer allowance over a recurring window. Bytes sent
+// and received on the peer's TCP streams and UDP flows both count against it.
+type Quota struct {
+	// Bytes per window (0 = unlimited; usage is still recorded)
+	Bytes int64 `json:"bytes,omitempty"`
+	// Accounting window starting at midnight UTC: "daily" or "monthly" (default)
+	Window string `json:"window,omitempty"`
+	// What happens once the quota is used up: "reject" (default) new streams,
+	// "throttle" the peer's streams to ThrottleRate, or only "alert"
+	Action string `json:"action,omitempty"`
+	// Bytes per second left to the peer by the "throttle" action
+	ThrottleRate int64 `json:"throttle_rate,omitempty"`
+}
+
+// Enroll lets new nodes obtain a certificate signed by a CA held on this hub,
+// in exchange for a one-time token minted through the management API.
+type Enroll struct {
+	// HTTPS address nodes enroll at; served with the TLS section's
+	// certificate, which nodes pin by its SPKI
+	Listen string `json:"listen"`
+	// CA certificate and PKCS #8 key that sign enrolled nodes (inline PEM or
+	// "@path")
+	CACert string `json:"ca_cert"`
+	CAKey  string `json:"ca_key"`
+	// Passphrase source of an encrypted ca_key, as TLS.KeyPassphrase
+	CAKeyPassphrase string `json:"ca_key_passphrase,omitempty"`
+	// Validity of issued certificates in days (0 = 90)
+	Days int `json:"days,omitempty"`
+	// Lifetime of minted tokens in seconds (0 = 86400)
+	TokenTTL int `json:"token_ttl,omitempty"`
+	// Allow tokens minted without a name, whose certificate carries the
+	// names the node requests
+	AllowUnnamed bool `json:"allow_unnamed,omitempty"`
+	// File that keeps pending tokens and issued certificates across
+	// restarts (empty = kept in memory only)
+	State string `json:"state,omitempty"`
+}
+
+// MuxTarget is an Identity.MuxConnect entry, written either as a plain dial
+// address or as an object that also sets the fields below.
+type MuxTarget struct {
+	// Dial address of the peer's mux listener
+	Addr string `json:"addr"`
+	// Number of parallel sessions kept to Addr (0 = 1)
+	Connections int `json:"connections,omitempty"`
+	// Backup addresses of the same peer, in order of preference after Addr
+	Failover []string `json:"failover,omitempty"`
+	// How Addr and Failover are dialed: "ordered" (default) tries one at a
+	// time; "parallel" starts the next one after a short delay and keeps the
+	// first session established
+	Dial string `json:"dial,omitempty"`
+	// Seconds between attempts to move back to Addr while connected to a
+	// failover address (0 = 300)
+	FallbackInterval int `json:"fallback_interval,omitempty"`
+}
+
+// UnmarshalJSON accepts a plain address string or an object.
+func (t *MuxTarget) UnmarshalJSON(b []byte) error {
+	var addr string
+	if err := json.Unmarshal(b, &addr); err == nil {
+		*t = MuxTarget{Addr: addr}
+		return nil
+	}
+	type plain MuxTarget
+	return json.Unmarshal(b, (*plain)(t))
+}
+
+// MarshalJSON writes a plain address string unless other fields are set.
+func (t MuxTarget) MarshalJSON() ([]byte, error) {
+	if t.Connections == 0 && len(t.Failover) == 0 && t.Dial == "" && t.FallbackInterval == 0 {
+		return json.Marshal(t.Addr)
+	}
+	type plain MuxTarget
+	return json.Marshal(plain(t))
+}
+
+// Pool is a named group of backends that Connect, Identity.Connect and
+// Services may refer to instead of a single address. Each inbound stream is
+// forwarded to one available backend picked by Balance; if the dial fails,
+// the next one is tried.
+type Pool struct {
+	// Backend dial addresses
+	Backends []string `json:"backends"`
+	// Backend selection policy: "round-robin" (default), "random",
+	// "least-connections" or "hash" (consistent hashing on the peer identity)
+	Balance string `json:"balance,omitempty"`
+	// Seconds between active TCP health checks of each backend (0 = disabled)
+	HealthCheck int `json:"health_check,omitempty"`
+	// Consecutive dial failures after which a backend is ejected (0 = 3)
+	MaxFails int `json:"max_fails,omitempty"`
+	// Seconds an ejected backend is skipped (0 = 30)
+	EjectTime int `json:"eject_time,omitempty"`
+}
+
+// Policy grants the peers it matches access to forwarding targets. A peer
+// matches when every non-empty match field (Identities, OU, Issuers) has an
+// entry that applies to it; certificate fields never match plaintext peers.
+type Policy struct {
+	// Peer identities the rule applies to ("*" = any)
+	Identities []string `json:"identities,omitempty"`
+	// Organizational units, one of which the subject of the peer's leaf
+	// certificate must carry
+	OU []string `json:"ou,omitempty"`
+	// Common names, one of which must be the issuer of the peer's leaf
+	// certificate
+	Issuers []string `json:"issuers,omitempty"`
+	// Allow streams to the peer's default target (Identity.Connect or Connect)
+	Connect bool `json:"connect,omitempty"`
+	// Named services the peer may request ("*" = any)
+	Services []string `json:"services,omitempty"`
+	// Allow destination requests, still limited by AllowDestinations
+	Destinations bool `json:"destinations,omitempty"`
+	// Allow datagram flows to UDPConnect
+	UDP bool `json:"udp,omitempty"`
+	// Allow local listeners to open streams and UDP flows toward the peer
+	Receive bool `json:"receive,omitempty"`
+	// Maximum concurrent streams, UDP flows and relayed streams the peer may
+	// keep open to us (0 = unlimited)
+	MaxStreams int `json:"max_streams,omitempty"`
+}
+
 // Identity holds the local handshake identity and per-peer tunnel routing.
 type Identity struct {
 	// Identity string sent to the peer during the mux handshake
 	Claim string `json:"claim,omitempty"`
 	// Additional outbound mux dial targets besides the top-level MuxConnect
-	MuxConnect []string `json:"mux_connect,omitempty"`
-	// Local listen addresses keyed by the remote identity they should use
+	MuxConnect []MuxTarget `json:"mux_connect,omitempty"`
+	// Local listen addresses keyed by the remote identity they should use.
+	// A "peer#service" key also names the remote service to request.
 	Listen map[string]string `json:"listen,omitempty"`
+	// Forwarding targets for inbound streams keyed by the opening peer's
+	// identity; peers without an entry use the top-level Connect.
+	Connect map[string]string `json:"connect,omitempty"`
+	// Local UDP listen addresses keyed by the remote identity they should use
+	UDPListen map[string]string `json:"udp_listen,omitempty"`
+	// Local SOCKS5 listen addresses keyed by the remote identity they should use
+	SOCKS5Listen map[string]string `json:"socks5_listen,omitempty"`
+	// Intermediate peer identity keyed by the identity it relays streams to;
+	// streams toward a routed identity are opened on the session to the
+	// intermediate peer instead
+	Routes map[string]string `json:"routes,omitempty"`
+	// Identities each peer may reach by relaying streams through this node,
+	// keyed by the peer's identity ("*" = any identity)
+	AllowRelay map[string][]string `json:"allow_relay,omitempty"`
+	// Maximum intermediate peers a relayed stream may pass (0 = 3)
+	MaxHops int `json:"max_hops,omitempty"`
 }
 
 // File represents the top-level configuration structure.
@@ -101,8 +350,49 @@ type File struct {
 	MuxProtocol string `json:"mux_protocol,omitempty"`
 	// Local TCP address to accept application traffic on
 	Listen string `json:"listen,omitempty"`
+	// Remote service requested for connections accepted on Listen (empty = peer's connect)
+	Service string `json:"service,omitempty"`
+	// Local UDP address whose datagrams are relayed over the default tunnel
+	UDPListen string `json:"udp_listen,omitempty"`
+	// Local SOCKS5 address whose CONNECT requests are relayed over the default tunnel
+	SOCKS5Listen string `json:"socks5_listen,omitempty"`
+	// Proxy protocol spoken on Listen and Identity.Listen: "" forwards
+	// connections as-is, "http" reads the destination from an HTTP CONNECT
+	ListenProxy string `json:"listen_proxy,omitempty"`
+	// Listeners that accept a PROXY protocol header from trusted sources
+	AcceptProxy AcceptProxy `json:"accept_proxy,omitempty"`
+	// Source address allow and deny lists of the listeners
+	SourceACL SourceACL `json:"source_acl,omitempty"`
+	// Rate limits of forwarded streams
+	Bandwidth Bandwidth `json:"bandwidth,omitempty"`
+	// Transfer quotas keyed by peer identity ("*" = each peer without an entry)
+	Quotas map[string]Quota `json:"quotas,omitempty"`
+	// File that keeps quota usage across restarts (empty = not persisted)
+	QuotaState string `json:"quota_state,omitempty"`
+	// Certificate enrollment of new nodes (nil = disabled)
+	Enroll *Enroll `json:"enroll,omitempty"`
 	// Forwarding target for streams arriving from inbound ephemeral tunnels
 	Connect string `json:"connect,omitempty"`
+	// Named forwarding targets for streams that request a service
+	Services map[string]string `json:"services,omitempty"`
+	// Access rules for peers; the first rule that matches a peer applies.
+	// When set, peers that match no rule are denied everything.
+	Policies []Policy `json:"policies,omitempty"`
+	// Backend pools keyed by name; a forwarding target equal to a pool name
+	// dials that pool
+	Pools map[string]Pool `json:"pools,omitempty"`
+	// PROXY protocol version ("v1" or "v2") sent to Connect, per-peer connect
+	// and service targets before relaying; empty = disabled
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	// UDP forwarding target for datagram flows arriving from peers
+	UDPConnect string `json:"udp_connect,omitempty"`
+	// Idle timeout in seconds after which a UDP flow is closed
+	UDPTimeout int `json:"udp_timeout"`
+	// Destinations ("CIDR", "CIDR:port" or "CIDR:lo-hi") that peers may
+	// request with a stream, e.g. from a SOCKS5 listener
+	AllowDestinations []string `json:"allow_destinations,omitempty"`
+	// AllowDestinations as parsed by Validate
+	allowDestinations []destinationRule
 	// Handshake identity plus per-peer tunnel settings
 	Identity Identity `json:"identity,omitempty"`
 	// Log output destination ("stdout", "stderr", "syslog", "discard")
@@ -117,6 +407,8 @@ type File struct {
 	NoRedial bool `json:"no_redial,omitempty"`
 	// TLS configuration (nil = plaintext mode)
 	TLS *TLS `json:"tls,omitempty"`
+	// Pre-shared key configuration, an alternative to TLS for h2mux
+	PSK *PSK `json:"psk,omitempty"`
 	// Mux socket and buffer settings
 	Mux Mux `json:"mux"`
 	// Local TCP socket settings
@@ -132,6 +424,7 @@ var Default = File{
 
 	MaxSessions: 128,
 	MaxStartups: "10:30:60",
+	UDPTimeout:  60,
 
 	Mux: Mux{
 		TCP: TCP{
@@ -162,3 +455,66 @@ func (c *File) FindListen(name string) string {
 	}
 	return c.Identity.Listen[name]
 }
+
+// FindService returns the forwarding target for streams opened by peer that
+// request the named service. The empty name selects the peer's entry in
+// Identity.Connect, falling back to the top-level Connect address.
+func (c *File) FindService(peer, name string) (string, bool) {
+	if name == "" {
+		if addr, ok := c.Identity.Connect[peer]; ok {
+			return addr, true
+		}
+		return c.Connect, c.Connect != ""
+	}
+	addr, ok := c.Services[name]
+	return addr, ok
+}
+
+// AcceptsInbound reports whether streams opened by peers have a forwarding
+// target, i.e. Connect, a per-peer connect, a named service, UDPConnect, an
+// allowed destination, or a relay permission is configured.
+func (c *File) AcceptsInbound() bool {
+	return c.Connect != "" || len(c.Identity.Connect) > 0 || len(c.Services) > 0 ||
+		c.UDPConnect != "" || len(c.AllowDestinations) > 0 || len(c.Identity.AllowRelay) > 0
+}
+
+// FindSOCKS5Listen returns the SOCKS5 listen address for the given peer name.
+// For the empty name "", the top-level SOCKS5Listen field is returned.
+func (c *File) FindSOCKS5Listen(name string) string {
+	if name == "" {
+		return c.SOCKS5Listen
+	}
+	return c.Identity.SOCKS5Listen[name]
+}
+
+// FindUDPListen returns the UDP listen address for the given peer name.
+// For the empty name "", the top-level UDPListen field is returned.
+func (c *File) FindUDPListen(name string) string {
+	if name == "" {
+		return c.UDPListen
+	}
+	return c.Identity.UDPListen[name]
+}
+
+// ListenTarget returns the peer identity and remote service requested by
+// connections accepted on the named listener. For the empty name "", the
+// top-level Listen targets the default tunnel and requests Service.
+func (c *File) ListenTarget(name string) (peer, service string) {
+	if name == "" {
+		return "", c.Service
+	}
+	return parseListenName(name)
+}
+
+// listenServiceSep separates the peer identity from the service in an
+// Identity.Listen key. Identities may contain "/" (URI SANs do), so it is "#",
+// which Validate allows only once per key.
+const listenServiceSep = "#"
+
+// parseListenName splits an Identity.Listen key into the peer identity and the
+// remote service it requests: a "peer#service" key requests service, a plain
+// "peer" key the peer's default target.
+func parseListenName(name string) (peer, service string) {
+	peer, service, _ = strings.Cut(name, listenServiceSep)
+	return peer, service
+}
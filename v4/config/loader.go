@@ -11,6 +11,7 @@ import (
 	"mime"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -31,6 +32,10 @@ func loadPEM(s string) (string, error) {
 
 // load resolves any "@path" references in the TLS section.
 func (t *TLS) load() error {
+	source := *t
+	source.AuthCerts = slices.Clone(t.AuthCerts)
+	source.CRL = slices.Clone(t.CRL)
+	t.source = &source
 	certPEM, err := loadPEM(t.Certificate)
 	if err != nil {
 		return err
@@ -48,6 +53,31 @@ func (t *TLS) load() error {
 		}
 		t.AuthCerts[i] = certPEM
 	}
+	for i, crl := range t.CRL {
+		crlPEM, err := loadPEM(crl)
+		if err != nil {
+			return err
+		}
+		t.CRL[i] = crlPEM
+	}
+	return nil
+}
+
+func (p *PSK) validate() error {
+	if len(p.Keys) == 0 {
+		return fmt.Errorf("psk.keys: no key configured")
+	}
+	for id, key := range p.Keys {
+		if id == "" || len(id) > 255 {
+			return fmt.Errorf("psk.keys: invalid key id %q", id)
+		}
+		if _, err := decodePSK(key); err != nil {
+			return fmt.Errorf("psk.keys: %q: %w", id, err)
+		}
+	}
+	if _, ok := p.Keys[p.outboundKeyID()]; !ok {
+		return fmt.Errorf("psk.key_id: unknown key id %q", p.KeyID)
+	}
 	return nil
 }
 
@@ -59,12 +89,32 @@ func clampInt(v *int, min, max int) {
 	}
 }
 
+// load resolves any "@path" references in the enroll section.
+func (e *Enroll) load() error {
+	certPEM, err := loadPEM(e.CACert)
+	if err != nil {
+		return err
+	}
+	e.CACert = certPEM
+	keyPEM, err := loadPEM(e.CAKey)
+	if err != nil {
+		return err
+	}
+	e.CAKey = keyPEM
+	return nil
+}
+
 func (cfg *File) load() error {
 	if cfg.TLS != nil {
 		if err := cfg.TLS.load(); err != nil {
 			return err
 		}
 	}
+	if cfg.Enroll != nil {
+		if err := cfg.Enroll.load(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -173,14 +223,272 @@ func (c *File) Validate() error {
 	if err := checkType(c.Type); err != nil {
 		return err
 	}
+	switch c.ListenProxy {
+	case "", "http":
+	default:
+		return fmt.Errorf("listen_proxy: unknown value %q", c.ListenProxy)
+	}
+	switch c.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("proxy_protocol: unknown version %q", c.ProxyProtocol)
+	}
 	if c.MuxProtocol == "h3mux" && c.TLS == nil {
 		return fmt.Errorf("h3mux requires TLS to be configured")
 	}
+	if c.PSK != nil {
+		if err := c.PSK.validate(); err != nil {
+			return err
+		}
+		if c.TLS != nil {
+			return fmt.Errorf("psk and tls cannot be configured together")
+		}
+	}
 	if c.MaxStartups != "" {
 		if _, _, _, err := parseMaxStartups(c.MaxStartups); err != nil {
 			return fmt.Errorf("max_startups: %w", err)
 		}
 	}
+	if c.TLS != nil {
+		for fp := range c.TLS.Identities {
+			if _, err := parseFingerprint(fp); err != nil {
+				return fmt.Errorf("tls.identities: %w", err)
+			}
+		}
+	}
+	switch c.Mux.Balance {
+	case "", "round-robin", "least-streams", "lowest-latency":
+	default:
+		return fmt.Errorf("mux.balance: unknown policy %q", c.Mux.Balance)
+	}
+	for _, t := range c.Identity.MuxConnect {
+		if t.Addr == "" {
+			return fmt.Errorf("identity.mux_connect: empty address")
+		}
+		if t.Connections < 0 {
+			return fmt.Errorf("identity.mux_connect: %q: negative connections", t.Addr)
+		}
+		if slices.Contains(t.Failover, "") {
+			return fmt.Errorf("identity.mux_connect: %q: empty failover address", t.Addr)
+		}
+		switch t.Dial {
+		case "", "ordered", "parallel":
+		default:
+			return fmt.Errorf("identity.mux_connect: %q: unknown dial mode %q", t.Addr, t.Dial)
+		}
+		if t.FallbackInterval < 0 {
+			return fmt.Errorf("identity.mux_connect: %q: negative fallback_interval", t.Addr)
+		}
+	}
+	for peer, addr := range c.Identity.Connect {
+		if peer == "" {
+			return fmt.Errorf("identity.connect: empty peer identity")
+		}
+		if addr == "" {
+			return fmt.Errorf("identity.connect: %q has no address", peer)
+		}
+	}
+	for name, addr := range c.Identity.Listen {
+		if name == "" {
+			return fmt.Errorf("identity.listen: empty peer identity")
+		}
+		if addr == "" {
+			return fmt.Errorf("identity.listen: %q has no address", name)
+		}
+		if strings.Count(name, listenServiceSep) > 1 {
+			return fmt.Errorf("identity.listen: %q is ambiguous: more than one %q", name, listenServiceSep)
+		}
+	}
+	for peer, addr := range c.Identity.UDPListen {
+		if peer == "" {
+			return fmt.Errorf("identity.udp_listen: empty peer identity")
+		}
+		if addr == "" {
+			return fmt.Errorf("identity.udp_listen: %q has no address", peer)
+		}
+	}
+	for peer, addr := range c.Identity.SOCKS5Listen {
+		if peer == "" {
+			return fmt.Errorf("identity.socks5_listen: empty peer identity")
+		}
+		if addr == "" {
+			return fmt.Errorf("identity.socks5_listen: %q has no address", peer)
+		}
+	}
+	c.AcceptProxy.trusted = nil
+	for _, s := range c.AcceptProxy.Trusted {
+		prefix, err := parseTrustedSource(s)
+		if err != nil {
+			return fmt.Errorf("accept_proxy.trusted: %w", err)
+		}
+		c.AcceptProxy.trusted = append(c.AcceptProxy.trusted, prefix)
+	}
+	for _, acl := range []struct {
+		name  string
+		rules *SourceRules
+	}{
+		{"listen", &c.SourceACL.Listen},
+		{"mux_listen", &c.SourceACL.MuxListen},
+		{"api_listen", &c.SourceACL.APIListen},
+		{"enroll_listen", &c.SourceACL.EnrollListen},
+	} {
+		if err := acl.rules.parse(); err != nil {
+			return fmt.Errorf("source_acl.%s: %w", acl.name, err)
+		}
+	}
+	listenAddrs := c.localListenAddrs()
+	if len(c.SourceACL.Listeners) > 0 {
+		// Parse into a copy: c may share the map with the config it was
+		// copied from.
+		listeners := make(map[string]SourceRules, len(c.SourceACL.Listeners))
+		for addr, rules := range c.SourceACL.Listeners {
+			if addr == "" || !slices.Contains(listenAddrs, addr) {
+				return fmt.Errorf("source_acl.listeners: %q is not a local listen address", addr)
+			}
+			if err := rules.parse(); err != nil {
+				return fmt.Errorf("source_acl.listeners[%q]: %w", addr, err)
+			}
+			listeners[addr] = rules
+		}
+		c.SourceACL.Listeners = listeners
+	}
+	checkRate := func(name string, l RateLimit) error {
+		if l.Send < 0 || l.Receive < 0 || l.Burst < 0 {
+			return fmt.Errorf("bandwidth.%s: negative value", name)
+		}
+		return nil
+	}
+	if err := checkRate("total", c.Bandwidth.Total); err != nil {
+		return err
+	}
+	if err := checkRate("stream", c.Bandwidth.Stream); err != nil {
+		return err
+	}
+	for peer, l := range c.Bandwidth.Peers {
+		if peer == "" {
+			return fmt.Errorf("bandwidth.peers: empty peer identity")
+		}
+		if err := checkRate(fmt.Sprintf("peers[%q]", peer), l); err != nil {
+			return err
+		}
+	}
+	for addr, l := range c.Bandwidth.Listeners {
+		if addr == "" || !slices.Contains(listenAddrs, addr) {
+			return fmt.Errorf("bandwidth.listeners: %q is not a local listen address", addr)
+		}
+		if err := checkRate(fmt.Sprintf("listeners[%q]", addr), l); err != nil {
+			return err
+		}
+	}
+	if (c.AcceptProxy.Listen || c.AcceptProxy.MuxListen) && len(c.AcceptProxy.Trusted) == 0 {
+		return fmt.Errorf("accept_proxy: no trusted sources")
+	}
+	if c.AcceptProxy.MuxListen && c.MuxProtocol == "h3mux" {
+		return fmt.Errorf("accept_proxy.mux_listen is not supported with h3mux")
+	}
+	c.allowDestinations = nil
+	for _, s := range c.AllowDestinations {
+		r, err := parseDestinationRule(s)
+		if err != nil {
+			return fmt.Errorf("allow_destinations: %w", err)
+		}
+		c.allowDestinations = append(c.allowDestinations, r)
+	}
+	for name, addr := range c.Services {
+		if name == "" {
+			return fmt.Errorf("services: empty service name")
+		}
+		if addr == "" {
+			return fmt.Errorf("services: %q has no address", name)
+		}
+	}
+	for dest, via := range c.Identity.Routes {
+		if dest == "" || via == "" {
+			return fmt.Errorf("identity.routes: empty peer identity")
+		}
+		if dest == via {
+			return fmt.Errorf("identity.routes: %q routes to itself", dest)
+		}
+	}
+	for peer, dests := range c.Identity.AllowRelay {
+		if peer == "" || slices.Contains(dests, "") {
+			return fmt.Errorf("identity.allow_relay: empty peer identity")
+		}
+	}
+	if c.Identity.MaxHops < 0 {
+		return fmt.Errorf("identity.max_hops: negative value")
+	}
+	for i, p := range c.Policies {
+		if slices.Contains(p.Identities, "") || slices.Contains(p.OU, "") ||
+			slices.Contains(p.Issuers, "") || slices.Contains(p.Services, "") {
+			return fmt.Errorf("policies[%d]: empty match or service entry", i)
+		}
+		if p.MaxStreams < 0 {
+			return fmt.Errorf("policies[%d]: negative max_streams", i)
+		}
+	}
+	for name, p := range c.Pools {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("pools: invalid pool name %q", name)
+		}
+		if len(p.Backends) == 0 {
+			return fmt.Errorf("pools: %q has no backends", name)
+		}
+		if slices.Contains(p.Backends, "") {
+			return fmt.Errorf("pools: %q: empty backend address", name)
+		}
+		switch p.Balance {
+		case "", "round-robin", "random", "least-connections", "hash":
+		default:
+			return fmt.Errorf("pools: %q: unknown policy %q", name, p.Balance)
+		}
+		if p.HealthCheck < 0 || p.MaxFails < 0 || p.EjectTime < 0 {
+			return fmt.Errorf("pools: %q: negative health_check, max_fails or eject_time", name)
+		}
+	}
+	for peer, q := range c.Quotas {
+		if peer == "" {
+			return fmt.Errorf("quotas: empty peer identity")
+		}
+		if q.Bytes < 0 || q.ThrottleRate < 0 {
+			return fmt.Errorf("quotas: %q: negative bytes or throttle_rate", peer)
+		}
+		switch q.Window {
+		case "", "daily", "monthly":
+		default:
+			return fmt.Errorf("quotas: %q: unknown window %q", peer, q.Window)
+		}
+		switch q.Action {
+		case "", "reject", "alert":
+		case "throttle":
+			if q.ThrottleRate == 0 {
+				return fmt.Errorf("quotas: %q: throttle action without throttle_rate", peer)
+			}
+		default:
+			return fmt.Errorf("quotas: %q: unknown action %q", peer, q.Action)
+		}
+	}
+	if c.TLS != nil && c.TLS.KeyPassphrase != "" {
+		if err := checkPassphraseSource(c.TLS.KeyPassphrase); err != nil {
+			return fmt.Errorf("tls.key_passphrase: %w", err)
+		}
+	}
+	if e := c.Enroll; e != nil {
+		if e.CAKeyPassphrase != "" {
+			if err := checkPassphraseSource(e.CAKeyPassphrase); err != nil {
+				return fmt.Errorf("enroll.ca_key_passphrase: %w", err)
+			}
+		}
+		if c.TLS == nil {
+			return fmt.Errorf("enroll requires TLS to be configured")
+		}
+		if e.Listen == "" || e.CACert == "" || e.CAKey == "" {
+			return fmt.Errorf("enroll: listen, ca_cert and ca_key are required")
+		}
+		if e.Days < 0 || e.TokenTTL < 0 {
+			return fmt.Errorf("enroll: negative days or token_ttl")
+		}
+	}
 	// clamp limits (negative values would break downstream consumers,
 	// e.g. make(chan, n) panics and uint32 conversions wrap around)
 	clampInt(&c.MaxSessions, 0, math.MaxInt32)
@@ -214,6 +522,7 @@ func (c *File) Validate() error {
 		clampInt(&c.TCP.WriteBuffer, 1, math.MaxInt32)
 	}
 	clampInt(&c.TCP.Backlog, 1, 4096)
+	clampInt(&c.UDPTimeout, 1, 86400)
 	// Warn when APIListen is bound to a non-loopback address; the API has no
 	// authentication and exposes config reload, GC triggers, and goroutine stacks.
 	if c.APIListen != "" {
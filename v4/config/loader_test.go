@@ -4,13 +4,20 @@
 package config
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 )
 
 func TestParseMaxStartups(t *testing.T) {
@@ -222,6 +229,335 @@ func TestValidate(t *testing.T) {
 			t.Fatalf("unexpected error for h3mux with TLS: %v", err)
 		}
 	})
+
+	t.Run("rejects-empty-service-name", func(t *testing.T) {
+		c := Default
+		c.Services = map[string]string{"": "127.0.0.1:22"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for empty service name")
+		}
+	})
+
+	t.Run("rejects-service-without-address", func(t *testing.T) {
+		c := Default
+		c.Services = map[string]string{"ssh": ""}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for service without address")
+		}
+	})
+
+	t.Run("rejects-identity-connect-without-address", func(t *testing.T) {
+		c := Default
+		c.Identity.Connect = map[string]string{"peerA": ""}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for identity.connect entry without address")
+		}
+	})
+
+	t.Run("rejects-identity-udp-listen-without-address", func(t *testing.T) {
+		c := Default
+		c.Identity.UDPListen = map[string]string{"peerA": ""}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for identity.udp_listen entry without address")
+		}
+	})
+
+	t.Run("rejects-identity-socks5-listen-without-address", func(t *testing.T) {
+		c := Default
+		c.Identity.SOCKS5Listen = map[string]string{"peerA": ""}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for identity.socks5_listen entry without address")
+		}
+	})
+
+	t.Run("rejects-invalid-allow-destination", func(t *testing.T) {
+		c := Default
+		c.AllowDestinations = []string{"10.0.0.0/8:99999"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for invalid allow_destinations entry")
+		}
+	})
+
+	t.Run("rejects-unknown-listen-proxy", func(t *testing.T) {
+		c := Default
+		c.ListenProxy = "socks4"
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for unknown listen_proxy")
+		}
+	})
+
+	t.Run("rejects-unknown-balance", func(t *testing.T) {
+		c := Default
+		c.Mux.Balance = "random"
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for unknown mux.balance")
+		}
+	})
+
+	t.Run("rejects-negative-connections", func(t *testing.T) {
+		c := Default
+		c.Identity.MuxConnect = []MuxTarget{{Addr: "peer:7000", Connections: -1}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for negative connections")
+		}
+	})
+
+	t.Run("rejects-unknown-dial-mode", func(t *testing.T) {
+		c := Default
+		c.Identity.MuxConnect = []MuxTarget{{Addr: "peer:7000", Dial: "random"}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for unknown dial mode")
+		}
+	})
+
+	t.Run("rejects-empty-failover", func(t *testing.T) {
+		c := Default
+		c.Identity.MuxConnect = []MuxTarget{{Addr: "peer:7000", Failover: []string{""}}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for empty failover address")
+		}
+	})
+
+	t.Run("rejects-invalid-relay-config", func(t *testing.T) {
+		for name, id := range map[string]Identity{
+			"empty-route":       {Routes: map[string]string{"carol": ""}},
+			"self-route":        {Routes: map[string]string{"carol": "carol"}},
+			"empty-relay-peer":  {AllowRelay: map[string][]string{"": {"*"}}},
+			"empty-relay-dest":  {AllowRelay: map[string][]string{"alice": {""}}},
+			"negative-max-hops": {MaxHops: -1},
+		} {
+			c := Default
+			c.Identity = id
+			if err := c.Validate(); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+		}
+	})
+
+	t.Run("rejects-invalid-policies", func(t *testing.T) {
+		for name, p := range map[string]Policy{
+			"empty-identity":      {Identities: []string{""}},
+			"empty-service":       {Services: []string{"ssh", ""}},
+			"negative-max-stream": {MaxStreams: -1},
+		} {
+			c := Default
+			c.Policies = []Policy{p}
+			if err := c.Validate(); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+		}
+	})
+
+	t.Run("rejects-invalid-pools", func(t *testing.T) {
+		for name, pools := range map[string]map[string]Pool{
+			"empty-name":     {"": {Backends: []string{"a:1"}}},
+			"address-name":   {"a:1": {Backends: []string{"a:1"}}},
+			"no-backends":    {"web": {}},
+			"empty-backend":  {"web": {Backends: []string{"a:1", ""}}},
+			"unknown-policy": {"web": {Backends: []string{"a:1"}, Balance: "fastest"}},
+			"negative-fails": {"web": {Backends: []string{"a:1"}, MaxFails: -1}},
+		} {
+			c := Default
+			c.Pools = pools
+			if err := c.Validate(); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+		}
+		c := Default
+		c.Pools = map[string]Pool{"web": {Backends: []string{"a:1", "b:1"}, Balance: "hash", HealthCheck: 5}}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("valid pool rejected: %v", err)
+		}
+	})
+
+	t.Run("rejects-accept-proxy-without-trusted", func(t *testing.T) {
+		c := Default
+		c.AcceptProxy.Listen = true
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for accept_proxy without trusted sources")
+		}
+	})
+
+	t.Run("rejects-invalid-accept-proxy-trusted", func(t *testing.T) {
+		c := Default
+		c.AcceptProxy.Trusted = []string{"10.0.0.0/33"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for invalid accept_proxy.trusted entry")
+		}
+	})
+
+	t.Run("rejects-accept-proxy-mux-listen-h3mux", func(t *testing.T) {
+		c := Default
+		c.MuxProtocol = "h3mux"
+		c.TLS = &TLS{}
+		c.AcceptProxy.MuxListen = true
+		c.AcceptProxy.Trusted = []string{"10.0.0.0/8"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for accept_proxy.mux_listen with h3mux")
+		}
+	})
+
+	t.Run("rejects-invalid-source-acl", func(t *testing.T) {
+		c := Default
+		c.SourceACL.MuxListen.Deny = []string{"192.0.2.0/24", "not-an-address"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for invalid source_acl entry")
+		}
+	})
+
+	t.Run("rejects-unknown-source-acl-listener", func(t *testing.T) {
+		c := Default
+		c.Listen, c.UDPListen = "127.0.0.1:2222", "127.0.0.1:2223"
+		c.SourceACL.Listeners = map[string]SourceRules{
+			"127.0.0.1:2222": {Allow: []string{"192.0.2.0/24"}},
+			"127.0.0.1:2223": {Deny: []string{"192.0.2.0/24"}},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		c.SourceACL.Listeners = map[string]SourceRules{"127.0.0.1:3333": {Allow: []string{"192.0.2.0/24"}}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for source_acl.listeners without a listener")
+		}
+	})
+
+	t.Run("rejects-ambiguous-listen", func(t *testing.T) {
+		c := Default
+		c.Identity.Listen = map[string]string{"spiffe://example.org/a#ssh": "127.0.0.1:2222"}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		c.Identity.Listen = map[string]string{"spiffe://example.org/a#b#ssh": "127.0.0.1:2222"}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for a listen key with two service separators")
+		}
+	})
+
+	t.Run("rejects-invalid-bandwidth", func(t *testing.T) {
+		c := Default
+		c.Bandwidth.Peers = map[string]RateLimit{"alice": {Send: -1}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for a negative rate")
+		}
+		c = Default
+		c.Listen = "127.0.0.1:8080"
+		c.Bandwidth.Listeners = map[string]RateLimit{"127.0.0.1:8081": {Send: 1000}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for a rate limit on an unknown listener")
+		}
+		c.Bandwidth.Listeners = map[string]RateLimit{"127.0.0.1:8080": {Send: 1000}}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		c.UDPListen = "127.0.0.1:5353"
+		c.UDPConnect = "127.0.0.1:53"
+		c.Bandwidth.Listeners = map[string]RateLimit{"127.0.0.1:5353": {Send: 1000}}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rejects-invalid-quotas", func(t *testing.T) {
+		for _, q := range []Quota{
+			{Bytes: -1},
+			{Bytes: 1000, Window: "weekly"},
+			{Bytes: 1000, Action: "drop"},
+			{Bytes: 1000, Action: "throttle"},
+		} {
+			c := Default
+			c.Quotas = map[string]Quota{"alice": q}
+			if err := c.Validate(); err == nil {
+				t.Fatalf("expected error for quota %+v", q)
+			}
+		}
+		c := Default
+		c.Quotas = map[string]Quota{"*": {Bytes: 1000, Window: "daily", Action: "throttle", ThrottleRate: 100}}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rejects-invalid-enroll", func(t *testing.T) {
+		valid := Enroll{Listen: ":8443", CACert: "cert", CAKey: "key"}
+		c := Default
+		c.Enroll = &valid
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for enroll without TLS")
+		}
+		c.TLS = &TLS{}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range []Enroll{
+			{CACert: "cert", CAKey: "key"},
+			{Listen: ":8443", CACert: "cert"},
+			{Listen: ":8443", CACert: "cert", CAKey: "key", Days: -1},
+			{Listen: ":8443", CACert: "cert", CAKey: "key", TokenTTL: -1},
+		} {
+			c.Enroll = &e
+			if err := c.Validate(); err == nil {
+				t.Fatalf("expected error for enroll %+v", e)
+			}
+		}
+	})
+
+	t.Run("rejects-invalid-psk", func(t *testing.T) {
+		key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+		c := Default
+		c.PSK = &PSK{Keys: map[string]string{"a": key}}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if id := c.PSKConfig().KeyID; id != "a" {
+			t.Fatalf("PSKConfig().KeyID = %q, want the only key", id)
+		}
+		c.TLS = &TLS{}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for psk with tls")
+		}
+		c.TLS = nil
+		for _, p := range []PSK{
+			{},
+			{Keys: map[string]string{"": key}},
+			{Keys: map[string]string{strings.Repeat("a", 256): key}},
+			{Keys: map[string]string{"a": "short"}},
+			{Keys: map[string]string{"a": base64.StdEncoding.EncodeToString(make([]byte, 16))}},
+			{Keys: map[string]string{"a": key, "b": key}},
+			{Keys: map[string]string{"a": key}, KeyID: "b"},
+		} {
+			c.PSK = &p
+			if err := c.Validate(); err == nil {
+				t.Fatalf("expected error for psk %+v", p)
+			}
+		}
+	})
+
+	t.Run("rejects-unknown-proxy-protocol", func(t *testing.T) {
+		c := Default
+		c.ProxyProtocol = "v3"
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for unknown proxy_protocol")
+		}
+	})
+
+	t.Run("clamps-udp-timeout", func(t *testing.T) {
+		c := Default
+		c.UDPTimeout = 0
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if c.UDPTimeout != 1 {
+			t.Fatalf("UDPTimeout = %d, want 1", c.UDPTimeout)
+		}
+	})
+
+	t.Run("rejects-invalid-identity-fingerprint", func(t *testing.T) {
+		c := Default
+		c.TLS = &TLS{Identities: map[string]string{"not-hex": "peer"}}
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected error for invalid fingerprint")
+		}
+	})
 }
 
 func TestLoad(t *testing.T) {
@@ -408,7 +744,7 @@ func TestFindListen(t *testing.T) {
 		Connect:    "backend:9000",
 		Identity: Identity{
 			Claim:      "self",
-			MuxConnect: []string{"peer-a:7001"},
+			MuxConnect: []MuxTarget{{Addr: "peer-a:7001"}},
 			Listen: map[string]string{
 				"peer-a": "127.0.0.1:8001",
 			},
@@ -434,6 +770,94 @@ func TestFindListen(t *testing.T) {
 	})
 }
 
+func TestFindService(t *testing.T) {
+	cfg := &File{
+		Connect:  "backend:9000",
+		Services: map[string]string{"ssh": "127.0.0.1:22"},
+	}
+
+	t.Run("default-entry", func(t *testing.T) {
+		got, ok := cfg.FindService("", "")
+		if !ok || got != "backend:9000" {
+			t.Fatalf("FindService(%q) = %q, %v, want %q, true", "", got, ok, "backend:9000")
+		}
+	})
+
+	t.Run("named-service", func(t *testing.T) {
+		got, ok := cfg.FindService("", "ssh")
+		if !ok || got != "127.0.0.1:22" {
+			t.Fatalf("FindService(%q) = %q, %v, want %q, true", "ssh", got, ok, "127.0.0.1:22")
+		}
+	})
+
+	t.Run("unknown-service", func(t *testing.T) {
+		if got, ok := cfg.FindService("", "http"); ok {
+			t.Fatalf("FindService(%q) = %q, true, want not found", "http", got)
+		}
+	})
+
+	t.Run("per-peer-connect", func(t *testing.T) {
+		c := &File{
+			Connect:  "backend:9000",
+			Identity: Identity{Connect: map[string]string{"peerA": "127.0.0.1:80"}},
+		}
+		if got, ok := c.FindService("peerA", ""); !ok || got != "127.0.0.1:80" {
+			t.Fatalf("FindService(%q, %q) = %q, %v, want %q, true", "peerA", "", got, ok, "127.0.0.1:80")
+		}
+		if got, ok := c.FindService("peerB", ""); !ok || got != "backend:9000" {
+			t.Fatalf("FindService(%q, %q) = %q, %v, want %q, true", "peerB", "", got, ok, "backend:9000")
+		}
+		if !(&File{Identity: c.Identity}).AcceptsInbound() {
+			t.Fatal("AcceptsInbound() = false with only identity.connect set")
+		}
+	})
+
+	t.Run("udp-connect", func(t *testing.T) {
+		if !(&File{UDPConnect: "127.0.0.1:53"}).AcceptsInbound() {
+			t.Fatal("AcceptsInbound() = false with only udp_connect set")
+		}
+	})
+
+	t.Run("allow-relay", func(t *testing.T) {
+		c := &File{Identity: Identity{AllowRelay: map[string][]string{"alice": {"*"}}}}
+		if !c.AcceptsInbound() {
+			t.Fatal("AcceptsInbound() = false with only identity.allow_relay set")
+		}
+	})
+
+	t.Run("no-connect", func(t *testing.T) {
+		c := &File{Services: cfg.Services}
+		if got, ok := c.FindService("", ""); ok {
+			t.Fatalf("FindService(%q) = %q, true, want not found", "", got)
+		}
+		if !c.AcceptsInbound() {
+			t.Fatal("AcceptsInbound() = false, want true with services configured")
+		}
+	})
+}
+
+func TestListenTarget(t *testing.T) {
+	cfg := &File{Service: "web"}
+	tests := []struct {
+		name        string
+		wantPeer    string
+		wantService string
+	}{
+		{"", "", "web"},
+		{"peer-a", "peer-a", ""},
+		{"peer-a#ssh", "peer-a", "ssh"},
+		{"#ssh", "", "ssh"},
+		{"spiffe://example.org/ns/peer", "spiffe://example.org/ns/peer", ""},
+		{"spiffe://example.org/ns/peer#ssh", "spiffe://example.org/ns/peer", "ssh"},
+	}
+	for _, tt := range tests {
+		peer, service := cfg.ListenTarget(tt.name)
+		if peer != tt.wantPeer || service != tt.wantService {
+			t.Fatalf("ListenTarget(%q) = %q, %q, want %q, %q", tt.name, peer, service, tt.wantPeer, tt.wantService)
+		}
+	}
+}
+
 func TestLoadPEM(t *testing.T) {
 	t.Run("plain-string", func(t *testing.T) {
 		got, err := loadPEM("INLINE")
@@ -469,6 +893,54 @@ func TestLoadPEM(t *testing.T) {
 	})
 }
 
+func TestReloadTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	certPath, crlPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "crl.pem")
+	for _, name := range []string{certPath, crlPath} {
+		if err := os.WriteFile(name, []byte("OLD"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := Default
+	cfg.TLS = &TLS{
+		Certificate: "@" + certPath,
+		PrivateKey:  "INLINE-KEY",
+		AuthCerts:   []string{"@" + certPath, "INLINE-CA"},
+		CRL:         []string{"@" + crlPath},
+	}
+	if err := cfg.load(); err != nil {
+		t.Fatal(err)
+	}
+	if files := cfg.TLSFiles(); !slices.Equal(files, []string{certPath, crlPath}) {
+		t.Fatalf("TLSFiles() = %v, want the cert and CRL once each", files)
+	}
+	if err := os.WriteFile(certPath, []byte("NEW"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := cfg.ReloadTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.TLS.Certificate != "NEW" || reloaded.TLS.AuthCerts[0] != "NEW" || reloaded.TLS.CRL[0] != "OLD" {
+		t.Fatalf("reloaded TLS = %+v", reloaded.TLS)
+	}
+	if cfg.TLS.Certificate != "OLD" {
+		t.Fatal("ReloadTLSFiles modified the original config")
+	}
+	if files := reloaded.TLSFiles(); len(files) != 2 {
+		t.Fatalf("reloaded TLSFiles() = %v, want the references kept", files)
+	}
+	if err := os.Remove(crlPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.ReloadTLSFiles(); err == nil {
+		t.Fatal("expected error for a removed file")
+	}
+	if files := (&File{}).TLSFiles(); files != nil {
+		t.Fatalf("plaintext TLSFiles() = %v", files)
+	}
+}
+
 func TestLoadFile(t *testing.T) {
 	t.Run("valid-file", func(t *testing.T) {
 		dir := t.TempDir()
@@ -539,3 +1011,217 @@ func TestLoadReader(t *testing.T) {
 		}
 	})
 }
+
+func TestMuxTargetJSON(t *testing.T) {
+	var cfg File
+	b := []byte(`{"identity": {"mux_connect": ["a:1", {"addr": "b:2", "connections": 4}]}}`)
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []MuxTarget{{Addr: "a:1"}, {Addr: "b:2", Connections: 4}}
+	if !reflect.DeepEqual(cfg.Identity.MuxConnect, want) {
+		t.Fatalf("MuxConnect = %+v, want %+v", cfg.Identity.MuxConnect, want)
+	}
+	if n := cfg.Identity.MuxConnect[0].NumConnections(); n != 1 {
+		t.Fatalf("NumConnections() = %d, want 1", n)
+	}
+	out, err := json.Marshal(cfg.Identity.MuxConnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != `["a:1",{"addr":"b:2","connections":4}]` {
+		t.Fatalf("Marshal = %s", got)
+	}
+}
+
+func TestFindMuxTarget(t *testing.T) {
+	c := &File{Identity: Identity{MuxConnect: []MuxTarget{
+		{Addr: "a:1", Failover: []string{"b:1", "c:1"}, FallbackInterval: 30},
+	}}}
+	target := c.FindMuxTarget("a:1")
+	if got := target.DialAddrs(); !reflect.DeepEqual(got, []string{"a:1", "b:1", "c:1"}) {
+		t.Fatalf("DialAddrs() = %v", got)
+	}
+	if got := target.FallbackDelay(); got != 30*time.Second {
+		t.Fatalf("FallbackDelay() = %v, want 30s", got)
+	}
+	plain := c.FindMuxTarget("x:1")
+	if got := plain.DialAddrs(); !reflect.DeepEqual(got, []string{"x:1"}) {
+		t.Fatalf("DialAddrs() = %v, want [x:1]", got)
+	}
+	if got := plain.FallbackDelay(); got != 300*time.Second {
+		t.Fatalf("FallbackDelay() = %v, want 300s", got)
+	}
+}
+
+func TestPoolDefaults(t *testing.T) {
+	var p Pool
+	if got := p.MaxFailures(); got != 3 {
+		t.Fatalf("MaxFailures() = %d, want 3", got)
+	}
+	if got := p.EjectDuration(); got != 30*time.Second {
+		t.Fatalf("EjectDuration() = %v, want 30s", got)
+	}
+	if got := p.HealthCheckInterval(); got != 0 {
+		t.Fatalf("HealthCheckInterval() = %v, want 0", got)
+	}
+	p = Pool{MaxFails: 1, EjectTime: 5, HealthCheck: 2}
+	if p.MaxFailures() != 1 || p.EjectDuration() != 5*time.Second || p.HealthCheckInterval() != 2*time.Second {
+		t.Fatalf("accessors ignore configured values: %+v", p)
+	}
+}
+
+func TestRelayRules(t *testing.T) {
+	c := &File{Identity: Identity{
+		Routes:     map[string]string{"carol": "bob"},
+		AllowRelay: map[string][]string{"alice": {"carol"}, "bob": {"*"}},
+	}}
+	if got := c.NextHop("carol"); got != "bob" {
+		t.Fatalf("NextHop(carol) = %q, want bob", got)
+	}
+	if got := c.NextHop("dave"); got != "dave" {
+		t.Fatalf("NextHop(dave) = %q, want dave", got)
+	}
+	for _, tc := range []struct {
+		peer, dest string
+		want       bool
+	}{
+		{"alice", "carol", true},
+		{"alice", "dave", false},
+		{"bob", "dave", true},
+		{"mallory", "carol", false},
+	} {
+		if got := c.RelayAllowed(tc.peer, tc.dest); got != tc.want {
+			t.Errorf("RelayAllowed(%q, %q) = %v, want %v", tc.peer, tc.dest, got, tc.want)
+		}
+	}
+	if got := c.MaxRelayHops(); got != 3 {
+		t.Fatalf("MaxRelayHops() = %d, want 3", got)
+	}
+	c.Identity.MaxHops = 1
+	if got := c.MaxRelayHops(); got != 1 {
+		t.Fatalf("MaxRelayHops() = %d, want 1", got)
+	}
+}
+
+func TestPeerPolicy(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops"}},
+		Issuer:  pkix.Name{CommonName: "Site CA"},
+	}
+	if p := (&File{}).PeerPolicy("anyone", nil); !p.Receive || !p.AllowsService("") || !p.AllowsService("ssh") {
+		t.Fatalf("PeerPolicy() without rules = %+v, want unrestricted", p)
+	}
+	c := &File{Policies: []Policy{
+		{Identities: []string{"alice"}, OU: []string{"dev"}, Services: []string{"git"}},
+		{Identities: []string{"alice"}, OU: []string{"ops"}, Issuers: []string{"Site CA"}, Connect: true, Services: []string{"ssh"}},
+		{Issuers: []string{"Partner CA"}, Receive: true},
+		{Identities: []string{"*"}, Services: []string{"web"}},
+	}}
+	p := c.PeerPolicy("alice", leaf)
+	if !p.AllowsService("") || !p.AllowsService("ssh") || p.AllowsService("git") {
+		t.Fatalf("PeerPolicy(alice, ops) = %+v, want the second rule", p)
+	}
+	// Certificate rules never match a peer without a certificate.
+	p = c.PeerPolicy("alice", nil)
+	if p.AllowsService("ssh") || !p.AllowsService("web") {
+		t.Fatalf("PeerPolicy(alice, nil) = %+v, want the wildcard rule", p)
+	}
+	partner := &x509.Certificate{Issuer: pkix.Name{CommonName: "Partner CA"}}
+	if p := c.PeerPolicy("bob", partner); !p.Receive {
+		t.Fatalf("PeerPolicy(bob, partner) = %+v, want the issuer rule", p)
+	}
+	c.Policies = c.Policies[:3]
+	if p := c.PeerPolicy("bob", nil); p.Receive || p.AllowsService("") || p.AllowsService("web") {
+		t.Fatalf("PeerPolicy() without a match = %+v, want nothing allowed", p)
+	}
+}
+
+func TestSourceRulesCheck(t *testing.T) {
+	check := func(r SourceRules, addr string) (string, bool) {
+		if err := r.parse(); err != nil {
+			t.Fatal(err)
+		}
+		return r.Check(netip.MustParseAddr(addr))
+	}
+	if rule, ok := check(SourceRules{}, "192.0.2.1"); !ok || rule != "" {
+		t.Fatalf("empty rules refused a source by %q", rule)
+	}
+	r := SourceRules{
+		Allow: []string{"10.0.0.0/8", "192.0.2.7"},
+		Deny:  []string{"10.1.0.0/16"},
+	}
+	for _, tc := range []struct {
+		addr string
+		rule string
+		ok   bool
+	}{
+		{"10.2.3.4", "", true},
+		{"::ffff:10.2.3.4", "", true},
+		{"192.0.2.7", "", true},
+		{"10.1.2.3", "10.1.0.0/16", false},
+		{"192.0.2.8", "default", false},
+		{"2001:db8::1", "default", false},
+	} {
+		if rule, ok := check(r, tc.addr); rule != tc.rule || ok != tc.ok {
+			t.Errorf("Check(%s) = %q, %v; want %q, %v", tc.addr, rule, ok, tc.rule, tc.ok)
+		}
+	}
+	r.Allow = nil
+	if _, ok := check(r, "192.0.2.8"); !ok {
+		t.Fatal("deny-only rules refused an unlisted source")
+	}
+	acl := SourceACL{APIListen: r}
+	_, got := acl.Rules("api_listen", "")
+	_, listen := acl.Rules("listen", "127.0.0.1:2222")
+	if len(got.Deny) != 1 || !listen.Empty() {
+		t.Fatalf("Rules() = %+v, want the api_listen rules only", got)
+	}
+	acl.Listeners = map[string]SourceRules{"127.0.0.1:2222": r}
+	if name, rules := acl.Rules("listen", "127.0.0.1:2222"); name != "listen 127.0.0.1:2222" || len(rules.Deny) != 1 {
+		t.Fatalf("Rules(listen, 127.0.0.1:2222) = %q, %+v, want its own rules", name, rules)
+	}
+	if name, rules := acl.Rules("listen", "127.0.0.1:3333"); name != "listen" || !rules.Empty() {
+		t.Fatalf("Rules(listen, 127.0.0.1:3333) = %q, %+v, want the shared rules", name, rules)
+	}
+}
+
+func TestBandwidthPeerLimit(t *testing.T) {
+	b := Bandwidth{}
+	if l := b.PeerLimit("alice"); !l.Unlimited() {
+		t.Fatalf("PeerLimit() without entries = %+v, want unlimited", l)
+	}
+	b.Peers = map[string]RateLimit{"alice": {Send: 1000}, "*": {Receive: 2000}}
+	if l := b.PeerLimit("alice"); l.Send != 1000 || l.Receive != 0 {
+		t.Fatalf("PeerLimit(alice) = %+v, want its own entry", l)
+	}
+	if l := b.PeerLimit("bob"); l.Receive != 2000 || l.Unlimited() {
+		t.Fatalf("PeerLimit(bob) = %+v, want the \"*\" entry", l)
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	now := time.Date(2026, time.January, 31, 15, 4, 5, 0, time.FixedZone("UTC+8", 8*3600))
+	for _, tc := range []struct {
+		window     string
+		start, end time.Time
+	}{
+		{"", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2026, time.January, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		q := Quota{Window: tc.window}
+		start := q.WindowStart(now)
+		if !start.Equal(tc.start) || !q.WindowEnd(start).Equal(tc.end) {
+			t.Errorf("window %q = [%v, %v), want [%v, %v)", tc.window, start, q.WindowEnd(start), tc.start, tc.end)
+		}
+	}
+	c := File{Quotas: map[string]Quota{"alice": {Bytes: 1}}}
+	if _, ok := c.PeerQuota("bob"); ok {
+		t.Fatal("PeerQuota(bob) found a quota without a \"*\" entry")
+	}
+	c.Quotas["*"] = Quota{Bytes: 2}
+	if q, ok := c.PeerQuota("bob"); !ok || q.Bytes != 2 {
+		t.Fatalf("PeerQuota(bob) = %+v, %v; want the \"*\" entry", q, ok)
+	}
+}
@@ -0,0 +1,274 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrIncorrectPassphrase is returned when an encrypted private key does not
+// decrypt with the given passphrase.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 work factor of keys we encrypt.
+const pbkdf2Iterations = 600000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is the PKCS #8 EncryptedPrivateKeyInfo (RFC 5208).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params and pbkdf2Params are the PKCS #5 v2 parameters (RFC 8018).
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"` // absent = HMAC-SHA1
+}
+
+// EncryptPKCS8PrivateKey encrypts the PKCS #8 private key der with
+// PBES2 (PBKDF2-HMAC-SHA256, AES-256-CBC) and returns the
+// EncryptedPrivateKeyInfo, as written in "ENCRYPTED PRIVATE KEY" PEM blocks.
+func EncryptPKCS8PrivateKey(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(bytes.Clone(der), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+}
+
+// DecryptPKCS8PrivateKey decrypts a PKCS #8 EncryptedPrivateKeyInfo using
+// PBES2 with PBKDF2 and AES-CBC, as written by EncryptPKCS8PrivateKey and
+// "openssl pkcs8 -topk8 -v2 aes256", and returns the PKCS #8 private key.
+func DecryptPKCS8PrivateKey(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %v", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("malformed PBES2 parameters")
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil || kdf.IterationCount <= 0 {
+		return nil, errors.New("malformed PBKDF2 parameters")
+	}
+	var prf func() hash.Hash
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0, alg.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case alg.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case alg.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 PRF %v", alg)
+	}
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher %v", alg)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLen {
+		return nil, errors.New("malformed PBKDF2 parameters")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("malformed cipher parameters")
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	// A wrong key shows as bad padding, or rarely as garbage after it.
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > aes.BlockSize || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, ErrIncorrectPassphrase
+	}
+	plain = plain[:len(plain)-n]
+	if _, err := x509.ParsePKCS8PrivateKey(plain); err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return plain, nil
+}
+
+// ReadPassphrase reads a passphrase from source: "env:NAME" is the
+// environment variable NAME, "file:PATH" the content of PATH, and
+// "credential:NAME" the systemd credential NAME in $CREDENTIALS_DIRECTORY.
+// One trailing newline is removed from files.
+func ReadPassphrase(source string) ([]byte, error) {
+	if err := checkPassphraseSource(source); err != nil {
+		return nil, err
+	}
+	kind, arg, _ := strings.Cut(source, ":")
+	var passphrase []byte
+	switch kind {
+	case "env":
+		s, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("passphrase: environment variable %s is not set", arg)
+		}
+		passphrase = []byte(s)
+	default:
+		name := arg
+		if kind == "credential" {
+			dir := os.Getenv("CREDENTIALS_DIRECTORY")
+			if dir == "" {
+				return nil, fmt.Errorf("passphrase: credential %s: CREDENTIALS_DIRECTORY is not set", arg)
+			}
+			name = filepath.Join(dir, arg)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %w", err)
+		}
+		b, _ = bytes.CutSuffix(b, []byte("\n"))
+		b, _ = bytes.CutSuffix(b, []byte("\r"))
+		passphrase = b
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase: %s is empty", source)
+	}
+	return passphrase, nil
+}
+
+// checkPassphraseSource validates the syntax of a passphrase source.
+func checkPassphraseSource(source string) error {
+	kind, arg, _ := strings.Cut(source, ":")
+	switch {
+	case arg == "":
+	case kind == "env", kind == "file":
+		return nil
+	case kind == "credential" && !strings.ContainsRune(arg, '/'):
+		return nil
+	}
+	return fmt.Errorf("invalid passphrase source %q", source)
+}
+
+// decryptKeyPEM returns keyPEM with its "ENCRYPTED PRIVATE KEY" block
+// decrypted with the passphrase from source. Unencrypted keys are returned
+// unchanged.
+func decryptKeyPEM(keyPEM, source string) (string, error) {
+	rest := []byte(keyPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return keyPEM, nil
+		}
+		if block.Type != "ENCRYPTED PRIVATE KEY" {
+			continue
+		}
+		if source == "" {
+			return "", errors.New("private key is encrypted, but no passphrase is configured")
+		}
+		passphrase, err := ReadPassphrase(source)
+		if err != nil {
+			return "", err
+		}
+		der, err := DecryptPKCS8PrivateKey(block.Bytes, passphrase)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+	}
+}
@@ -4,15 +4,27 @@
 package config
 
 import (
+	"bytes"
+	"cmp"
+	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hexian000/gosnippets/formats"
 	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/mux/psk"
 )
 
 // SetLogger applies cfg.Log to l.
@@ -32,9 +44,14 @@ func (cfg *File) SetLogger(l *slog.Logger) error {
 	return nil
 }
 
+// newX509CertPool adds the PEM entries of authCerts to a pool; pins are
+// skipped.
 func newX509CertPool(authCerts []string) (*x509.CertPool, error) {
 	certPool := x509.NewCertPool()
 	for i, cert := range authCerts {
+		if _, ok, _ := parsePin(cert); ok {
+			continue
+		}
 		if !certPool.AppendCertsFromPEM([]byte(cert)) {
 			return nil, fmt.Errorf("unable to parse authorized certificate #%d", i)
 		}
@@ -42,6 +59,107 @@ func newX509CertPool(authCerts []string) (*x509.CertPool, error) {
 	return certPool, nil
 }
 
+// pin identifies a peer leaf certificate by the SHA-256 of its
+// SubjectPublicKeyInfo, which survives re-signing, or of the whole certificate.
+type pin struct {
+	spki bool
+	sum  [sha256.Size]byte
+}
+
+// pinSet holds the pins listed in authcerts.
+type pinSet map[pin]struct{}
+
+// parsePin decodes an authcerts entry that pins a peer certificate: an SPKI
+// pin ("sha256/" followed by the base64 SHA-256 of the SubjectPublicKeyInfo)
+// or a certificate fingerprint (hex SHA-256, colons optional). ok is false for
+// any other entry, which is taken as PEM.
+func parsePin(s string) (p pin, ok bool, err error) {
+	s = strings.TrimSpace(s)
+	if b64, found := strings.CutPrefix(s, "sha256/"); found {
+		b, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(b) != sha256.Size {
+			return pin{}, true, fmt.Errorf("invalid SPKI pin %q", s)
+		}
+		p.spki = true
+		copy(p.sum[:], b)
+		return p, true, nil
+	}
+	b, err := parseFingerprint(s)
+	if err != nil {
+		return pin{}, false, nil
+	}
+	copy(p.sum[:], b)
+	return p, true, nil
+}
+
+func newPinSet(authCerts []string) (pinSet, error) {
+	pins := make(pinSet)
+	for i, s := range authCerts {
+		p, ok, err := parsePin(s)
+		if err != nil {
+			return nil, fmt.Errorf("authorized certificate #%d: %w", i, err)
+		}
+		if ok {
+			pins[p] = struct{}{}
+		}
+	}
+	return pins, nil
+}
+
+// matches reports whether leaf is pinned by its key or fingerprint.
+func (pins pinSet) matches(leaf *x509.Certificate) bool {
+	if _, ok := pins[pin{spki: true, sum: sha256.Sum256(leaf.RawSubjectPublicKeyInfo)}]; ok {
+		return true
+	}
+	_, ok := pins[pin{sum: sha256.Sum256(leaf.Raw)}]
+	return ok
+}
+
+// verify accepts a peer whose leaf certificate is pinned and currently valid,
+// or whose chain verifies with opts, and returns the verified chains. Only the
+// chain check uses opts: a pinned leaf is trusted for any name and usage.
+func (pins pinSet) verify(certs []*x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	leaf := certs[0]
+	if pins.matches(leaf) {
+		if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return nil, fmt.Errorf("pinned certificate %q is not valid at this time", leaf.Subject.CommonName)
+		}
+		return [][]*x509.Certificate{{leaf}}, nil
+	}
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return leaf.Verify(opts)
+}
+
+// verifyConnection returns a VerifyConnection hook that takes the peer's
+// chains from verify and checks them against revocations.
+func verifyConnection(verify func(tls.ConnectionState) ([][]*x509.Certificate, error), revocations *Revocations) func(tls.ConnectionState) error {
+	// VerifyConnection also runs on resumed sessions, unlike
+	// VerifyPeerCertificate.
+	return func(cs tls.ConnectionState) error {
+		chains, err := verify(cs)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			if err := revocations.Check(chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// verifiedChains returns the chains crypto/tls has already verified.
+func verifiedChains(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+	return cs.VerifiedChains, nil
+}
+
 // ConnectTimeout returns the connection establishment timeout as a duration.
 func (c *File) ConnectTimeout() time.Duration {
 	return time.Duration(c.Mux.ConnectTimeout) * time.Second
@@ -68,13 +186,327 @@ func (c *File) IdleTimeout() time.Duration {
 	return time.Duration(c.Mux.IdleTimeout) * time.Second
 }
 
+// DefaultExpiryWarningDays is used when the TLS section omits
+// expiry_warning_days.
+const DefaultExpiryWarningDays = 30
+
+// CertExpiryWarning returns how long before expiry a certificate is reported.
+// A zero return means expiry warnings are disabled.
+func (c *File) CertExpiryWarning() time.Duration {
+	days := DefaultExpiryWarningDays
+	if c.TLS != nil && c.TLS.ExpiryWarningDays != 0 {
+		days = c.TLS.ExpiryWarningDays
+	}
+	return time.Duration(max(days, 0)) * 24 * time.Hour
+}
+
+// CertDays returns the validity of enrolled certificates in days.
+func (e *Enroll) CertDays() int {
+	return cmp.Or(e.Days, 90)
+}
+
+// TokenLifetime returns how long a minted enrollment token stays valid.
+func (e *Enroll) TokenLifetime() time.Duration {
+	return time.Duration(cmp.Or(e.TokenTTL, 86400)) * time.Second
+}
+
+// NewSigner parses the CA key pair of the enroll section and checks that the
+// key belongs to the certificate.
+func (e *Enroll) NewSigner() (*x509.Certificate, crypto.Signer, error) {
+	keyPEM, err := decryptKeyPEM(e.CAKey, e.CAKeyPassphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("enroll: CA key: %s", formats.Error(err))
+	}
+	pair, err := tls.X509KeyPair([]byte(e.CACert), []byte(keyPEM))
+	if err != nil {
+		return nil, nil, fmt.Errorf("enroll: unable to parse CA key pair: %s", formats.Error(err))
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("enroll: unable to parse CA certificate: %s", formats.Error(err))
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, nil, fmt.Errorf("enroll: %q is not a CA", cert.Subject.CommonName)
+	}
+	return cert, signer, nil
+}
+
+// KnownIdentities returns the identities this config refers to: its own claim
+// and the peers named in the identity section and in tls.identities.
+func (c *File) KnownIdentities() []string {
+	var ids []string
+	add := func(id string) {
+		if id != "" && id != "*" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	add(c.Identity.Claim)
+	for name := range c.Identity.Listen {
+		peer, _ := c.ListenTarget(name)
+		add(peer)
+	}
+	for _, m := range []map[string]string{c.Identity.Connect, c.Identity.UDPListen, c.Identity.SOCKS5Listen} {
+		for peer := range m {
+			add(peer)
+		}
+	}
+	for peer, hop := range c.Identity.Routes {
+		add(peer)
+		add(hop)
+	}
+	for peer := range c.Identity.AllowRelay {
+		add(peer)
+	}
+	if c.TLS != nil {
+		for _, id := range c.TLS.Identities {
+			add(id)
+		}
+	}
+	for peer := range c.Quotas {
+		add(peer)
+	}
+	return ids
+}
+
+// destinationRule is one parsed AllowDestinations entry.
+type destinationRule struct {
+	prefix netip.Prefix
+	lo, hi uint16 // inclusive port range
+}
+
+// parseDestinationRule parses "CIDR", "CIDR:port" or "CIDR:lo-hi". A bare
+// address stands for a single host, and IPv6 entries with a port are written
+// in brackets, e.g. "[2001:db8::/32]:443".
+func parseDestinationRule(s string) (destinationRule, error) {
+	prefixPart, portPart, hasPort := s, "", false
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return destinationRule{}, fmt.Errorf("%q: missing ']'", s)
+		}
+		prefixPart, portPart = s[1:i], s[i+1:]
+		if portPart != "" {
+			if portPart[0] != ':' {
+				return destinationRule{}, fmt.Errorf("%q: unexpected text after ']'", s)
+			}
+			portPart, hasPort = portPart[1:], true
+		}
+	} else if strings.Count(s, ":") == 1 {
+		prefixPart, portPart, hasPort = strings.Cut(s, ":")
+	}
+	var prefix netip.Prefix
+	var err error
+	if strings.Contains(prefixPart, "/") {
+		prefix, err = netip.ParsePrefix(prefixPart)
+	} else {
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(prefixPart); err == nil {
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+	if err != nil {
+		return destinationRule{}, fmt.Errorf("%q: %w", s, err)
+	}
+	r := destinationRule{prefix: prefix.Masked(), lo: 0, hi: 65535}
+	if !hasPort {
+		return r, nil
+	}
+	lo, hi, isRange := strings.Cut(portPart, "-")
+	if !isRange {
+		hi = lo
+	}
+	loPort, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return destinationRule{}, fmt.Errorf("%q: invalid port: %w", s, err)
+	}
+	hiPort, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return destinationRule{}, fmt.Errorf("%q: invalid port: %w", s, err)
+	}
+	if loPort > hiPort {
+		return destinationRule{}, fmt.Errorf("%q: empty port range", s)
+	}
+	r.lo, r.hi = uint16(loPort), uint16(hiPort)
+	return r, nil
+}
+
+// DestinationAllowed reports whether peers may request a stream to dest,
+// i.e. whether dest matches an AllowDestinations entry. It uses the entries
+// as parsed by Validate.
+func (c *File) DestinationAllowed(dest netip.AddrPort) bool {
+	addr, port := dest.Addr().Unmap(), dest.Port()
+	for _, r := range c.allowDestinations {
+		if r.prefix.Contains(addr) && r.lo <= port && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedSource parses an AcceptProxy.Trusted entry: a CIDR prefix or a
+// single address.
+func parseTrustedSource(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q: invalid address or CIDR", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ProxySourceTrusted reports whether a connection from addr may carry a PROXY
+// protocol header, i.e. whether addr matches an AcceptProxy.Trusted entry.
+// It uses the entries as parsed by Validate.
+func (c *File) ProxySourceTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range c.AcceptProxy.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NumConnections returns the number of parallel sessions kept to t.Addr.
+func (t MuxTarget) NumConnections() int {
+	return max(t.Connections, 1)
+}
+
+// DialAddrs returns t.Addr followed by the failover addresses.
+func (t MuxTarget) DialAddrs() []string {
+	return append([]string{t.Addr}, t.Failover...)
+}
+
+// FallbackDelay returns the interval between attempts to move a session from a
+// failover address back to t.Addr.
+func (t MuxTarget) FallbackDelay() time.Duration {
+	if t.FallbackInterval <= 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(t.FallbackInterval) * time.Second
+}
+
+// FindMuxTarget returns the Identity.MuxConnect entry that dials addr. Other
+// addresses, such as the top-level MuxConnect, get a plain target.
+func (c *File) FindMuxTarget(addr string) MuxTarget {
+	for _, t := range c.Identity.MuxConnect {
+		if t.Addr == addr {
+			return t
+		}
+	}
+	return MuxTarget{Addr: addr}
+}
+
+// unrestricted applies to every peer when no policies are configured.
+var unrestricted = Policy{Connect: true, Services: []string{"*"}, Destinations: true, UDP: true, Receive: true}
+
+// PeerPolicy returns the first policy matching the peer with identity and leaf
+// certificate (nil in plaintext mode). Without policies every peer is
+// unrestricted; otherwise a peer that matches no rule gets the zero Policy,
+// which allows nothing.
+func (c *File) PeerPolicy(identity string, leaf *x509.Certificate) Policy {
+	if len(c.Policies) == 0 {
+		return unrestricted
+	}
+	for _, p := range c.Policies {
+		if p.matches(identity, leaf) {
+			return p
+		}
+	}
+	return Policy{}
+}
+
+func (p *Policy) matches(identity string, leaf *x509.Certificate) bool {
+	if len(p.Identities) > 0 && !slices.Contains(p.Identities, "*") && !slices.Contains(p.Identities, identity) {
+		return false
+	}
+	if len(p.OU) == 0 && len(p.Issuers) == 0 {
+		return true
+	}
+	if leaf == nil {
+		return false
+	}
+	if len(p.OU) > 0 && !slices.ContainsFunc(leaf.Subject.OrganizationalUnit, func(ou string) bool {
+		return slices.Contains(p.OU, ou)
+	}) {
+		return false
+	}
+	return len(p.Issuers) == 0 || slices.Contains(p.Issuers, leaf.Issuer.CommonName)
+}
+
+// AllowsService reports whether p lets the peer open streams to the named
+// service; the empty name is the peer's default target.
+func (p *Policy) AllowsService(name string) bool {
+	if name == "" {
+		return p.Connect
+	}
+	return slices.Contains(p.Services, "*") || slices.Contains(p.Services, name)
+}
+
+// NextHop returns the peer identity whose session carries streams toward
+// identity: its entry in Identity.Routes, or identity itself.
+func (c *File) NextHop(identity string) string {
+	if via, ok := c.Identity.Routes[identity]; ok {
+		return via
+	}
+	return identity
+}
+
+// RelayAllowed reports whether peer may relay streams toward dest through
+// this node.
+func (c *File) RelayAllowed(peer, dest string) bool {
+	dests := c.Identity.AllowRelay[peer]
+	return slices.Contains(dests, "*") || slices.Contains(dests, dest)
+}
+
+// MaxRelayHops returns the maximum number of intermediate peers a relayed
+// stream may pass.
+func (c *File) MaxRelayHops() int {
+	if c.Identity.MaxHops <= 0 {
+		return 3
+	}
+	return c.Identity.MaxHops
+}
+
+// MaxFailures returns the consecutive dial failures that eject a backend.
+func (p Pool) MaxFailures() int {
+	if p.MaxFails <= 0 {
+		return 3
+	}
+	return p.MaxFails
+}
+
+// EjectDuration returns how long an ejected backend is skipped.
+func (p Pool) EjectDuration() time.Duration {
+	if p.EjectTime <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(p.EjectTime) * time.Second
+}
+
+// HealthCheckInterval returns the interval between active health checks, or
+// 0 when they are disabled.
+func (p Pool) HealthCheckInterval() time.Duration {
+	return time.Duration(p.HealthCheck) * time.Second
+}
+
+// UDPIdleTimeout returns the UDP flow idle timeout as a duration.
+func (c *File) UDPIdleTimeout() time.Duration {
+	return time.Duration(c.UDPTimeout) * time.Second
+}
+
 // DefaultServerName is the SNI used when TLS.ServerName is empty.
 // It matches the default server name used by the gencerts certificate tool.
 const DefaultServerName = "example.com"
 
 // NewTLSConfig builds the credential portion of the TLS config (certificate,
-// peer verification, minimum version) from the TLS section. Returns nil if TLS
-// is not configured (plaintext mode).
+// peer verification, minimum version) from the TLS section for inbound
+// handshakes, where peers are TLS clients; NewClientTLSConfig derives the
+// config for outbound ones. Returns nil if TLS is not configured (plaintext
+// mode).
 //
 // SNI and ALPN are deliberately left unset: they are applied per handshake by
 // the mux layer from the ServerName and ALPN accessors, so the same credential
@@ -83,7 +515,11 @@ func (c *File) NewTLSConfig() (*tls.Config, error) {
 	if c.TLS == nil {
 		return nil, nil
 	}
-	tlsCert, err := tls.X509KeyPair([]byte(c.TLS.Certificate), []byte(c.TLS.PrivateKey))
+	keyPEM, err := decryptKeyPEM(c.TLS.PrivateKey, c.TLS.KeyPassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %s", formats.Error(err))
+	}
+	tlsCert, err := tls.X509KeyPair([]byte(c.TLS.Certificate), []byte(keyPEM))
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse certificate: %s", formats.Error(err))
 	}
@@ -91,13 +527,281 @@ func (c *File) NewTLSConfig() (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
+	pins, err := newPinSet(c.TLS.AuthCerts)
+	if err != nil {
+		return nil, err
+	}
+	revocations, err := c.NewRevocations()
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ClientCAs:    certPool,
 		RootCAs:      certPool,
 		MinVersion:   tls.VersionTLS13,
-	}, nil
+	}
+	if len(pins) == 0 && revocations == nil {
+		return tlsCfg, nil
+	}
+	verify := verifiedChains
+	if len(pins) > 0 {
+		// Pinned clients need not chain to the pool, so crypto/tls only
+		// requires a certificate and VerifyConnection does the rest.
+		tlsCfg.ClientAuth = tls.RequireAnyClientCert
+		verify = func(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+			return pins.verify(cs.PeerCertificates, x509.VerifyOptions{
+				Roots:     certPool,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+		}
+	}
+	tlsCfg.VerifyConnection = verifyConnection(verify, revocations)
+	return tlsCfg, nil
+}
+
+// NewClientTLSConfig returns a copy of tlscfg, as built by NewTLSConfig, for
+// outbound handshakes, where peers are TLS servers. A server certificate must
+// chain to authcerts, allow server authentication and match the SNI, as
+// crypto/tls checks by default; only a pinned leaf is accepted without. Returns
+// nil in plaintext mode.
+func (c *File) NewClientTLSConfig(tlscfg *tls.Config) (*tls.Config, error) {
+	if tlscfg == nil {
+		return nil, nil
+	}
+	pins, err := newPinSet(c.TLS.AuthCerts)
+	if err != nil {
+		return nil, err
+	}
+	revocations, err := c.NewRevocations()
+	if err != nil {
+		return nil, err
+	}
+	clientCfg := tlscfg.Clone()
+	clientCfg.VerifyConnection = nil
+	if len(pins) == 0 && revocations == nil {
+		return clientCfg, nil
+	}
+	verify := verifiedChains
+	if len(pins) > 0 {
+		// Pinned servers need not chain to the pool nor match the SNI, so
+		// crypto/tls skips verification and VerifyConnection does it instead.
+		clientCfg.InsecureSkipVerify = true
+		verify = func(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+			return pins.verify(cs.PeerCertificates, x509.VerifyOptions{
+				Roots:   clientCfg.RootCAs,
+				DNSName: cs.ServerName,
+			})
+		}
+	}
+	clientCfg.VerifyConnection = verifyConnection(verify, revocations)
+	return clientCfg, nil
+}
+
+// Revocations holds the parsed certificate revocation lists of the TLS section.
+type Revocations struct {
+	lists []revocationList
+	// issuers are the authorized certificates, which may sign CRLs for
+	// certificates whose chain the peer sends without its root.
+	issuers []*x509.Certificate
+}
+
+type revocationList struct {
+	crl     *x509.RevocationList
+	revoked map[string]struct{} // serial numbers in hex
+}
+
+// NewRevocations parses the CRLs of the TLS section. Returns nil if there are
+// none.
+func (c *File) NewRevocations() (*Revocations, error) {
+	if c.TLS == nil || len(c.TLS.CRL) == 0 {
+		return nil, nil
+	}
+	r := &Revocations{}
+	for i, s := range c.TLS.CRL {
+		n := len(r.lists)
+		for rest := []byte(s); ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse certificate revocation list #%d: %s", i, formats.Error(err))
+			}
+			l := revocationList{crl: crl, revoked: make(map[string]struct{}, len(crl.RevokedCertificateEntries))}
+			for _, e := range crl.RevokedCertificateEntries {
+				l.revoked[e.SerialNumber.Text(16)] = struct{}{}
+			}
+			r.lists = append(r.lists, l)
+		}
+		if len(r.lists) == n {
+			return nil, fmt.Errorf("unable to parse certificate revocation list #%d", i)
+		}
+	}
+	r.issuers = c.AuthCertificates()
+	return r, nil
+}
+
+// parseCertificates returns the certificates in the PEM blocks of s, skipping
+// anything that does not parse.
+func parseCertificates(s string) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for rest := []byte(s); ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// LocalCertificate returns the parsed leaf of the TLS section's certificate,
+// or nil in plaintext mode.
+func (c *File) LocalCertificate() *x509.Certificate {
+	if c.TLS == nil {
+		return nil
+	}
+	if certs := parseCertificates(c.TLS.Certificate); len(certs) > 0 {
+		return certs[0]
+	}
+	return nil
+}
+
+// AuthCertificates returns the parsed PEM certificates of authcerts; pins are
+// left out.
+func (c *File) AuthCertificates() []*x509.Certificate {
+	if c.TLS == nil {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, s := range c.TLS.AuthCerts {
+		certs = append(certs, parseCertificates(s)...)
+	}
+	return certs
+}
+
+// Pinned reports whether leaf is pinned by an SPKI pin or fingerprint in
+// authcerts.
+func (c *File) Pinned(leaf *x509.Certificate) bool {
+	if c.TLS == nil {
+		return false
+	}
+	pins, err := newPinSet(c.TLS.AuthCerts)
+	return err == nil && pins.matches(leaf)
+}
+
+// Check returns an error if a certificate of chain, leaf first, is listed in a
+// CRL signed by its issuer: the next certificate in chain or an authorized
+// certificate. Authorized certificates themselves are trust anchors and are
+// never revoked. A nil Revocations revokes nothing.
+func (r *Revocations) Check(chain []*x509.Certificate) error {
+	if r == nil {
+		return nil
+	}
+	for i, cert := range chain {
+		if slices.ContainsFunc(r.issuers, cert.Equal) {
+			continue
+		}
+		serial := cert.SerialNumber.Text(16)
+		for _, l := range r.lists {
+			if _, ok := l.revoked[serial]; !ok || !bytes.Equal(l.crl.RawIssuer, cert.RawIssuer) {
+				continue
+			}
+			issuers := r.issuers
+			if i+1 < len(chain) {
+				issuers = slices.Concat(chain[i+1:i+2], issuers)
+			}
+			for _, issuer := range issuers {
+				if bytes.Equal(issuer.RawSubject, cert.RawIssuer) && l.crl.CheckSignatureFrom(issuer) == nil {
+					return fmt.Errorf("certificate %q (serial %s) is revoked", cert.Subject.CommonName, serial)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TLSFiles returns the files referenced by "@path" in the TLS section, which
+// ReloadTLSFiles reads again.
+func (c *File) TLSFiles() []string {
+	if c.TLS == nil || c.TLS.source == nil {
+		return nil
+	}
+	t := c.TLS.source
+	var files []string
+	for _, s := range slices.Concat([]string{t.Certificate, t.PrivateKey}, t.AuthCerts, t.CRL) {
+		if name, ok := strings.CutPrefix(s, "@"); ok && !slices.Contains(files, name) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// ReloadTLSFiles returns a copy of c with the "@path" references of the TLS
+// section read again. The rest of the config is shared with c.
+func (c *File) ReloadTLSFiles() (*File, error) {
+	if c.TLS == nil || c.TLS.source == nil {
+		return c, nil
+	}
+	t := *c.TLS.source
+	t.AuthCerts = slices.Clone(t.AuthCerts)
+	t.CRL = slices.Clone(t.CRL)
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	cfg := *c
+	cfg.TLS = &t
+	return &cfg, nil
+}
+
+// decodePSK decodes a base64-encoded pre-shared key.
+func decodePSK(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != psk.KeySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(key), psk.KeySize)
+	}
+	return key, nil
+}
+
+// outboundKeyID returns KeyID, or the only key's ID when KeyID is omitted.
+func (p *PSK) outboundKeyID() string {
+	if p.KeyID == "" && len(p.Keys) == 1 {
+		for id := range p.Keys {
+			return id
+		}
+	}
+	return p.KeyID
+}
+
+// PSKConfig returns the pre-shared keys for h2mux, or nil when the PSK
+// section is absent. Keys that do not decode are left out; Validate has
+// rejected them already.
+func (c *File) PSKConfig() *psk.Config {
+	if c.PSK == nil {
+		return nil
+	}
+	cfg := &psk.Config{
+		Keys:  make(map[string][]byte, len(c.PSK.Keys)),
+		KeyID: c.PSK.outboundKeyID(),
+	}
+	for id, s := range c.PSK.Keys {
+		if key, err := decodePSK(s); err == nil {
+			cfg.Keys[id] = key
+		}
+	}
+	return cfg
 }
 
 // ServerName returns the SNI to send on outbound TLS handshakes, applying
@@ -121,6 +825,61 @@ func (c *File) ALPN() string {
 	return c.TLS.ALPN
 }
 
+// parseFingerprint decodes a hex SHA-256 certificate fingerprint. Colon
+// separators and letter case are ignored.
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return b, nil
+}
+
+// VerifyPeerIdentity checks an identity claim received in the mux handshake
+// against the peer's verified certificate chain. It accepts any claim unless
+// identity verification is enabled in the TLS section. An empty claim asserts
+// nothing and is always accepted.
+//
+// When the leaf certificate's fingerprint is listed in TLS.Identities, the
+// claim must equal the mapped identity; otherwise it must equal the subject
+// CN, a DNS SAN (case-insensitive), or a URI SAN.
+func (c *File) VerifyPeerIdentity(identity string, certs []*x509.Certificate) error {
+	if c.TLS == nil || (!c.TLS.VerifyIdentity && len(c.TLS.Identities) == 0) {
+		return nil
+	}
+	if identity == "" {
+		return nil
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("identity %q: no peer certificate", identity)
+	}
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.Raw)
+	for fp, id := range c.TLS.Identities {
+		if b, err := parseFingerprint(fp); err != nil || !bytes.Equal(b, sum[:]) {
+			continue
+		}
+		if id != identity {
+			return fmt.Errorf("identity %q: certificate is bound to %q", identity, id)
+		}
+		return nil
+	}
+	if leaf.Subject.CommonName == identity {
+		return nil
+	}
+	for _, name := range leaf.DNSNames {
+		if strings.EqualFold(name, identity) {
+			return nil
+		}
+	}
+	for _, uri := range leaf.URIs {
+		if uri.String() == identity {
+			return nil
+		}
+	}
+	return fmt.Errorf("identity %q does not match peer certificate", identity)
+}
+
 // logWrapper wraps slog.Logger to implement io.Writer
 type logWrapper struct {
 	*slog.Logger
@@ -138,3 +897,122 @@ func (w *logWrapper) Write(p []byte) (n int, err error) {
 	}
 	return len(p), nil
 }
+
+// Empty reports whether r accepts every source.
+func (r *SourceRules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// parse parses the Allow and Deny entries once, for Check.
+func (r *SourceRules) parse() error {
+	r.allow, r.deny = nil, nil
+	for _, s := range r.Allow {
+		prefix, err := parseTrustedSource(s)
+		if err != nil {
+			return err
+		}
+		r.allow = append(r.allow, prefix)
+	}
+	for _, s := range r.Deny {
+		prefix, err := parseTrustedSource(s)
+		if err != nil {
+			return err
+		}
+		r.deny = append(r.deny, prefix)
+	}
+	return nil
+}
+
+// Check reports whether a connection from addr is accepted. When it is not,
+// rule names the entry that refused it: the matching Deny entry, or "default"
+// when no Allow entry matched. Check uses the entries as parsed by Validate.
+func (r *SourceRules) Check(addr netip.Addr) (rule string, ok bool) {
+	addr = addr.Unmap()
+	for i, prefix := range r.deny {
+		if prefix.Contains(addr) {
+			return r.Deny[i], false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return "", true
+	}
+	for _, prefix := range r.allow {
+		if prefix.Contains(addr) {
+			return "", true
+		}
+	}
+	return "default", false
+}
+
+// Rules returns the source rules of a listener kind: "listen", "mux_listen",
+// "api_listen" or "enroll_listen". For "listen", the local TCP and UDP
+// listeners, listenAddr selects a Listeners entry, which replaces the shared rules. name labels the rules
+// returned: the kind, or "listen" followed by the address for an entry.
+func (a *SourceACL) Rules(listener, listenAddr string) (name string, rules SourceRules) {
+	switch listener {
+	case "listen":
+		if r, ok := a.Listeners[listenAddr]; ok && listenAddr != "" {
+			return "listen " + listenAddr, r
+		}
+		return listener, a.Listen
+	case "mux_listen":
+		return listener, a.MuxListen
+	case "api_listen":
+		return listener, a.APIListen
+	case "enroll_listen":
+		return listener, a.EnrollListen
+	}
+	return listener, SourceRules{}
+}
+
+// Unlimited reports whether l throttles neither direction.
+func (l RateLimit) Unlimited() bool {
+	return l.Send <= 0 && l.Receive <= 0
+}
+
+// PeerLimit returns the rate limit shared by the streams of the peer with
+// identity, falling back to the "*" entry.
+func (b *Bandwidth) PeerLimit(identity string) RateLimit {
+	if l, ok := b.Peers[identity]; ok {
+		return l
+	}
+	return b.Peers["*"]
+}
+
+// localListenAddrs returns the addresses of the local TCP and UDP listeners.
+func (c *File) localListenAddrs() []string {
+	addrs := []string{c.Listen, c.SOCKS5Listen, c.UDPListen}
+	for _, m := range []map[string]string{c.Identity.Listen, c.Identity.SOCKS5Listen, c.Identity.UDPListen} {
+		for _, addr := range m {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// PeerQuota returns the quota of the peer with identity, falling back to the
+// "*" entry, and whether there is one.
+func (c *File) PeerQuota(identity string) (Quota, bool) {
+	if q, ok := c.Quotas[identity]; ok {
+		return q, true
+	}
+	q, ok := c.Quotas["*"]
+	return q, ok
+}
+
+// WindowStart returns the start of the accounting window that contains now.
+func (q Quota) WindowStart(now time.Time) time.Time {
+	now = now.UTC()
+	if q.Window == "daily" {
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// WindowEnd returns the end of the accounting window that starts at start.
+func (q Quota) WindowEnd(start time.Time) time.Time {
+	if q.Window == "daily" {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
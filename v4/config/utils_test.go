@@ -5,6 +5,18 @@ package config
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
@@ -351,3 +363,452 @@ func TestDurationAccessors(t *testing.T) {
 		t.Fatalf("IdleTimeout() zero = %v, want 0", got)
 	}
 }
+
+func TestVerifyPeerIdentity(t *testing.T) {
+	block, _ := pem.Decode([]byte(utilsTestCertPEM))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	fp := strings.ToUpper(hex.EncodeToString(sum[:]))
+	certs := []*x509.Certificate{leaf}
+
+	tests := []struct {
+		name     string
+		tls      *TLS
+		identity string
+		certs    []*x509.Certificate
+		wantErr  bool
+	}{
+		{"plaintext", nil, "anything", nil, false},
+		{"disabled", &TLS{}, "anything", certs, false},
+		{"empty-claim", &TLS{VerifyIdentity: true}, "", certs, false},
+		{"common-name", &TLS{VerifyIdentity: true}, "example.com", certs, false},
+		{"dns-san-case", &TLS{VerifyIdentity: true}, "EXAMPLE.com", certs, false},
+		{"mismatch", &TLS{VerifyIdentity: true}, "server", certs, true},
+		{"no-certs", &TLS{VerifyIdentity: true}, "example.com", nil, true},
+		{"fingerprint", &TLS{Identities: map[string]string{fp: "server"}}, "server", certs, false},
+		{"fingerprint-overrides-cn", &TLS{Identities: map[string]string{fp: "server"}}, "example.com", certs, true},
+		{"fingerprint-other-cert", &TLS{Identities: map[string]string{strings.Repeat("00", 32): "server"}}, "example.com", certs, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &File{TLS: tt.tls}
+			err := c.VerifyPeerIdentity(tt.identity, tt.certs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyPeerIdentity(%q) = %v, wantErr %v", tt.identity, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	colons := strings.TrimSuffix(strings.Repeat("ab:", 32), ":")
+	if _, err := parseFingerprint(colons); err != nil {
+		t.Fatalf("colon-separated fingerprint: %v", err)
+	}
+	for _, s := range []string{"", "abcd", strings.Repeat("zz", 32)} {
+		if _, err := parseFingerprint(s); err == nil {
+			t.Fatalf("parseFingerprint(%q): expected error", s)
+		}
+	}
+}
+
+func TestParseDestinationRule(t *testing.T) {
+	for _, s := range []string{
+		"10.0.0.0/8", "10.0.0.1", "10.0.0.0/8:22", "10.0.0.0/8:8000-8100",
+		"2001:db8::/32", "::1", "[2001:db8::/32]:443", "[::1]",
+	} {
+		if _, err := parseDestinationRule(s); err != nil {
+			t.Fatalf("parseDestinationRule(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"", "example.com", "10.0.0.0/33", "10.0.0.0/8:", "10.0.0.0/8:70000",
+		"10.0.0.0/8:90-80", "[2001:db8::/32", "[::1]443",
+	} {
+		if _, err := parseDestinationRule(s); err == nil {
+			t.Fatalf("parseDestinationRule(%q): expected error", s)
+		}
+	}
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	c := Default
+	c.AllowDestinations = []string{"10.0.0.0/8:22", "192.168.1.1", "[2001:db8::/32]:8000-8100"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest string
+		want bool
+	}{
+		{"10.1.2.3:22", true},
+		{"10.1.2.3:23", false},
+		{"192.168.1.1:9", true},
+		{"192.168.1.2:9", false},
+		{"[::ffff:10.0.0.1]:22", true},
+		{"[2001:db8::1]:8080", true},
+		{"[2001:db8::1]:80", false},
+		{"[2001:db9::1]:8080", false},
+	}
+	for _, tt := range tests {
+		if got := c.DestinationAllowed(netip.MustParseAddrPort(tt.dest)); got != tt.want {
+			t.Errorf("DestinationAllowed(%s) = %v, want %v", tt.dest, got, tt.want)
+		}
+	}
+	if (&File{}).DestinationAllowed(netip.MustParseAddrPort("127.0.0.1:80")) {
+		t.Fatal("DestinationAllowed() = true with an empty allowlist")
+	}
+}
+
+func TestProxySourceTrusted(t *testing.T) {
+	c := Default
+	c.AcceptProxy.Trusted = []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		if got := c.ProxySourceTrusted(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("ProxySourceTrusted(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "test-ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	issue := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64) *x509.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "peer"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	revoke := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serials ...int64) string {
+		tmpl := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		for _, serial := range serials {
+			tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+				x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+	}
+
+	ca, caKey, caPEM := newCA()
+	// An impostor CA with the same subject name but another key.
+	fake, fakeKey, _ := newCA()
+	revoked, valid := issue(ca, caKey, 1), issue(ca, caKey, 2)
+	c := &File{TLS: &TLS{AuthCerts: []string{caPEM}}}
+	if r, err := c.NewRevocations(); r != nil || err != nil {
+		t.Fatalf("NewRevocations() without CRLs = %v, %v; want nil", r, err)
+	}
+	c.TLS.CRL = []string{revoke(ca, caKey, 1), revoke(fake, fakeKey, 2)}
+	r, err := c.NewRevocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		chain   []*x509.Certificate
+		wantErr bool
+	}{
+		{"revoked", []*x509.Certificate{revoked, ca}, true},
+		{"revoked-without-root", []*x509.Certificate{revoked}, true},
+		{"listed-by-impostor", []*x509.Certificate{valid, ca}, false},
+		{"trust-anchor", []*x509.Certificate{ca}, false},
+	} {
+		if err := r.Check(tc.chain); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if err := (*Revocations)(nil).Check([]*x509.Certificate{revoked}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.TLS.Certificate, c.TLS.PrivateKey = utilsTestCertPEM, utilsTestKeyPEM
+	tlsCfg, err := c.NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsCfg.VerifyConnection == nil {
+		t.Fatal("VerifyConnection not set with CRLs configured")
+	}
+	c.TLS.CRL = []string{utilsTestCertPEM}
+	if _, err := c.NewTLSConfig(); err == nil {
+		t.Fatal("expected error for a CRL entry without an X509 CRL block")
+	}
+}
+
+func TestPinSet(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSign := func(key *ecdsa.PrivateKey, serial int64, notAfter time.Time) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "peer"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	valid := time.Now().Add(time.Hour)
+	cert, resigned := selfSign(key, 1, valid), selfSign(key, 2, valid)
+	expired := selfSign(key, 3, time.Now().Add(-time.Minute))
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := selfSign(otherKey, 4, valid)
+
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	spkiPin := "sha256/" + base64.StdEncoding.EncodeToString(spkiSum[:])
+	certSum := sha256.Sum256(other.Raw)
+	for _, tc := range []struct {
+		in      string
+		wantPin bool
+		wantErr bool
+	}{
+		{spkiPin, true, false},
+		{"  " + spkiPin + "\n", true, false},
+		{hex.EncodeToString(certSum[:]), true, false},
+		{"sha256/not-base64!", true, true},
+		{"sha256/" + base64.StdEncoding.EncodeToString([]byte("short")), true, true},
+		{utilsTestCertPEM, false, false},
+		{"not a pem certificate", false, false},
+	} {
+		_, ok, err := parsePin(tc.in)
+		if ok != tc.wantPin || (err != nil) != tc.wantErr {
+			t.Errorf("parsePin(%q) = %v, %v; want pin %v, error %v", tc.in, ok, err, tc.wantPin, tc.wantErr)
+		}
+	}
+
+	pins, err := newPinSet([]string{utilsTestCertPEM, spkiPin, hex.EncodeToString(certSum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 {
+		t.Fatalf("newPinSet() = %v, want 2 pins", pins)
+	}
+	pool := x509.NewCertPool()
+	for _, tc := range []struct {
+		name    string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{"spki", []*x509.Certificate{cert}, false},
+		{"spki-resigned", []*x509.Certificate{resigned}, false},
+		{"spki-expired", []*x509.Certificate{expired}, true},
+		{"fingerprint", []*x509.Certificate{other}, false},
+		{"unpinned", []*x509.Certificate{selfSign(otherKey, 5, valid)}, true},
+		{"empty", nil, true},
+	} {
+		if _, err := pins.verify(tc.certs, x509.VerifyOptions{Roots: pool}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: verify() = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+	// Unpinned peers still verify against the pool.
+	pool.AddCert(other)
+	if chains, err := (pinSet{}).verify([]*x509.Certificate{other}, x509.VerifyOptions{Roots: pool}); err != nil || len(chains) == 0 {
+		t.Fatalf("verify() against the pool = %v, %v", chains, err)
+	}
+
+	c := &File{TLS: &TLS{
+		Certificate: utilsTestCertPEM,
+		PrivateKey:  utilsTestKeyPEM,
+		AuthCerts:   []string{spkiPin, utilsTestCertPEM},
+	}}
+	tlsCfg, err := c.NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsCfg.InsecureSkipVerify || tlsCfg.ClientAuth != tls.RequireAnyClientCert || tlsCfg.VerifyConnection == nil {
+		t.Fatal("pinned clients are verified by crypto/tls")
+	}
+	clientCfg, err := c.NewClientTLSConfig(tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clientCfg.InsecureSkipVerify || clientCfg.VerifyConnection == nil {
+		t.Fatal("pinned servers are verified by crypto/tls")
+	}
+	c.TLS.AuthCerts = []string{"sha256/AAAA"}
+	if _, err := c.NewTLSConfig(); err == nil {
+		t.Fatal("expected error for a malformed SPKI pin")
+	}
+}
+
+func TestTLSConfigRoles(t *testing.T) {
+	newCert := func(tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	ca, caKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	leaf := func(serial int64, usage x509.ExtKeyUsage) *x509.Certificate {
+		cert, _ := newCert(&x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "node.example.com"},
+			DNSNames:     []string{"node.example.com"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, caKey)
+		return cert
+	}
+	server, client := leaf(2, x509.ExtKeyUsageServerAuth), leaf(3, x509.ExtKeyUsageClientAuth)
+	stranger, _ := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "stranger"},
+	}, nil, nil)
+	spkiSum := sha256.Sum256(stranger.RawSubjectPublicKeyInfo)
+
+	c := &File{TLS: &TLS{
+		Certificate: utilsTestCertPEM,
+		PrivateKey:  utilsTestKeyPEM,
+		AuthCerts: []string{
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+			"sha256/" + base64.StdEncoding.EncodeToString(spkiSum[:]),
+		},
+	}}
+	tlsCfg, err := c.NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg, err := c.NewClientTLSConfig(tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		cfg        *tls.Config
+		cert       *x509.Certificate
+		serverName string
+		wantErr    bool
+	}{
+		{"inbound-client-auth", tlsCfg, client, "", false},
+		{"inbound-server-auth-only", tlsCfg, server, "", true},
+		{"inbound-pinned", tlsCfg, stranger, "", false},
+		{"outbound-matching-sni", clientCfg, server, "node.example.com", false},
+		{"outbound-mismatched-sni", clientCfg, server, "other.example.com", true},
+		{"outbound-client-auth-only", clientCfg, client, "node.example.com", true},
+		{"outbound-pinned", clientCfg, stranger, "other.example.com", false},
+	} {
+		cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}, ServerName: tc.serverName}
+		if err := tc.cfg.VerifyConnection(cs); (err != nil) != tc.wantErr {
+			t.Errorf("%s: VerifyConnection() = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if cfg, err := (&File{}).NewClientTLSConfig(nil); cfg != nil || err != nil {
+		t.Fatalf("NewClientTLSConfig(nil) = %v, %v; want nil", cfg, err)
+	}
+}
+
+func TestCertExpiryAccessors(t *testing.T) {
+	c := &File{}
+	if got := c.CertExpiryWarning(); got != DefaultExpiryWarningDays*24*time.Hour {
+		t.Fatalf("CertExpiryWarning() in plaintext mode = %v", got)
+	}
+	if c.LocalCertificate() != nil || c.AuthCertificates() != nil {
+		t.Fatal("certificates returned in plaintext mode")
+	}
+	c.TLS = &TLS{
+		Certificate:       utilsTestCertPEM,
+		AuthCerts:         []string{"sha256/" + strings.Repeat("A", 43) + "=", utilsTestCertPEM},
+		ExpiryWarningDays: 7,
+	}
+	if got := c.CertExpiryWarning(); got != 7*24*time.Hour {
+		t.Fatalf("CertExpiryWarning() = %v, want 7 days", got)
+	}
+	leaf := c.LocalCertificate()
+	if leaf == nil {
+		t.Fatal("LocalCertificate() = nil")
+	}
+	if certs := c.AuthCertificates(); len(certs) != 1 || !certs[0].Equal(leaf) {
+		t.Fatalf("AuthCertificates() = %v, want the PEM entry only", certs)
+	}
+	c.TLS.ExpiryWarningDays = -1
+	if got := c.CertExpiryWarning(); got != 0 {
+		t.Fatalf("CertExpiryWarning() = %v, want disabled", got)
+	}
+}
@@ -0,0 +1,215 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// A stream that requests a destination (mux.StreamHeader.Destination) starts
+// with one status byte written by the accepting side once it has dialed, so
+// proxy front-ends can tell the client whether the destination was reached.
+const (
+	destStatusOK          byte = 0x00
+	destStatusDenied      byte = 0x01
+	destStatusUnreachable byte = 0x02
+)
+
+var errDestinationUnreachable = errors.New("destination is unreachable")
+
+// writeDestinationStatus reports the dial result for a destination stream.
+func writeDestinationStatus(conn net.Conn, dialErr error, timeout time.Duration) error {
+	status := destStatusOK
+	switch {
+	case dialErr == nil:
+	case errors.Is(dialErr, ErrDestinationDenied):
+		status = destStatusDenied
+	default:
+		status = destStatusUnreachable
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	_, err := conn.Write([]byte{status})
+	return err
+}
+
+// readDestinationStatus waits for the accepting side's dial result and maps a
+// failure to ErrDestinationDenied or errDestinationUnreachable.
+func readDestinationStatus(conn net.Conn, timeout time.Duration) error {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return fmt.Errorf("%w: %v", errDestinationUnreachable, err)
+	}
+	switch status[0] {
+	case destStatusOK:
+		return nil
+	case destStatusDenied:
+		return ErrDestinationDenied
+	default:
+		return errDestinationUnreachable
+	}
+}
+
+// dialDestination dials a destination requested by a peer. Host names are
+// resolved here and only addresses allowed by cfg.AllowDestinations are
+// dialed, so a name cannot be used to reach a denied address.
+func (s *Server) dialDestination(ctx context.Context, cfg *config.File, dest string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	err = ErrDestinationDenied
+	for _, addr := range addrs {
+		addrPort := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+		if !cfg.DestinationAllowed(addrPort) {
+			continue
+		}
+		var dialed net.Conn
+		if dialed, err = s.dialDirect(ctx, addrPort.String()); err == nil {
+			return dialed, nil
+		}
+	}
+	return nil, err
+}
+
+// proxyMode selects the protocol a local listener speaks to its clients.
+type proxyMode int
+
+const (
+	// proxyNone forwards connections as-is to the listener's fixed target.
+	proxyNone proxyMode = iota
+	// proxySOCKS5 reads the destination from a SOCKS5 CONNECT request.
+	proxySOCKS5
+	// proxyHTTP reads the destination from an HTTP/1.1 CONNECT request.
+	proxyHTTP
+)
+
+// readProxyRequest reads the client's proxy request and returns the requested
+// destination together with the conn to forward, which replays any bytes the
+// client sent after the request.
+func readProxyRequest(mode proxyMode, conn net.Conn) (string, net.Conn, error) {
+	switch mode {
+	case proxySOCKS5:
+		dest, err := readSOCKS5Request(conn)
+		return dest, conn, err
+	case proxyHTTP:
+		return readHTTPConnect(conn)
+	}
+	return "", conn, nil
+}
+
+// writeProxyReply answers the client's proxy request: err is nil on success,
+// or the reason the destination could not be reached.
+func writeProxyReply(mode proxyMode, conn net.Conn, err error) error {
+	switch mode {
+	case proxySOCKS5:
+		rep := byte(socks5Succeeded)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrDestinationDenied):
+			rep = socks5NotAllowed
+		case errors.Is(err, errDestinationUnreachable):
+			rep = socks5HostUnreachable
+		default:
+			rep = socks5GeneralFailure
+		}
+		return writeSOCKS5Reply(conn, rep)
+	case proxyHTTP:
+		code := http.StatusOK
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrDestinationDenied):
+			code = http.StatusForbidden
+		case errors.Is(err, errDestinationUnreachable):
+			code = http.StatusBadGateway
+		default:
+			code = http.StatusServiceUnavailable
+		}
+		return writeHTTPConnectReply(conn, code)
+	}
+	return nil
+}
+
+// readHTTPConnect reads an HTTP/1.1 CONNECT request from conn. Other methods
+// are answered with 405 Method Not Allowed.
+func readHTTPConnect(conn net.Conn) (string, net.Conn, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		_ = writeHTTPConnectReply(conn, http.StatusBadRequest)
+		return "", conn, err
+	}
+	if req.Method != http.MethodConnect {
+		_ = writeHTTPConnectReply(conn, http.StatusMethodNotAllowed)
+		return "", conn, fmt.Errorf("http: unsupported method %q", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		_ = writeHTTPConnectReply(conn, http.StatusBadRequest)
+		return "", conn, fmt.Errorf("http: CONNECT %q: %w", req.Host, err)
+	}
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		conn = &prefixConn{Conn: conn, prefix: b}
+	}
+	return req.Host, conn, nil
+}
+
+// writeHTTPConnectReply sends a minimal HTTP/1.1 response with status code.
+func writeHTTPConnectReply(w io.Writer, code int) error {
+	var msg string
+	if code == http.StatusOK {
+		msg = "HTTP/1.1 200 Connection established\r\n\r\n"
+	} else {
+		msg = fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			code, http.StatusText(code))
+	}
+	_, err := io.WriteString(w, msg)
+	return err
+}
+
+// prefixConn replays prefix before reading from the wrapped conn. It keeps
+// CloseWrite so the forwarder can still half-close.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,109 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestReadHTTPConnect(t *testing.T) {
+	t.Run("replays-early-data", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+		go func() {
+			_, _ = io.WriteString(cli, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nearly")
+		}()
+		dest, conn, err := readHTTPConnect(srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != "example.com:443" {
+			t.Fatalf("dest = %q, want %q", dest, "example.com:443")
+		}
+		got := make([]byte, len("early"))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "early" {
+			t.Fatalf("replayed %q, want %q", got, "early")
+		}
+	})
+
+	t.Run("rejects-other-methods", func(t *testing.T) {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		defer srv.Close()
+		go func() {
+			_, _ = io.WriteString(cli, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		}()
+		respCh := make(chan string, 1)
+		go func() {
+			b := make([]byte, 256)
+			n, _ := cli.Read(b)
+			respCh <- string(b[:n])
+		}()
+		if _, _, err := readHTTPConnect(srv); err == nil {
+			t.Fatal("readHTTPConnect: expected error for GET")
+		}
+		select {
+		case resp := <-respCh:
+			if !strings.HasPrefix(resp, "HTTP/1.1 405 ") {
+				t.Fatalf("response = %q, want 405", resp)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no response")
+		}
+	})
+}
+
+func TestDestinationStatus(t *testing.T) {
+	for _, tt := range []struct {
+		dialErr error
+		want    error
+	}{
+		{nil, nil},
+		{ErrDestinationDenied, ErrDestinationDenied},
+		{errors.New("connection refused"), errDestinationUnreachable},
+	} {
+		a, b := net.Pipe()
+		go func() { _ = writeDestinationStatus(a, tt.dialErr, time.Second) }()
+		if err := readDestinationStatus(b, time.Second); !errors.Is(err, tt.want) && err != tt.want {
+			t.Errorf("dial error %v: readDestinationStatus() = %v, want %v", tt.dialErr, err, tt.want)
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}
+
+	a, b := net.Pipe()
+	_ = a.Close()
+	if err := readDestinationStatus(b, time.Second); !errors.Is(err, errDestinationUnreachable) {
+		t.Fatalf("closed stream: readDestinationStatus() = %v, want %v", err, errDestinationUnreachable)
+	}
+}
+
+// TestDestinationWithService verifies that a stream requesting both a service
+// and a destination is refused with a status, not just closed.
+func TestDestinationWithService(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"policies": []map[string]any{
+			{"identities": []string{"peer-a"}, "services": []string{"ssh"}, "destinations": true},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	stream, peer := net.Pipe()
+	t.Cleanup(func() { _ = peer.Close() })
+	hdr := mux.StreamHeader{Service: "ssh", Destination: "127.0.0.1:9"}
+	go s.handleInboundStream(nil, "peer-a", &headerStream{Conn: stream, hdr: hdr})
+	if err := readDestinationStatus(peer, 5*time.Second); !errors.Is(err, ErrDestinationDenied) {
+		t.Fatalf("readDestinationStatus() = %v, want %v", err, ErrDestinationDenied)
+	}
+}
@@ -0,0 +1,621 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bytes"
+	"cmp"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+var (
+	// ErrEnrollDisabled is returned when enrollment is not configured.
+	ErrEnrollDisabled = errors.New("enrollment is not configured")
+	// ErrEnrollToken is returned for an unknown, used or expired token.
+	ErrEnrollToken = errors.New("invalid enrollment token")
+	// ErrEnrollUnnamed is returned for a token without a name unless
+	// enroll.allow_unnamed is set.
+	ErrEnrollUnnamed = errors.New("enrollment token needs a name")
+	// ErrEnrollName is returned when a node asks for a name that belongs to
+	// a known or previously enrolled identity.
+	ErrEnrollName = errors.New("name is already in use")
+)
+
+// enrollTokenPrefix versions the enrollment token format:
+// "tw1.<secret>.<SHA-256 of the hub's SPKI>", both parts base64url.
+const enrollTokenPrefix = "tw1"
+
+// enrollTimeout bounds an enrollment request on either side.
+const enrollTimeout = 30 * time.Second
+
+func formatEnrollToken(secret []byte, pin [sha256.Size]byte) string {
+	enc := base64.RawURLEncoding
+	return enrollTokenPrefix + "." + enc.EncodeToString(secret) + "." + enc.EncodeToString(pin[:])
+}
+
+func parseEnrollToken(s string) (secret []byte, pin [sha256.Size]byte, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 3 || parts[0] != enrollTokenPrefix {
+		return nil, pin, ErrEnrollToken
+	}
+	enc := base64.RawURLEncoding
+	secret, err = enc.DecodeString(parts[1])
+	if err != nil || len(secret) == 0 {
+		return nil, pin, ErrEnrollToken
+	}
+	b, err := enc.DecodeString(parts[2])
+	if err != nil || len(b) != sha256.Size {
+		return nil, pin, ErrEnrollToken
+	}
+	copy(pin[:], b)
+	return secret, pin, nil
+}
+
+// enrollToken is a pending token. Only the SHA-256 of its secret is kept.
+type enrollToken struct {
+	Hash    string    `json:"hash"`
+	Name    string    `json:"name,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// EnrolledCert records a certificate issued through enrollment, so that it
+// can be found and revoked later.
+type EnrolledCert struct {
+	Serial      string    `json:"serial"` // hex
+	Subject     string    `json:"subject"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	URIs        []string  `json:"uris,omitempty"`
+	Remote      string    `json:"remote"`
+	Issued      time.Time `json:"issued"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// enrollState is the content of the enrollment state file.
+type enrollState struct {
+	Tokens []enrollToken  `json:"tokens"`
+	Issued []EnrolledCert `json:"issued"`
+}
+
+// enrollment holds the tokens and issued certificates. The state is read from
+// the configured file the first time it is needed after the path changed.
+type enrollment struct {
+	mu     sync.Mutex
+	path   string
+	loaded bool
+	state  enrollState
+	// The CA of the enroll section it was loaded from, so that an encrypted
+	// ca_key is decrypted once per config
+	signer struct {
+		from *config.Enroll
+		ca   *x509.Certificate
+		key  crypto.Signer
+	}
+}
+
+// loadEnrollState makes s.enroll.state reflect cfg.Enroll.State. Called with
+// s.enroll.mu held.
+func (s *Server) loadEnrollState(cfg *config.File) error {
+	e := &s.enroll
+	path := cfg.Enroll.State
+	if e.loaded && e.path == path {
+		return nil
+	}
+	var state enrollState
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(b, &state)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("enroll state %s: %w", path, err)
+		}
+	} else if e.loaded {
+		// Keep what was recorded in memory when the file is dropped.
+		state = e.state
+	}
+	e.path, e.loaded, e.state = path, true, state
+	return nil
+}
+
+// saveEnrollState writes the state to its file, if any. Called with
+// s.enroll.mu held.
+func (s *Server) saveEnrollState() error {
+	e := &s.enroll
+	if e.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(e.state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(e.path, b, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("enroll state %s: %w", e.path, err)
+	}
+	return nil
+}
+
+// lockEnroll locks the enrollment state for cfg and drops expired tokens.
+// On success the caller must unlock s.enroll.mu.
+func (s *Server) lockEnroll(cfg *config.File, now time.Time) error {
+	if cfg.Enroll == nil {
+		return ErrEnrollDisabled
+	}
+	s.enroll.mu.Lock()
+	if err := s.loadEnrollState(cfg); err != nil {
+		s.enroll.mu.Unlock()
+		return err
+	}
+	s.enroll.state.Tokens = slices.DeleteFunc(s.enroll.state.Tokens, func(t enrollToken) bool {
+		return !now.Before(t.Expires)
+	})
+	return nil
+}
+
+// enrollSigner returns the CA key pair of cfg. Called with s.enroll.mu held.
+func (s *Server) enrollSigner(cfg *config.File) (*x509.Certificate, crypto.Signer, error) {
+	signer := &s.enroll.signer
+	if signer.from != cfg.Enroll {
+		ca, key, err := cfg.Enroll.NewSigner()
+		if err != nil {
+			return nil, nil, err
+		}
+		signer.from, signer.ca, signer.key = cfg.Enroll, ca, key
+	}
+	return signer.ca, signer.key, nil
+}
+
+// MintEnrollToken returns a one-time enrollment token. The certificate
+// issued for the token carries name only; an empty name lets the node choose
+// and requires enroll.allow_unnamed.
+func (s *Server) MintEnrollToken(name string) (token string, expires time.Time, err error) {
+	cfg, _ := s.getConfig()
+	leaf := cfg.LocalCertificate()
+	if cfg.Enroll == nil || leaf == nil {
+		return "", time.Time{}, ErrEnrollDisabled
+	}
+	if name == "" && !cfg.Enroll.AllowUnnamed {
+		return "", time.Time{}, ErrEnrollUnnamed
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	if err := s.lockEnroll(cfg, now); err != nil {
+		return "", time.Time{}, err
+	}
+	defer s.enroll.mu.Unlock()
+	hash := sha256.Sum256(secret)
+	expires = now.Add(cfg.Enroll.TokenLifetime()).Truncate(time.Second)
+	s.enroll.state.Tokens = append(s.enroll.state.Tokens, enrollToken{
+		Hash:    hex.EncodeToString(hash[:]),
+		Name:    name,
+		Expires: expires,
+	})
+	if err := s.saveEnrollState(); err != nil {
+		s.enroll.state.Tokens = s.enroll.state.Tokens[:len(s.enroll.state.Tokens)-1]
+		return "", time.Time{}, err
+	}
+	return formatEnrollToken(secret, sha256.Sum256(leaf.RawSubjectPublicKeyInfo)), expires, nil
+}
+
+// EnrolledCerts returns the certificates issued through enrollment, oldest
+// first.
+func (s *Server) EnrolledCerts() ([]EnrolledCert, error) {
+	cfg, _ := s.getConfig()
+	if err := s.lockEnroll(cfg, time.Now()); err != nil {
+		return nil, err
+	}
+	defer s.enroll.mu.Unlock()
+	return slices.Clone(s.enroll.state.Issued), nil
+}
+
+// enrollNode signs csrPEM in exchange for token and returns the certificate
+// with the certificates the node should list in its authcerts. The token is
+// used up before the CA key is loaded, so that requests without a valid token
+// cost no more than a lookup; it stays used even when no certificate is
+// returned.
+func (s *Server) enrollNode(token string, csrPEM []byte, remote string) (certPEM []byte, authCerts []string, err error) {
+	cfg, _ := s.getConfig()
+	secret, _, err := parseEnrollToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	csrDER := parsePEM(csrPEM, "CERTIFICATE REQUEST")
+	if csrDER == nil {
+		return nil, nil, errors.New("certificate request not found")
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("certificate request: %s", formats.Error(err))
+	}
+
+	now := time.Now()
+	if err := s.lockEnroll(cfg, now); err != nil {
+		return nil, nil, err
+	}
+	defer s.enroll.mu.Unlock()
+	hash := sha256.Sum256(secret)
+	i := slices.IndexFunc(s.enroll.state.Tokens, func(t enrollToken) bool {
+		b, err := hex.DecodeString(t.Hash)
+		return err == nil && subtle.ConstantTimeCompare(b, hash[:]) == 1
+	})
+	if i < 0 {
+		return nil, nil, ErrEnrollToken
+	}
+	name := s.enroll.state.Tokens[i].Name
+	s.enroll.state.Tokens = slices.Delete(s.enroll.state.Tokens, i, i+1)
+	if err := s.saveEnrollState(); err != nil {
+		return nil, nil, err
+	}
+	names := certNames{commonName: name}
+	if name == "" {
+		if !cfg.Enroll.AllowUnnamed {
+			return nil, nil, ErrEnrollUnnamed
+		}
+		names = certNames{
+			commonName:  csr.Subject.CommonName,
+			dnsNames:    csr.DNSNames,
+			ipAddresses: csr.IPAddresses,
+			uris:        csr.URIs,
+		}
+		// The node may not take over the identity of another peer.
+		if taken := s.takenEnrollName(cfg, names); taken != "" {
+			return nil, nil, fmt.Errorf("%w: %q", ErrEnrollName, taken)
+		}
+	}
+	ca, caKey, err := s.enrollSigner(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := certOptions{profile: "leaf", days: cfg.Enroll.CertDays()}
+	certPEM, err = signCertificate(ca, caKey, opts, names, csr.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(parsePEM(certPEM, "CERTIFICATE"))
+	if err != nil {
+		return nil, nil, err
+	}
+	issued := EnrolledCert{
+		Serial:   cert.SerialNumber.Text(16),
+		Subject:  certSubject(cert),
+		DNSNames: cert.DNSNames,
+		Remote:   remote,
+		Issued:   now.Truncate(time.Second),
+		NotAfter: cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		issued.IPAddresses = append(issued.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		issued.URIs = append(issued.URIs, u.String())
+	}
+	s.enroll.state.Issued = append(s.enroll.state.Issued, issued)
+	if err := s.saveEnrollState(); err != nil {
+		return nil, nil, err
+	}
+	msg := fmt.Sprintf("enroll: issued %q (serial %s) to %s", issued.Subject, issued.Serial, remote)
+	slog.Info(msg)
+	s.recentEvents.Add(now, msg)
+	return certPEM, enrollAuthCerts(cfg, ca), nil
+}
+
+// takenEnrollName returns the first of names that an identity claim could
+// match (the CN, a DNS or URI SAN) and that is already an identity known to
+// cfg or of a certificate issued before, or "" when there is none. Called
+// with s.enroll.mu held.
+func (s *Server) takenEnrollName(cfg *config.File, names certNames) string {
+	taken := cfg.KnownIdentities()
+	for _, c := range s.enroll.state.Issued {
+		taken = append(taken, c.Subject)
+		taken = append(taken, c.DNSNames...)
+		taken = append(taken, c.URIs...)
+	}
+	requested := []string{names.commonName}
+	requested = append(requested, names.dnsNames...)
+	for _, u := range names.uris {
+		requested = append(requested, u.String())
+	}
+	for _, name := range requested {
+		if name == "" {
+			continue
+		}
+		if slices.ContainsFunc(taken, func(id string) bool { return strings.EqualFold(id, name) }) {
+			return name
+		}
+	}
+	return ""
+}
+
+// enrollAuthCerts returns the certificates an enrolled node needs to trust
+// this hub and its peers: the CA, the hub's own certificate unless the CA
+// signed it, and the certificates in the hub's authcerts.
+func enrollAuthCerts(cfg *config.File, ca *x509.Certificate) []string {
+	certs := []*x509.Certificate{ca}
+	if leaf := cfg.LocalCertificate(); leaf != nil && leaf.CheckSignatureFrom(ca) != nil {
+		certs = append(certs, leaf)
+	}
+	certs = append(certs, cfg.AuthCertificates()...)
+	var bundle []string
+	for i, cert := range certs {
+		if slices.ContainsFunc(certs[:i], cert.Equal) {
+			continue
+		}
+		bundle = append(bundle, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	return bundle
+}
+
+// enrollRequest is the body a node posts to the enrollment listener.
+type enrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"`
+}
+
+// enrollResponse carries the signed certificate and the authcerts bundle.
+type enrollResponse struct {
+	Certificate string   `json:"cert"`
+	AuthCerts   []string `json:"authcerts"`
+}
+
+// enrollHandler serves POST /enroll on the enrollment listener.
+type enrollHandler struct {
+	s *Server
+}
+
+func (h *enrollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req enrollRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxContentLength)).Decode(&req); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	certPEM, authCerts, err := h.s.enrollNode(req.Token, []byte(req.CSR), r.RemoteAddr)
+	switch {
+	case errors.Is(err, ErrEnrollToken), errors.Is(err, ErrEnrollUnnamed), errors.Is(err, ErrEnrollName):
+		slog.Warningf("enroll: %s from %s", formats.Error(err), r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrEnrollDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Errorf("enroll: request from %s: %s", r.RemoteAddr, formats.Error(err))
+		http.Error(w, "enrollment failed", http.StatusInternalServerError)
+		return
+	}
+	setRespHeader(w.Header(), "application/json", true)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(enrollResponse{Certificate: string(certPEM), AuthCerts: authCerts}); err != nil {
+		slog.Debugf("enroll: %s", formats.Error(err))
+	}
+}
+
+// enrollCertificate serves the current TLS certificate on the enrollment
+// listener, so that rotations with the same key keep minted tokens valid.
+func (s *Server) enrollCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	_, tlscfg := s.getConfig()
+	if tlscfg == nil || len(tlscfg.Certificates) == 0 {
+		return nil, ErrEnrollDisabled
+	}
+	return &tlscfg.Certificates[0], nil
+}
+
+// startEnrollListen serves enrollment over HTTPS on addr, without client
+// authentication.
+func (s *Server) startEnrollListen(addr string) error {
+	l, err := s.Listen(addr)
+	if err != nil {
+		return err
+	}
+	l = s.filterSources(l, aclEnrollListen, "")
+	slog.Noticef("enroll listen: %v", l.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/enroll", &enrollHandler{s: s})
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: enrollTimeout,
+		ErrorLog:          slog.Wrap(slog.Default(), slog.LevelError),
+	}
+	tl := tls.NewListener(l, &tls.Config{
+		GetCertificate: s.enrollCertificate,
+		MinVersion:     tls.VersionTLS13,
+	})
+	if err := s.g.Go(func() {
+		if err := server.Serve(tl); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error(formats.Error(err))
+		}
+	}); err != nil {
+		ioClose(l)
+		return err
+	}
+	s.listenMu.Lock()
+	s.enrollListener = l
+	s.listenMu.Unlock()
+	return nil
+}
+
+// reloadEnrollListen restarts the enrollment listener when its address
+// changed from old to cfg.
+func (s *Server) reloadEnrollListen(old, cfg *config.File) error {
+	listenAddr := func(c *config.File) string {
+		if c.Enroll == nil {
+			return ""
+		}
+		return c.Enroll.Listen
+	}
+	addr := listenAddr(cfg)
+	if addr == listenAddr(old) {
+		return nil
+	}
+	s.listenMu.Lock()
+	el := s.enrollListener
+	s.enrollListener = nil
+	s.listenMu.Unlock()
+	if el != nil {
+		ioClose(el)
+	}
+	if addr == "" {
+		return nil
+	}
+	if err := s.startEnrollListen(addr); err != nil {
+		slog.Errorf("reload: enroll listen %s: %s", addr, formats.Error(err))
+		return fmt.Errorf("reload enroll listen %s: %w", addr, err)
+	}
+	return nil
+}
+
+// enrollURL returns the enrollment endpoint of hub, given as host:port or as
+// an https URL.
+func enrollURL(hub string) string {
+	if strings.Contains(hub, "://") {
+		return hub
+	}
+	return "https://" + hub + "/enroll"
+}
+
+// defaultEnrollName names the files written by -enroll without -gencerts.
+const defaultEnrollName = "node"
+
+func enroll(f *AppFlags) int {
+	keygen, err := makeKeyGenerator(f.KeyType, f.KeySize)
+	if err != nil {
+		slog.Fatalf("enroll: %s", formats.Error(err))
+		return 1
+	}
+	passphrase, err := keyPassphrase(f)
+	if err != nil {
+		slog.Fatalf("enroll: %s", formats.Error(err))
+		return 1
+	}
+	if err := enrollCerts(f, keygen, passphrase); err != nil {
+		slog.Fatalf("enroll: %s", formats.Error(err))
+		return 1
+	}
+	slog.Notice("enroll: ok")
+	return 0
+}
+
+// enrollCerts obtains the -gencerts key pair from the hub at f.Enroll: the
+// key is generated (or reused) locally and only a CSR leaves the node. The
+// hub is authenticated by the SPKI pin in the token. Writes
+// <name>-cert.pem, <name>-key.pem and <name>-authcerts.pem.
+func enrollCerts(f *AppFlags, keygen keyGenerator, passphrase []byte) error {
+	name := cmp.Or(f.GenCerts, defaultEnrollName)
+	_, pin, err := parseEnrollToken(f.Token)
+	if err != nil {
+		return err
+	}
+	names, err := genCertNames(f)
+	if err != nil {
+		return err
+	}
+	pubKey, key, err := loadOrGenerateKey(name, f.ReuseKey, keygen, passphrase)
+	if err != nil {
+		return fmt.Errorf("generate key: %s", formats.Error(err))
+	}
+	keyPEM, err := marshalPrivateKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	csrPEM, err := newCSR(names, key)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(enrollRequest{Token: f.Token, CSR: string(csrPEM)})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: enrollTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// The hub is authenticated by its pinned key, not by a CA.
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS13,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					if len(cs.PeerCertificates) == 0 ||
+						sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo) != pin {
+						return errors.New("hub certificate does not match the SPKI pin in the token")
+					}
+					return nil
+				},
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	url := enrollURL(f.Enroll)
+	slog.Noticef("enroll: request certificate from %q", url)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("enroll: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var v enrollResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxContentLength)).Decode(&v); err != nil {
+		return fmt.Errorf("enroll: %s", formats.Error(err))
+	}
+	certDER := parsePEM([]byte(v.Certificate), "CERTIFICATE")
+	if certDER == nil {
+		return errors.New("enroll: certificate not found in response")
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, spki) {
+		return errors.New("enroll: issued certificate does not carry the requested key")
+	}
+	if err := writeKeyPair(name, []byte(v.Certificate), keyPEM); err != nil {
+		return err
+	}
+	authFile := name + "-authcerts.pem"
+	if err := os.WriteFile(authFile, []byte(strings.Join(v.AuthCerts, "")), 0644); err != nil {
+		return err
+	}
+	slog.Noticef("enroll: write %q", authFile)
+	return nil
+}
@@ -0,0 +1,324 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEnrollHub starts a server with enrollment enabled, signing with a CA
+// created in the current directory. The hub's own certificate is
+// self-signed.
+func newEnrollHub(t *testing.T, state string, allowUnnamed bool) (s *Server, addr string) {
+	t.Helper()
+	addr = freePort(t)
+	s = newTestServer(t, enrollHubConfig(t, addr, state, allowUnnamed))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return s, addr
+}
+
+func enrollHubConfig(t *testing.T, addr, state string, allowUnnamed bool) map[string]any {
+	t.Helper()
+	if _, err := os.Stat("ca-cert.pem"); err != nil {
+		if code := genCerts(&AppFlags{GenCerts: "ca", ServerName: "Test CA", KeyType: "ecdsa", Profile: "ca"}); code != 0 {
+			t.Fatalf("genCerts(ca) = %d, want 0", code)
+		}
+	}
+	certPEM, keyPEM := newExpiringKeyPair(t, "hub", time.Now().Add(24*time.Hour))
+	return map[string]any{
+		"tls": map[string]any{"cert": certPEM, "key": keyPEM},
+		"enroll": map[string]any{
+			"listen":        addr,
+			"ca_cert":       "@ca-cert.pem",
+			"ca_key":        "@ca-key.pem",
+			"days":          30,
+			"state":         state,
+			"allow_unnamed": allowUnnamed,
+		},
+		"identity": map[string]any{
+			"claim":   "hub",
+			"connect": map[string]any{"peer1": "127.0.0.1:1"},
+		},
+	}
+}
+
+func mintToken(t *testing.T, s *Server, name string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	(&apiEnrollTokenHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/enroll/token?name="+name, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /enroll/token = %d: %s", rec.Code, rec.Body.String())
+	}
+	var v struct {
+		Token   string    `json:"token"`
+		Name    string    `json:"name"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != name || time.Until(v.Expires) < 23*time.Hour {
+		t.Fatalf("minted token: %+v", v)
+	}
+	return v.Token
+}
+
+func TestEnrollToken(t *testing.T) {
+	var pin [sha256.Size]byte
+	pin[0] = 1
+	token := formatEnrollToken([]byte("secret"), pin)
+	secret, got, err := parseEnrollToken(" " + token + "\n")
+	if err != nil || string(secret) != "secret" || got != pin {
+		t.Fatalf("parseEnrollToken(%q) = %q, %x, %v", token, secret, got, err)
+	}
+	for _, s := range []string{
+		"",
+		"tw2" + strings.TrimPrefix(token, "tw1"),
+		token + ".x",
+		strings.TrimSuffix(token, "A"),
+		"tw1..AQ",
+	} {
+		if _, _, err := parseEnrollToken(s); !errors.Is(err, ErrEnrollToken) {
+			t.Fatalf("parseEnrollToken(%q) = %v, want ErrEnrollToken", s, err)
+		}
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	dir := t.TempDir()
+	chdirTemp(t, dir)
+	state := filepath.Join(dir, "enroll.json")
+	s, addr := newEnrollHub(t, state, true)
+	keygen, err := makeKeyGenerator("ecdsa", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A named token fixes the certificate's names.
+	token := mintToken(t, s, "node1")
+	f := &AppFlags{GenCerts: "node1", Enroll: addr, Token: token, ServerName: "chosen", SANs: "chosen.example.com"}
+	if err := enrollCerts(f, keygen, nil); err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := readKeyPair("node1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := readKeyPair("ca", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "node1" || len(cert.DNSNames) != 0 || cert.IsCA || cert.CheckSignatureFrom(ca) != nil {
+		t.Fatalf("enrolled certificate: CN=%q DNSNames=%v IsCA=%v", cert.Subject.CommonName, cert.DNSNames, cert.IsCA)
+	}
+	if days := cert.NotAfter.Sub(cert.NotBefore).Hours() / 24; days < 29 || days > 31 {
+		t.Fatalf("enrolled certificate valid for %.1f days, want 30", days)
+	}
+	b, err := os.ReadFile("node1-authcerts.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "BEGIN CERTIFICATE"); n != 2 {
+		t.Fatalf("authcerts bundle has %d certificates, want the CA and the hub", n)
+	}
+
+	// Tokens are single use.
+	if err := enrollCerts(f, keygen, nil); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("reused token: %v", err)
+	}
+
+	// A token carrying the wrong pin does not reach the hub, so the token
+	// stays usable.
+	token = mintToken(t, s, "")
+	var wrong [sha256.Size]byte
+	secret, _, _ := parseEnrollToken(token)
+	f = &AppFlags{GenCerts: "node2", Enroll: addr, Token: formatEnrollToken(secret, wrong), ServerName: "node2", SANs: "node2.example.com"}
+	if err := enrollCerts(f, keygen, nil); err == nil || !strings.Contains(err.Error(), "SPKI pin") {
+		t.Fatalf("wrong pin: %v", err)
+	}
+	f.Token = token
+	if err := enrollCerts(f, keygen, nil); err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err = readKeyPair("node2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "node2" || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "node2.example.com" {
+		t.Fatalf("unnamed token certificate: CN=%q DNSNames=%v", cert.Subject.CommonName, cert.DNSNames)
+	}
+
+	// Expired tokens are refused.
+	token = mintToken(t, s, "node3")
+	s.enroll.mu.Lock()
+	s.enroll.state.Tokens[0].Expires = time.Now().Add(-time.Second)
+	s.enroll.mu.Unlock()
+	f = &AppFlags{GenCerts: "node3", Enroll: addr, Token: token, ServerName: "node3"}
+	if err := enrollCerts(f, keygen, nil); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expired token: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	(&apiEnrollIssuedHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/enroll/issued", nil))
+	var issued []EnrolledCert
+	if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 2 || issued[0].Subject != "node1" || issued[1].Serial != cert.SerialNumber.Text(16) {
+		t.Fatalf("GET /enroll/issued = %s", rec.Body.String())
+	}
+
+	// The state survives a restart.
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = newEnrollHub(t, state, true)
+	issued, err = s.EnrolledCerts()
+	if err != nil || len(issued) != 2 {
+		t.Fatalf("EnrolledCerts() after restart = %v, %v", issued, err)
+	}
+}
+
+// Unnamed tokens are opt-in and may not claim a name that is already in use.
+func TestEnrollUnnamed(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	keygen, err := makeKeyGenerator("ecdsa", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newEnrollHub(t, "", false)
+	rec := httptest.NewRecorder()
+	(&apiEnrollTokenHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/enroll/token", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST /enroll/token without a name = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, addr := newEnrollHub(t, "", true)
+	if err := enrollCerts(&AppFlags{GenCerts: "node1", Enroll: addr, Token: mintToken(t, s, ""), ServerName: "node1"}, keygen, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*AppFlags{
+		{GenCerts: "hub", ServerName: "hub"},
+		{GenCerts: "peer1", ServerName: "other", SANs: "PEER1"},
+		{GenCerts: "node1", ServerName: "node1"},
+	} {
+		f.Enroll, f.Token = addr, mintToken(t, s, "")
+		if err := enrollCerts(f, keygen, nil); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("enroll as %q: %v, want 403", f.GenCerts, err)
+		}
+		// The token is used up by the refused request.
+		s.enroll.mu.Lock()
+		n := len(s.enroll.state.Tokens)
+		s.enroll.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%d tokens pending after a refused request, want 0", n)
+		}
+	}
+}
+
+// Requests without a valid token never load the CA key.
+func TestEnrollTokenBeforeSigner(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	s, _ := newEnrollHub(t, "", false)
+	keygen, err := makeKeyGenerator("ecdsa", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := keygen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, err := newCSR(certNames{commonName: "node"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.enrollNode("tw1.AQ."+strings.Repeat("A", 43), csrPEM, "test"); !errors.Is(err, ErrEnrollToken) {
+		t.Fatalf("enrollNode(fake token) = %v, want ErrEnrollToken", err)
+	}
+	if s.enroll.signer.from != nil {
+		t.Fatal("CA key loaded for a request without a valid token")
+	}
+	if _, _, err := s.enrollNode(mintToken(t, s, "node"), csrPEM, "test"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := s.getConfig()
+	ca := s.enroll.signer.ca
+	if s.enroll.signer.from != cfg.Enroll || ca == nil {
+		t.Fatal("CA key not cached after enrollment")
+	}
+	if _, _, err := s.enrollNode(mintToken(t, s, "node2"), csrPEM, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if s.enroll.signer.ca != ca {
+		t.Fatal("CA key loaded again for the same config")
+	}
+}
+
+func TestEnrollSourceACL(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	addr := freePort(t)
+	cfg := enrollHubConfig(t, addr, "", false)
+	maps.Copy(cfg, denyLoopback(aclEnrollListen))
+	s := newTestServer(t, cfg)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown() })
+	expectRefused(t, addr)
+}
+
+func TestEnrollDisabled(t *testing.T) {
+	s := newTestServer(t, nil)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	rec := httptest.NewRecorder()
+	(&apiEnrollTokenHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/enroll/token", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("POST /enroll/token = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if _, err := s.EnrolledCerts(); !errors.Is(err, ErrEnrollDisabled) {
+		t.Fatalf("EnrolledCerts() = %v, want ErrEnrollDisabled", err)
+	}
+	if _, _, err := s.enrollNode("tw1.AQ."+strings.Repeat("A", 43), nil, "test"); err == nil {
+		t.Fatal("enrollNode succeeded without a request")
+	}
+}
+
+// The bundle carries the CA and the hub certificate the CA did not sign.
+func TestEnrollAuthCerts(t *testing.T) {
+	chdirTemp(t, t.TempDir())
+	s, _ := newEnrollHub(t, "", false)
+	cfg, _ := s.getConfig()
+	ca, _, err := cfg.Enroll.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := enrollAuthCerts(cfg, ca)
+	if len(bundle) != 2 {
+		t.Fatalf("bundle has %d certificates, want 2", len(bundle))
+	}
+	pool := x509.NewCertPool()
+	for _, c := range bundle {
+		if !pool.AppendCertsFromPEM([]byte(c)) {
+			t.Fatalf("unparsable bundle entry:\n%s", c)
+		}
+	}
+}
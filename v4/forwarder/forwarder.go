@@ -78,6 +78,8 @@ type Forwarder interface {
 	// handler may be nil. If Start returns nil, OnWriteClosed runs once per
 	// direction and OnClosed runs once after both directions finish.
 	Start(accepted net.Conn, dialed net.Conn, handler EventHandler) error
+	// StartLimited is like Start, but throttles each direction by limits.
+	StartLimited(accepted net.Conn, dialed net.Conn, handler EventHandler, limits Limits) error
 	// SetLimit adjusts the maximum number of active connection pairs.
 	// Pairs already running are unaffected when the limit shrinks.
 	SetLimit(maxConn int)
@@ -129,8 +131,9 @@ func (f *forwarder) cleanupConn(accepted net.Conn, dialed net.Conn) {
 	delete(f.conn, dialed)
 }
 
-// connCopy copies from src to dst and returns the io.CopyBuffer error (nil on clean EOF).
-func (f *forwarder) connCopy(dst net.Conn, src net.Conn) error {
+// connCopy copies from src to dst, throttled by buckets, and returns the
+// io.CopyBuffer error (nil on clean EOF).
+func (f *forwarder) connCopy(dst net.Conn, src net.Conn, buckets []*Bucket) error {
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Stackf(slog.LevelError, 0, "panic: %v", r)
@@ -141,7 +144,7 @@ func (f *forwarder) connCopy(dst net.Conn, src net.Conn) error {
 	// our buffer: one side is always a mux stream (splice never applies),
 	// and the generic fallbacks copy in 32 KiB pieces, which split each mux
 	// chunk across two HTTP/2 frames and force a merge copy on receive.
-	_, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bp)
+	_, err := io.CopyBuffer(struct{ io.Writer }{dst}, limitReader(struct{ io.Reader }{src}, buckets, f.g.CloseC()), *bp)
 	copyBufPool.Put(bp)
 	if err != nil &&
 		!errors.Is(err, net.ErrClosed) &&
@@ -153,6 +156,11 @@ func (f *forwarder) connCopy(dst net.Conn, src net.Conn) error {
 
 // Start begins forwarding data between accepted and dialed.
 func (f *forwarder) Start(accepted net.Conn, dialed net.Conn, handler EventHandler) error {
+	return f.StartLimited(accepted, dialed, handler, Limits{})
+}
+
+// StartLimited begins forwarding data between accepted and dialed, throttled by limits.
+func (f *forwarder) StartLimited(accepted net.Conn, dialed net.Conn, handler EventHandler, limits Limits) error {
 	select {
 	case <-f.g.CloseC():
 		return routines.ErrClosed
@@ -170,8 +178,8 @@ func (f *forwarder) Start(accepted net.Conn, dialed net.Conn, handler EventHandl
 	var remaining atomic.Int32
 	remaining.Store(2)
 	closeOnce := &sync.Once{}
-	run := func(dst, src net.Conn) {
-		err := f.connCopy(dst, src)
+	run := func(dst, src net.Conn, buckets []*Bucket) {
+		err := f.connCopy(dst, src, buckets)
 		// On clean EOF, attempt a half-close so the peer can drain remaining data.
 		// On error or if half-close is not supported, force-close both connections.
 		if err == nil {
@@ -203,11 +211,11 @@ func (f *forwarder) Start(accepted net.Conn, dialed net.Conn, handler EventHandl
 			}
 		}
 	}
-	if err := f.g.Go(func() { run(accepted, dialed) }); err != nil {
+	if err := f.g.Go(func() { run(accepted, dialed, limits.Reverse) }); err != nil {
 		cleanup()
 		return err
 	}
-	if err := f.g.Go(func() { run(dialed, accepted) }); err != nil {
+	if err := f.g.Go(func() { run(dialed, accepted, limits.Forward) }); err != nil {
 		// Signal the first goroutine to stop.
 		closeOnce.Do(func() {
 			_ = accepted.Close()
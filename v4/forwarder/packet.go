@@ -0,0 +1,452 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/routines"
+	"github.com/hexian000/gosnippets/slog"
+)
+
+const (
+	// maxDatagramSize bounds one relayed datagram (the largest UDP payload).
+	maxDatagramSize = 65535
+	// sourceQueue is the number of datagrams queued per source address while
+	// its flow is being opened or is busy; datagrams arriving at a full queue
+	// are dropped.
+	sourceQueue = 64
+)
+
+// PacketForwarder is the datagram counterpart of Forwarder. It relays flows of
+// datagrams over message-oriented connections, where each Write sends one
+// datagram and each Read returns one (a connected UDP socket or a mux datagram
+// flow). A flow that carries no datagram in either direction for the idle
+// timeout is closed.
+type PacketForwarder interface {
+	// Start relays datagrams between accepted and dialed. handler may be nil.
+	// If Start returns nil, OnWriteClosed runs once per direction and
+	// OnClosed runs once after the flow ends.
+	Start(accepted net.Conn, dialed net.Conn, handler EventHandler) error
+	// StartLimited is like Start, but throttles each direction by limits.
+	// Datagrams are never split: one larger than a bucket's burst passes
+	// whole and the flow waits until the bucket has refilled.
+	StartLimited(accepted net.Conn, dialed net.Conn, handler EventHandler, limits Limits) error
+	// Serve reads datagrams from pc until pc is closed. The first datagram
+	// from each source address opens a flow by calling dial; datagrams read
+	// from the flow are sent back to that address. The flow is throttled by
+	// the limits dial returns, Forward applying to datagrams from pc. Each
+	// flow is opened and fed in its own goroutine, so a slow dial or a
+	// throttled flow only delays its own source: datagrams from that source
+	// are queued meanwhile and dropped when the queue is full.
+	Serve(pc net.PacketConn, dial func(src net.Addr) (net.Conn, Limits, error)) error
+	// SetLimit adjusts the maximum number of active flows.
+	SetLimit(maxFlows int)
+	// SetIdleTimeout adjusts the idle timeout, including for active flows.
+	SetIdleTimeout(timeout time.Duration)
+	Count() int
+	// Dropped returns the bytes of the datagrams Serve dropped at full
+	// queues. They also count as Dropped on the limited rates of the flow.
+	Dropped() uint64
+	Close()
+}
+
+// flow is one relayed datagram flow.
+type flow struct {
+	mu         sync.Mutex
+	conns      []net.Conn
+	closed     bool
+	done       chan struct{} // closed by close
+	lastActive atomic.Int64  // unix nanoseconds
+}
+
+func (fl *flow) touch() {
+	fl.lastActive.Store(time.Now().UnixNano())
+}
+
+// attach adds conn to the flow. If the flow has already been closed, conn is
+// closed instead and attach returns false.
+func (fl *flow) attach(conn net.Conn) bool {
+	fl.mu.Lock()
+	if !fl.closed {
+		fl.conns = append(fl.conns, conn)
+		fl.mu.Unlock()
+		return true
+	}
+	fl.mu.Unlock()
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Warningf("close: %s", formats.Error(err))
+	}
+	return false
+}
+
+// close closes the flow's connections, which unblocks its relay goroutines.
+func (fl *flow) close() {
+	fl.mu.Lock()
+	if fl.closed {
+		fl.mu.Unlock()
+		return
+	}
+	fl.closed = true
+	conns := fl.conns
+	fl.mu.Unlock()
+	close(fl.done)
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Warningf("close: %s", formats.Error(err))
+		}
+	}
+}
+
+type packetForwarder struct {
+	mu    sync.Mutex
+	g     routines.Group
+	flows map[*flow]struct{}
+	count atomic.Int64
+	limit atomic.Int64
+	idle  atomic.Int64 // idle timeout in nanoseconds
+	// dropped counts the bytes of datagrams dropped by Serve.
+	dropped atomic.Uint64
+}
+
+// NewPacket returns a PacketForwarder limited to maxFlows active flows. Flows
+// idle for longer than idleTimeout are closed by a sweeper running in g.
+func NewPacket(maxFlows int, idleTimeout time.Duration, g routines.Group) PacketForwarder {
+	f := &packetForwarder{
+		flows: make(map[*flow]struct{}),
+		g:     g,
+	}
+	f.limit.Store(int64(maxFlows))
+	f.idle.Store(int64(idleTimeout))
+	if err := g.Go(f.sweepLoop); err != nil {
+		slog.Errorf("packet forwarder: %s", formats.Error(err))
+	}
+	return f
+}
+
+func (f *packetForwarder) SetLimit(maxFlows int) {
+	f.limit.Store(int64(maxFlows))
+}
+
+func (f *packetForwarder) SetIdleTimeout(timeout time.Duration) {
+	f.idle.Store(int64(timeout))
+}
+
+// sweepInterval returns how often idle flows are looked for: a quarter of the
+// idle timeout, within [10ms, 1s].
+func (f *packetForwarder) sweepInterval() time.Duration {
+	return min(max(time.Duration(f.idle.Load())/4, 10*time.Millisecond), time.Second)
+}
+
+func (f *packetForwarder) sweepLoop() {
+	timer := time.NewTimer(f.sweepInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-f.g.CloseC():
+			return
+		case <-timer.C:
+		}
+		f.sweep()
+		timer.Reset(f.sweepInterval())
+	}
+}
+
+// sweep closes flows that have been idle for longer than the idle timeout.
+func (f *packetForwarder) sweep() {
+	idle := time.Duration(f.idle.Load())
+	if idle <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-idle).UnixNano()
+	var expired []*flow
+	f.mu.Lock()
+	for fl := range f.flows {
+		if fl.lastActive.Load() < deadline {
+			expired = append(expired, fl)
+		}
+	}
+	f.mu.Unlock()
+	for _, fl := range expired {
+		fl.close()
+	}
+}
+
+// addFlow registers a flow over conns, enforcing the flow limit.
+func (f *packetForwarder) addFlow(conns ...net.Conn) (*flow, error) {
+	select {
+	case <-f.g.CloseC():
+		return nil, routines.ErrClosed
+	default:
+	}
+	if f.count.Add(1) > f.limit.Load() {
+		f.count.Add(-1)
+		return nil, ErrConnLimit
+	}
+	fl := &flow{conns: conns, done: make(chan struct{})}
+	fl.touch()
+	f.mu.Lock()
+	f.flows[fl] = struct{}{}
+	f.mu.Unlock()
+	return fl, nil
+}
+
+func (f *packetForwarder) removeFlow(fl *flow) {
+	fl.close()
+	f.mu.Lock()
+	delete(f.flows, fl)
+	f.mu.Unlock()
+	f.count.Add(-1)
+}
+
+// packetCopy relays datagrams from src to dst, throttled by buckets, until
+// either fails, and returns the error (nil when src was closed, including by
+// the idle sweeper).
+func (f *packetForwarder) packetCopy(fl *flow, dst net.Conn, src net.Conn, buckets []*Bucket) error {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Stackf(slog.LevelError, 0, "panic: %v", r)
+		}
+	}()
+	bp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bp)
+	buf := *bp
+	r := limitPacketReader(src, buckets, fl.done)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return closedIsNil(err)
+		}
+		fl.touch()
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return closedIsNil(err)
+		}
+	}
+}
+
+// closedIsNil maps errors caused by closing a flow to nil.
+func closedIsNil(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Start begins relaying datagrams between accepted and dialed.
+func (f *packetForwarder) Start(accepted net.Conn, dialed net.Conn, handler EventHandler) error {
+	return f.StartLimited(accepted, dialed, handler, Limits{})
+}
+
+// StartLimited begins relaying datagrams between accepted and dialed, throttled by limits.
+func (f *packetForwarder) StartLimited(accepted net.Conn, dialed net.Conn, handler EventHandler, limits Limits) error {
+	fl, err := f.addFlow(accepted, dialed)
+	if err != nil {
+		return err
+	}
+	var remaining atomic.Int32
+	remaining.Store(2)
+	run := func(dst, src net.Conn, buckets []*Bucket) {
+		err := f.packetCopy(fl, dst, src, buckets)
+		// Datagram flows have no half-close: either direction ending ends the flow.
+		fl.close()
+		if handler != nil {
+			handler.OnWriteClosed(src, err)
+		}
+		if remaining.Add(-1) == 0 {
+			f.removeFlow(fl)
+			if handler != nil {
+				handler.OnClosed()
+			}
+		}
+	}
+	if err := f.g.Go(func() { run(accepted, dialed, limits.Reverse) }); err != nil {
+		f.removeFlow(fl)
+		return err
+	}
+	if err := f.g.Go(func() { run(dialed, accepted, limits.Forward) }); err != nil {
+		fl.close()
+		// The second direction never ran; synthesise its OnWriteClosed callback
+		// so the handler always receives exactly two calls.
+		if handler != nil {
+			handler.OnWriteClosed(accepted, err)
+		}
+		if remaining.Add(-1) == 0 {
+			f.removeFlow(fl)
+			if handler != nil {
+				handler.OnClosed()
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// packetSource is a flow opened by Serve for one source address.
+type packetSource struct {
+	*flow
+	queue chan []byte
+	// forward holds the buckets throttling the queue once the flow is dialed.
+	forward atomic.Pointer[[]*Bucket]
+}
+
+// drop counts a datagram of n bytes dropped at the full queue of ps, against
+// every limited rate of its flow as well.
+func (f *packetForwarder) drop(ps *packetSource, n int) {
+	f.dropped.Add(uint64(n))
+	buckets := ps.forward.Load()
+	if buckets == nil {
+		return
+	}
+	for _, b := range *buckets {
+		if bytesPerSec, _ := b.rate.Limit(); bytesPerSec > 0 {
+			b.rate.dropped.Add(uint64(n))
+		}
+	}
+}
+
+// Serve relays datagrams between pc and per-source flows.
+func (f *packetForwarder) Serve(pc net.PacketConn, dial func(src net.Addr) (net.Conn, Limits, error)) error {
+	var mu sync.Mutex
+	sources := make(map[string]*packetSource)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ps := range sources {
+			ps.close()
+		}
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return closedIsNil(err)
+		}
+		key := src.String()
+		mu.Lock()
+		ps := sources[key]
+		mu.Unlock()
+		if ps == nil {
+			ps, err = f.openSource(pc, src, dial, func(ps *packetSource) {
+				mu.Lock()
+				if sources[key] == ps {
+					delete(sources, key)
+				}
+				mu.Unlock()
+			})
+			if err != nil {
+				slog.Debugf("udp %v: %s", src, formats.Error(err))
+				continue
+			}
+			mu.Lock()
+			sources[key] = ps
+			mu.Unlock()
+		}
+		ps.touch()
+		select {
+		case ps.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			f.drop(ps, n)
+			slog.Debugf("udp %v: queue full, datagram dropped", src)
+		}
+	}
+}
+
+// openSource registers a flow for src and starts a goroutine that dials it,
+// sends the queued datagrams and relays replies back to src. done is called
+// once the flow has ended.
+func (f *packetForwarder) openSource(pc net.PacketConn, src net.Addr, dial func(net.Addr) (net.Conn, Limits, error), done func(*packetSource)) (*packetSource, error) {
+	fl, err := f.addFlow()
+	if err != nil {
+		return nil, err
+	}
+	ps := &packetSource{flow: fl, queue: make(chan []byte, sourceQueue)}
+	if err := f.g.Go(func() {
+		defer func() {
+			f.removeFlow(fl)
+			done(ps)
+		}()
+		conn, limits, err := dial(src)
+		if err != nil {
+			slog.Debugf("udp %v: %s", src, formats.Error(err))
+			return
+		}
+		if !fl.attach(conn) {
+			return
+		}
+		forward := activeBuckets(limits.Forward)
+		ps.forward.Store(&forward)
+		if err := f.g.Go(func() { f.sendQueued(ps, conn, src, forward) }); err != nil {
+			return
+		}
+		bp := copyBufPool.Get().(*[]byte)
+		defer copyBufPool.Put(bp)
+		buf := *bp
+		r := limitPacketReader(conn, limits.Reverse, fl.done)
+		for {
+			n, err := r.Read(buf)
+			if err != nil {
+				if err = closedIsNil(err); err != nil {
+					slog.Debugf("udp %v: %s", src, formats.Error(err))
+				}
+				return
+			}
+			fl.touch()
+			if _, err := pc.WriteTo(buf[:n], src); err != nil {
+				slog.Debugf("udp %v: %s", src, formats.Error(err))
+				return
+			}
+		}
+	}); err != nil {
+		f.removeFlow(fl)
+		return nil, err
+	}
+	return ps, nil
+}
+
+// sendQueued writes the datagrams queued for ps to conn, throttled by
+// buckets, until the flow ends.
+func (f *packetForwarder) sendQueued(ps *packetSource, conn net.Conn, src net.Addr, buckets []*Bucket) {
+	for {
+		select {
+		case <-ps.done:
+			return
+		case b := <-ps.queue:
+			if len(buckets) > 0 {
+				waitTokens(buckets, len(b), ps.done)
+			}
+			if _, err := conn.Write(b); err != nil {
+				if err = closedIsNil(err); err != nil {
+					slog.Debugf("udp %v: %s", src, formats.Error(err))
+				}
+				ps.close()
+				return
+			}
+		}
+	}
+}
+
+func (f *packetForwarder) Count() int {
+	return int(f.count.Load())
+}
+
+func (f *packetForwarder) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+func (f *packetForwarder) Close() {
+	f.mu.Lock()
+	flows := make([]*flow, 0, len(f.flows))
+	for fl := range f.flows {
+		flows = append(flows, fl)
+	}
+	f.mu.Unlock()
+	for _, fl := range flows {
+		fl.close()
+	}
+}
@@ -0,0 +1,380 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoPackets echoes every datagram read from conn until it fails.
+func echoPackets(conn net.Conn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestPacketForwarderStart(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, time.Minute, g)
+
+	accepted, acceptedPeer := net.Pipe()
+	dialed, dialedPeer := net.Pipe()
+	go echoPackets(dialedPeer)
+
+	var writeClosedCount atomic.Int32
+	closed := make(chan struct{})
+	if err := f.Start(accepted, dialed, HandlerFuncs{
+		WriteClosed: func(net.Conn, error) { writeClosedCount.Add(1) },
+		Closed:      func() { close(closed) },
+	}); err != nil {
+		t.Fatal("Start:", err)
+	}
+	if got := f.Count(); got != 1 {
+		t.Fatalf("Count() = %d, want 1", got)
+	}
+
+	buf := make([]byte, 64)
+	for _, want := range []string{"first", "second datagram"} {
+		if _, err := acceptedPeer.Write([]byte(want)); err != nil {
+			t.Fatal("write:", err)
+		}
+		n, err := acceptedPeer.Read(buf)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("got %q, want %q", buf[:n], want)
+		}
+	}
+
+	// Either side closing ends the whole flow.
+	_ = acceptedPeer.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClosed not called")
+	}
+	if got := writeClosedCount.Load(); got != 2 {
+		t.Fatalf("OnWriteClosed called %d times, want 2", got)
+	}
+	if got := f.Count(); got != 0 {
+		t.Fatalf("Count() = %d after close, want 0", got)
+	}
+}
+
+func TestPacketForwarderIdleTimeout(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, 50*time.Millisecond, g)
+
+	accepted, _ := net.Pipe()
+	dialed, _ := net.Pipe()
+	closed := make(chan struct{})
+	if err := f.Start(accepted, dialed, HandlerFuncs{
+		Closed: func() { close(closed) },
+	}); err != nil {
+		t.Fatal("Start:", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow was not closed")
+	}
+}
+
+func TestPacketForwarderLimit(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(0, time.Minute, g)
+
+	accepted, _ := net.Pipe()
+	dialed, _ := net.Pipe()
+	defer accepted.Close()
+	defer dialed.Close()
+	if err := f.Start(accepted, dialed, nil); !errors.Is(err, ErrConnLimit) {
+		t.Fatalf("Start = %v, want ErrConnLimit", err)
+	}
+	if got := f.Count(); got != 0 {
+		t.Fatalf("Count() = %d, want 0", got)
+	}
+}
+
+func TestPacketForwarderServe(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, 200*time.Millisecond, g)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	dialed := make(map[string]int)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- f.Serve(pc, func(src net.Addr) (net.Conn, Limits, error) {
+			mu.Lock()
+			dialed[src.String()]++
+			mu.Unlock()
+			conn, peer := net.Pipe()
+			go echoPackets(peer)
+			return conn, Limits{}, nil
+		})
+	}()
+
+	clients := make([]net.Conn, 2)
+	for i := range clients {
+		c, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+	buf := make([]byte, 64)
+	for round := 0; round < 2; round++ {
+		for i, c := range clients {
+			want := []byte{byte('a' + i), byte('0' + round)}
+			if _, err := c.Write(want); err != nil {
+				t.Fatal("write:", err)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+			if string(buf[:n]) != string(want) {
+				t.Fatalf("client %d got %q, want %q", i, buf[:n], want)
+			}
+		}
+	}
+	mu.Lock()
+	if len(dialed) != 2 || dialed[clients[0].LocalAddr().String()] != 1 {
+		t.Fatalf("dialed = %v, want one flow per source address", dialed)
+	}
+	mu.Unlock()
+
+	// Idle flows are closed and counted out.
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Count() = %d, want 0 after idle timeout", f.Count())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_ = pc.Close()
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Fatalf("Serve = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after close")
+	}
+}
+
+func TestPacketForwarderServeSlowDial(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, time.Minute, g)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	release := make(chan struct{})
+	go func() {
+		_ = f.Serve(pc, func(src net.Addr) (net.Conn, Limits, error) {
+			if src.String() == slow.LocalAddr().String() {
+				<-release
+			}
+			conn, peer := net.Pipe()
+			go echoPackets(peer)
+			return conn, Limits{}, nil
+		})
+	}()
+
+	// The slow source's dial blocks; its datagrams wait in the queue.
+	for _, b := range []string{"s1", "s2"} {
+		if _, err := slow.Write([]byte(b)); err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+	// Other sources are served meanwhile.
+	buf := make([]byte, 64)
+	if _, err := fast.Write([]byte("f1")); err != nil {
+		t.Fatal("write:", err)
+	}
+	_ = fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := fast.Read(buf); err != nil || string(buf[:n]) != "f1" {
+		t.Fatalf("fast read = %q, %v, want %q", buf[:n], err, "f1")
+	}
+
+	close(release)
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"s1", "s2"} {
+		n, err := slow.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("slow read = %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestPacketForwarderStartLimited(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, time.Minute, g)
+	accepted, acceptedPeer := net.Pipe()
+	dialed, dialedPeer := net.Pipe()
+	t.Cleanup(func() {
+		_ = acceptedPeer.Close()
+		_ = dialedPeer.Close()
+	})
+
+	// Datagrams larger than the burst pass whole.
+	rate := NewRate(16*1024, 1024)
+	limits := Limits{Forward: []*Bucket{NewBucket(rate), nil}}
+	if err := f.StartLimited(accepted, dialed, nil, limits); err != nil {
+		t.Fatal("StartLimited:", err)
+	}
+	want := make([]byte, 4*1024)
+	start := time.Now()
+	go func() {
+		for range 2 {
+			if _, err := acceptedPeer.Write(want); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxDatagramSize)
+	_ = dialedPeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for range 2 {
+		n, err := dialedPeer.Read(buf)
+		if err != nil {
+			t.Fatal("read from dialedPeer:", err)
+		}
+		if n != len(want) {
+			t.Fatalf("read %d bytes, want a whole datagram of %d", n, len(want))
+		}
+	}
+	// 8 KiB at 16 KiB/s with 1 KiB available at once takes at least 375ms.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("forwarded 2 datagrams in %v, want throttling", elapsed)
+	}
+	if stats := rate.Stats(); stats.Delayed == 0 || stats.Wait <= 0 {
+		t.Fatalf("rate stats = %+v, want delayed bytes", stats)
+	}
+}
+
+func TestPacketForwarderServeLimited(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, time.Minute, g)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	rate := NewRate(8*1024, 1024)
+	go func() {
+		_ = f.Serve(pc, func(net.Addr) (net.Conn, Limits, error) {
+			conn, peer := net.Pipe()
+			go echoPackets(peer)
+			return conn, Limits{Reverse: []*Bucket{NewBucket(rate)}}, nil
+		})
+	}()
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := make([]byte, 1024)
+	buf := make([]byte, maxDatagramSize)
+	start := time.Now()
+	for range 4 {
+		if _, err := c.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(buf); err != nil || n != len(want) {
+			t.Fatalf("read %d bytes, %v, want %d", n, err, len(want))
+		}
+	}
+	// Replies after the first 1 KiB wait for 3 KiB at 8 KiB/s.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("echoed 4 datagrams in %v, want replies throttled", elapsed)
+	}
+}
+
+func TestPacketForwarderServeDropped(t *testing.T) {
+	g := newTestGroup(t)
+	f := NewPacket(10, time.Minute, g)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	rate := NewRate(100, 100)
+	go func() {
+		_ = f.Serve(pc, func(net.Addr) (net.Conn, Limits, error) {
+			conn, peer := net.Pipe()
+			go echoPackets(peer)
+			return conn, Limits{Forward: []*Bucket{NewBucket(rate)}}, nil
+		})
+	}()
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The first datagram empties the bucket; the rest wait in the queue,
+	// and those beyond it are dropped.
+	want := make([]byte, 100)
+	if _, err := c.Write(want); err != nil {
+		t.Fatal("write:", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, maxDatagramSize)); err != nil {
+		t.Fatal("read:", err)
+	}
+	for range 2 * sourceQueue {
+		if _, err := c.Write(want); err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Dropped() == 0 || f.Dropped() != rate.Stats().Dropped {
+		if time.Now().After(deadline) {
+			t.Fatalf("Dropped() = %d, rate Dropped = %d; want the same nonzero count",
+				f.Dropped(), rate.Stats().Dropped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := f.Dropped(); n%uint64(len(want)) != 0 {
+		t.Fatalf("Dropped() = %d, want whole datagrams", n)
+	}
+}
@@ -0,0 +1,214 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package forwarder
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate is an adjustable token bucket rate shared by one or more Buckets.
+// Changes apply to copies already in progress. It also counts how much the
+// copies throttled by its buckets were held back.
+type Rate struct {
+	bytesPerSec atomic.Int64
+	burst       atomic.Int64
+
+	waiting atomic.Int32
+	delayed atomic.Uint64
+	wait    atomic.Int64 // nanoseconds
+	dropped atomic.Uint64
+}
+
+// NewRate returns a Rate of bytesPerSec (0 = unlimited) refilling a bucket of
+// burst bytes (0 = one second of the rate).
+func NewRate(bytesPerSec, burst int64) *Rate {
+	r := &Rate{}
+	r.Set(bytesPerSec, burst)
+	return r
+}
+
+// Set changes the rate; see NewRate.
+func (r *Rate) Set(bytesPerSec, burst int64) {
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	r.bytesPerSec.Store(max(bytesPerSec, 0))
+	r.burst.Store(burst)
+}
+
+// Limit returns the current rate and bucket size; a zero rate is unlimited.
+func (r *Rate) Limit() (bytesPerSec, burst int64) {
+	return r.bytesPerSec.Load(), r.burst.Load()
+}
+
+// RateStats is a snapshot of a Rate.
+type RateStats struct {
+	BytesPerSec int64
+	Burst       int64
+	Waiting     int           // copies currently waiting for tokens
+	Delayed     uint64        // bytes that had to wait for tokens
+	Wait        time.Duration // total time copies spent waiting
+	Dropped     uint64        // datagram bytes dropped while flows waited
+}
+
+// Stats snapshots the rate and its counters.
+func (r *Rate) Stats() RateStats {
+	bytesPerSec, burst := r.Limit()
+	return RateStats{
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+		Waiting:     int(r.waiting.Load()),
+		Delayed:     r.delayed.Load(),
+		Wait:        time.Duration(r.wait.Load()),
+		Dropped:     r.dropped.Load(),
+	}
+}
+
+// Bucket is a token bucket refilled at its Rate. It may go into debt: a copy
+// that takes more tokens than are left waits until the debt is paid back, so
+// concurrent copies through one bucket share its rate.
+type Bucket struct {
+	rate *Rate
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket refilled at rate.
+func NewBucket(rate *Rate) *Bucket {
+	_, burst := rate.Limit()
+	return &Bucket{rate: rate, tokens: float64(burst), last: time.Now()}
+}
+
+// Rate returns the rate that refills b.
+func (b *Bucket) Rate() *Rate {
+	return b.rate
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// using them.
+func (b *Bucket) reserve(n int, now time.Time) time.Duration {
+	bytesPerSec, burst := b.rate.Limit()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bytesPerSec <= 0 {
+		b.tokens, b.last = float64(burst), now
+		return 0
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * float64(bytesPerSec)
+		b.last = now
+	}
+	b.tokens = min(b.tokens, float64(burst)) - float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(bytesPerSec) * float64(time.Second))
+}
+
+// chunk returns the largest read that b lets through at once.
+func (b *Bucket) chunk() int64 {
+	bytesPerSec, burst := b.rate.Limit()
+	if bytesPerSec <= 0 {
+		return 0
+	}
+	return max(burst, 1)
+}
+
+// Limits throttles a forwarded pair. Forward applies to data copied from the
+// accepted conn to the dialed one, Reverse to data copied back. Nil buckets
+// are ignored.
+type Limits struct {
+	Forward []*Bucket
+	Reverse []*Bucket
+}
+
+// limitedReader delays each read from r until every bucket has the tokens for
+// it, reading no more than the smallest bucket holds. A packet reader returns
+// whole datagrams instead, which may leave the buckets in debt.
+type limitedReader struct {
+	r       io.Reader
+	buckets []*Bucket
+	done    <-chan struct{}
+	packet  bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if !l.packet {
+		for _, b := range l.buckets {
+			if size := b.chunk(); size > 0 && int64(len(p)) > size {
+				p = p[:size]
+			}
+		}
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		waitTokens(l.buckets, n, l.done)
+	}
+	return n, err
+}
+
+// waitTokens blocks until n bytes may pass every bucket or done is closed.
+func waitTokens(buckets []*Bucket, n int, done <-chan struct{}) {
+	now := time.Now()
+	var d time.Duration
+	var throttled []*Rate
+	for _, b := range buckets {
+		if wait := b.reserve(n, now); wait > 0 {
+			d = max(d, wait)
+			throttled = append(throttled, b.rate)
+		}
+	}
+	if d <= 0 {
+		return
+	}
+	for _, r := range throttled {
+		r.waiting.Add(1)
+		r.delayed.Add(uint64(n))
+	}
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+	case <-done:
+		timer.Stop()
+	}
+	waited := time.Since(now)
+	for _, r := range throttled {
+		r.waiting.Add(-1)
+		r.wait.Add(int64(waited))
+	}
+}
+
+// activeBuckets returns the non-nil buckets.
+func activeBuckets(buckets []*Bucket) []*Bucket {
+	var active []*Bucket
+	for _, b := range buckets {
+		if b != nil {
+			active = append(active, b)
+		}
+	}
+	return active
+}
+
+// limitReader returns r throttled by buckets, or r itself without any.
+func limitReader(r io.Reader, buckets []*Bucket, done <-chan struct{}) io.Reader {
+	active := activeBuckets(buckets)
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReader{r: r, buckets: active, done: done}
+}
+
+// limitPacketReader is like limitReader for r returning one datagram per Read.
+func limitPacketReader(r io.Reader, buckets []*Bucket, done <-chan struct{}) io.Reader {
+	active := activeBuckets(buckets)
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReader{r: r, buckets: active, done: done, packet: true}
+}
@@ -0,0 +1,124 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	rate := NewRate(1000, 0)
+	if bytesPerSec, burst := rate.Limit(); bytesPerSec != 1000 || burst != 1000 {
+		t.Fatalf("Limit() = %d, %d; want the burst to default to one second", bytesPerSec, burst)
+	}
+	b := NewBucket(rate)
+	now := b.last
+	if d := b.reserve(1000, now); d != 0 {
+		t.Fatalf("reserve(burst) = %v, want no wait from a full bucket", d)
+	}
+	if d := b.reserve(500, now); d != 500*time.Millisecond {
+		t.Fatalf("reserve(500) = %v, want 500ms", d)
+	}
+	// The debt is paid back before new tokens accrue.
+	if d := b.reserve(500, now.Add(time.Second)); d != 0 {
+		t.Fatalf("reserve(500) after 1s = %v, want no wait", d)
+	}
+	// Idle time refills no more than the burst.
+	now = now.Add(time.Hour)
+	if d := b.reserve(1500, now); d != 500*time.Millisecond {
+		t.Fatalf("reserve(1500) after an hour = %v, want 500ms", d)
+	}
+
+	rate.Set(0, 0)
+	if d := b.reserve(1<<20, now); d != 0 || b.chunk() != 0 {
+		t.Fatalf("reserve() = %v with chunk %d, want an unlimited rate", d, b.chunk())
+	}
+	// The unlimited rate left a bucket of zero bytes.
+	rate.Set(100, 10)
+	if d := b.reserve(20, now); d != 200*time.Millisecond || b.chunk() != 10 {
+		t.Fatalf("reserve(20) = %v with chunk %d after Set, want 200ms and 10", d, b.chunk())
+	}
+}
+
+func TestForwarderStartLimited(t *testing.T) {
+	g := newTestGroup(t)
+	f := New(10, g)
+	accepted, acceptedPeer := net.Pipe()
+	dialed, dialedPeer := net.Pipe()
+	t.Cleanup(func() {
+		_ = acceptedPeer.Close()
+		_ = dialedPeer.Close()
+	})
+
+	rate := NewRate(64*1024, 8*1024)
+	limits := Limits{Forward: []*Bucket{NewBucket(rate), nil}}
+	if err := f.StartLimited(accepted, dialed, nil, limits); err != nil {
+		t.Fatal("StartLimited:", err)
+	}
+	want := bytes.Repeat([]byte("0123456789abcdef"), 2*1024)
+	start := time.Now()
+	go func() { _, _ = acceptedPeer.Write(want) }()
+	got := make([]byte, len(want))
+	_ = dialedPeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(dialedPeer, got); err != nil {
+		t.Fatal("read from dialedPeer:", err)
+	}
+	// 32 KiB at 64 KiB/s with 8 KiB available at once takes at least 375ms.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("forwarded %d bytes in %v, want throttling", len(want), elapsed)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("forwarded data mismatch")
+	}
+	stats := rate.Stats()
+	if stats.Delayed == 0 || stats.Wait <= 0 || stats.Waiting != 0 {
+		t.Fatalf("rate stats = %+v, want delayed bytes and no waiters", stats)
+	}
+
+	// The reverse direction is not throttled.
+	go func() { _, _ = dialedPeer.Write(want) }()
+	start = time.Now()
+	_ = acceptedPeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(acceptedPeer, got); err != nil {
+		t.Fatal("read from acceptedPeer:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("reverse direction took %v, want it unthrottled", elapsed)
+	}
+}
+
+func TestLimitedReaderDone(t *testing.T) {
+	rate := NewRate(1, 1)
+	b := NewBucket(rate)
+	b.reserve(1, time.Now()) // empty the bucket
+	done := make(chan struct{})
+	r := limitReader(bytes.NewReader([]byte("xy")), []*Bucket{b}, done)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 2))
+		errc <- err
+	}()
+	waitForWaiting := time.Now().Add(5 * time.Second)
+	for rate.Stats().Waiting == 0 && time.Now().Before(waitForWaiting) {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still waiting for tokens after done was closed")
+	}
+	if r := limitReader(bytes.NewReader(nil), []*Bucket{nil}, nil); r == nil {
+		t.Fatal("limitReader returned nil")
+	} else if _, ok := r.(*limitedReader); ok {
+		t.Fatal("limitReader without buckets wrapped the reader")
+	}
+}
@@ -5,11 +5,16 @@ package tlswrapper
 
 import (
 	"context"
+	"crypto/x509"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/routines"
 	"github.com/hexian000/gosnippets/slog"
 	"github.com/hexian000/tlswrapper/v4/forwarder"
+	"github.com/hexian000/tlswrapper/v4/mux"
 )
 
 // Handler serves one accepted connection.
@@ -18,19 +23,71 @@ type Handler interface {
 }
 
 // LocalHandler forwards accepted local connections over a matching mux session.
+// id is the listener name (see config.File.ListenTarget), which selects both
+// the peer and the remote service. In proxySOCKS5 mode, id is the peer identity
+// and each connection requests its destination with a SOCKS5 CONNECT;
+// otherwise cfg.ListenProxy may select HTTP CONNECT in the same way.
 type LocalHandler struct {
-	l  net.Listener
-	s  *Server
-	id string
+	l    net.Listener
+	s    *Server
+	id   string
+	addr string // configured listen address, for config.Bandwidth.Listeners
+	mode proxyMode
 }
 
 func (h *LocalHandler) Serve(ctx context.Context, accepted net.Conn) {
 	cfg, _ := h.s.getConfig()
-	setTCPConnParams(cfg.TCP, accepted)
-	t := h.s.findSession(h.id)
+	raw := accepted
+	if cfg.AcceptProxy.Listen {
+		conn, err := acceptProxyHeader(cfg, accepted, time.Now().Add(cfg.ConnectTimeout()))
+		if err != nil {
+			slog.Warningf("listen: %s", formats.Error(err))
+			ioClose(accepted)
+			return
+		}
+		if !h.s.proxiedSourceAllowed(aclListen, h.addr, conn) {
+			ioClose(conn)
+			return
+		}
+		accepted = conn
+	}
+	setTCPConnParams(cfg.TCP, raw)
+	mode := h.mode
+	var peer string
+	var hdr mux.StreamHeader
+	switch {
+	case mode == proxySOCKS5:
+		peer = h.id
+	case cfg.ListenProxy == "http":
+		mode = proxyHTTP
+		// The destination comes with each request; a service in the
+		// listener name does not apply.
+		peer, _ = cfg.ListenTarget(h.id)
+	default:
+		peer, hdr.Service = cfg.ListenTarget(h.id)
+	}
+	hdr.Source = accepted.RemoteAddr().String()
+	if mode != proxyNone {
+		_ = accepted.SetDeadline(time.Now().Add(cfg.ConnectTimeout()))
+		dest, conn, err := readProxyRequest(mode, accepted)
+		if err != nil {
+			slog.Debugf("proxy %v: %s", accepted.RemoteAddr(), formats.Error(err))
+			ioClose(accepted)
+			return
+		}
+		_ = accepted.SetDeadline(time.Time{})
+		accepted, hdr.Destination = conn, dest
+	}
+	// A routed peer is reached by asking the next hop to relay the stream.
+	next := cfg.NextHop(peer)
+	if next != peer {
+		hdr.Relay = peer
+	}
+	t := h.s.findSession(next)
 	if t == nil {
-		tunnelTag := formatTunnelTag(true, cfg.Identity.Claim, "", h.id, accepted.LocalAddr(), nil, accepted)
+		tunnelTag := formatTunnelTag(true, cfg.Identity.Claim, "", peer, accepted.LocalAddr(), nil, accepted)
 		slog.Warningf("%s: no active session", tunnelTag)
+		_ = writeProxyReply(mode, accepted, ErrNoSession)
 		ioClose(accepted)
 		return
 	}
@@ -39,14 +96,49 @@ func (h *LocalHandler) Serve(ctx context.Context, accepted net.Conn) {
 	if sess := t.getSession(); sess != nil {
 		peerIdentity = sess.PeerIdentity()
 	}
-	dialed, err := t.OpenStream(ctx)
+	// A relayed stream is checked against its final peer, whose certificate
+	// is not known here.
+	policyIdentity, leaf := peer, (*x509.Certificate)(nil)
+	if hdr.Relay == "" && peerIdentity != "" {
+		policyIdentity, leaf = peerIdentity, peerLeaf(t)
+	}
+	if policy := cfg.PeerPolicy(policyIdentity, leaf); !policy.Receive {
+		h.s.policyDenied(tunnelTag, false, fmt.Sprintf("%q may not receive streams", policyIdentity))
+		_ = writeProxyReply(mode, accepted, ErrDestinationDenied)
+		ioClose(accepted)
+		return
+	}
+	if h.s.quotaRejects(tunnelTag, peerIdentity) {
+		_ = writeProxyReply(mode, accepted, ErrQuotaExceeded)
+		ioClose(accepted)
+		return
+	}
+	dialed, err := t.OpenStream(ctx, hdr)
 	if err != nil {
 		slog.Errorf("%s: %s", tunnelTag, formats.Error(err))
+		_ = writeProxyReply(mode, accepted, err)
 		ioClose(accepted)
 		return
 	}
-	tag := formatStreamTag(true, cfg.Identity.Claim, peerIdentity, h.id, accepted.LocalAddr(), dialed.RemoteAddr(), dialed)
-	if err := h.s.f.Start(accepted, dialed, forwarder.HandlerFuncs{
+	dialed = h.s.meterStream(peerIdentity, dialed)
+	tag := formatStreamTag(true, cfg.Identity.Claim, peerIdentity, peer, accepted.LocalAddr(), dialed.RemoteAddr(), dialed)
+	if hdr.Destination != "" {
+		err := readDestinationStatus(dialed, cfg.ConnectTimeout())
+		if err != nil {
+			slog.Debugf("%s: destination %q: %s", tag, hdr.Destination, formats.Error(err))
+		}
+		if replyErr := writeProxyReply(mode, accepted, err); err == nil && replyErr != nil {
+			slog.Debugf("%s: proxy reply: %s", tag, formats.Error(replyErr))
+			err = replyErr
+		}
+		if err != nil {
+			ioClose(accepted)
+			ioClose(dialed)
+			return
+		}
+	}
+	limits := h.s.streamLimits(peerIdentity, h.addr)
+	if err := h.s.f.StartLimited(accepted, dialed, forwarder.HandlerFuncs{
 		WriteClosed: func(conn net.Conn, err error) {
 			if err != nil {
 				slog.Debugf("%s: half-close %v: %s", tag, conn.RemoteAddr(), formats.Error(err))
@@ -57,13 +149,76 @@ func (h *LocalHandler) Serve(ctx context.Context, accepted net.Conn) {
 		Closed: func() {
 			slog.Debugf("%s: forward finished", tag)
 		},
-	}); err != nil {
+	}, forwarder.Limits{Forward: limits.send, Reverse: limits.receive}); err != nil {
 		slog.Errorf("%s: %s", tag, formats.Error(err))
 		ioClose(accepted)
 		ioClose(dialed)
 		return
 	}
-	slog.Debugf("%s: forward established", tag)
+	switch {
+	case hdr.Destination != "":
+		slog.Debugf("%s: forward established (destination: %q)", tag, hdr.Destination)
+	case hdr.Service != "":
+		slog.Debugf("%s: forward established (service: %q)", tag, hdr.Service)
+	default:
+		slog.Debugf("%s: forward established", tag)
+	}
+}
+
+// LocalPacketHandler relays datagrams received on a local UDP socket over a
+// matching mux session, one datagram flow per source address. id is the peer
+// identity ("" = the top-level tunnel) and addr the configured listen address.
+type LocalPacketHandler struct {
+	s    *Server
+	id   string
+	addr string
+}
+
+// Serve relays datagrams read from pc until pc is closed.
+func (h *LocalPacketHandler) Serve(pc net.PacketConn) error {
+	return h.s.pf.Serve(pc, h.dial)
+}
+
+// dial opens the datagram flow for src, metered against the peer's quota and
+// throttled by its bandwidth limits. Sources refused by the source rules of
+// the listener get no flow.
+func (h *LocalPacketHandler) dial(src net.Addr) (net.Conn, forwarder.Limits, error) {
+	if !h.s.sourceAllowed(aclListen, h.addr, src) {
+		return nil, forwarder.Limits{}, ErrSourceRefused
+	}
+	cfg, _ := h.s.getConfig()
+	t := h.s.findSession(h.id)
+	if t == nil {
+		return nil, forwarder.Limits{}, ErrNoSession
+	}
+	peerIdentity := ""
+	if sess := t.getSession(); sess != nil {
+		peerIdentity = sess.PeerIdentity()
+	}
+	policyIdentity, leaf := h.id, (*x509.Certificate)(nil)
+	if peerIdentity != "" {
+		policyIdentity, leaf = peerIdentity, peerLeaf(t)
+	}
+	if policy := cfg.PeerPolicy(policyIdentity, leaf); !policy.Receive {
+		h.s.policyDenied(t.tagValue(), false, fmt.Sprintf("%q may not receive flows", policyIdentity))
+		return nil, forwarder.Limits{}, ErrDestinationDenied
+	}
+	if h.s.quotaRejects(t.tagValue(), peerIdentity) {
+		return nil, forwarder.Limits{}, ErrQuotaExceeded
+	}
+	ctx := h.s.ctx.withTimeout()
+	if ctx == nil {
+		return nil, forwarder.Limits{}, routines.ErrClosed
+	}
+	defer h.s.ctx.cancel(ctx)
+	flow, err := t.OpenPacket(ctx, mux.StreamHeader{})
+	if err != nil {
+		return nil, forwarder.Limits{}, err
+	}
+	tag := formatStreamTag(true, cfg.Identity.Claim, peerIdentity, h.id, flow.LocalAddr(), flow.RemoteAddr(), flow)
+	slog.Debugf("%s: udp flow established (source: %v)", tag, src)
+	limits := h.s.streamLimits(peerIdentity, h.addr)
+	return h.s.meterStream(peerIdentity, flow), forwarder.Limits{Forward: limits.send, Reverse: limits.receive}, nil
 }
 
 // EmptyHandler closes every accepted connection.
@@ -74,20 +229,45 @@ func (h *EmptyHandler) Serve(_ context.Context, accepted net.Conn) {
 }
 
 // identityListener owns a named local listener that routes inbound TCP
-// connections to the mux session identified by id.
+// connections to the mux session identified by id, speaking mode to its
+// clients (see LocalHandler).
 type identityListener struct {
 	id   string
 	addr string // configured listen address; compared on config reload
 	l    net.Listener
+	mode proxyMode
 }
 
 // start launches the accept loop for il in s's goroutine group.
 func (il *identityListener) start(s *Server) error {
-	h := &LocalHandler{s: s, id: il.id}
-	return s.g.Go(func() { s.Serve(il.l, h) })
+	h := &LocalHandler{s: s, id: il.id, addr: il.addr, mode: il.mode}
+	return s.g.Go(func() { s.Serve(s.filterSources(il.l, aclListen, il.addr), h) })
 }
 
 // stop closes the listener.
 func (il *identityListener) stop() {
 	ioClose(il.l)
 }
+
+// udpListener owns a local UDP socket whose datagrams are relayed to the mux
+// session identified by id.
+type udpListener struct {
+	id   string
+	addr string // configured listen address; compared on config reload
+	pc   net.PacketConn
+}
+
+// start launches the relay loop for ul in s's goroutine group.
+func (ul *udpListener) start(s *Server) error {
+	h := &LocalPacketHandler{s: s, id: ul.id, addr: ul.addr}
+	return s.g.Go(func() {
+		if err := h.Serve(ul.pc); err != nil {
+			slog.Errorf("udp listen %s: %s", ul.addr, formats.Error(err))
+		}
+	})
+}
+
+// stop closes the socket.
+func (ul *udpListener) stop() {
+	ioClose(ul.pc)
+}
@@ -4,11 +4,14 @@
 package h2mux
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"math"
 	"net"
 	"time"
 
+	"github.com/hexian000/tlswrapper/v4/mux/psk"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
@@ -26,6 +29,12 @@ type Config struct {
 	// TLSConfigProvider, when non-nil, is called on each Dial/AcceptSession to
 	// obtain the current TLS config. Takes precedence over TLSConfig.
 	TLSConfigProvider func() *tls.Config
+	// PSKConfig, when non-nil and no TLS config is set, secures the raw
+	// connection with a pre-shared key handshake instead.
+	PSKConfig *psk.Config
+	// PSKConfigProvider, when non-nil, is called on each Dial/AcceptSession to
+	// obtain the current PSK config. Takes precedence over PSKConfig.
+	PSKConfigProvider func() *psk.Config
 	// ServerName is the TLS SNI to send on outbound (client) handshakes.
 	// Empty leaves the resolved TLS config's ServerName untouched.
 	ServerName string
@@ -34,6 +43,10 @@ type Config struct {
 	ALPN string
 	// RejectInbound is advertised in the hello: the peer should not Open() streams to us.
 	RejectInbound bool
+	// VerifyPeerIdentity, when non-nil, is called during the mux handshake with
+	// the peer's identity claim and its verified certificate chain (nil in
+	// plaintext mode). A non-nil error rejects the session.
+	VerifyPeerIdentity func(identity string, peerCerts []*x509.Certificate) error
 
 	// Dialer is used by H2Mux.Dial to establish outbound TCP connections.
 	// The zero value (net.Dialer{}) uses the system default.
@@ -42,6 +55,11 @@ type Config struct {
 	// immediately after the TCP connection is established and before the mux
 	// handshake.  Use it to apply socket options such as TCP_NODELAY.
 	ConnSetup func(net.Conn)
+	// ConnPreface, when non-nil, is called on each accepted net.Conn at the
+	// start of the server-side handshake, before TLS. It may consume a preface
+	// such as a PROXY protocol header and returns the conn to use in its
+	// place; a non-nil error rejects the session.
+	ConnPreface func(ctx context.Context, conn net.Conn) (net.Conn, error)
 
 	// Client-side transport tuning.
 	KeepAlive     time.Duration // default 25s
@@ -68,6 +86,31 @@ func (c *Config) tlsConfig() *tls.Config {
 	return c.TLSConfig
 }
 
+// pskConfig resolves the PSK config to use for a single connection.
+// PSKConfigProvider takes precedence over PSKConfig.
+func (c *Config) pskConfig() *psk.Config {
+	if c.PSKConfigProvider != nil {
+		return c.PSKConfigProvider()
+	}
+	return c.PSKConfig
+}
+
+// identityVerifier returns the handshake hook that passes the peer's identity
+// claim and the certificates presented on tlsConn to VerifyPeerIdentity.
+// tlsConn is nil in plaintext mode. Returns nil when no verifier is set.
+func (c *Config) identityVerifier(tlsConn *tls.Conn) func(string) error {
+	if c.VerifyPeerIdentity == nil {
+		return nil
+	}
+	return func(identity string) error {
+		var certs []*x509.Certificate
+		if tlsConn != nil {
+			certs = tlsConn.ConnectionState().PeerCertificates
+		}
+		return c.VerifyPeerIdentity(identity, certs)
+	}
+}
+
 // alpn returns the ALPN identifier to advertise, applying defaultH2ALPN when
 // Config.ALPN is empty.
 func (c *Config) alpn() string {
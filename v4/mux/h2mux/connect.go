@@ -6,6 +6,7 @@ package h2mux
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"sync"
@@ -17,6 +18,7 @@ import (
 
 	mux "github.com/hexian000/tlswrapper/v4/mux"
 	muxpb "github.com/hexian000/tlswrapper/v4/mux/h2mux/proto"
+	"github.com/hexian000/tlswrapper/v4/mux/psk"
 )
 
 // compile-time check that H2Mux implements mux.Dialer.
@@ -82,8 +84,9 @@ type h2InboundSession struct {
 	handshakeErr  error
 }
 
-// compile-time check that h2InboundSession implements mux.Session.
+// compile-time checks that h2InboundSession implements mux.Session and mux.TLSSession.
 var _ mux.Session = (*h2InboundSession)(nil)
+var _ mux.TLSSession = (*h2InboundSession)(nil)
 
 // doHandshake performs the h2mux server-side handshake exactly once.
 // The mutex is held for the entire handshake duration, matching crypto/tls.Conn.
@@ -96,7 +99,19 @@ func (s *h2InboundSession) doHandshake(ctx context.Context) error {
 	if s.handshakeDone.Load() {
 		return s.handshakeErr
 	}
-	ss, err := Server(ctx, s.conn, s.cfg)
+	// s.conn stays the accepted conn so that a concurrent Close reaches it.
+	conn := s.conn
+	if s.cfg.ConnPreface != nil {
+		var err error
+		conn, err = s.cfg.ConnPreface(ctx, s.conn)
+		if err != nil {
+			_ = s.conn.Close()
+			s.handshakeErr = err
+			s.handshakeDone.Store(true)
+			return err
+		}
+	}
+	ss, err := Server(ctx, conn, s.cfg)
 	if err != nil {
 		_ = s.conn.Close()
 		s.handshakeErr = err
@@ -120,12 +135,12 @@ func (s *h2InboundSession) delegate() (mux.Session, error) {
 	return s.ss, nil // safe: ss is stored before handshakeDone is set
 }
 
-func (s *h2InboundSession) Open(ctx context.Context) (net.Conn, error) {
+func (s *h2InboundSession) Open(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
 	ss, err := s.delegate()
 	if err != nil {
 		return nil, err
 	}
-	return ss.Open(ctx)
+	return ss.Open(ctx, hdr)
 }
 
 func (s *h2InboundSession) Accept() (net.Conn, error) {
@@ -181,6 +196,14 @@ func (s *h2InboundSession) PeerIdentity() string {
 	return ""
 }
 
+// PeerCertificates implements mux.TLSSession.
+func (s *h2InboundSession) PeerCertificates() []*x509.Certificate {
+	if s.handshakeDone.Load() && s.ss != nil {
+		return mux.PeerCertificatesOf(s.ss)
+	}
+	return nil
+}
+
 func (s *h2InboundSession) LocalAddr() net.Addr {
 	if s.handshakeDone.Load() && s.ss != nil {
 		return s.ss.LocalAddr()
@@ -242,8 +265,9 @@ func (l *oneConnListener) Close() error {
 
 func (l *oneConnListener) Addr() net.Addr { return l.addr }
 
-// Client performs the TLS handshake (if cfg.TLSConfig is non-nil) and the mux
-// protocol handshake over conn, returning a client-mode Session on success.
+// Client performs the TLS handshake (if cfg.TLSConfig is non-nil) or else the
+// PSK handshake (if cfg.PSKConfig is non-nil) and the mux protocol handshake
+// over conn, returning a client-mode Session on success.
 func Client(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error) {
 	if deadline, ok := ctx.Deadline(); ok {
 		if err := conn.SetDeadline(deadline); err != nil {
@@ -251,9 +275,17 @@ func Client(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 		}
 	}
 
+	var tlsConn *tls.Conn
 	tlscfg := cfg.appliedTLSConfig()
 	if tlscfg != nil {
-		conn = tls.Client(conn, tlscfg)
+		tlsConn = tls.Client(conn, tlscfg)
+		conn = tlsConn
+	} else if pskcfg := cfg.pskConfig(); pskcfg != nil {
+		pskConn, err := psk.Client(conn, pskcfg)
+		if err != nil {
+			return nil, err
+		}
+		conn = pskConn
 	}
 	if cfg.WriteTimeout > 0 {
 		conn = &writeTimeoutConn{Conn: conn, timeout: cfg.WriteTimeout}
@@ -298,8 +330,9 @@ func Client(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 		err                error
 	}
 	hsCh := make(chan hsResult, 1)
+	verify := cfg.identityVerifier(tlsConn)
 	go func() {
-		peerIdentity, peerRejectsInbound, err := doClientHandshake(ctrlStream, cfg.LocalID, cfg.RejectInbound)
+		peerIdentity, peerRejectsInbound, err := doClientHandshake(ctrlStream, cfg.LocalID, cfg.RejectInbound, verify)
 		hsCh <- hsResult{peerIdentity, peerRejectsInbound, err}
 	}()
 
@@ -325,7 +358,7 @@ func Client(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 		_ = cc.Close()
 	}
 
-	return newClientSession(
+	sess := newClientSession(
 		ctrlStream,
 		grpcClient,
 		sessionCtx,
@@ -336,7 +369,9 @@ func Client(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 		peerRejectsInbound,
 		&sh.metrics,
 		sh.idleNotify,
-	), nil
+	)
+	sess.setPeerCertificates(tlsConn)
+	return sess, nil
 }
 
 // muxServer is the gRPC server-side implementation for one mux session.
@@ -346,9 +381,14 @@ type muxServer struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 	sh         *muxStatsHandler
+	// verify checks the peer's identity claim during the handshake; nil
+	// accepts any claim.
+	verify func(string) error
 
 	// ready delivers the serverSession to Server() after the handshake succeeds.
 	ready chan *serverSession
+	// failed delivers the handshake error to Server() when the handshake fails.
+	failed chan error
 
 	// sess is set by Control() after handshake; Stream() handlers wait on sessReady.
 	mu          sync.RWMutex
@@ -364,6 +404,7 @@ func newMuxServer(cfg *Config, localAddr, remoteAddr net.Addr, sh *muxStatsHandl
 		remoteAddr: remoteAddr,
 		sh:         sh,
 		ready:      make(chan *serverSession, 1),
+		failed:     make(chan error, 1),
 		sessReady:  make(chan struct{}),
 	}
 }
@@ -380,8 +421,9 @@ func (svc *muxServer) Control(stream muxpb.Mux_ControlServer) error {
 	}
 	svc.ctrlStarted = true
 	svc.mu.Unlock()
-	peerIdentity, peerRejectsInbound, err := doServerHandshake(stream, svc.cfg.LocalID, svc.cfg.RejectInbound)
+	peerIdentity, peerRejectsInbound, err := doServerHandshake(stream, svc.cfg.LocalID, svc.cfg.RejectInbound, svc.verify)
 	if err != nil {
+		svc.failed <- err
 		return err
 	}
 
@@ -426,15 +468,18 @@ func (svc *muxServer) Stream(stream muxpb.Mux_StreamServer) error {
 	svc.mu.RUnlock()
 
 	var requestID string
+	var hdr mux.StreamHeader
 	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
 		if vals := md.Get(metaRequestIDKey); len(vals) > 0 {
 			requestID = vals[0]
 		}
+		hdr = headerFromMD(md)
 	}
 
 	conn := newServerSideStream(stream, svc.localAddr, svc.remoteAddr, nil, func() {
 		_ = sess.Close()
 	})
+	conn.header = hdr
 	sess.DeliverStream(requestID, conn)
 
 	// Keep the handler alive until Close() is called on conn (or context is done).
@@ -445,9 +490,9 @@ func (svc *muxServer) Stream(stream muxpb.Mux_StreamServer) error {
 	return nil
 }
 
-// Server performs the TLS handshake (if cfg.TLSConfig is non-nil) and waits for
-// the mux protocol handshake from the client, returning a server-mode Session
-// on success.
+// Server performs the TLS handshake (if cfg.TLSConfig is non-nil) or else the
+// PSK handshake (if cfg.PSKConfig is non-nil) and waits for the mux protocol
+// handshake from the client, returning a server-mode Session on success.
 func Server(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error) {
 	if deadline, ok := ctx.Deadline(); ok {
 		if err := conn.SetDeadline(deadline); err != nil {
@@ -455,9 +500,17 @@ func Server(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 		}
 	}
 
+	var tlsConn *tls.Conn
 	tlscfg := cfg.appliedTLSConfig()
 	if tlscfg != nil {
-		conn = tls.Server(conn, tlscfg)
+		tlsConn = tls.Server(conn, tlscfg)
+		conn = tlsConn
+	} else if pskcfg := cfg.pskConfig(); pskcfg != nil {
+		pskConn, err := psk.Server(conn, pskcfg)
+		if err != nil {
+			return nil, err
+		}
+		conn = pskConn
 	}
 	if cfg.WriteTimeout > 0 {
 		conn = &writeTimeoutConn{Conn: conn, timeout: cfg.WriteTimeout}
@@ -465,6 +518,7 @@ func Server(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 
 	sh := newMuxStatsHandler()
 	svc := newMuxServer(cfg, conn.LocalAddr(), conn.RemoteAddr(), sh)
+	svc.verify = cfg.identityVerifier(tlsConn)
 	grpcSrv := grpc.NewServer(append(cfg.grpcServerOptions(), grpc.StatsHandler(sh))...)
 	muxpb.RegisterMuxServer(grpcSrv, svc)
 
@@ -479,8 +533,12 @@ func Server(ctx context.Context, conn net.Conn, cfg *Config) (mux.Session, error
 	case sess := <-svc.ready:
 		// Wire up cleanup: stopping the gRPC server closes all streams.
 		sess.cleanup = func() { grpcSrv.Stop() }
+		sess.setPeerCertificates(tlsConn)
 		_ = conn.SetDeadline(time.Time{})
 		return sess, nil
+	case err := <-svc.failed:
+		grpcSrv.Stop()
+		return nil, fmt.Errorf("mux: handshake: %w", err)
 	case <-ctx.Done():
 		grpcSrv.Stop()
 		select {
@@ -4,6 +4,7 @@
 package h2mux
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	mux "github.com/hexian000/tlswrapper/v4/mux"
+	"github.com/hexian000/tlswrapper/v4/mux/psk"
 )
 
 // pipeSession creates a pair of connected mux Sessions over an in-memory net.Pipe().
@@ -116,7 +118,7 @@ func TestSessionClientOpen(t *testing.T) {
 		acceptCh <- acceptResult{conn, err}
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -150,7 +152,7 @@ func TestSessionServerOpen(t *testing.T) {
 	}()
 
 	// Server opens a stream to the client.
-	srvConn, err := srv.Open(ctx)
+	srvConn, err := srv.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("srv.Open:", err)
 	}
@@ -166,6 +168,106 @@ func TestSessionServerOpen(t *testing.T) {
 	transferAndVerify(t, res.conn, srvConn, []byte("client-to-server"))
 }
 
+func TestSessionStreamHeader(t *testing.T) {
+	hdr := mux.StreamHeader{Service: "ssh", Destination: "example.com:22", Relay: "carol", Hops: 2}
+	tests := []struct {
+		name   string
+		opener func(cli, srv mux.Session) mux.Session
+		accept func(cli, srv mux.Session) mux.Session
+	}{
+		{"client-open", func(cli, _ mux.Session) mux.Session { return cli }, func(_, srv mux.Session) mux.Session { return srv }},
+		{"server-open", func(_, srv mux.Session) mux.Session { return srv }, func(cli, _ mux.Session) mux.Session { return cli }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli, srv := pipeSession(t, &Config{LocalID: "cli"}, &Config{LocalID: "srv"})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			acceptCh := make(chan net.Conn, 1)
+			go func() {
+				conn, err := tt.accept(cli, srv).Accept()
+				if err != nil {
+					close(acceptCh)
+					return
+				}
+				acceptCh <- conn
+			}()
+			opened, err := tt.opener(cli, srv).Open(ctx, hdr)
+			if err != nil {
+				t.Fatal("Open:", err)
+			}
+			defer opened.Close()
+			accepted, ok := <-acceptCh
+			if !ok {
+				t.Fatal("Accept failed")
+			}
+			defer accepted.Close()
+
+			got, err := mux.HeaderOf(accepted)
+			if err != nil {
+				t.Fatal("HeaderOf:", err)
+			}
+			if got != hdr {
+				t.Fatalf("HeaderOf() = %+v, want %+v", got, hdr)
+			}
+			transferAndVerify(t, opened, accepted, []byte("after header"))
+		})
+	}
+}
+
+func TestSessionPacketFlow(t *testing.T) {
+	cli, srv := pipeSession(t, &Config{LocalID: "cli"}, &Config{LocalID: "srv"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := srv.Accept()
+		if err != nil {
+			close(acceptCh)
+			return
+		}
+		acceptCh <- conn
+	}()
+	opened, err := mux.OpenPacket(ctx, cli, mux.StreamHeader{Service: "dns"})
+	if err != nil {
+		t.Fatal("OpenPacket:", err)
+	}
+	defer opened.Close()
+	stream, ok := <-acceptCh
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	hdr, err := mux.HeaderOf(stream)
+	if err != nil {
+		t.Fatal("HeaderOf:", err)
+	}
+	if want := (mux.StreamHeader{Service: "dns", Datagram: true}); hdr != want {
+		t.Fatalf("HeaderOf() = %+v, want %+v", hdr, want)
+	}
+	accepted := mux.AcceptPacket(stream)
+	defer accepted.Close()
+
+	// Datagrams written back to back keep their boundaries.
+	datagrams := [][]byte{[]byte("one"), {}, bytes.Repeat([]byte("x"), 3000)}
+	for _, d := range datagrams {
+		if _, err := opened.Write(d); err != nil {
+			t.Fatal("Write:", err)
+		}
+	}
+	buf := make([]byte, mux.MaxDatagramSize)
+	for _, want := range datagrams {
+		n, err := accepted.Read(buf)
+		if err != nil {
+			t.Fatal("Read:", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("Read %d bytes, want %d", n, len(want))
+		}
+	}
+}
+
 func TestSessionClose(t *testing.T) {
 	cli, srv := pipeSession(t, &Config{}, &Config{})
 
@@ -174,7 +276,7 @@ func TestSessionClose(t *testing.T) {
 
 	// Subsequent Open should return ErrSessionClosed immediately.
 	ctx := context.Background()
-	_, err := cli.Open(ctx)
+	_, err := cli.Open(ctx, mux.StreamHeader{})
 	if !errors.Is(err, mux.ErrSessionClosed) {
 		t.Fatalf("cli.Open after close: got %v, want ErrSessionClosed", err)
 	}
@@ -195,7 +297,7 @@ func TestSessionRejectInbound(t *testing.T) {
 	)
 
 	ctx := context.Background()
-	_, err := cli.Open(ctx)
+	_, err := cli.Open(ctx, mux.StreamHeader{})
 	if !errors.Is(err, ErrInboundRejected) {
 		t.Fatalf("cli.Open: got %v, want ErrInboundRejected", err)
 	}
@@ -221,7 +323,7 @@ func TestSessionMultipleStreams(t *testing.T) {
 			acceptCh <- conn
 		}()
 
-		cliConn, err := cli.Open(ctx)
+		cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 		if err != nil {
 			t.Fatalf("cli.Open[%d]: %v", i, err)
 		}
@@ -392,7 +494,7 @@ func TestH2InboundSessionImplicitHandshake(t *testing.T) {
 	}
 	t.Cleanup(func() { _ = cliSess.Close() })
 
-	cliConn, err := cliSess.Open(ctx)
+	cliConn, err := cliSess.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -421,7 +523,7 @@ func TestH2InboundSessionImplicitHandshake(t *testing.T) {
 		}
 		cliAcceptCh <- conn
 	}()
-	srvConn, err := srv.Open(ctx)
+	srvConn, err := srv.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("srv.Open:", err)
 	}
@@ -573,7 +675,7 @@ func TestSessionAccessors(t *testing.T) {
 		acceptCh <- conn
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -647,3 +749,117 @@ func TestH2MuxDialWithConnSetup(t *testing.T) {
 		t.Fatal("ConnSetup was not called")
 	}
 }
+
+// addrConn overrides the remote address of a net.Conn.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// TestH2ListenerConnPreface verifies that the ConnPreface callback runs before
+// the server-side handshake, that the conn it returns carries the session, and
+// that an error rejects the session.
+func TestH2ListenerConnPreface(t *testing.T) {
+	lbAddr := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4242}
+	for _, fail := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml := NewListener(l, &Config{
+			LocalID: "server",
+			ConnPreface: func(_ context.Context, conn net.Conn) (net.Conn, error) {
+				if fail {
+					return nil, errors.New("preface rejected")
+				}
+				return &addrConn{Conn: conn, remote: lbAddr}, nil
+			},
+		})
+		t.Cleanup(func() { _ = ml.Close() })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.Cleanup(cancel)
+		srvCh := make(chan mux.Session, 1)
+		errCh := make(chan error, 1)
+		go func() {
+			ss, err := ml.Accept()
+			if err == nil {
+				err = ss.Handshake(ctx)
+			}
+			srvCh <- ss
+			errCh <- err
+		}()
+		cliSess, dialErr := New(&Config{LocalID: "client"}).Dial(ctx, l.Addr().String())
+		if dialErr == nil {
+			t.Cleanup(func() { _ = cliSess.Close() })
+		}
+		srvSess, err := <-srvCh, <-errCh
+		if fail {
+			if err == nil {
+				t.Fatal("Handshake succeeded after ConnPreface failed")
+			}
+			continue
+		}
+		if dialErr != nil {
+			t.Fatal("Dial:", dialErr)
+		}
+		if err != nil {
+			t.Fatal("Handshake:", err)
+		}
+		t.Cleanup(func() { _ = srvSess.Close() })
+		if got := srvSess.RemoteAddr().String(); got != lbAddr.String() {
+			t.Fatalf("RemoteAddr() = %s, want %s", got, lbAddr)
+		}
+	}
+}
+
+func TestSessionPSK(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, psk.KeySize)
+	keys := map[string][]byte{"k1": key}
+	cli, srv := pipeSession(t,
+		&Config{LocalID: "cli", PSKConfig: &psk.Config{Keys: keys, KeyID: "k1"}},
+		&Config{LocalID: "srv", PSKConfigProvider: func() *psk.Config { return &psk.Config{Keys: keys} }})
+	if got := srv.PeerIdentity(); got != "cli" {
+		t.Fatalf("srv.PeerIdentity() = %q, want %q", got, "cli")
+	}
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := srv.Accept()
+		if err != nil {
+			t.Error("srv.Accept:", err)
+		}
+		acceptCh <- conn
+	}()
+	cliConn, err := cli.Open(context.Background(), mux.StreamHeader{})
+	if err != nil {
+		t.Fatal("cli.Open:", err)
+	}
+	defer cliConn.Close()
+	srvConn := <-acceptCh
+	if srvConn == nil {
+		t.FailNow()
+	}
+	defer srvConn.Close()
+	transferAndVerify(t, cliConn, srvConn, []byte("hello over psk"))
+
+	// A peer with another key fails the handshake.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := Server(ctx, serverConn, &Config{PSKConfig: &psk.Config{Keys: keys}})
+		_ = serverConn.Close()
+		errCh <- err
+	}()
+	other := map[string][]byte{"k1": bytes.Repeat([]byte{8}, psk.KeySize)}
+	if _, err := Client(ctx, clientConn, &Config{PSKConfig: &psk.Config{Keys: other, KeyID: "k1"}}); err == nil {
+		t.Fatal("Client() succeeded with the wrong key")
+	}
+	if err := <-errCh; !errors.Is(err, psk.ErrHandshakeFailed) {
+		t.Fatalf("Server() = %v, want psk.ErrHandshakeFailed", err)
+	}
+}
@@ -12,6 +12,10 @@ var (
 	// ErrHandshakeFailed is returned by Server when the mux protocol handshake fails.
 	ErrHandshakeFailed = errors.New("mux: handshake failed")
 
+	// ErrIdentityRejected is returned by the handshake when
+	// Config.VerifyPeerIdentity rejects the peer's identity claim.
+	ErrIdentityRejected = errors.New("mux: peer identity rejected")
+
 	errUnexpectedMessage = errors.New("mux: unexpected control message")
 
 	errDuplicateControl = errors.New("mux: duplicate control stream")
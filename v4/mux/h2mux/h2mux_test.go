@@ -285,7 +285,7 @@ func BenchmarkStreamThroughputTLS(b *testing.B) {
 		acceptCh <- conn
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		b.Fatalf("cli.Open: %v", err)
 	}
@@ -17,7 +17,8 @@ type controlStream interface {
 
 // doClientHandshake sends ClientHello and waits for ServerHello on the control stream.
 // Returns peerIdentity and peerRejectsInbound parsed from the ServerHello.
-func doClientHandshake(ctrl controlStream, localID string, rejectInbound bool) (peerIdentity string, peerRejectsInbound bool, err error) {
+// verify, when non-nil, must accept the peer's identity claim.
+func doClientHandshake(ctrl controlStream, localID string, rejectInbound bool, verify func(string) error) (peerIdentity string, peerRejectsInbound bool, err error) {
 	if err = ctrl.Send(&muxpb.ControlMessage{
 		Body: &muxpb.ControlMessage_ClientHello{
 			ClientHello: &muxpb.ClientHello{
@@ -40,12 +41,19 @@ func doClientHandshake(ctrl controlStream, localID string, rejectInbound bool) (
 	}
 	peerIdentity = ack.ServerHello.GetIdentity()
 	peerRejectsInbound = ack.ServerHello.GetRejectInbound()
+	if verify != nil {
+		if err = verify(peerIdentity); err != nil {
+			err = fmt.Errorf("%w: %v", ErrIdentityRejected, err)
+		}
+	}
 	return
 }
 
 // doServerHandshake waits for ClientHello and replies with ServerHello on the control stream.
 // Returns peerIdentity and peerRejectsInbound parsed from the ClientHello.
-func doServerHandshake(ctrl controlStream, localID string, rejectInbound bool) (peerIdentity string, peerRejectsInbound bool, err error) {
+// verify, when non-nil, must accept the peer's identity claim; otherwise no
+// ServerHello is sent.
+func doServerHandshake(ctrl controlStream, localID string, rejectInbound bool, verify func(string) error) (peerIdentity string, peerRejectsInbound bool, err error) {
 	msg, err := ctrl.Recv()
 	if err != nil {
 		return
@@ -57,6 +65,12 @@ func doServerHandshake(ctrl controlStream, localID string, rejectInbound bool) (
 	}
 	peerIdentity = hello.ClientHello.GetIdentity()
 	peerRejectsInbound = hello.ClientHello.GetRejectInbound()
+	if verify != nil {
+		if err = verify(peerIdentity); err != nil {
+			err = fmt.Errorf("%w: %v", ErrIdentityRejected, err)
+			return
+		}
+	}
 
 	err = ctrl.Send(&muxpb.ControlMessage{
 		Body: &muxpb.ControlMessage_ServerHello{
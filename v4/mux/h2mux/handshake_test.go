@@ -70,7 +70,7 @@ func TestDoClientHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{serverHelloMsg("srv", false)},
 		}
-		peerIdentity, reject, err := doClientHandshake(ms, "cli", false)
+		peerIdentity, reject, err := doClientHandshake(ms, "cli", false, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -97,7 +97,7 @@ func TestDoClientHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{serverHelloMsg("srv", true)},
 		}
-		_, reject, err := doClientHandshake(ms, "cli", false)
+		_, reject, err := doClientHandshake(ms, "cli", false, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -110,7 +110,7 @@ func TestDoClientHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{serverHelloMsg("srv", false)},
 		}
-		_, _, err := doClientHandshake(ms, "cli", true)
+		_, _, err := doClientHandshake(ms, "cli", true, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -125,7 +125,7 @@ func TestDoClientHandshake(t *testing.T) {
 
 	t.Run("send-error", func(t *testing.T) {
 		ms := &mockControlStream{sendErr: io.ErrClosedPipe}
-		_, _, err := doClientHandshake(ms, "cli", false)
+		_, _, err := doClientHandshake(ms, "cli", false, nil)
 		if err == nil {
 			t.Fatal("expected error when Send fails")
 		}
@@ -133,7 +133,7 @@ func TestDoClientHandshake(t *testing.T) {
 
 	t.Run("recv-error", func(t *testing.T) {
 		ms := &mockControlStream{recvErr: io.ErrUnexpectedEOF}
-		_, _, err := doClientHandshake(ms, "cli", false)
+		_, _, err := doClientHandshake(ms, "cli", false, nil)
 		if err == nil {
 			t.Fatal("expected error when Recv fails")
 		}
@@ -144,11 +144,28 @@ func TestDoClientHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{clientHelloMsg("other", false)},
 		}
-		_, _, err := doClientHandshake(ms, "cli", false)
+		_, _, err := doClientHandshake(ms, "cli", false, nil)
 		if !errors.Is(err, errUnexpectedMessage) {
 			t.Fatalf("got %v, want errUnexpectedMessage", err)
 		}
 	})
+
+	t.Run("verify-rejects", func(t *testing.T) {
+		ms := &mockControlStream{
+			msgs: []*muxpb.ControlMessage{serverHelloMsg("srv", false)},
+		}
+		var got string
+		_, _, err := doClientHandshake(ms, "cli", false, func(id string) error {
+			got = id
+			return errors.New("deny")
+		})
+		if !errors.Is(err, ErrIdentityRejected) {
+			t.Fatalf("got %v, want ErrIdentityRejected", err)
+		}
+		if got != "srv" {
+			t.Fatalf("verified identity = %q, want %q", got, "srv")
+		}
+	})
 }
 
 func TestDoServerHandshake(t *testing.T) {
@@ -156,7 +173,7 @@ func TestDoServerHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{clientHelloMsg("cli", false)},
 		}
-		peerIdentity, reject, err := doServerHandshake(ms, "srv", false)
+		peerIdentity, reject, err := doServerHandshake(ms, "srv", false, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -183,7 +200,7 @@ func TestDoServerHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{clientHelloMsg("cli", true)},
 		}
-		_, reject, err := doServerHandshake(ms, "srv", false)
+		_, reject, err := doServerHandshake(ms, "srv", false, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -196,7 +213,7 @@ func TestDoServerHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{clientHelloMsg("cli", false)},
 		}
-		_, _, err := doServerHandshake(ms, "srv", true)
+		_, _, err := doServerHandshake(ms, "srv", true, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -211,7 +228,7 @@ func TestDoServerHandshake(t *testing.T) {
 
 	t.Run("recv-error", func(t *testing.T) {
 		ms := &mockControlStream{recvErr: io.ErrUnexpectedEOF}
-		_, _, err := doServerHandshake(ms, "srv", false)
+		_, _, err := doServerHandshake(ms, "srv", false, nil)
 		if err == nil {
 			t.Fatal("expected error when Recv fails")
 		}
@@ -222,7 +239,7 @@ func TestDoServerHandshake(t *testing.T) {
 		ms := &mockControlStream{
 			msgs: []*muxpb.ControlMessage{serverHelloMsg("other", false)},
 		}
-		_, _, err := doServerHandshake(ms, "srv", false)
+		_, _, err := doServerHandshake(ms, "srv", false, nil)
 		if !errors.Is(err, errUnexpectedMessage) {
 			t.Fatalf("got %v, want errUnexpectedMessage", err)
 		}
@@ -233,9 +250,28 @@ func TestDoServerHandshake(t *testing.T) {
 			msgs:    []*muxpb.ControlMessage{clientHelloMsg("cli", false)},
 			sendErr: io.ErrClosedPipe,
 		}
-		_, _, err := doServerHandshake(ms, "srv", false)
+		_, _, err := doServerHandshake(ms, "srv", false, nil)
 		if err == nil {
 			t.Fatal("expected error when Send fails")
 		}
 	})
+
+	t.Run("verify-rejects", func(t *testing.T) {
+		ms := &mockControlStream{
+			msgs: []*muxpb.ControlMessage{clientHelloMsg("cli", false)},
+		}
+		_, _, err := doServerHandshake(ms, "srv", false, func(id string) error {
+			if id != "cli" {
+				t.Errorf("verified identity = %q, want %q", id, "cli")
+			}
+			return errors.New("deny")
+		})
+		if !errors.Is(err, ErrIdentityRejected) {
+			t.Fatalf("got %v, want ErrIdentityRejected", err)
+		}
+		// No ServerHello may be sent for a rejected claim.
+		if len(ms.sent) != 0 {
+			t.Fatalf("sent %d messages, want 0", len(ms.sent))
+		}
+	})
 }
@@ -178,10 +178,12 @@ func (x *ServerHello) GetRejectInbound() bool {
 // OpenRequest is sent by the server on the Control stream to ask the client to
 // open a new Stream RPC back to the server. The client identifies the resulting
 // Stream RPC by setting x-mux-request-id in the outgoing gRPC metadata to
-// request_id.
+// request_id. metadata carries the stream header under the same keys that a
+// client-initiated Stream RPC sends as gRPC metadata.
 type OpenRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Metadata      map[string]string      `protobuf:"bytes,2,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -223,6 +225,13 @@ func (x *OpenRequest) GetRequestId() string {
 	return ""
 }
 
+func (x *OpenRequest) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
 // ControlMessage is the envelope for all messages on the Control stream.
 type ControlMessage struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
@@ -334,10 +343,14 @@ const file_mux_proto_rawDesc = "" +
 	"\x0ereject_inbound\x18\x02 \x01(\bR\rrejectInbound\"P\n" +
 	"\vServerHello\x12\x1a\n" +
 	"\bidentity\x18\x01 \x01(\tR\bidentity\x12%\n" +
-	"\x0ereject_inbound\x18\x02 \x01(\bR\rrejectInbound\",\n" +
+	"\x0ereject_inbound\x18\x02 \x01(\bR\rrejectInbound\"\xb3\x01\n" +
 	"\vOpenRequest\x12\x1d\n" +
 	"\n" +
-	"request_id\x18\x01 \x01(\tR\trequestId\"\xe7\x01\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12H\n" +
+	"\bmetadata\x18\x02 \x03(\v2,.tlswrapper.mux.v1.OpenRequest.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xe7\x01\n" +
 	"\x0eControlMessage\x12C\n" +
 	"\fclient_hello\x18\x01 \x01(\v2\x1e.tlswrapper.mux.v1.ClientHelloH\x00R\vclientHello\x12C\n" +
 	"\fserver_hello\x18\x02 \x01(\v2\x1e.tlswrapper.mux.v1.ServerHelloH\x00R\vserverHello\x12C\n" +
@@ -359,27 +372,29 @@ func file_mux_proto_rawDescGZIP() []byte {
 	return file_mux_proto_rawDescData
 }
 
-var file_mux_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_mux_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_mux_proto_goTypes = []any{
 	(*Chunk)(nil),          // 0: tlswrapper.mux.v1.Chunk
 	(*ClientHello)(nil),    // 1: tlswrapper.mux.v1.ClientHello
 	(*ServerHello)(nil),    // 2: tlswrapper.mux.v1.ServerHello
 	(*OpenRequest)(nil),    // 3: tlswrapper.mux.v1.OpenRequest
 	(*ControlMessage)(nil), // 4: tlswrapper.mux.v1.ControlMessage
+	nil,                    // 5: tlswrapper.mux.v1.OpenRequest.MetadataEntry
 }
 var file_mux_proto_depIdxs = []int32{
-	1, // 0: tlswrapper.mux.v1.ControlMessage.client_hello:type_name -> tlswrapper.mux.v1.ClientHello
-	2, // 1: tlswrapper.mux.v1.ControlMessage.server_hello:type_name -> tlswrapper.mux.v1.ServerHello
-	3, // 2: tlswrapper.mux.v1.ControlMessage.open_request:type_name -> tlswrapper.mux.v1.OpenRequest
-	4, // 3: tlswrapper.mux.v1.Mux.Control:input_type -> tlswrapper.mux.v1.ControlMessage
-	0, // 4: tlswrapper.mux.v1.Mux.Stream:input_type -> tlswrapper.mux.v1.Chunk
-	4, // 5: tlswrapper.mux.v1.Mux.Control:output_type -> tlswrapper.mux.v1.ControlMessage
-	0, // 6: tlswrapper.mux.v1.Mux.Stream:output_type -> tlswrapper.mux.v1.Chunk
-	5, // [5:7] is the sub-list for method output_type
-	3, // [3:5] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	5, // 0: tlswrapper.mux.v1.OpenRequest.metadata:type_name -> tlswrapper.mux.v1.OpenRequest.MetadataEntry
+	1, // 1: tlswrapper.mux.v1.ControlMessage.client_hello:type_name -> tlswrapper.mux.v1.ClientHello
+	2, // 2: tlswrapper.mux.v1.ControlMessage.server_hello:type_name -> tlswrapper.mux.v1.ServerHello
+	3, // 3: tlswrapper.mux.v1.ControlMessage.open_request:type_name -> tlswrapper.mux.v1.OpenRequest
+	4, // 4: tlswrapper.mux.v1.Mux.Control:input_type -> tlswrapper.mux.v1.ControlMessage
+	0, // 5: tlswrapper.mux.v1.Mux.Stream:input_type -> tlswrapper.mux.v1.Chunk
+	4, // 6: tlswrapper.mux.v1.Mux.Control:output_type -> tlswrapper.mux.v1.ControlMessage
+	0, // 7: tlswrapper.mux.v1.Mux.Stream:output_type -> tlswrapper.mux.v1.Chunk
+	6, // [6:8] is the sub-list for method output_type
+	4, // [4:6] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_mux_proto_init() }
@@ -398,7 +413,7 @@ func file_mux_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_mux_proto_rawDesc), len(file_mux_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   5,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
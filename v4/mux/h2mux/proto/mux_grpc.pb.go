@@ -43,7 +43,8 @@ type MuxClient interface {
 	// server-side stream initiation.
 	Control(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ControlMessage, ControlMessage], error)
 	// Stream is a single logical bidirectional byte stream.
-	// Client-initiated: no special metadata required.
+	// Client-initiated: the stream header (e.g. x-mux-service) is sent as
+	// metadata.
 	// Server-initiated: client sets x-mux-request-id metadata to the
 	// request_id from the OpenRequest message received on Control.
 	Stream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Chunk, Chunk], error)
@@ -100,7 +101,8 @@ type MuxServer interface {
 	// server-side stream initiation.
 	Control(grpc.BidiStreamingServer[ControlMessage, ControlMessage]) error
 	// Stream is a single logical bidirectional byte stream.
-	// Client-initiated: no special metadata required.
+	// Client-initiated: the stream header (e.g. x-mux-service) is sent as
+	// metadata.
 	// Server-initiated: client sets x-mux-request-id metadata to the
 	// request_id from the OpenRequest message received on Control.
 	Stream(grpc.BidiStreamingServer[Chunk, Chunk]) error
@@ -5,6 +5,8 @@ package h2mux
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"strconv"
 	"sync"
@@ -19,9 +21,85 @@ import (
 // server-initiated stream. The value is the request_id from OpenRequest.
 const metaRequestIDKey = "x-mux-request-id"
 
-// compile-time checks that clientSession and serverSession implement mux.Session.
+// metaServiceKey is the gRPC metadata key carrying StreamHeader.Service.
+// Server-initiated streams carry the same key in OpenRequest.metadata.
+const metaServiceKey = "x-mux-service"
+
+// metaDatagramKey is the gRPC metadata key marking a datagram flow
+// (StreamHeader.Datagram); its value is "1".
+const metaDatagramKey = "x-mux-datagram"
+
+// metaDestinationKey is the gRPC metadata key carrying
+// StreamHeader.Destination.
+const metaDestinationKey = "x-mux-destination"
+
+// metaSourceKey is the gRPC metadata key carrying StreamHeader.Source.
+const metaSourceKey = "x-mux-source"
+
+// metaRelayKey is the gRPC metadata key carrying StreamHeader.Relay.
+const metaRelayKey = "x-mux-relay"
+
+// metaHopsKey is the gRPC metadata key carrying StreamHeader.Hops in decimal.
+const metaHopsKey = "x-mux-hops"
+
+// headerPairs encodes hdr as metadata pairs; empty fields are omitted.
+func headerPairs(hdr mux.StreamHeader) map[string]string {
+	if hdr.IsZero() {
+		return nil
+	}
+	m := make(map[string]string, 4)
+	if hdr.Service != "" {
+		m[metaServiceKey] = hdr.Service
+	}
+	if hdr.Datagram {
+		m[metaDatagramKey] = "1"
+	}
+	if hdr.Destination != "" {
+		m[metaDestinationKey] = hdr.Destination
+	}
+	if hdr.Source != "" {
+		m[metaSourceKey] = hdr.Source
+	}
+	if hdr.Relay != "" {
+		m[metaRelayKey] = hdr.Relay
+	}
+	if hdr.Hops != 0 {
+		m[metaHopsKey] = strconv.Itoa(hdr.Hops)
+	}
+	return m
+}
+
+// headerFromMD decodes a StreamHeader from Stream RPC metadata.
+func headerFromMD(md metadata.MD) mux.StreamHeader {
+	var hdr mux.StreamHeader
+	if vals := md.Get(metaServiceKey); len(vals) > 0 {
+		hdr.Service = vals[0]
+	}
+	if vals := md.Get(metaDatagramKey); len(vals) > 0 {
+		hdr.Datagram = vals[0] == "1"
+	}
+	if vals := md.Get(metaDestinationKey); len(vals) > 0 {
+		hdr.Destination = vals[0]
+	}
+	if vals := md.Get(metaSourceKey); len(vals) > 0 {
+		hdr.Source = vals[0]
+	}
+	if vals := md.Get(metaRelayKey); len(vals) > 0 {
+		hdr.Relay = vals[0]
+	}
+	if vals := md.Get(metaHopsKey); len(vals) > 0 {
+		// A malformed count is read as 0; the relaying side enforces the limit.
+		hdr.Hops, _ = strconv.Atoi(vals[0])
+	}
+	return hdr
+}
+
+// compile-time checks that clientSession and serverSession implement mux.Session
+// and mux.TLSSession.
 var _ mux.Session = (*clientSession)(nil)
 var _ mux.Session = (*serverSession)(nil)
+var _ mux.TLSSession = (*clientSession)(nil)
+var _ mux.TLSSession = (*serverSession)(nil)
 
 // session holds the common state shared by clientSession and serverSession.
 type session struct {
@@ -29,7 +107,7 @@ type session struct {
 
 	// onOpenRequest is called (in a new goroutine) when a server-initiated
 	// OpenRequest arrives. Set by clientSession constructor; nil on serverSession.
-	onOpenRequest func(requestID string)
+	onOpenRequest func(requestID string, hdr mux.StreamHeader)
 
 	pendingMu sync.Mutex
 	pending   map[string]chan net.Conn // request_id -> delivery channel
@@ -40,6 +118,7 @@ type session struct {
 
 	mu           sync.RWMutex
 	peerIdentity string
+	peerCerts    []*x509.Certificate // nil in plaintext mode
 	localAddr    net.Addr
 	remoteAddr   net.Addr
 
@@ -64,7 +143,8 @@ func (ss *session) recvControlLoop() {
 			if rid == "" || ss.onOpenRequest == nil {
 				continue
 			}
-			go ss.onOpenRequest(rid)
+			hdr := headerFromMD(metadata.New(body.OpenRequest.GetMetadata()))
+			go ss.onOpenRequest(rid, hdr)
 		default:
 			// ignore unexpected messages after handshake
 		}
@@ -143,6 +223,24 @@ func (ss *session) PeerIdentity() string {
 	return ss.peerIdentity
 }
 
+// PeerCertificates implements mux.TLSSession.
+func (ss *session) PeerCertificates() []*x509.Certificate {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.peerCerts
+}
+
+// setPeerCertificates records the certificates presented on tlsConn, which
+// is nil in plaintext mode.
+func (ss *session) setPeerCertificates(tlsConn *tls.Conn) {
+	if tlsConn == nil {
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.peerCerts = tlsConn.ConnectionState().PeerCertificates
+}
+
 func (ss *session) LocalAddr() net.Addr { return ss.localAddr }
 
 func (ss *session) RemoteAddr() net.Addr { return ss.remoteAddr }
@@ -200,7 +298,7 @@ func newClientSession(
 	return ss
 }
 
-func (ss *clientSession) dialStreamForServer(requestID string) {
+func (ss *clientSession) dialStreamForServer(requestID string, hdr mux.StreamHeader) {
 	streamCtx, streamCancel := context.WithCancel(ss.streamCtx)
 	ctx := metadata.NewOutgoingContext(streamCtx, metadata.Pairs(metaRequestIDKey, requestID))
 	cs, err := ss.grpcClient.Stream(ctx)
@@ -209,6 +307,7 @@ func (ss *clientSession) dialStreamForServer(requestID string) {
 		return
 	}
 	conn := newClientSideStream(cs, ss.localAddr, ss.remoteAddr, streamCancel, streamCancel)
+	conn.header = hdr
 	select {
 	case ss.acceptCh <- conn:
 		if ss.metrics != nil {
@@ -219,7 +318,7 @@ func (ss *clientSession) dialStreamForServer(requestID string) {
 	}
 }
 
-func (ss *clientSession) Open(ctx context.Context) (net.Conn, error) {
+func (ss *clientSession) Open(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
 	if ss.IsClosed() {
 		return nil, mux.ErrSessionClosed
 	}
@@ -227,7 +326,11 @@ func (ss *clientSession) Open(ctx context.Context) (net.Conn, error) {
 		return nil, ErrInboundRejected
 	}
 	streamCtx, streamCancel := context.WithCancel(ss.streamCtx)
-	cs, err := ss.grpcClient.Stream(streamCtx)
+	rpcCtx := streamCtx
+	if pairs := headerPairs(hdr); pairs != nil {
+		rpcCtx = metadata.NewOutgoingContext(streamCtx, metadata.New(pairs))
+	}
+	cs, err := ss.grpcClient.Stream(rpcCtx)
 	if err != nil {
 		streamCancel()
 		return nil, err
@@ -291,7 +394,8 @@ func newServerSession(
 }
 
 // Open asks the client to dial back a Stream RPC and waits for delivery.
-func (ss *serverSession) Open(ctx context.Context) (net.Conn, error) {
+// hdr travels in the OpenRequest so the client can expose it on the stream.
+func (ss *serverSession) Open(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
 	if ss.IsClosed() {
 		return nil, mux.ErrSessionClosed
 	}
@@ -322,7 +426,7 @@ func (ss *serverSession) Open(ctx context.Context) (net.Conn, error) {
 
 	if err := ss.ctrl.Send(&muxpb.ControlMessage{
 		Body: &muxpb.ControlMessage_OpenRequest{
-			OpenRequest: &muxpb.OpenRequest{RequestId: rid},
+			OpenRequest: &muxpb.OpenRequest{RequestId: rid, Metadata: headerPairs(hdr)},
 		},
 	}); err != nil {
 		if abandon() {
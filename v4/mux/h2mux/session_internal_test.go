@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	mux "github.com/hexian000/tlswrapper/v4/mux"
 	muxpb "github.com/hexian000/tlswrapper/v4/mux/h2mux/proto"
 )
 
@@ -136,7 +137,7 @@ func TestServerSessionOpenDeliverConcurrent(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(),
 				time.Duration(rand.Intn(200))*time.Microsecond)
 			defer cancel()
-			conn, err := ss.Open(ctx)
+			conn, err := ss.Open(ctx, mux.StreamHeader{})
 			if err == nil {
 				// Caller owns a successfully opened conn.
 				_ = conn.Close()
@@ -11,6 +11,7 @@ import (
 
 	"google.golang.org/grpc/mem"
 
+	mux "github.com/hexian000/tlswrapper/v4/mux"
 	muxpb "github.com/hexian000/tlswrapper/v4/mux/h2mux/proto"
 )
 
@@ -28,6 +29,9 @@ type streamRW interface {
 	RecvMsg(m any) error
 }
 
+// compile-time check that grpcStream implements mux.Stream.
+var _ mux.Stream = (*grpcStream)(nil)
+
 // grpcStream is a single gRPC bidi stream that implements net.Conn.
 // It wraps either a client-side or server-side Stream RPC.
 //
@@ -48,6 +52,9 @@ type grpcStream struct {
 	readBufs   mem.BufferSlice
 	localAddr  net.Addr
 	remoteAddr net.Addr
+	// header is the StreamHeader received with an accepted stream; it is set
+	// before the stream is delivered and never modified afterwards.
+	header mux.StreamHeader
 
 	mu            sync.RWMutex
 	readDeadline  time.Time
@@ -204,6 +211,10 @@ func (s *grpcStream) Close() error {
 	return nil
 }
 
+// Header implements mux.Stream. The header arrives with the Stream RPC
+// metadata (or the OpenRequest), so it never blocks.
+func (s *grpcStream) Header() (mux.StreamHeader, error) { return s.header, nil }
+
 func (s *grpcStream) LocalAddr() net.Addr  { return s.localAddr }
 func (s *grpcStream) RemoteAddr() net.Addr { return s.remoteAddr }
 
@@ -246,7 +257,7 @@ func newClientSideStream(
 	localAddr, remoteAddr net.Addr,
 	onClose func(),
 	abortWrite func(),
-) net.Conn {
+) *grpcStream {
 	return &grpcStream{
 		rw:         cs,
 		closeWrite: cs.CloseSend,
@@ -5,7 +5,9 @@ package h3mux
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"net"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -39,6 +41,10 @@ type Config struct {
 	ALPN string
 	// RejectInbound is advertised in the handshake: the peer should not Open() streams to us.
 	RejectInbound bool
+	// VerifyPeerIdentity, when non-nil, is called during the mux handshake with
+	// the peer's identity claim and its verified certificate chain. A non-nil
+	// error rejects the session.
+	VerifyPeerIdentity func(identity string, peerCerts []*x509.Certificate) error
 
 	// KeepAlivePeriod is how often to send QUIC keepalive pings.
 	// 0 uses the QUIC default (disabled unless MaxIdleTimeout is set).
@@ -52,6 +58,11 @@ type Config struct {
 	// 0 uses quic-go's default of 30s.
 	MaxIdleTimeout time.Duration
 
+	// AcceptSource, when non-nil, is called with the remote address of each
+	// inbound connection attempt before any handshake work is done; returning
+	// false refuses the connection. Listener only.
+	AcceptSource func(net.Addr) bool
+
 	// MaxIncomingStreams is the maximum number of inbound bidirectional streams
 	// the peer may open concurrently (i.e., the depth of the Accept queue).
 	// 0 uses the default of 1024.
@@ -85,6 +96,8 @@ func (c *Config) quicConfig() *quic.Config {
 		MaxIncomingStreams: c.maxIncomingStreams(),
 		// Disallow unidirectional streams: h3mux only uses bidirectional streams.
 		MaxIncomingUniStreams: -1,
+		// Datagram flows (see OpenPacket) prefer QUIC DATAGRAM frames.
+		EnableDatagrams: true,
 	}
 	if c.HandshakeTimeout > 0 {
 		qcfg.HandshakeIdleTimeout = c.HandshakeTimeout
@@ -107,6 +120,18 @@ func (c *Config) quicConfig() *quic.Config {
 	return qcfg
 }
 
+// identityVerifier returns the handshake hook that passes the peer's identity
+// claim and the certificates presented on conn to VerifyPeerIdentity.
+// Returns nil when no verifier is set.
+func (c *Config) identityVerifier(conn *quic.Conn) func(string) error {
+	if c.VerifyPeerIdentity == nil {
+		return nil
+	}
+	return func(identity string) error {
+		return c.VerifyPeerIdentity(identity, conn.ConnectionState().TLS.PeerCertificates)
+	}
+}
+
 // currentTLSConfig resolves the TLS config to use right now.
 // TLSConfigProvider takes precedence over TLSConfig.
 func (c *Config) currentTLSConfig() *tls.Config {
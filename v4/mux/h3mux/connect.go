@@ -5,6 +5,7 @@ package h3mux
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"sync"
@@ -76,7 +77,7 @@ func clientHandshake(ctx context.Context, conn *quic.Conn, cfg *Config, metrics
 		return nil, fmt.Errorf("%w: open control stream: %v", ErrHandshakeFailed, err)
 	}
 	applyHandshakeDeadline(ctx, ctrl)
-	peerID, peerRejectsOpen, err := doClientHandshake(ctrl, cfg.LocalID, cfg.RejectInbound)
+	peerID, peerRejectsOpen, err := doClientHandshake(ctrl, cfg.LocalID, cfg.RejectInbound, cfg.identityVerifier(conn))
 	if err != nil {
 		_ = conn.CloseWithError(0, "handshake failed")
 		return nil, err
@@ -94,7 +95,7 @@ func serverHandshake(ctx context.Context, conn *quic.Conn, cfg *Config) (mux.Ses
 		return nil, fmt.Errorf("%w: accept control stream: %v", ErrHandshakeFailed, err)
 	}
 	applyHandshakeDeadline(ctx, ctrl)
-	peerID, peerRejectsOpen, err := doServerHandshake(ctrl, cfg.LocalID, cfg.RejectInbound)
+	peerID, peerRejectsOpen, err := doServerHandshake(ctrl, cfg.LocalID, cfg.RejectInbound, cfg.identityVerifier(conn))
 	if err != nil {
 		_ = conn.CloseWithError(0, "handshake failed")
 		return nil, err
@@ -173,7 +174,10 @@ func ListenMux(addr string, cfg *Config) (*H3Listener, error) {
 	}
 	tr := &quic.Transport{
 		Conn: pconn,
-		ConnContext: func(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+		ConnContext: func(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+			if cfg.AcceptSource != nil && !cfg.AcceptSource(info.RemoteAddr) {
+				return ctx, errSourceRefused
+			}
 			return context.WithValue(ctx, wireMetricsKey{}, &mux.SessionMetrics{}), nil
 		},
 	}
@@ -228,8 +232,11 @@ type h3InboundSession struct {
 	handshakeErr  error
 }
 
-// compile-time check that h3InboundSession implements mux.Session.
+// compile-time checks that h3InboundSession implements mux.Session,
+// mux.TLSSession and mux.PacketSession.
 var _ mux.Session = (*h3InboundSession)(nil)
+var _ mux.TLSSession = (*h3InboundSession)(nil)
+var _ mux.PacketSession = (*h3InboundSession)(nil)
 
 // doHandshake performs the h3mux server-side handshake exactly once.
 // The mutex is held for the entire handshake duration, matching crypto/tls.Conn.
@@ -265,12 +272,22 @@ func (s *h3InboundSession) delegate() (mux.Session, error) {
 	return s.ss, nil // safe: ss is stored before handshakeDone is set
 }
 
-func (s *h3InboundSession) Open(ctx context.Context) (net.Conn, error) {
+func (s *h3InboundSession) Open(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
 	ss, err := s.delegate()
 	if err != nil {
 		return nil, err
 	}
-	return ss.Open(ctx)
+	return ss.Open(ctx, hdr)
+}
+
+// OpenPacket implements mux.PacketSession so datagram flows opened on an
+// accepted connection use DATAGRAM frames like those on a dialed one.
+func (s *h3InboundSession) OpenPacket(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
+	ss, err := s.delegate()
+	if err != nil {
+		return nil, err
+	}
+	return mux.OpenPacket(ctx, ss, hdr)
 }
 
 func (s *h3InboundSession) Accept() (net.Conn, error) {
@@ -319,6 +336,14 @@ func (s *h3InboundSession) Stats() *mux.SessionMetrics {
 	return nil
 }
 
+// PeerCertificates implements mux.TLSSession.
+func (s *h3InboundSession) PeerCertificates() []*x509.Certificate {
+	if s.handshakeDone.Load() && s.ss != nil {
+		return mux.PeerCertificatesOf(s.ss)
+	}
+	return nil
+}
+
 func (s *h3InboundSession) PeerIdentity() string {
 	if s.handshakeDone.Load() && s.ss != nil {
 		return s.ss.PeerIdentity()
@@ -17,6 +17,7 @@ import (
 	"io"
 	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -193,7 +194,7 @@ func TestSessionClientOpen(t *testing.T) {
 		acceptCh <- acceptResult{conn, err}
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -224,7 +225,7 @@ func TestSessionServerOpen(t *testing.T) {
 		acceptCh <- acceptResult{conn, err}
 	}()
 
-	srvConn, err := srv.Open(ctx)
+	srvConn, err := srv.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("srv.Open:", err)
 	}
@@ -240,6 +241,130 @@ func TestSessionServerOpen(t *testing.T) {
 	transferAndVerify(t, res.conn, srvConn, []byte("client-to-server"))
 }
 
+func TestSessionStreamHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		hdr    mux.StreamHeader
+		server bool
+	}{
+		{"client-open", mux.StreamHeader{Service: "ssh"}, false},
+		{"server-open", mux.StreamHeader{Service: "ssh"}, true},
+		{"no-header", mux.StreamHeader{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli, srv := quicSessions(t, &Config{LocalID: "cli"}, &Config{LocalID: "srv"})
+			opener, acceptor := cli, srv
+			if tt.server {
+				opener, acceptor = srv, cli
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			acceptCh := make(chan net.Conn, 1)
+			go func() {
+				conn, err := acceptor.Accept()
+				if err != nil {
+					close(acceptCh)
+					return
+				}
+				acceptCh <- conn
+			}()
+			opened, err := opener.Open(ctx, tt.hdr)
+			if err != nil {
+				t.Fatal("Open:", err)
+			}
+			defer opened.Close()
+			accepted, ok := <-acceptCh
+			if !ok {
+				t.Fatal("Accept failed")
+			}
+			defer accepted.Close()
+
+			got, err := mux.HeaderOf(accepted)
+			if err != nil {
+				t.Fatal("HeaderOf:", err)
+			}
+			if got != tt.hdr {
+				t.Fatalf("HeaderOf() = %+v, want %+v", got, tt.hdr)
+			}
+			transferAndVerify(t, opened, accepted, []byte("after header"))
+		})
+	}
+}
+
+func TestSessionPacketFlow(t *testing.T) {
+	cli, srv := quicSessions(t, &Config{LocalID: "cli"}, &Config{LocalID: "srv"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := srv.Accept()
+		if err != nil {
+			close(acceptCh)
+			return
+		}
+		acceptCh <- conn
+	}()
+	opened, err := mux.OpenPacket(ctx, cli, mux.StreamHeader{})
+	if err != nil {
+		t.Fatal("OpenPacket:", err)
+	}
+	defer opened.Close()
+	// The first datagram may arrive before the accepting side sets up the flow.
+	if _, err := opened.Write([]byte("early")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	stream, ok := <-acceptCh
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	hdr, err := mux.HeaderOf(stream)
+	if err != nil {
+		t.Fatal("HeaderOf:", err)
+	}
+	if !hdr.Datagram {
+		t.Fatalf("HeaderOf() = %+v, want Datagram set", hdr)
+	}
+	accepted := mux.AcceptPacket(stream)
+	defer accepted.Close()
+	_ = accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_ = opened.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, mux.MaxDatagramSize)
+	n, err := accepted.Read(buf)
+	if err != nil || string(buf[:n]) != "early" {
+		t.Fatalf("Read = %q, %v, want %q", buf[:n], err, "early")
+	}
+	// Small datagrams use DATAGRAM frames; the large one exceeds a QUIC packet
+	// and falls back to the stream. Boundaries are preserved either way.
+	for _, want := range [][]byte{[]byte("ping"), bytes.Repeat([]byte("x"), 8000), {}} {
+		if _, err := opened.Write(want); err != nil {
+			t.Fatal("Write:", err)
+		}
+		n, err := accepted.Read(buf)
+		if err != nil {
+			t.Fatal("Read:", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("Read %d bytes, want %d", n, len(want))
+		}
+		if _, err := accepted.Write(buf[:n]); err != nil {
+			t.Fatal("reply Write:", err)
+		}
+		if n, err = opened.Read(buf); err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatalf("reply Read %d bytes, %v, want %d", n, err, len(want))
+		}
+	}
+
+	// Closing one side ends the flow on the other.
+	_ = opened.Close()
+	if _, err := accepted.Read(buf); err == nil {
+		t.Fatal("Read after peer close: expected error")
+	}
+}
+
 func TestSessionClose(t *testing.T) {
 	cli, srv := quicSessions(t, &Config{}, &Config{})
 
@@ -247,7 +372,7 @@ func TestSessionClose(t *testing.T) {
 	_ = srv.Close()
 
 	ctx := context.Background()
-	_, err := cli.Open(ctx)
+	_, err := cli.Open(ctx, mux.StreamHeader{})
 	if !errors.Is(err, mux.ErrSessionClosed) {
 		t.Fatalf("cli.Open after close: got %v, want ErrSessionClosed", err)
 	}
@@ -266,7 +391,7 @@ func TestSessionRejectInbound(t *testing.T) {
 	)
 
 	ctx := context.Background()
-	_, err := cli.Open(ctx)
+	_, err := cli.Open(ctx, mux.StreamHeader{})
 	if !errors.Is(err, ErrInboundRejected) {
 		t.Fatalf("cli.Open: got %v, want ErrInboundRejected", err)
 	}
@@ -291,7 +416,7 @@ func TestSessionMultipleStreams(t *testing.T) {
 			}
 			acceptCh <- conn
 		}()
-		cliConn, err := cli.Open(ctx)
+		cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 		if err != nil {
 			t.Fatalf("cli.Open [%d]: %v", i, err)
 		}
@@ -419,7 +544,7 @@ func TestH3MuxWireMetrics(t *testing.T) {
 		}
 		acceptCh <- conn
 	}()
-	cliConn, err := cliSess.Open(ctx)
+	cliConn, err := cliSess.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -546,7 +671,7 @@ func TestH3InboundSessionImplicitHandshake(t *testing.T) {
 	}
 	t.Cleanup(func() { _ = cliSess.Close() })
 
-	cliConn, err := cliSess.Open(ctx)
+	cliConn, err := cliSess.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -575,7 +700,7 @@ func TestH3InboundSessionImplicitHandshake(t *testing.T) {
 		}
 		cliAcceptCh <- conn
 	}()
-	srvConn, err := srv.Open(ctx)
+	srvConn, err := srv.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("srv.Open:", err)
 	}
@@ -587,6 +712,38 @@ func TestH3InboundSessionImplicitHandshake(t *testing.T) {
 	defer cliConn2.Close()
 	transferAndVerify(t, srvConn, cliConn2, []byte("server opened stream"))
 
+	// Datagram flows opened by the server use the native packet path.
+	if _, ok := srv.(mux.PacketSession); !ok {
+		t.Fatal("accepted session does not implement mux.PacketSession")
+	}
+	go func() {
+		conn, err := cliSess.Accept()
+		if err != nil {
+			cliAcceptCh <- nil
+			return
+		}
+		cliAcceptCh <- conn
+	}()
+	srvFlow, err := mux.OpenPacket(ctx, srv, mux.StreamHeader{})
+	if err != nil {
+		t.Fatal("srv.OpenPacket:", err)
+	}
+	defer srvFlow.Close()
+	cliStream := <-cliAcceptCh
+	if cliStream == nil {
+		t.Fatal("cli.Accept returned nil")
+	}
+	cliFlow := mux.AcceptPacket(cliStream)
+	defer cliFlow.Close()
+	if _, err := srvFlow.Write([]byte("datagram")); err != nil {
+		t.Fatal("srvFlow.Write:", err)
+	}
+	_ = cliFlow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, mux.MaxDatagramSize)
+	if n, err := cliFlow.Read(buf); err != nil || string(buf[:n]) != "datagram" {
+		t.Fatalf("cliFlow.Read = %q, %v, want %q", buf[:n], err, "datagram")
+	}
+
 	// Post-handshake: accessors forward to the underlying session.
 	if got := srv.PeerIdentity(); got != "cli" {
 		t.Fatalf("post-handshake PeerIdentity() = %q, want %q", got, "cli")
@@ -769,6 +926,50 @@ func TestH3DialError(t *testing.T) {
 	}
 }
 
+// TestH3ListenMuxAcceptSource verifies that a connection refused by
+// Config.AcceptSource fails to dial and never reaches Accept.
+func TestH3ListenMuxAcceptSource(t *testing.T) {
+	serverTLS, clientTLS := generateSelfSignedTLS(t)
+	sources := make(chan net.Addr, 1)
+	ml, err := ListenMux("127.0.0.1:0", &Config{
+		TLSConfig: serverTLS,
+		AcceptSource: func(addr net.Addr) bool {
+			sources <- addr
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatal("ListenMux:", err)
+	}
+	t.Cleanup(func() { _ = ml.Close() })
+	accepted := make(chan struct{})
+	go func() {
+		if ss, err := ml.Accept(); err == nil {
+			_ = ss.Close()
+			close(accepted)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := Dial(ctx, ml.Addr().String(), &Config{TLSConfig: clientTLS}); err == nil {
+		t.Fatal("Dial: expected error for a refused source, got nil")
+	}
+	select {
+	case addr := <-sources:
+		if !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+			t.Fatalf("AcceptSource got %v, want the client address", addr)
+		}
+	default:
+		t.Fatal("AcceptSource was not called")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("refused connection was accepted")
+	default:
+	}
+}
+
 // TestH3ListenMuxError verifies that ListenMux returns an error for an invalid address.
 func TestH3ListenMuxError(t *testing.T) {
 	serverTLS, _ := generateSelfSignedTLS(t)
@@ -817,7 +1018,7 @@ func TestH3SessionAccessors(t *testing.T) {
 		acceptCh <- conn
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -854,7 +1055,7 @@ func TestH3StreamLocalRemoteAddr(t *testing.T) {
 		acceptCh <- conn
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -0,0 +1,293 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package h3mux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+// Datagram flows are announced on a stream (see h3Session.OpenPacket). Each
+// QUIC DATAGRAM frame carries the flow's stream ID as a QUIC variable-length
+// integer followed by one datagram. The stream itself carries datagrams that
+// cannot be sent as DATAGRAM frames, framed as in mux.NewFramedPacketConn, and
+// ends the flow when closed.
+
+const (
+	// flowRecvQueue is the number of received datagrams buffered per flow;
+	// datagrams arriving at a full queue are dropped.
+	flowRecvQueue = 64
+	// maxPendingFlows bounds the stream IDs for which datagrams are buffered
+	// before the accepting side has set up the flow.
+	maxPendingFlows = 64
+	// maxPendingDatagrams bounds the datagrams buffered per pending flow.
+	maxPendingDatagrams = 8
+	// pendingFlowTimeout discards datagrams buffered for a flow that is never
+	// set up, e.g. because the accepting side rejected it.
+	pendingFlowTimeout = 10 * time.Second
+)
+
+// pendingFlow buffers datagrams that arrived before their flow was set up.
+type pendingFlow struct {
+	added time.Time
+	data  [][]byte
+}
+
+// datagramsSupported reports whether both endpoints negotiated QUIC datagrams.
+func datagramsSupported(conn *quic.Conn) bool {
+	st := conn.ConnectionState().SupportsDatagrams
+	return st.Local && st.Remote
+}
+
+// recvDatagrams dispatches received DATAGRAM frames to their flows until the
+// connection closes.
+func (s *h3Session) recvDatagrams() {
+	for {
+		b, err := s.conn.ReceiveDatagram(s.conn.Context())
+		if err != nil {
+			return
+		}
+		id, n, err := quicvarint.Parse(b)
+		if err != nil {
+			continue
+		}
+		s.dispatchDatagram(quic.StreamID(id), b[n:])
+	}
+}
+
+// dispatchDatagram delivers one datagram to the flow on stream id, or buffers
+// it briefly when the accepting side has not set that flow up yet.
+func (s *h3Session) dispatchDatagram(id quic.StreamID, b []byte) {
+	s.flowsMu.Lock()
+	f := s.flows[id]
+	if f == nil {
+		s.bufferDatagramLocked(id, b)
+		s.flowsMu.Unlock()
+		return
+	}
+	s.flowsMu.Unlock()
+	s.metrics.BytesReceived.Add(uint64(len(b)))
+	f.deliver(b)
+}
+
+func (s *h3Session) bufferDatagramLocked(id quic.StreamID, b []byte) {
+	now := time.Now()
+	for pid, p := range s.pending {
+		if now.Sub(p.added) > pendingFlowTimeout {
+			delete(s.pending, pid)
+		}
+	}
+	p := s.pending[id]
+	if p == nil {
+		if len(s.pending) >= maxPendingFlows {
+			return
+		}
+		p = &pendingFlow{added: now}
+		s.pending[id] = p
+	}
+	if len(p.data) < maxPendingDatagrams {
+		p.data = append(p.data, b)
+	}
+}
+
+// newDatagramFlow registers the datagram flow announced on stream and returns
+// it. Datagrams buffered for the stream before registration are delivered.
+func (s *h3Session) newDatagramFlow(id quic.StreamID, stream net.Conn) *datagramFlow {
+	f := &datagramFlow{
+		sess:         s,
+		id:           id,
+		stream:       stream,
+		framed:       mux.NewFramedPacketConn(stream),
+		recvCh:       make(chan []byte, flowRecvQueue),
+		closed:       make(chan struct{}),
+		readDeadline: makeDeadline(),
+	}
+	s.flowsMu.Lock()
+	s.flows[id] = f
+	p := s.pending[id]
+	delete(s.pending, id)
+	s.flowsMu.Unlock()
+	if p != nil {
+		for _, b := range p.data {
+			s.metrics.BytesReceived.Add(uint64(len(b)))
+			f.deliver(b)
+		}
+	}
+	go f.recvFramed()
+	return f
+}
+
+// datagramFlow is one datagram flow of an h3Session. It implements net.Conn
+// with message semantics: each Write sends one datagram and each Read returns
+// one.
+type datagramFlow struct {
+	sess   *h3Session
+	id     quic.StreamID
+	stream net.Conn
+	framed net.Conn
+
+	recvCh       chan []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline deadline
+}
+
+// recvFramed delivers datagrams framed on the stream and closes the flow when
+// the peer closes the stream.
+func (f *datagramFlow) recvFramed() {
+	buf := make([]byte, mux.MaxDatagramSize)
+	for {
+		n, err := f.framed.Read(buf)
+		if err != nil {
+			_ = f.Close()
+			return
+		}
+		f.deliver(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// deliver queues b for Read, dropping it when the queue is full.
+func (f *datagramFlow) deliver(b []byte) {
+	select {
+	case <-f.closed:
+	case f.recvCh <- b:
+	default:
+	}
+}
+
+func (f *datagramFlow) Read(b []byte) (int, error) {
+	select {
+	case p := <-f.recvCh:
+		return copy(b, p), nil
+	case <-f.closed:
+		return 0, net.ErrClosed
+	case <-f.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b as a DATAGRAM frame when possible and falls back to the
+// stream when the peer does not support datagrams or b does not fit in one
+// packet.
+func (f *datagramFlow) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(b) > mux.MaxDatagramSize {
+		return 0, fmt.Errorf("%w (%d bytes)", mux.ErrDatagramTooLarge, len(b))
+	}
+	if f.sess.datagrams {
+		payload := quicvarint.Append(make([]byte, 0, quicvarint.Len(uint64(f.id))+len(b)), uint64(f.id))
+		payload = append(payload, b...)
+		err := f.sess.conn.SendDatagram(payload)
+		if err == nil {
+			f.sess.metrics.BytesSent.Add(uint64(len(b)))
+			return len(b), nil
+		}
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return 0, err
+		}
+	}
+	return f.framed.Write(b)
+}
+
+// Close ends the flow and closes its stream.
+func (f *datagramFlow) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		f.sess.flowsMu.Lock()
+		if f.sess.flows[f.id] == f {
+			delete(f.sess.flows, f.id)
+		}
+		f.sess.flowsMu.Unlock()
+		close(f.closed)
+		err = f.stream.Close()
+	})
+	return err
+}
+
+func (f *datagramFlow) LocalAddr() net.Addr  { return f.stream.LocalAddr() }
+func (f *datagramFlow) RemoteAddr() net.Addr { return f.stream.RemoteAddr() }
+
+func (f *datagramFlow) SetDeadline(t time.Time) error {
+	f.readDeadline.set(t)
+	return f.stream.SetWriteDeadline(t)
+}
+
+func (f *datagramFlow) SetReadDeadline(t time.Time) error {
+	f.readDeadline.set(t)
+	return nil
+}
+
+func (f *datagramFlow) SetWriteDeadline(t time.Time) error {
+	return f.stream.SetWriteDeadline(t)
+}
+
+// deadline is a settable read deadline that can be waited on with select.
+// It follows the deadline handling of net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set arms the deadline for t; the zero value clears it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -12,5 +12,13 @@ var (
 	// ErrHandshakeFailed is returned by NewSession when the mux protocol handshake fails.
 	ErrHandshakeFailed = errors.New("mux: handshake failed")
 
+	// ErrIdentityRejected is returned by the handshake when
+	// Config.VerifyPeerIdentity rejects the peer's identity claim.
+	ErrIdentityRejected = errors.New("mux: peer identity rejected")
+
 	errUnexpectedMessage = errors.New("mux: unexpected control message")
+
+	errBadStreamHeader = errors.New("mux: malformed stream header")
+
+	errSourceRefused = errors.New("mux: source address refused")
 )
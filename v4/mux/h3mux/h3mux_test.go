@@ -11,6 +11,7 @@ import (
 
 	"github.com/quic-go/quic-go"
 
+	mux "github.com/hexian000/tlswrapper/v4/mux"
 	. "github.com/hexian000/tlswrapper/v4/mux/h3mux"
 )
 
@@ -169,7 +170,7 @@ func BenchmarkStreamThroughput(b *testing.B) {
 		acceptCh <- conn
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		b.Fatalf("cli.Open: %v", err)
 	}
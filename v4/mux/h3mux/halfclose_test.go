@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	mux "github.com/hexian000/tlswrapper/v4/mux"
 	. "github.com/hexian000/tlswrapper/v4/mux/h3mux"
 )
 
@@ -32,7 +33,7 @@ func TestH3StreamHalfClose(t *testing.T) {
 		srvCh <- acceptResult{conn, err}
 	}()
 
-	cliConn, err := cli.Open(ctx)
+	cliConn, err := cli.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("cli.Open:", err)
 	}
@@ -63,7 +63,8 @@ func readHandshake(r io.Reader) (handshakeMsg, error) {
 // doClientHandshake performs the client side of the h3mux handshake over ctrl.
 // It sends a ClientHello then waits for a ServerHello.
 // Returns the peer's identity and whether the peer rejects inbound streams.
-func doClientHandshake(ctrl io.ReadWriter, localID string, rejectInbound bool) (string, bool, error) {
+// verify, when non-nil, must accept the peer's identity claim.
+func doClientHandshake(ctrl io.ReadWriter, localID string, rejectInbound bool, verify func(string) error) (string, bool, error) {
 	// Send ClientHello
 	hello := handshakeMsg{Identity: localID, RejectInbound: rejectInbound}
 	if err := writeHandshake(ctrl, hello); err != nil {
@@ -74,18 +75,30 @@ func doClientHandshake(ctrl io.ReadWriter, localID string, rejectInbound bool) (
 	if err != nil {
 		return "", false, err
 	}
+	if verify != nil {
+		if err := verify(reply.Identity); err != nil {
+			return "", false, fmt.Errorf("%w: %v", ErrIdentityRejected, err)
+		}
+	}
 	return reply.Identity, reply.RejectInbound, nil
 }
 
 // doServerHandshake performs the server side of the h3mux handshake over ctrl.
 // It waits for a ClientHello then sends a ServerHello.
 // Returns the peer's identity and whether the peer rejects inbound streams.
-func doServerHandshake(ctrl io.ReadWriter, localID string, rejectInbound bool) (string, bool, error) {
+// verify, when non-nil, must accept the peer's identity claim; otherwise no
+// ServerHello is sent.
+func doServerHandshake(ctrl io.ReadWriter, localID string, rejectInbound bool, verify func(string) error) (string, bool, error) {
 	// Receive ClientHello
 	hello, err := readHandshake(ctrl)
 	if err != nil {
 		return "", false, err
 	}
+	if verify != nil {
+		if err := verify(hello.Identity); err != nil {
+			return "", false, fmt.Errorf("%w: %v", ErrIdentityRejected, err)
+		}
+	}
 	// Send ServerHello
 	reply := handshakeMsg{Identity: localID, RejectInbound: rejectInbound}
 	if err := writeHandshake(ctrl, reply); err != nil {
@@ -94,3 +94,52 @@ func TestWriteHandshakeHeaderError(t *testing.T) {
 		t.Fatalf("error = %v, want to wrap ErrHandshakeFailed", err)
 	}
 }
+
+// rwPair joins a reader of scripted peer messages and a writer capturing ours.
+type rwPair struct {
+	io.Reader
+	io.Writer
+}
+
+func TestHandshakeVerifyRejects(t *testing.T) {
+	errDeny := errors.New("deny")
+	verify := func(id string) error {
+		if id != "good" {
+			return errDeny
+		}
+		return nil
+	}
+	peerMsg := func(id string) *bytes.Buffer {
+		var buf bytes.Buffer
+		if err := writeHandshake(&buf, handshakeMsg{Identity: id}); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	t.Run("server", func(t *testing.T) {
+		var out bytes.Buffer
+		_, _, err := doServerHandshake(rwPair{peerMsg("bad"), &out}, "srv", false, verify)
+		if !errors.Is(err, ErrIdentityRejected) {
+			t.Fatalf("error = %v, want to wrap ErrIdentityRejected", err)
+		}
+		if out.Len() != 0 {
+			t.Fatal("ServerHello sent despite rejected identity")
+		}
+		id, _, err := doServerHandshake(rwPair{peerMsg("good"), &out}, "srv", false, verify)
+		if err != nil || id != "good" {
+			t.Fatalf("got (%q, %v), want (%q, nil)", id, err, "good")
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		_, _, err := doClientHandshake(rwPair{peerMsg("bad"), io.Discard}, "cli", false, verify)
+		if !errors.Is(err, ErrIdentityRejected) {
+			t.Fatalf("error = %v, want to wrap ErrIdentityRejected", err)
+		}
+		id, _, err := doClientHandshake(rwPair{peerMsg("good"), io.Discard}, "cli", false, verify)
+		if err != nil || id != "good" {
+			t.Fatalf("got (%q, %v), want (%q, nil)", id, err, "good")
+		}
+	})
+}
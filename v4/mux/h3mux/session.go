@@ -5,6 +5,7 @@ package h3mux
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"sync"
@@ -14,8 +15,11 @@ import (
 	"github.com/hexian000/tlswrapper/v4/mux"
 )
 
-// compile-time check that h3Session implements mux.Session.
+// compile-time checks that h3Session implements mux.Session, mux.PacketSession,
+// and mux.TLSSession.
 var _ mux.Session = (*h3Session)(nil)
+var _ mux.PacketSession = (*h3Session)(nil)
+var _ mux.TLSSession = (*h3Session)(nil)
 
 // openMarker is a 1-byte stream-open signal written by Open() and stripped on
 // the accepting side before the first application read. QUIC streams are
@@ -25,6 +29,12 @@ var _ mux.Session = (*h3Session)(nil)
 // when opening a stream).
 var openMarker = [1]byte{0}
 
+// openHeaderMarker replaces openMarker when the opener sends a StreamHeader.
+// The marker is followed by the header encoded as a 2-byte big-endian length
+// prefix and JSON (see writeStreamHeader). Streams without a header keep
+// sending the plain openMarker, so they remain readable by older peers.
+var openHeaderMarker = [1]byte{1}
+
 // h3Session implements mux.Session over a QUIC connection.
 // Because QUIC is symmetric (both endpoints can open streams), there is no
 // distinction between client and server sessions.
@@ -39,6 +49,14 @@ type h3Session struct {
 	closeOnce sync.Once
 	metrics   *mux.SessionMetrics
 	idleCh    chan struct{}
+
+	// datagrams is set when both endpoints support QUIC DATAGRAM frames.
+	datagrams bool
+	// flows maps the stream ID of each datagram flow to its receiver; pending
+	// buffers datagrams for flows not yet set up by the accepting side.
+	flowsMu sync.Mutex
+	flows   map[quic.StreamID]*datagramFlow
+	pending map[quic.StreamID]*pendingFlow
 }
 
 // newH3Session creates an h3Session and starts its lifecycle goroutine.
@@ -58,8 +76,14 @@ func newH3Session(conn *quic.Conn, ctrl *quic.Stream, peerIdentity string, peerR
 		metrics:         metrics,
 		closedCh:        make(chan struct{}),
 		idleCh:          make(chan struct{}, 1),
+		datagrams:       datagramsSupported(conn),
+		flows:           make(map[quic.StreamID]*datagramFlow),
+		pending:         make(map[quic.StreamID]*pendingFlow),
 	}
 	go s.run()
+	if conn.ConnectionState().SupportsDatagrams.Local {
+		go s.recvDatagrams()
+	}
 	return s
 }
 
@@ -95,16 +119,17 @@ func (s *h3Session) onStreamClose(_ error) {
 }
 
 // wrapStream wraps a raw quic.Stream into a net.Conn-compatible countingConn.
-// stripMarker must be true for accepted streams so the 1-byte open marker is
-// consumed before the first application read.
-func (s *h3Session) wrapStream(qs *quic.Stream, stripMarker bool) net.Conn {
+// accepted must be true for accepted streams so the open marker and stream
+// header are consumed before the first application read.
+func (s *h3Session) wrapStream(qs *quic.Stream, accepted bool) net.Conn {
 	local := s.conn.LocalAddr()
 	remote := s.conn.RemoteAddr()
 	inner := newQuicConn(qs, local, remote, s.onStreamClose)
-	inner.stripMarker = stripMarker
+	inner.accepted = accepted
 	return &countingConn{
 		Conn:    inner,
 		metrics: s.metrics,
+		sess:    s,
 	}
 }
 
@@ -114,14 +139,19 @@ func (s *h3Session) wrapStream(qs *quic.Stream, stripMarker bool) net.Conn {
 // sent. This mirrors the behaviour of gRPC/h2mux, which sends HTTP/2 HEADERS
 // on stream open. Without this, Accept() on the peer would block until the
 // first application Write(), because QUIC streams are not announced to the
-// peer until the first STREAM frame is transmitted.
-func (s *h3Session) Open(ctx context.Context) (net.Conn, error) {
+// peer until the first STREAM frame is transmitted. A non-zero hdr is sent in
+// the same write, following openHeaderMarker instead of openMarker.
+func (s *h3Session) Open(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
 	if s.IsClosed() {
 		return nil, mux.ErrSessionClosed
 	}
 	if s.peerRejectsOpen {
 		return nil, ErrInboundRejected
 	}
+	preamble, err := encodeOpenPreamble(hdr)
+	if err != nil {
+		return nil, err
+	}
 	qs, err := s.conn.OpenStreamSync(ctx)
 	if err != nil {
 		s.metrics.StreamsFailed.Add(1)
@@ -130,7 +160,7 @@ func (s *h3Session) Open(ctx context.Context) (net.Conn, error) {
 		}
 		return nil, err
 	}
-	if _, err := qs.Write(openMarker[:]); err != nil {
+	if _, err := qs.Write(preamble); err != nil {
 		_ = qs.Close()
 		s.metrics.StreamsFailed.Add(1)
 		if s.IsClosed() {
@@ -143,10 +173,23 @@ func (s *h3Session) Open(ctx context.Context) (net.Conn, error) {
 	return s.wrapStream(qs, false), nil
 }
 
+// OpenPacket implements mux.PacketSession. The flow is announced on a new
+// stream carrying hdr; its datagrams travel in QUIC DATAGRAM frames tagged with
+// that stream's ID, or framed on the stream when the peer does not support
+// datagrams or a datagram does not fit in one packet.
+func (s *h3Session) OpenPacket(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
+	conn, err := s.Open(ctx, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return mux.AcceptPacket(conn), nil
+}
+
 // Accept blocks until a new stream is available or the session is closed.
-// The 1-byte open marker written by the opener's Open() is consumed lazily by
-// the returned conn's first Read, so a stream whose marker has not arrived
-// yet cannot stall the accept loop for subsequent streams.
+// The open marker and stream header written by the opener's Open() are
+// consumed lazily by the returned conn's first Read or Header call, so a
+// stream whose marker has not arrived yet cannot stall the accept loop for
+// subsequent streams.
 func (s *h3Session) Accept() (net.Conn, error) {
 	qs, err := s.conn.AcceptStream(s.conn.Context())
 	if err != nil {
@@ -188,6 +231,11 @@ func (s *h3Session) Stats() *mux.SessionMetrics { return s.metrics }
 // PeerIdentity returns the remote identity claim from the handshake.
 func (s *h3Session) PeerIdentity() string { return s.peerIdentity }
 
+// PeerCertificates implements mux.TLSSession.
+func (s *h3Session) PeerCertificates() []*x509.Certificate {
+	return s.conn.ConnectionState().TLS.PeerCertificates
+}
+
 // LocalAddr returns the local QUIC address.
 func (s *h3Session) LocalAddr() net.Addr { return s.conn.LocalAddr() }
 
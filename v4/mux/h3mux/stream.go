@@ -4,9 +4,12 @@
 package h3mux
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 
 	"github.com/quic-go/quic-go"
@@ -14,8 +17,90 @@ import (
 	"github.com/hexian000/tlswrapper/v4/mux"
 )
 
-// compile-time check that quicConn implements net.Conn.
-var _ net.Conn = (*quicConn)(nil)
+// compile-time checks that quicConn and countingConn implement mux.Stream.
+var _ mux.Stream = (*quicConn)(nil)
+var _ mux.Stream = (*countingConn)(nil)
+var _ mux.PacketStream = (*countingConn)(nil)
+
+// maxStreamHeaderSize bounds the encoded StreamHeader following
+// openHeaderMarker.
+const maxStreamHeaderSize = 4096
+
+// streamHeaderMsg is the wire form of mux.StreamHeader.
+type streamHeaderMsg struct {
+	Service     string `json:"service,omitempty"`
+	Datagram    bool   `json:"datagram,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Relay       string `json:"relay,omitempty"`
+	Hops        int    `json:"hops,omitempty"`
+}
+
+// encodeOpenPreamble returns the bytes written by Open before any application
+// data: openMarker alone, or openHeaderMarker followed by the encoded hdr.
+func encodeOpenPreamble(hdr mux.StreamHeader) ([]byte, error) {
+	if hdr.IsZero() {
+		return openMarker[:], nil
+	}
+	data, err := json.Marshal(streamHeaderMsg{
+		Service:     hdr.Service,
+		Datagram:    hdr.Datagram,
+		Destination: hdr.Destination,
+		Source:      hdr.Source,
+		Relay:       hdr.Relay,
+		Hops:        hdr.Hops,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: json encode: %v", errBadStreamHeader, err)
+	}
+	if len(data) > maxStreamHeaderSize {
+		return nil, fmt.Errorf("%w: header too large (%d bytes)", errBadStreamHeader, len(data))
+	}
+	b := make([]byte, 0, 3+len(data))
+	b = append(b, openHeaderMarker[0])
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...), nil
+}
+
+// readOpenPreamble consumes the open marker and, when present, the stream
+// header that follows it.
+func readOpenPreamble(r io.Reader) (mux.StreamHeader, error) {
+	var marker [1]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return mux.StreamHeader{}, fmt.Errorf("open marker read: %w", err)
+	}
+	switch marker[0] {
+	case openMarker[0]:
+		return mux.StreamHeader{}, nil
+	case openHeaderMarker[0]:
+	default:
+		return mux.StreamHeader{}, fmt.Errorf("%w: unknown open marker %#x", errBadStreamHeader, marker[0])
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return mux.StreamHeader{}, fmt.Errorf("stream header read: %w", err)
+	}
+	n := binary.BigEndian.Uint16(size[:])
+	if n > maxStreamHeaderSize {
+		return mux.StreamHeader{}, fmt.Errorf("%w: header too large (%d bytes)", errBadStreamHeader, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return mux.StreamHeader{}, fmt.Errorf("stream header read: %w", err)
+	}
+	var msg streamHeaderMsg
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		return mux.StreamHeader{}, fmt.Errorf("%w: json decode: %v", errBadStreamHeader, err)
+	}
+	return mux.StreamHeader{
+		Service:     msg.Service,
+		Datagram:    msg.Datagram,
+		Destination: msg.Destination,
+		Source:      msg.Source,
+		Relay:       msg.Relay,
+		Hops:        msg.Hops,
+	}, nil
+}
 
 // quicConn wraps *quic.Stream (struct pointer), adding the LocalAddr and RemoteAddr
 // methods required by net.Conn (which quic.Stream itself does not provide).
@@ -24,11 +109,15 @@ type quicConn struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 
-	// stripMarker is set on accepted streams: the 1-byte open marker written
-	// by the opener's Open() is consumed before the first application read.
-	// Doing this lazily (instead of in Accept) keeps the session-level accept
-	// loop from blocking on a stream whose marker has not arrived yet.
-	stripMarker bool
+	// accepted is set on accepted streams: the open marker and stream header
+	// written by the opener's Open() are consumed before the first
+	// application read. Doing this lazily (instead of in Accept) keeps the
+	// session-level accept loop from blocking on a stream whose marker has not
+	// arrived yet.
+	accepted   bool
+	headerOnce sync.Once
+	header     mux.StreamHeader
+	headerErr  error
 
 	// onClose is called exactly once when Close is called.
 	onClose   func(err error)
@@ -36,16 +125,24 @@ type quicConn struct {
 }
 
 func (c *quicConn) Read(b []byte) (int, error) {
-	if c.stripMarker {
-		var marker [1]byte
-		if _, err := io.ReadFull(c.Stream, marker[:]); err != nil {
-			return 0, fmt.Errorf("open marker read: %w", err)
-		}
-		c.stripMarker = false
+	if _, err := c.Header(); err != nil {
+		return 0, err
 	}
 	return c.Stream.Read(b)
 }
 
+// Header implements mux.Stream. On accepted streams the first call reads the
+// open preamble; streams opened locally report the zero header.
+func (c *quicConn) Header() (mux.StreamHeader, error) {
+	if !c.accepted {
+		return mux.StreamHeader{}, nil
+	}
+	c.headerOnce.Do(func() {
+		c.header, c.headerErr = readOpenPreamble(c.Stream)
+	})
+	return c.header, c.headerErr
+}
+
 func (c *quicConn) LocalAddr() net.Addr  { return c.localAddr }
 func (c *quicConn) RemoteAddr() net.Addr { return c.remoteAddr }
 
@@ -89,6 +186,8 @@ type countingConn struct {
 	net.Conn
 	metrics *mux.SessionMetrics
 	errored atomic.Bool
+	// sess carries datagram flows for PacketConn; nil disables them.
+	sess *h3Session
 }
 
 func (c *countingConn) Read(b []byte) (int, error) {
@@ -113,6 +212,21 @@ func (c *countingConn) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Header forwards to the wrapped stream's mux.Stream implementation.
+func (c *countingConn) Header() (mux.StreamHeader, error) {
+	return mux.HeaderOf(c.Conn)
+}
+
+// PacketConn implements mux.PacketStream: the stream's datagram flow uses QUIC
+// DATAGRAM frames when the peer supports them.
+func (c *countingConn) PacketConn() net.Conn {
+	qc, ok := c.Conn.(*quicConn)
+	if !ok || c.sess == nil {
+		return mux.NewFramedPacketConn(c)
+	}
+	return c.sess.newDatagramFlow(qc.Stream.StreamID(), c)
+}
+
 // CloseWrite half-closes the write side when the underlying conn supports it
 // (quicConn always does); otherwise it falls back to a full Close.
 func (c *countingConn) CloseWrite() error {
@@ -0,0 +1,87 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package h3mux
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestOpenPreamble(t *testing.T) {
+	t.Run("zero-header-is-legacy-marker", func(t *testing.T) {
+		b, err := encodeOpenPreamble(mux.StreamHeader{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, openMarker[:]) {
+			t.Fatalf("encodeOpenPreamble() = %v, want %v", b, openMarker[:])
+		}
+	})
+
+	t.Run("round-trip", func(t *testing.T) {
+		want := mux.StreamHeader{Service: "ssh"}
+		b, err := encodeOpenPreamble(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bytes.NewReader(append(b, "payload"...))
+		got, err := readOpenPreamble(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("readOpenPreamble() = %+v, want %+v", got, want)
+		}
+		if rest := r.Len(); rest != len("payload") {
+			t.Fatalf("unread bytes = %d, want %d", rest, len("payload"))
+		}
+	})
+
+	t.Run("round-trip-destination", func(t *testing.T) {
+		want := mux.StreamHeader{Destination: "[2001:db8::1]:443"}
+		b, err := encodeOpenPreamble(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readOpenPreamble(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("readOpenPreamble() = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("round-trip-relay", func(t *testing.T) {
+		want := mux.StreamHeader{Service: "ssh", Relay: "carol", Hops: 2}
+		b, err := encodeOpenPreamble(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readOpenPreamble(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("readOpenPreamble() = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("unknown-marker", func(t *testing.T) {
+		_, err := readOpenPreamble(bytes.NewReader([]byte{0xff}))
+		if !errors.Is(err, errBadStreamHeader) {
+			t.Fatalf("readOpenPreamble() error = %v, want %v", err, errBadStreamHeader)
+		}
+	})
+
+	t.Run("oversized-header", func(t *testing.T) {
+		_, err := readOpenPreamble(bytes.NewReader([]byte{openHeaderMarker[0], 0xff, 0xff}))
+		if !errors.Is(err, errBadStreamHeader) {
+			t.Fatalf("readOpenPreamble() error = %v, want %v", err, errBadStreamHeader)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxDatagramSize is the largest datagram a packet flow carries.
+const MaxDatagramSize = 65535
+
+// ErrDatagramTooLarge is returned when writing a datagram larger than
+// MaxDatagramSize to a packet flow.
+var ErrDatagramTooLarge = errors.New("mux: datagram too large")
+
+// PacketSession is implemented by sessions that carry datagram flows natively
+// instead of framing them on a stream.
+type PacketSession interface {
+	// OpenPacket opens a datagram flow; hdr.Datagram is already set.
+	OpenPacket(ctx context.Context, hdr StreamHeader) (net.Conn, error)
+}
+
+// PacketStream is implemented by accepted streams that can carry the datagram
+// flow announced in their header natively.
+type PacketStream interface {
+	// PacketConn returns the datagram flow carried by the stream. The flow
+	// owns the stream: closing the flow closes the stream.
+	PacketConn() net.Conn
+}
+
+// OpenPacket opens a datagram flow to the peer of s. Each Write on the
+// returned conn sends one datagram and each Read returns one. The accepting
+// side sees a stream whose header has Datagram set and passes it to
+// AcceptPacket.
+func OpenPacket(ctx context.Context, s Session, hdr StreamHeader) (net.Conn, error) {
+	hdr.Datagram = true
+	if ps, ok := s.(PacketSession); ok {
+		return ps.OpenPacket(ctx, hdr)
+	}
+	conn, err := s.Open(ctx, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return NewFramedPacketConn(conn), nil
+}
+
+// AcceptPacket returns the datagram flow carried by an accepted stream whose
+// header has Datagram set.
+func AcceptPacket(stream net.Conn) net.Conn {
+	if ps, ok := stream.(PacketStream); ok {
+		return ps.PacketConn()
+	}
+	return NewFramedPacketConn(stream)
+}
+
+// framedPacketConn carries datagrams on a stream, each prefixed with its
+// length as a 2-byte big-endian integer.
+type framedPacketConn struct {
+	net.Conn
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+// NewFramedPacketConn wraps a stream so that each Write sends one
+// length-prefixed datagram and each Read returns one. A datagram larger than
+// the Read buffer is truncated, as with a UDP socket.
+func NewFramedPacketConn(c net.Conn) net.Conn {
+	return &framedPacketConn{Conn: c}
+}
+
+func (c *framedPacketConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var size [2]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n <= len(b) {
+		if _, err := io.ReadFull(c.Conn, b[:n]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		return n, nil
+	}
+	if _, err := io.ReadFull(c.Conn, b); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if _, err := io.CopyN(io.Discard, c.Conn, int64(n-len(b))); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return len(b), nil
+}
+
+func (c *framedPacketConn) Write(b []byte) (int, error) {
+	if len(b) > MaxDatagramSize {
+		return 0, fmt.Errorf("%w (%d bytes)", ErrDatagramTooLarge, len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// unexpectedEOF reports a stream that ended inside a datagram.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
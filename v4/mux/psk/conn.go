@@ -0,0 +1,112 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package psk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxRecord is the largest Noise message; a record carries at most
+// maxRecord-tagLen bytes of data.
+const maxRecord = 65535
+
+var errRecordAuth = errors.New("psk: record authentication failed")
+
+// Conn is a net.Conn whose data is carried in AES-GCM records keyed by the
+// handshake. Read and Write may be called concurrently.
+type Conn struct {
+	net.Conn
+	keyID string
+
+	rmu  sync.Mutex
+	rcs  *cipherState
+	rbuf []byte // ciphertext of the current record, reused
+	rpt  []byte // unread plaintext of the current record
+	rerr error
+
+	wmu  sync.Mutex
+	wcs  *cipherState
+	wbuf []byte
+	werr error
+}
+
+func newConn(conn net.Conn, keyID string, wcs, rcs *cipherState) *Conn {
+	return &Conn{Conn: conn, keyID: keyID, rcs: rcs, wcs: wcs}
+}
+
+// KeyID returns the ID of the key the connection was established with.
+func (c *Conn) KeyID() string { return c.keyID }
+
+// Read decrypts records from the underlying connection. Errors are
+// permanent, as a record cut short cannot be resumed.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rpt) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		if err := c.readRecord(); err != nil {
+			c.rerr = err
+			return 0, err
+		}
+	}
+	n := copy(b, c.rpt)
+	c.rpt = c.rpt[n:]
+	return n, nil
+}
+
+func (c *Conn) readRecord() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n < tagLen {
+		return errRecordAuth
+	}
+	if cap(c.rbuf) < n {
+		c.rbuf = make([]byte, n, maxRecord)
+	}
+	rec := c.rbuf[:n]
+	if _, err := io.ReadFull(c.Conn, rec); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	pt, err := c.rcs.open(rec[:0], nil, rec)
+	if err != nil {
+		return errRecordAuth
+	}
+	c.rpt = pt
+	return nil
+}
+
+// Write encrypts b into one or more records.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxRecord-tagLen)]
+		c.wbuf = binary.BigEndian.AppendUint16(c.wbuf[:0], uint16(len(chunk)+tagLen))
+		c.wbuf = c.wcs.seal(c.wbuf, nil, chunk)
+		if _, err := c.Conn.Write(c.wbuf); err != nil {
+			// A partly written record cannot be resumed.
+			c.werr = err
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
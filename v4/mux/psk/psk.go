@@ -0,0 +1,314 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+// Package psk secures a connection with a pre-shared key instead of
+// certificates. The handshake is Noise_NNpsk0_25519_AESGCM_SHA256: both sides
+// contribute an ephemeral X25519 key, and only holders of the PSK can
+// complete it. The initiator names its key by ID in the first message, so
+// that a responder can hold several keys while one is being rotated.
+package psk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// KeySize is the size of a pre-shared key in bytes.
+const KeySize = 32
+
+const protocolName = "Noise_NNpsk0_25519_AESGCM_SHA256"
+
+// prologue binds the handshake to this protocol; the key ID is appended.
+const prologue = "tlswrapper psk v1\x00"
+
+var (
+	// ErrUnknownKey is returned by Server when the initiator names a key ID
+	// that is not configured.
+	ErrUnknownKey = errors.New("psk: unknown key id")
+	// ErrHandshakeFailed is returned when the peer does not hold the key.
+	ErrHandshakeFailed = errors.New("psk: handshake failed")
+	// ErrNoKey is returned by Client when Config.KeyID names no key.
+	ErrNoKey = errors.New("psk: no key to dial with")
+)
+
+// Config holds the pre-shared keys.
+type Config struct {
+	// Keys maps key IDs to KeySize-byte keys. Server accepts any of them.
+	Keys map[string][]byte
+	// KeyID selects the key Client uses.
+	KeyID string
+}
+
+// cipherState is a Noise CipherState over AES-256-GCM.
+type cipherState struct {
+	aead  cipher.AEAD
+	n     uint64
+	nonce [12]byte
+}
+
+func newCipherState(k []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(k[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead}, nil
+}
+
+func (c *cipherState) nextNonce() []byte {
+	binary.BigEndian.PutUint64(c.nonce[4:], c.n)
+	c.n++
+	return c.nonce[:]
+}
+
+func (c *cipherState) seal(dst, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nextNonce(), plaintext, ad)
+}
+
+func (c *cipherState) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nextNonce(), ciphertext, ad)
+}
+
+// symmetricState is the Noise SymmetricState with SHA-256.
+type symmetricState struct {
+	ck, h [sha256.Size]byte
+	cs    *cipherState
+}
+
+func newSymmetricState(keyID string) *symmetricState {
+	s := &symmetricState{}
+	copy(s.h[:], protocolName) // exactly HASHLEN bytes
+	s.ck = s.h
+	s.mixHash([]byte(prologue + keyID))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+// hkdf is the Noise HKDF, returning 3 outputs.
+func (s *symmetricState) hkdf(ikm []byte) (out [3][sha256.Size]byte) {
+	mac := hmac.New(sha256.New, s.ck[:])
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+	var prev []byte
+	for i := range out {
+		mac := hmac.New(sha256.New, tempKey)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i + 1)})
+		mac.Sum(out[i][:0])
+		prev = out[i][:]
+	}
+	return out
+}
+
+func (s *symmetricState) mixKey(ikm []byte) error {
+	out := s.hkdf(ikm)
+	s.ck = out[0]
+	cs, err := newCipherState(out[1][:])
+	s.cs = cs
+	return err
+}
+
+func (s *symmetricState) mixKeyAndHash(ikm []byte) error {
+	out := s.hkdf(ikm)
+	s.ck = out[0]
+	s.mixHash(out[1][:])
+	cs, err := newCipherState(out[2][:])
+	s.cs = cs
+	return err
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	c := s.cs.seal(nil, s.h[:], plaintext)
+	s.mixHash(c)
+	return c
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	p, err := s.cs.open(nil, s.h[:], ciphertext)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	s.mixHash(ciphertext)
+	return p, nil
+}
+
+// split returns the initiator-to-responder and responder-to-initiator
+// cipher states.
+func (s *symmetricState) split() (*cipherState, *cipherState, error) {
+	out := s.hkdf(nil)
+	c1, err := newCipherState(out[0][:])
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newCipherState(out[1][:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// Handshake messages: a 2-byte length, then for the first message the key ID
+// (1-byte length and bytes) followed by the Noise message "psk, e" and its
+// empty encrypted payload; the response is the Noise message "e, ee".
+const (
+	dhLen     = 32
+	tagLen    = 16
+	msgLen    = dhLen + tagLen
+	maxKeyLen = 255
+)
+
+// Client runs the initiator handshake on conn with the key cfg.KeyID.
+func Client(conn net.Conn, cfg *Config) (*Conn, error) {
+	psk, ok := cfg.Keys[cfg.KeyID]
+	if !ok || len(psk) != KeySize {
+		return nil, ErrNoKey
+	}
+	if len(cfg.KeyID) > maxKeyLen {
+		return nil, fmt.Errorf("psk: key id %q is too long", cfg.KeyID)
+	}
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := newSymmetricState(cfg.KeyID)
+	if err := s.mixKeyAndHash(psk); err != nil {
+		return nil, err
+	}
+	epub := e.PublicKey().Bytes()
+	s.mixHash(epub)
+	if err := s.mixKey(epub); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 0, 2+1+len(cfg.KeyID)+msgLen)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(1+len(cfg.KeyID)+msgLen))
+	msg = append(msg, byte(len(cfg.KeyID)))
+	msg = append(msg, cfg.KeyID...)
+	msg = append(msg, epub...)
+	msg = append(msg, s.encryptAndHash(nil)...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	resp, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != msgLen {
+		return nil, ErrHandshakeFailed
+	}
+	re, err := ecdh.X25519().NewPublicKey(resp[:dhLen])
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	s.mixHash(resp[:dhLen])
+	if err := s.mixKey(resp[:dhLen]); err != nil {
+		return nil, err
+	}
+	ee, err := e.ECDH(re)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	if err := s.mixKey(ee); err != nil {
+		return nil, err
+	}
+	if _, err := s.decryptAndHash(resp[dhLen:]); err != nil {
+		return nil, err
+	}
+	c1, c2, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, cfg.KeyID, c1, c2), nil
+}
+
+// Server runs the responder handshake on conn with the key the initiator
+// names, which must be in cfg.Keys.
+func Server(conn net.Conn, cfg *Config) (*Conn, error) {
+	msg, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 1 || len(msg) != 1+int(msg[0])+msgLen {
+		return nil, ErrHandshakeFailed
+	}
+	keyID, msg := string(msg[1:1+msg[0]]), msg[1+msg[0]:]
+	psk, ok := cfg.Keys[keyID]
+	if !ok || len(psk) != KeySize {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:dhLen])
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	s := newSymmetricState(keyID)
+	if err := s.mixKeyAndHash(psk); err != nil {
+		return nil, err
+	}
+	s.mixHash(msg[:dhLen])
+	if err := s.mixKey(msg[:dhLen]); err != nil {
+		return nil, err
+	}
+	if _, err := s.decryptAndHash(msg[dhLen:]); err != nil {
+		return nil, err
+	}
+
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	epub := e.PublicKey().Bytes()
+	s.mixHash(epub)
+	if err := s.mixKey(epub); err != nil {
+		return nil, err
+	}
+	ee, err := e.ECDH(re)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	if err := s.mixKey(ee); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 0, 2+msgLen)
+	resp = binary.BigEndian.AppendUint16(resp, msgLen)
+	resp = append(resp, epub...)
+	resp = append(resp, s.encryptAndHash(nil)...)
+	if _, err := conn.Write(resp); err != nil {
+		return nil, err
+	}
+	c1, c2, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, keyID, c2, c1), nil
+}
+
+// readMessage reads one length-prefixed handshake message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,165 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package psk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	k := make([]byte, KeySize)
+	if _, err := rand.Read(k); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// handshake runs Client and Server over a pipe.
+func handshake(t *testing.T, client, server *Config) (*Conn, *Conn, error, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := Server(c2, server)
+		if err != nil {
+			_ = c2.Close()
+		}
+		ch <- result{conn, err}
+	}()
+	cc, cerr := Client(c1, client)
+	if cerr != nil {
+		_ = c1.Close()
+	}
+	r := <-ch
+	return cc, r.conn, cerr, r.err
+}
+
+func TestHandshakeAndRecords(t *testing.T) {
+	old, cur := newKey(t), newKey(t)
+	server := &Config{Keys: map[string][]byte{"old": old, "cur": cur}}
+	for _, id := range []string{"old", "cur"} {
+		client := &Config{Keys: map[string][]byte{id: server.Keys[id]}, KeyID: id}
+		cc, sc, cerr, serr := handshake(t, client, server)
+		if cerr != nil || serr != nil {
+			t.Fatalf("handshake with key %q: client %v, server %v", id, cerr, serr)
+		}
+		if cc.KeyID() != id || sc.KeyID() != id {
+			t.Fatalf("KeyID() = %q/%q, want %q", cc.KeyID(), sc.KeyID(), id)
+		}
+
+		// Larger than one record, in both directions at once.
+		data := make([]byte, 3*maxRecord)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := cc.Write(data)
+			errCh <- err
+		}()
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(sc, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data corrupted")
+		}
+		go func() {
+			_, err := sc.Write([]byte("pong"))
+			errCh <- err
+		}()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(cc, buf); err != nil || string(buf) != "pong" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	key := newKey(t)
+	server := &Config{Keys: map[string][]byte{"a": key}}
+
+	_, _, cerr, serr := handshake(t, &Config{Keys: map[string][]byte{"a": newKey(t)}, KeyID: "a"}, server)
+	if cerr == nil || !errors.Is(serr, ErrHandshakeFailed) {
+		t.Fatalf("wrong key: client %v, server %v", cerr, serr)
+	}
+	_, _, cerr, serr = handshake(t, &Config{Keys: map[string][]byte{"b": key}, KeyID: "b"}, server)
+	if cerr == nil || !errors.Is(serr, ErrUnknownKey) {
+		t.Fatalf("unknown key id: client %v, server %v", cerr, serr)
+	}
+	if _, err := Client(nil, &Config{Keys: map[string][]byte{"a": key}, KeyID: "c"}); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("Client() with missing key = %v, want ErrNoKey", err)
+	}
+}
+
+// tamperConn flips a bit in the first byte written after arm is set.
+type tamperConn struct {
+	net.Conn
+	arm bool
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if c.arm && len(b) > 2 {
+		b = bytes.Clone(b)
+		b[2] ^= 1
+		c.arm = false
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTamperedRecord(t *testing.T) {
+	key := newKey(t)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	tc := &tamperConn{Conn: c1}
+	errCh := make(chan error, 1)
+	var sc *Conn
+	go func() {
+		var err error
+		sc, err = Server(c2, &Config{Keys: map[string][]byte{"k": key}})
+		errCh <- err
+	}()
+	cc, err := Client(tc, &Config{Keys: map[string][]byte{"k": key}, KeyID: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	tc.arm = true
+	go func() {
+		_, err := cc.Write([]byte("hello"))
+		errCh <- err
+	}()
+	if _, err := sc.Read(make([]byte, 16)); !errors.Is(err, errRecordAuth) {
+		t.Fatalf("Read() of a tampered record = %v, want errRecordAuth", err)
+	}
+	if _, err := sc.Read(make([]byte, 16)); !errors.Is(err, errRecordAuth) {
+		t.Fatalf("Read() after a tampered record = %v, want errRecordAuth", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@ package mux
 
 import (
 	"context"
+	"crypto/x509"
 	"net"
 )
 
@@ -18,8 +19,9 @@ type Session interface {
 	// Handshake completes the protocol setup. It is a no-op after the first
 	// successful call, and returns the same error for every call after a failure.
 	Handshake(ctx context.Context) error
-	// Open opens a new outbound stream to the peer.
-	Open(ctx context.Context) (net.Conn, error)
+	// Open opens a new outbound stream to the peer. hdr is delivered to the
+	// peer together with the stream open; see Stream.Header.
+	Open(ctx context.Context, hdr StreamHeader) (net.Conn, error)
 	// Accept blocks until a new inbound stream arrives or the session is closed.
 	Accept() (net.Conn, error)
 	// Close closes the session and all its streams.
@@ -41,6 +43,23 @@ type Session interface {
 	RemoteAddr() net.Addr
 }
 
+// TLSSession is implemented by sessions that run over TLS and can report the
+// certificate chain presented by the peer.
+type TLSSession interface {
+	// PeerCertificates returns the peer's certificate chain, leaf first, or
+	// nil when the session is not encrypted.
+	PeerCertificates() []*x509.Certificate
+}
+
+// PeerCertificatesOf returns the peer certificates of s, or nil when s does
+// not run over TLS.
+func PeerCertificatesOf(s Session) []*x509.Certificate {
+	if ts, ok := s.(TLSSession); ok {
+		return ts.PeerCertificates()
+	}
+	return nil
+}
+
 // Dialer creates outbound mux sessions by dialing a remote address.
 // Implementations must be safe for concurrent use.
 type Dialer interface {
@@ -0,0 +1,50 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package mux
+
+import "net"
+
+// StreamHeader carries per-stream metadata sent by the opening side together
+// with the stream open. The zero value asks the accepting side for its default
+// forwarding target.
+type StreamHeader struct {
+	// Service names the accepting side's service to forward the stream to.
+	Service string
+	// Datagram marks the stream as a datagram flow (see OpenPacket).
+	Datagram bool
+	// Destination is a "host:port" requested by the opener in place of the
+	// accepting side's configured target, subject to its allowlist.
+	Destination string
+	// Source is the "ip:port" of the client whose connection the opener
+	// relays, for the accepting side to pass on to its target.
+	Source string
+	// Relay is the identity of the peer the stream is headed to when the
+	// accepting side is an intermediate hop that should pass it on.
+	Relay string
+	// Hops counts the intermediate peers the stream has already passed.
+	Hops int
+}
+
+// IsZero reports whether h carries no metadata.
+func (h StreamHeader) IsZero() bool {
+	return h == StreamHeader{}
+}
+
+// Stream is implemented by streams returned from Session.Accept.
+type Stream interface {
+	net.Conn
+	// Header returns the metadata sent by the opener. Transports that carry
+	// the header in-band read it on the first call, so Header may block until
+	// it arrives; the stream's read deadline applies.
+	Header() (StreamHeader, error)
+}
+
+// HeaderOf returns the header of an accepted stream. Streams that do not carry
+// a header report the zero value.
+func HeaderOf(conn net.Conn) (StreamHeader, error) {
+	if s, ok := conn.(Stream); ok {
+		return s.Header()
+	}
+	return StreamHeader{}, nil
+}
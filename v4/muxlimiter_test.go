@@ -17,17 +17,19 @@ type fakeMuxSession struct {
 	closed atomic.Bool
 }
 
-func (s *fakeMuxSession) Handshake(context.Context) error        { return nil }
-func (s *fakeMuxSession) Open(context.Context) (net.Conn, error) { return nil, mux.ErrSessionClosed }
-func (s *fakeMuxSession) Accept() (net.Conn, error)              { return nil, mux.ErrSessionClosed }
-func (s *fakeMuxSession) Close() error                           { s.closed.Store(true); return nil }
-func (s *fakeMuxSession) IsClosed() bool                         { return s.closed.Load() }
-func (s *fakeMuxSession) CloseChan() <-chan struct{}             { return nil }
-func (s *fakeMuxSession) IdleChan() <-chan struct{}              { return nil }
-func (s *fakeMuxSession) Stats() *mux.SessionMetrics             { return nil }
-func (s *fakeMuxSession) PeerIdentity() string                   { return "" }
-func (s *fakeMuxSession) LocalAddr() net.Addr                    { return nil }
-func (s *fakeMuxSession) RemoteAddr() net.Addr                   { return nil }
+func (s *fakeMuxSession) Handshake(context.Context) error { return nil }
+func (s *fakeMuxSession) Open(context.Context, mux.StreamHeader) (net.Conn, error) {
+	return nil, mux.ErrSessionClosed
+}
+func (s *fakeMuxSession) Accept() (net.Conn, error)  { return nil, mux.ErrSessionClosed }
+func (s *fakeMuxSession) Close() error               { s.closed.Store(true); return nil }
+func (s *fakeMuxSession) IsClosed() bool             { return s.closed.Load() }
+func (s *fakeMuxSession) CloseChan() <-chan struct{} { return nil }
+func (s *fakeMuxSession) IdleChan() <-chan struct{}  { return nil }
+func (s *fakeMuxSession) Stats() *mux.SessionMetrics { return nil }
+func (s *fakeMuxSession) PeerIdentity() string       { return "" }
+func (s *fakeMuxSession) LocalAddr() net.Addr        { return nil }
+func (s *fakeMuxSession) RemoteAddr() net.Addr       { return nil }
 
 // fakeMuxListener returns the queued sessions in order, then ErrSessionClosed.
 type fakeMuxListener struct {
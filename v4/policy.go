@@ -0,0 +1,101 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+// peerLeaf returns the leaf certificate the peer of t's session presented, or
+// nil when there is no session or it runs in plaintext mode.
+func peerLeaf(t *tunnel) *x509.Certificate {
+	if t == nil {
+		return nil
+	}
+	if ss := t.getSession(); ss != nil {
+		if certs := mux.PeerCertificatesOf(ss); len(certs) > 0 {
+			return certs[0]
+		}
+	}
+	return nil
+}
+
+// streamRequest describes what a stream header asks for, for log messages.
+func streamRequest(hdr mux.StreamHeader) string {
+	switch {
+	case hdr.Destination != "":
+		return fmt.Sprintf("destination %q", hdr.Destination)
+	case hdr.Datagram:
+		return "udp flows"
+	case hdr.Service != "":
+		return fmt.Sprintf("service %q", hdr.Service)
+	}
+	return "connect"
+}
+
+// policyAllowsStream reports whether p lets the peer open a stream with hdr.
+func policyAllowsStream(p *config.Policy, hdr mux.StreamHeader) bool {
+	switch {
+	case hdr.Destination != "":
+		return p.Destinations
+	case hdr.Datagram:
+		return p.UDP
+	}
+	return p.AllowsService(hdr.Service)
+}
+
+// policyDenied logs a policy denial, records it in the recent events, and
+// counts it by direction: inbound for streams opened by the peer, outbound for
+// streams our listeners would open toward it.
+func (s *Server) policyDenied(tag string, inbound bool, msg string) {
+	if inbound {
+		s.stats.deniedInbound.Add(1)
+	} else {
+		s.stats.deniedOutbound.Add(1)
+	}
+	msg = fmt.Sprintf("%s: policy: %s", tag, msg)
+	slog.Warning(msg)
+	s.recentEvents.Add(time.Now(), msg)
+}
+
+// peerStreams counts the streams each peer has open to us, for
+// config.Policy.MaxStreams.
+type peerStreams struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire reserves one of peer's limit concurrent streams (limit <= 0 =
+// unlimited). The returned release may be called more than once.
+func (ps *peerStreams) acquire(peer string, limit int) (release func(), ok bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.counts[peer] >= limit {
+		return nil, false
+	}
+	if ps.counts == nil {
+		ps.counts = make(map[string]int)
+	}
+	ps.counts[peer]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ps.mu.Lock()
+			defer ps.mu.Unlock()
+			if ps.counts[peer]--; ps.counts[peer] <= 0 {
+				delete(ps.counts, peer)
+			}
+		})
+	}, true
+}
@@ -0,0 +1,127 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestPolicyAllowsStream(t *testing.T) {
+	p := &config.Policy{Services: []string{"ssh"}, UDP: true}
+	for _, tc := range []struct {
+		hdr  mux.StreamHeader
+		want bool
+	}{
+		{mux.StreamHeader{}, false},
+		{mux.StreamHeader{Service: "ssh"}, true},
+		{mux.StreamHeader{Service: "web"}, false},
+		{mux.StreamHeader{Datagram: true}, true},
+		{mux.StreamHeader{Destination: "10.0.0.1:22"}, false},
+	} {
+		if got := policyAllowsStream(p, tc.hdr); got != tc.want {
+			t.Errorf("policyAllowsStream(%s) = %v, want %v", streamRequest(tc.hdr), got, tc.want)
+		}
+	}
+}
+
+func TestPeerStreamsAcquire(t *testing.T) {
+	var ps peerStreams
+	release1, ok := ps.acquire("alice", 2)
+	if !ok {
+		t.Fatal("first stream denied")
+	}
+	release2, ok := ps.acquire("alice", 2)
+	if !ok {
+		t.Fatal("second stream denied")
+	}
+	if _, ok := ps.acquire("alice", 2); ok {
+		t.Fatal("third stream allowed over the limit of 2")
+	}
+	if _, ok := ps.acquire("bob", 2); !ok {
+		t.Fatal("limit is not per peer")
+	}
+	release1()
+	release1() // releasing twice must not free a second slot
+	if _, ok := ps.acquire("alice", 2); !ok {
+		t.Fatal("released slot was not reused")
+	}
+	if _, ok := ps.acquire("alice", 2); ok {
+		t.Fatal("double release freed an extra slot")
+	}
+	release2()
+	if _, ok := ps.acquire("carol", 0); !ok {
+		t.Fatal("limit 0 must be unlimited")
+	}
+}
+
+// headerStream is an accepted stream that carries hdr.
+type headerStream struct {
+	net.Conn
+	hdr mux.StreamHeader
+}
+
+func (s *headerStream) Header() (mux.StreamHeader, error) { return s.hdr, nil }
+
+// TestPolicyMaxStreamsFlows verifies that UDP flows and relayed streams count
+// toward max_streams and free their slot when closed.
+func TestPolicyMaxStreamsFlows(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"udp_connect": "127.0.0.1:9",
+		"identity": map[string]any{
+			"claim":       "hub",
+			"allow_relay": map[string]any{"peer-a": []string{"peer-b"}},
+		},
+		"policies": []map[string]any{
+			{"identities": []string{"peer-a"}, "udp": true, "max_streams": 1},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	open := func(hdr mux.StreamHeader) net.Conn {
+		stream, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+		s.handleInboundStream(nil, "peer-a", &headerStream{Conn: stream, hdr: hdr})
+		return peer
+	}
+	isClosed := func(peer net.Conn) bool {
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := peer.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+	}
+
+	flow := open(mux.StreamHeader{Datagram: true})
+	if isClosed(flow) {
+		t.Fatal("first udp flow was refused")
+	}
+	if !isClosed(open(mux.StreamHeader{Datagram: true})) {
+		t.Fatal("second udp flow exceeded max_streams")
+	}
+	if !isClosed(open(mux.StreamHeader{Relay: "peer-b"})) {
+		t.Fatal("relayed stream exceeded max_streams")
+	}
+	if got := s.stats.deniedInbound.Load(); got != 2 {
+		t.Fatalf("deniedInbound = %d, want 2", got)
+	}
+	_ = flow.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		release, ok := s.peerStreams.acquire("peer-a", 1)
+		if ok {
+			release()
+		}
+		return ok
+	})
+	// A relayed stream that cannot be opened frees its slot too.
+	if !isClosed(open(mux.StreamHeader{Relay: "peer-b"})) {
+		t.Fatal("relayed stream without a session to peer-b was not closed")
+	}
+	if _, ok := s.peerStreams.acquire("peer-a", 1); !ok {
+		t.Fatal("failed relay did not free its slot")
+	}
+}
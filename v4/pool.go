@@ -0,0 +1,276 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// backendPool forwards inbound streams to the backends of a config.Pool.
+type backendPool struct {
+	name     string
+	cfg      config.Pool
+	backends []*backend
+	next     atomic.Uint64 // round-robin counter
+
+	// ctx is canceled by stop to end health checks, including in-flight dials.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// backend is one member of a backendPool.
+type backend struct {
+	addr     string
+	active   atomic.Int64 // forwarded connections currently open
+	dials    atomic.Uint64
+	failures atomic.Uint64
+
+	mu           sync.Mutex
+	healthy      bool // result of the last health check; true when disabled
+	fails        int  // consecutive dial failures
+	ejectedUntil time.Time
+}
+
+func newBackendPool(name string, cfg config.Pool) *backendPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &backendPool{name: name, cfg: cfg, ctx: ctx, cancel: cancel}
+	for _, addr := range cfg.Backends {
+		p.backends = append(p.backends, &backend{addr: addr, healthy: true})
+	}
+	return p
+}
+
+// available reports whether b passed its last health check and is not ejected.
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// recordDial counts a dial result and reports whether a failure ejected b.
+func (b *backend) recordDial(cfg config.Pool, err error, now time.Time) bool {
+	b.dials.Add(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.fails = 0
+		return false
+	}
+	b.failures.Add(1)
+	b.fails++
+	if b.fails < cfg.MaxFailures() {
+		return false
+	}
+	b.fails = 0
+	b.ejectedUntil = now.Add(cfg.EjectDuration())
+	return true
+}
+
+// setHealthy records a health check result and reports whether it changed the
+// backend's state. A passing check also ends an ejection early.
+func (b *backend) setHealthy(healthy bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := b.healthy != healthy
+	b.healthy = healthy
+	if healthy {
+		b.fails = 0
+		b.ejectedUntil = time.Time{}
+	}
+	return changed
+}
+
+// weight is the rendezvous hashing score of b for key.
+func (b *backend) weight(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(b.addr))
+	return h.Sum64()
+}
+
+// candidates returns the backends to try for one stream in order of
+// preference. key is hashed by the "hash" policy. When no backend is
+// available, all of them are returned: trying a backend that is believed to be
+// down beats failing the stream outright.
+func (p *backendPool) candidates(key string, now time.Time) []*backend {
+	list := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.available(now) {
+			list = append(list, b)
+		}
+	}
+	if len(list) == 0 {
+		list = append(list, p.backends...)
+	}
+	switch p.cfg.Balance {
+	case "random":
+		list = rotate(list, rand.IntN(len(list)))
+	case "least-connections":
+		// Rotate first so that ties are spread round-robin.
+		list = rotate(list, int((p.next.Add(1)-1)%uint64(len(list))))
+		slices.SortStableFunc(list, func(a, b *backend) int {
+			return cmp.Compare(a.active.Load(), b.active.Load())
+		})
+	case "hash":
+		slices.SortFunc(list, func(a, b *backend) int {
+			return cmp.Compare(b.weight(key), a.weight(key))
+		})
+	default:
+		list = rotate(list, int((p.next.Add(1)-1)%uint64(len(list))))
+	}
+	return list
+}
+
+func rotate(list []*backend, i int) []*backend {
+	return slices.Concat(list[i:], list[:i])
+}
+
+// dial connects to a backend chosen for the peer identity key, trying the
+// other candidates when a dial fails. Each attempt gets an equal share of the
+// time left before ctx's deadline.
+func (p *backendPool) dial(ctx context.Context, s *Server, key string) (net.Conn, error) {
+	list := p.candidates(key, time.Now())
+	var errs []error
+	for i, b := range list {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(list)-i))
+		}
+		dialed, err := s.dialDirect(attemptCtx, b.addr)
+		cancel()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// Shutting down; the backend is not to blame.
+			if dialed != nil {
+				ioClose(dialed)
+			}
+			break
+		}
+		if b.recordDial(p.cfg, err, time.Now()) {
+			slog.Warningf("pool %q: backend %s ejected after %d dial failures",
+				p.name, b.addr, p.cfg.MaxFailures())
+			s.recentEvents.Add(time.Now(), fmt.Sprintf("pool %q: backend %s ejected", p.name, b.addr))
+		}
+		if err == nil {
+			b.active.Add(1)
+			return &releaseConn{Conn: dialed, release: func() { b.active.Add(-1) }}, nil
+		}
+		slog.Debugf("pool %q: dial %s: %s", p.name, b.addr, formats.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %w", b.addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, ctx.Err())
+	}
+	return nil, fmt.Errorf("pool %q: %w", p.name, errors.Join(errs...))
+}
+
+// healthCheckLoop dials every backend each health check interval until the
+// pool is stopped or the server shuts down.
+func (p *backendPool) healthCheckLoop(s *Server) {
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval())
+	defer ticker.Stop()
+	for {
+		p.checkHealth(s)
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		case <-s.g.CloseC():
+			return
+		}
+	}
+}
+
+// checkHealth dials all backends concurrently and records the results.
+func (p *backendPool) checkHealth(s *Server) {
+	cfg, _ := s.getConfig()
+	ctx, cancel := context.WithTimeout(p.ctx, cfg.ConnectTimeout())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Go(func() {
+			conn, err := s.dialer.DialContext(ctx, network, b.addr)
+			if p.ctx.Err() != nil {
+				if conn != nil {
+					ioClose(conn)
+				}
+				return
+			}
+			if err == nil {
+				ioClose(conn)
+			}
+			if !b.setHealthy(err == nil) {
+				return
+			}
+			if err != nil {
+				slog.Warningf("pool %q: backend %s is down: %s", p.name, b.addr, formats.Error(err))
+				s.recentEvents.Add(time.Now(), fmt.Sprintf("pool %q: backend %s down", p.name, b.addr))
+			} else {
+				slog.Noticef("pool %q: backend %s is up", p.name, b.addr)
+				s.recentEvents.Add(time.Now(), fmt.Sprintf("pool %q: backend %s up", p.name, b.addr))
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// start launches health checks when they are enabled.
+func (p *backendPool) start(s *Server) error {
+	if p.cfg.HealthCheckInterval() <= 0 {
+		return nil
+	}
+	return s.g.Go(func() { p.healthCheckLoop(s) })
+}
+
+// stop ends health checks. Connections already forwarded are not affected.
+func (p *backendPool) stop() {
+	p.cancel()
+}
+
+// BackendStats is a snapshot of one backend of a pool.
+type BackendStats struct {
+	Pool     string
+	Addr     string
+	Healthy  bool // passed its last health check (always true when disabled)
+	Ejected  bool // skipped after consecutive dial failures
+	Active   int64
+	Dials    uint64
+	Failures uint64
+}
+
+// Stats snapshots all backends in config order.
+func (p *backendPool) Stats(now time.Time) []BackendStats {
+	stats := make([]BackendStats, 0, len(p.backends))
+	for _, b := range p.backends {
+		b.mu.Lock()
+		v := BackendStats{
+			Pool:    p.name,
+			Addr:    b.addr,
+			Healthy: b.healthy,
+			Ejected: now.Before(b.ejectedUntil),
+		}
+		b.mu.Unlock()
+		v.Active = b.active.Load()
+		v.Dials, v.Failures = b.dials.Load(), b.failures.Load()
+		stats = append(stats, v)
+	}
+	return stats
+}
@@ -0,0 +1,266 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+func backendAddrs(list []*backend) []string {
+	addrs := make([]string, 0, len(list))
+	for _, b := range list {
+		addrs = append(addrs, b.addr)
+	}
+	return addrs
+}
+
+func TestBackendPoolCandidates(t *testing.T) {
+	backends := []string{"a:1", "b:1", "c:1"}
+	now := time.Now()
+
+	t.Run("round-robin", func(t *testing.T) {
+		p := newBackendPool("web", config.Pool{Backends: backends})
+		for i, want := range []string{"a:1", "b:1", "c:1", "a:1"} {
+			if got := p.candidates("", now)[0].addr; got != want {
+				t.Fatalf("pick %d = %s, want %s", i, got, want)
+			}
+		}
+		if got := backendAddrs(p.candidates("", now)); strings.Join(got, ",") != "b:1,c:1,a:1" {
+			t.Fatalf("candidates = %v, want the others as fallbacks", got)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		p := newBackendPool("web", config.Pool{Backends: backends, Balance: "random"})
+		seen := make(map[string]bool)
+		for range 200 {
+			list := p.candidates("", now)
+			if len(list) != len(backends) {
+				t.Fatalf("candidates = %v", backendAddrs(list))
+			}
+			seen[list[0].addr] = true
+		}
+		if len(seen) != len(backends) {
+			t.Fatalf("random picks covered %v, want all backends", seen)
+		}
+	})
+
+	t.Run("least-connections", func(t *testing.T) {
+		p := newBackendPool("web", config.Pool{Backends: backends, Balance: "least-connections"})
+		p.backends[0].active.Store(2)
+		p.backends[1].active.Store(1)
+		p.backends[2].active.Store(3)
+		if got := backendAddrs(p.candidates("", now)); strings.Join(got, ",") != "b:1,a:1,c:1" {
+			t.Fatalf("candidates = %v, want fewest connections first", got)
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		p := newBackendPool("web", config.Pool{Backends: backends, Balance: "hash"})
+		seen := make(map[string]bool)
+		for i := range 30 {
+			key := fmt.Sprintf("peer-%d", i)
+			first := p.candidates(key, now)[0].addr
+			if again := p.candidates(key, now)[0].addr; again != first {
+				t.Fatalf("%s moved from %s to %s", key, first, again)
+			}
+			seen[first] = true
+			// Losing a backend only moves the keys that hashed to it.
+			p.backends[2].ejectedUntil = now.Add(time.Minute)
+			if first != "c:1" {
+				if got := p.candidates(key, now)[0].addr; got != first {
+					t.Fatalf("%s moved from %s to %s after c:1 was ejected", key, first, got)
+				}
+			}
+			p.backends[2].ejectedUntil = time.Time{}
+		}
+		if len(seen) < 2 {
+			t.Fatalf("all keys hashed to %v", seen)
+		}
+	})
+
+	t.Run("skips-unavailable", func(t *testing.T) {
+		p := newBackendPool("web", config.Pool{Backends: backends})
+		p.backends[0].healthy = false
+		p.backends[1].ejectedUntil = now.Add(time.Minute)
+		if got := backendAddrs(p.candidates("", now)); strings.Join(got, ",") != "c:1" {
+			t.Fatalf("candidates = %v, want only c:1", got)
+		}
+		p.backends[2].healthy = false
+		if got := p.candidates("", now); len(got) != len(backends) {
+			t.Fatalf("candidates = %v, want every backend when none is available", backendAddrs(got))
+		}
+		if got := backendAddrs(p.candidates("", now.Add(2*time.Minute))); strings.Join(got, ",") != "b:1" {
+			t.Fatalf("candidates = %v, want b:1 back after its ejection ends", got)
+		}
+	})
+}
+
+func TestBackendPoolDial(t *testing.T) {
+	s := newTestServer(t, nil)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	echoAddr := startEchoServer(t)
+	deadAddr := freePort(t)
+	p := newBackendPool("web", config.Pool{Backends: []string{deadAddr, echoAddr}, MaxFails: 2})
+
+	dial := func() net.Conn {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := p.dial(ctx, s, "")
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		return conn
+	}
+	// Round-robin starts at the dead backend twice; both dials fall through to
+	// the live one and the second failure ejects the dead backend.
+	var conns []net.Conn
+	for range 4 {
+		conns = append(conns, dial())
+	}
+	stats := p.Stats(time.Now())
+	if !stats[0].Ejected || stats[0].Failures != 2 {
+		t.Fatalf("dead backend stats = %+v, want ejected after 2 failures", stats[0])
+	}
+	if stats[1].Active != 4 || stats[1].Failures != 0 {
+		t.Fatalf("live backend stats = %+v, want 4 active connections", stats[1])
+	}
+	transferAndVerify(t, conns[0], conns[0], []byte("through the pool"))
+	for _, conn := range conns {
+		_ = conn.Close()
+		_ = conn.Close() // a second Close must not release the slot again
+	}
+	if got := p.backends[1].active.Load(); got != 0 {
+		t.Fatalf("active = %d after Close, want 0", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dead := newBackendPool("dead", config.Pool{Backends: []string{deadAddr}})
+	if _, err := dead.dial(ctx, s, ""); err == nil || !strings.Contains(err.Error(), deadAddr) {
+		t.Fatalf("dial error = %v, want one naming %s", err, deadAddr)
+	}
+}
+
+func TestBackendPoolHealthCheck(t *testing.T) {
+	s := newTestServer(t, nil)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	addr := freePort(t)
+	p := newBackendPool("web", config.Pool{Backends: []string{addr}, HealthCheck: 1})
+	if err := p.start(s); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.stop)
+	waitFor(t, 5*time.Second, func() bool { return !p.Stats(time.Now())[0].Healthy })
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	waitFor(t, 5*time.Second, func() bool { return p.Stats(time.Now())[0].Healthy })
+}
+
+func TestServerReloadPools(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"pools": map[string]any{
+			"web": map[string]any{"backends": []string{"127.0.0.1:1"}},
+			"db":  map[string]any{"backends": []string{"127.0.0.1:2"}},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	web, db := s.getPool("web"), s.getPool("db")
+	if web == nil || db == nil {
+		t.Fatal("pools not created on start")
+	}
+	if s.getPool("127.0.0.1:1") != nil {
+		t.Fatal("plain address resolved to a pool")
+	}
+
+	cfg := newTestConfig(t, map[string]any{
+		"pools": map[string]any{
+			"web": map[string]any{"backends": []string{"127.0.0.1:1"}},
+			"db":  map[string]any{"backends": []string{"127.0.0.1:3"}},
+		},
+	})
+	if err := s.ReloadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s.getPool("web") != web {
+		t.Fatal("unchanged pool was rebuilt")
+	}
+	if got := s.getPool("db"); got == db || got == nil || got.backends[0].addr != "127.0.0.1:3" {
+		t.Fatal("changed pool was not rebuilt")
+	}
+	if db.ctx.Err() == nil {
+		t.Fatal("replaced pool was not stopped")
+	}
+
+	if err := s.ReloadConfig(newTestConfig(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if s.getPool("web") != nil || web.ctx.Err() == nil {
+		t.Fatal("removed pool is still active")
+	}
+}
+
+func TestAPIPoolStats(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"pools": map[string]any{
+			"web": map[string]any{"backends": []string{"127.0.0.1:1", "127.0.0.1:2"}},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p := s.getPool("web")
+	p.backends[0].healthy = false
+	p.backends[1].ejectedUntil = time.Now().Add(time.Minute)
+	p.backends[1].active.Store(3)
+
+	rec := httptest.NewRecorder()
+	(&apiStatsHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?nobanner=true", nil))
+	body := rec.Body.String()
+	for _, want := range []string{"> Pools", "127.0.0.1:1 down", "127.0.0.1:2 ejected, 3 conns"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("stats missing %q:\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	newAPIMetricsHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		`tlswrapper_pool_backend_up{backend="127.0.0.1:1",pool="web"} 0`,
+		`tlswrapper_pool_backend_connections{backend="127.0.0.1:2",pool="web"} 3`,
+		`tlswrapper_pool_backend_dial_failures_total{backend="127.0.0.1:1",pool="web"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+// headers sent to forwarding targets when proxy_protocol is configured, and
+// read from trusted load balancers when accept_proxy is configured.
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107 // including CRLF
+
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+	proxyV2CmdLocal = 0x20 // version 2, LOCAL
+	proxyV2CmdProxy = 0x21 // version 2, PROXY
+
+	proxyV2FamUnspec = 0x00
+	proxyV2FamTCP4   = 0x11
+	proxyV2FamTCP6   = 0x21
+
+	// proxyV2TypePeerIdentity carries the authenticated peer identity (UTF-8).
+	proxyV2TypePeerIdentity = 0xe0
+	// proxyV2TypePeerCertSHA256 carries the SHA-256 fingerprint of the peer's
+	// leaf certificate (32 bytes).
+	proxyV2TypePeerCertSHA256 = 0xe1
+)
+
+// proxyHeader describes the connection a PROXY protocol header announces.
+type proxyHeader struct {
+	// src is the original client address; the zero value means unknown.
+	src netip.AddrPort
+	// dst is the address the relayed connection is headed to.
+	dst netip.AddrPort
+	// peerIdentity and peerCerts describe the mux peer that relayed the
+	// connection; they are carried in v2 TLVs only.
+	peerIdentity string
+	peerCerts    []*x509.Certificate
+}
+
+// addrPortOf converts a TCP address to netip.AddrPort; other addresses yield
+// the zero value.
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// proxyAddrs returns src and dst in a common family, or ok == false when the
+// source is unknown.
+func (h *proxyHeader) proxyAddrs() (src, dst netip.AddrPort, ok bool) {
+	if !h.src.IsValid() || !h.dst.IsValid() {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+	src = netip.AddrPortFrom(h.src.Addr().Unmap(), h.src.Port())
+	dst = netip.AddrPortFrom(h.dst.Addr().Unmap(), h.dst.Port())
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return src, dst, true
+}
+
+// appendV1 appends the human-readable (version 1) header.
+func (h *proxyHeader) appendV1(b []byte) []byte {
+	src, dst, ok := h.proxyAddrs()
+	if !ok {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	proto := "TCP4"
+	if !src.Addr().Is4() {
+		proto = "TCP6"
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n",
+		proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+// appendV2 appends the binary (version 2) header including its TLVs.
+func (h *proxyHeader) appendV2(b []byte) []byte {
+	var body []byte
+	cmd, fam := byte(proxyV2CmdLocal), byte(proxyV2FamUnspec)
+	if src, dst, ok := h.proxyAddrs(); ok {
+		cmd = proxyV2CmdProxy
+		if src.Addr().Is4() {
+			fam = proxyV2FamTCP4
+		} else {
+			fam = proxyV2FamTCP6
+		}
+		body = append(body, src.Addr().AsSlice()...)
+		body = append(body, dst.Addr().AsSlice()...)
+		body = binary.BigEndian.AppendUint16(body, src.Port())
+		body = binary.BigEndian.AppendUint16(body, dst.Port())
+	}
+	if h.peerIdentity != "" {
+		body = appendTLV(body, proxyV2TypePeerIdentity, []byte(h.peerIdentity))
+	}
+	if len(h.peerCerts) > 0 {
+		sum := sha256.Sum256(h.peerCerts[0].Raw)
+		body = appendTLV(body, proxyV2TypePeerCertSHA256, sum[:])
+	}
+	b = append(b, proxyV2Signature...)
+	b = append(b, cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+func appendTLV(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// writeProxyHeader sends the header for version ("v1" or "v2") to w.
+func writeProxyHeader(w io.Writer, version string, h *proxyHeader) error {
+	var b []byte
+	switch version {
+	case "v1":
+		b = h.appendV1(nil)
+	case "v2":
+		b = h.appendV2(nil)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+var errProxyHeader = errors.New("proxy protocol")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns the
+// client address it carries. The zero value means the header names no client:
+// v1 UNKNOWN, a v2 LOCAL command, or an address family other than TCP.
+func readProxyHeader(r *bufio.Reader) (netip.AddrPort, error) {
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch {
+	case string(b) == proxyV2Signature:
+		return readProxyV2(r)
+	case strings.HasPrefix(string(b), proxyV1Prefix):
+		return readProxyV1(r)
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w: missing header", errProxyHeader)
+}
+
+func readProxyV1(r *bufio.Reader) (netip.AddrPort, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for len(line) == 0 || line[len(line)-1] != '\n' {
+		if len(line) == proxyV1MaxLen {
+			return netip.AddrPort{}, fmt.Errorf("%w: v1 header too long", errProxyHeader)
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, c)
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("%w: v1 header not terminated by CRLF", errProxyHeader)
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("%w: malformed v1 header %q", errProxyHeader, s)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid v1 source address %q", errProxyHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid v1 source port %q", errProxyHeader, fields[4])
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+func readProxyV2(r *bufio.Reader) (netip.AddrPort, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch hdr[12] {
+	case proxyV2CmdLocal:
+		return netip.AddrPort{}, nil
+	case proxyV2CmdProxy:
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w: unsupported v2 version/command %#x", errProxyHeader, hdr[12])
+	}
+	switch hdr[13] {
+	case proxyV2FamTCP4:
+		if len(body) < 12 {
+			return netip.AddrPort{}, fmt.Errorf("%w: short v2 address block", errProxyHeader)
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10])), nil
+	case proxyV2FamTCP6:
+		if len(body) < 36 {
+			return netip.AddrPort{}, fmt.Errorf("%w: short v2 address block", errProxyHeader)
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34])), nil
+	}
+	return netip.AddrPort{}, nil
+}
+
+// acceptProxyHeader reads the PROXY protocol header that a trusted load
+// balancer sends ahead of the client's data, waiting until deadline (zero =
+// no deadline). Connections from untrusted sources are returned unchanged.
+// Otherwise the returned conn reports the client address carried in the
+// header as its RemoteAddr.
+func acceptProxyHeader(cfg *config.File, conn net.Conn, deadline time.Time) (net.Conn, error) {
+	src := addrPortOf(conn.RemoteAddr())
+	if !src.IsValid() || !cfg.ProxySourceTrusted(src.Addr()) {
+		return conn, nil
+	}
+	_ = conn.SetReadDeadline(deadline)
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	br := bufio.NewReader(conn)
+	client, err := readProxyHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", conn.RemoteAddr(), err)
+	}
+	pc := &proxiedConn{prefixConn: prefixConn{Conn: conn}, remote: conn.RemoteAddr()}
+	if n := br.Buffered(); n > 0 {
+		pc.prefix, _ = br.Peek(n)
+	}
+	if client.IsValid() {
+		pc.remote = net.TCPAddrFromAddrPort(client)
+	}
+	return pc, nil
+}
+
+// proxiedConn is a conn accepted from a load balancer; RemoteAddr reports the
+// client address announced in its PROXY protocol header.
+type proxiedConn struct {
+	prefixConn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,237 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string
+	}{
+		{"tcp4", "192.0.2.1:5000", "198.51.100.2:80", "PROXY TCP4 192.0.2.1 198.51.100.2 5000 80\r\n"},
+		{"tcp6", "[2001:db8::1]:5000", "[2001:db8::2]:80", "PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n"},
+		{"mapped", "[::ffff:192.0.2.1]:5000", "198.51.100.2:80", "PROXY TCP4 192.0.2.1 198.51.100.2 5000 80\r\n"},
+		{"mixed", "192.0.2.1:5000", "[2001:db8::2]:80", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 5000 80\r\n"},
+		{"unknown", "", "198.51.100.2:80", "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &proxyHeader{dst: netip.MustParseAddrPort(tt.dst)}
+			if tt.src != "" {
+				h.src = netip.MustParseAddrPort(tt.src)
+			}
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, "v1", h); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Fatalf("header = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("leaf certificate")}
+	h := &proxyHeader{
+		src:          netip.MustParseAddrPort("192.0.2.1:5000"),
+		dst:          netip.MustParseAddrPort("198.51.100.2:80"),
+		peerIdentity: "alice",
+		peerCerts:    []*x509.Certificate{cert},
+	}
+	var buf bytes.Buffer
+	if err := writeProxyHeader(&buf, "v2", h); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte(proxyV2Signature)) {
+		t.Fatalf("missing v2 signature: %q", b)
+	}
+	b = b[len(proxyV2Signature):]
+	if b[0] != proxyV2CmdProxy || b[1] != proxyV2FamTCP4 {
+		t.Fatalf("command/family = %#x/%#x", b[0], b[1])
+	}
+	if n := int(binary.BigEndian.Uint16(b[2:4])); n != len(b)-4 {
+		t.Fatalf("length = %d, want %d", n, len(b)-4)
+	}
+	b = b[4:]
+	wantAddrs := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x13, 0x88, 0, 80}
+	if !bytes.Equal(b[:12], wantAddrs) {
+		t.Fatalf("addresses = %v, want %v", b[:12], wantAddrs)
+	}
+	tlvs := parseTLVs(t, b[12:])
+	if got := string(tlvs[proxyV2TypePeerIdentity]); got != "alice" {
+		t.Fatalf("identity TLV = %q, want %q", got, "alice")
+	}
+	sum := sha256.Sum256(cert.Raw)
+	if got := tlvs[proxyV2TypePeerCertSHA256]; !bytes.Equal(got, sum[:]) {
+		t.Fatalf("fingerprint TLV = %x, want %x", got, sum)
+	}
+
+	t.Run("unknown-source-is-local", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := &proxyHeader{dst: netip.MustParseAddrPort("198.51.100.2:80")}
+		if err := writeProxyHeader(&buf, "v2", h); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()[len(proxyV2Signature):]
+		if b[0] != proxyV2CmdLocal || b[1] != proxyV2FamUnspec || len(b) != 4 {
+			t.Fatalf("header = %v, want an empty LOCAL header", b)
+		}
+	})
+}
+
+// parseTLVs splits a PROXY v2 TLV vector by type.
+func parseTLVs(t *testing.T, b []byte) map[byte][]byte {
+	t.Helper()
+	tlvs := make(map[byte][]byte)
+	for len(b) > 0 {
+		if len(b) < 3 {
+			t.Fatalf("truncated TLV: %v", b)
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			t.Fatalf("truncated TLV value: %v", b)
+		}
+		tlvs[b[0]] = b[3 : 3+n]
+		b = b[3+n:]
+	}
+	return tlvs
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(h *proxyHeader) string { return string(h.appendV2(nil)) }
+	tests := []struct {
+		name    string
+		in      string
+		want    string // "" = no client address
+		wantErr bool
+	}{
+		{name: "v1-tcp4", in: "PROXY TCP4 192.0.2.1 198.51.100.2 5000 80\r\n", want: "192.0.2.1:5000"},
+		{name: "v1-tcp6", in: "PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n", want: "[2001:db8::1]:5000"},
+		{name: "v1-unknown", in: "PROXY UNKNOWN ignored\r\n"},
+		{name: "v2-tcp4", in: v2(&proxyHeader{
+			src:          netip.MustParseAddrPort("192.0.2.1:5000"),
+			dst:          netip.MustParseAddrPort("198.51.100.2:80"),
+			peerIdentity: "alice",
+		}), want: "192.0.2.1:5000"},
+		{name: "v2-tcp6", in: v2(&proxyHeader{
+			src: netip.MustParseAddrPort("[2001:db8::1]:5000"),
+			dst: netip.MustParseAddrPort("[2001:db8::2]:80"),
+		}), want: "[2001:db8::1]:5000"},
+		{name: "v2-local", in: v2(&proxyHeader{})},
+		{name: "missing", in: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+		{name: "v1-family-mismatch", in: "PROXY TCP4 2001:db8::1 2001:db8::2 5000 80\r\n", wantErr: true},
+		{name: "v1-bad-port", in: "PROXY TCP4 192.0.2.1 198.51.100.2 70000 80\r\n", wantErr: true},
+		{name: "v1-no-crlf", in: "PROXY TCP4 192.0.2.1 198.51.100.2 5000 80\n", wantErr: true},
+		{name: "v1-too-long", in: "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in + "payload"))
+			got, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if got.IsValid() {
+					t.Fatalf("readProxyHeader() = %v, want no address", got)
+				}
+			} else if got.String() != tt.want {
+				t.Fatalf("readProxyHeader() = %v, want %s", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("data after header = %q, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return client, server
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	const header = "PROXY TCP4 203.0.113.7 127.0.0.1 4242 80\r\n"
+	deadline := time.Now().Add(5 * time.Second)
+
+	t.Run("trusted", func(t *testing.T) {
+		client, server := tcpPair(t)
+		cfg := newTestConfig(t, map[string]any{"accept_proxy": map[string]any{"trusted": []string{"127.0.0.0/8"}}})
+		if _, err := io.WriteString(client, header+"payload"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := acceptProxyHeader(cfg, server, deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != "203.0.113.7:4242" {
+			t.Fatalf("RemoteAddr() = %s, want 203.0.113.7:4242", got)
+		}
+		buf := make([]byte, len("payload"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "payload" {
+			t.Fatalf("read = %q, %v; want %q", buf, err, "payload")
+		}
+	})
+
+	t.Run("trusted-requires-header", func(t *testing.T) {
+		client, server := tcpPair(t)
+		cfg := newTestConfig(t, map[string]any{"accept_proxy": map[string]any{"trusted": []string{"127.0.0.1"}}})
+		if _, err := io.WriteString(client, "GET / HTTP/1.1\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := acceptProxyHeader(cfg, server, deadline); err == nil {
+			t.Fatal("expected error for a trusted source without a header")
+		}
+	})
+
+	t.Run("untrusted-unchanged", func(t *testing.T) {
+		_, server := tcpPair(t)
+		cfg := newTestConfig(t, map[string]any{"accept_proxy": map[string]any{"trusted": []string{"192.0.2.0/24"}}})
+		conn, err := acceptProxyHeader(cfg, server, deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != server {
+			t.Fatal("untrusted connection was wrapped")
+		}
+	})
+}
@@ -0,0 +1,377 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/forwarder"
+)
+
+// quotaUsage is a peer's traffic in one accounting window, as kept in the
+// quota state file.
+type quotaUsage struct {
+	WindowStart time.Time `json:"window_start"`
+	Sent        uint64    `json:"sent"`
+	Received    uint64    `json:"received"`
+}
+
+// quotaAccount tracks the usage of one peer against its config.Quota.
+type quotaAccount struct {
+	peer string
+	// throttle is shared by the peer's streams; its rate is zero (unlimited)
+	// until a "throttle" quota is used up.
+	throttle *forwarder.Bucket
+
+	mu        sync.Mutex
+	quota     config.Quota
+	usage     quotaUsage
+	exhausted bool
+}
+
+func newQuotaAccount(peer string, q config.Quota) *quotaAccount {
+	return &quotaAccount{
+		peer:     peer,
+		throttle: forwarder.NewBucket(forwarder.NewRate(0, 0)),
+		quota:    q,
+	}
+}
+
+// roll starts a new accounting window once now is past the current one.
+// Called with a.mu held.
+func (a *quotaAccount) roll(now time.Time) {
+	if !now.Before(a.quota.WindowEnd(a.usage.WindowStart)) {
+		a.usage = quotaUsage{WindowStart: a.quota.WindowStart(now)}
+	}
+}
+
+// update re-evaluates a.exhausted after the usage, window or quota changed and
+// reports whether the quota has just been used up. Called with a.mu held.
+func (a *quotaAccount) update(now time.Time) bool {
+	a.roll(now)
+	used := a.quota.Bytes > 0 && a.usage.Sent+a.usage.Received >= uint64(a.quota.Bytes)
+	exhausted := used && !a.exhausted
+	a.exhausted = used
+	rate := int64(0)
+	if used && a.quota.Action == "throttle" {
+		rate = a.quota.ThrottleRate
+	}
+	a.throttle.Rate().Set(rate, 0)
+	return exhausted
+}
+
+// setQuota applies a reloaded quota; usage is kept.
+func (a *quotaAccount) setQuota(q config.Quota, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.quota = q
+	return a.update(now)
+}
+
+// add records traffic and reports whether it used up the quota.
+func (a *quotaAccount) add(sent, received int, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roll(now)
+	a.usage.Sent += uint64(sent)
+	a.usage.Received += uint64(received)
+	return a.update(now)
+}
+
+// rejects reports whether new streams of the peer are refused.
+func (a *quotaAccount) rejects(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.update(now)
+	return a.exhausted && (a.quota.Action == "" || a.quota.Action == "reject")
+}
+
+// QuotaStats is a snapshot of one peer's quota.
+type QuotaStats struct {
+	Peer        string    `json:"peer"`
+	Window      string    `json:"window"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Limit       int64     `json:"limit"` // 0 = unlimited
+	Sent        uint64    `json:"sent"`
+	Received    uint64    `json:"received"`
+	Remaining   int64     `json:"remaining"` // -1 = unlimited
+	Exhausted   bool      `json:"exhausted"`
+	Action      string    `json:"action"`
+}
+
+func (a *quotaAccount) stats(now time.Time) QuotaStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.update(now)
+	v := QuotaStats{
+		Peer:        a.peer,
+		Window:      cmp.Or(a.quota.Window, "monthly"),
+		WindowStart: a.usage.WindowStart,
+		WindowEnd:   a.quota.WindowEnd(a.usage.WindowStart),
+		Limit:       a.quota.Bytes,
+		Sent:        a.usage.Sent,
+		Received:    a.usage.Received,
+		Remaining:   -1,
+		Exhausted:   a.exhausted,
+		Action:      cmp.Or(a.quota.Action, "reject"),
+	}
+	if v.Limit > 0 {
+		v.Remaining = max(v.Limit-int64(v.Sent+v.Received), 0)
+	}
+	return v
+}
+
+// quotas holds the accounts of peers that have a quota, or had one since the
+// server started. Accounts are never removed so that usage survives reloads.
+type quotas struct {
+	mu       sync.Mutex
+	accounts map[string]*quotaAccount
+	dirty    atomic.Bool // usage changed since the state file was written
+}
+
+// quotaAccount returns the account of peer, or nil when it has no quota. The
+// config is read under q.mu so that a concurrent reload also updates any
+// account created here.
+func (s *Server) quotaAccount(peer string) *quotaAccount {
+	q := &s.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if a, ok := q.accounts[peer]; ok {
+		return a
+	}
+	cfg, _ := s.getConfig()
+	quota, ok := cfg.PeerQuota(peer)
+	if !ok {
+		return nil
+	}
+	if q.accounts == nil {
+		q.accounts = make(map[string]*quotaAccount)
+	}
+	a := newQuotaAccount(peer, quota)
+	q.accounts[peer] = a
+	return a
+}
+
+// reloadQuotas applies cfg to every account.
+func (s *Server) reloadQuotas(cfg *config.File) {
+	var exhausted []*quotaAccount
+	s.quotas.mu.Lock()
+	for _, a := range s.quotas.accounts {
+		quota, _ := cfg.PeerQuota(a.peer)
+		if a.setQuota(quota, time.Now()) {
+			exhausted = append(exhausted, a)
+		}
+	}
+	s.quotas.mu.Unlock()
+	for _, a := range exhausted {
+		s.quotaExhausted(a)
+	}
+}
+
+// quotaExhausted reports that a peer has just used up its quota.
+func (s *Server) quotaExhausted(a *quotaAccount) {
+	v := a.stats(time.Now())
+	msg := fmt.Sprintf("quota: %q used up %d bytes of its %s quota (%s)", a.peer, v.Sent+v.Received, v.Window, v.Action)
+	slog.Warning(msg)
+	s.recentEvents.Add(time.Now(), msg)
+}
+
+// quotaRejects reports whether a new stream with peer is refused because the
+// peer used up its quota.
+func (s *Server) quotaRejects(tag, peer string) bool {
+	a := s.quotaAccount(peer)
+	if a == nil || !a.rejects(time.Now()) {
+		return false
+	}
+	slog.Debugf("%s: quota: %q has used up its quota", tag, peer)
+	return true
+}
+
+// meterStream returns stream, a TCP stream or a datagram flow, counting its
+// traffic against peer's quota, or stream itself when the peer has none.
+// Writes count as sent, reads as received.
+func (s *Server) meterStream(peer string, stream net.Conn) net.Conn {
+	a := s.quotaAccount(peer)
+	if a == nil {
+		return stream
+	}
+	return &meteredConn{Conn: stream, s: s, account: a}
+}
+
+// meteredConn counts the bytes of a mux stream against a quotaAccount. It keeps
+// CloseWrite so the forwarder can still half-close.
+type meteredConn struct {
+	net.Conn
+	s       *Server
+	account *quotaAccount
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(0, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(n, 0)
+	}
+	return n, err
+}
+
+func (c *meteredConn) record(sent, received int) {
+	c.s.quotas.dirty.Store(true)
+	if c.account.add(sent, received, time.Now()) {
+		c.s.quotaExhausted(c.account)
+	}
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// quotaState is the content of the quota state file.
+type quotaState struct {
+	Peers map[string]quotaUsage `json:"peers"`
+}
+
+// loadQuotaState restores usage from cfg.QuotaState. A missing file is not
+// an error.
+func (s *Server) loadQuotaState(cfg *config.File) error {
+	if cfg.QuotaState == "" {
+		return nil
+	}
+	b, err := os.ReadFile(cfg.QuotaState)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state quotaState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("quota state %s: %w", cfg.QuotaState, err)
+	}
+	q := &s.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.accounts == nil {
+		q.accounts = make(map[string]*quotaAccount)
+	}
+	now := time.Now()
+	for peer, usage := range state.Peers {
+		quota, _ := cfg.PeerQuota(peer)
+		a := newQuotaAccount(peer, quota)
+		a.usage = usage
+		a.update(now)
+		q.accounts[peer] = a
+	}
+	return nil
+}
+
+// saveQuotaState writes usage to cfg.QuotaState if it changed since the last
+// save. The file is replaced atomically.
+func (s *Server) saveQuotaState(cfg *config.File) error {
+	if cfg.QuotaState == "" || !s.quotas.dirty.Swap(false) {
+		return nil
+	}
+	state := quotaState{Peers: make(map[string]quotaUsage)}
+	s.quotas.mu.Lock()
+	for peer, a := range s.quotas.accounts {
+		a.mu.Lock()
+		state.Peers[peer] = a.usage
+		a.mu.Unlock()
+	}
+	s.quotas.mu.Unlock()
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(cfg.QuotaState, b, 0600)
+	}
+	if err != nil {
+		s.quotas.dirty.Store(true) // retry on the next save
+		return fmt.Errorf("quota state %s: %w", cfg.QuotaState, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it
+// over name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// PeerQuotaStats snapshots the quota of peer. A peer that has a quota but no
+// traffic yet is reported without creating its account.
+func (s *Server) PeerQuotaStats(peer string) (QuotaStats, bool) {
+	now := time.Now()
+	s.quotas.mu.Lock()
+	a, ok := s.quotas.accounts[peer]
+	s.quotas.mu.Unlock()
+	if ok {
+		return a.stats(now), true
+	}
+	cfg, _ := s.getConfig()
+	quota, ok := cfg.PeerQuota(peer)
+	if !ok {
+		return QuotaStats{}, false
+	}
+	return newQuotaAccount(peer, quota).stats(now), true
+}
+
+// QuotaStats snapshots every tracked peer's quota, sorted by identity.
+func (s *Server) QuotaStats() []QuotaStats {
+	s.quotas.mu.Lock()
+	accounts := slices.Collect(maps.Values(s.quotas.accounts))
+	s.quotas.mu.Unlock()
+	now := time.Now()
+	stats := make([]QuotaStats, 0, len(accounts))
+	for _, a := range accounts {
+		stats = append(stats, a.stats(now))
+	}
+	slices.SortFunc(stats, func(a, b QuotaStats) int {
+		return cmp.Compare(a.Peer, b.Peer)
+	})
+	return stats
+}
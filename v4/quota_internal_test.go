@@ -0,0 +1,263 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestQuotaAccount(t *testing.T) {
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+	a := newQuotaAccount("alice", config.Quota{Bytes: 1000, Window: "daily", Action: "throttle", ThrottleRate: 100})
+	if a.add(400, 200, now) {
+		t.Fatal("quota used up after 600 of 1000 bytes")
+	}
+	if !a.add(300, 100, now) {
+		t.Fatal("quota not used up after 1000 of 1000 bytes")
+	}
+	if a.add(1, 0, now) {
+		t.Fatal("quota reported as used up twice")
+	}
+	if got := rateOf(a.throttle); got != 100 {
+		t.Fatalf("throttle rate = %d, want 100", got)
+	}
+	if a.rejects(now) {
+		t.Fatal("throttle quota rejects streams")
+	}
+	if v := a.stats(now); v.Remaining != 0 || !v.Exhausted || v.Sent != 701 || v.Received != 300 {
+		t.Fatalf("stats = %+v, want 701 sent, 300 received and none remaining", v)
+	}
+
+	// The next window starts over.
+	now = now.Add(24 * time.Hour)
+	v := a.stats(now)
+	if v.Exhausted || v.Sent+v.Received != 0 || v.Remaining != 1000 || rateOf(a.throttle) != 0 {
+		t.Fatalf("stats = %+v in the next window, want a fresh quota", v)
+	}
+	if !v.WindowStart.Equal(time.Date(2026, time.March, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("window start = %v", v.WindowStart)
+	}
+
+	// Raising the quota on reload lifts the throttle.
+	a.add(1000, 0, now)
+	if a.setQuota(config.Quota{Bytes: 2000, Window: "daily", Action: "throttle", ThrottleRate: 100}, now) {
+		t.Fatal("raised quota reported as used up")
+	}
+	if a.stats(now).Exhausted || rateOf(a.throttle) != 0 {
+		t.Fatal("raised quota is still exhausted")
+	}
+}
+
+func TestQuotaReject(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"quotas": map[string]any{
+			"alice": map[string]any{"bytes": 10},
+			"carol": map[string]any{"bytes": 10, "action": "alert"},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	if conn := s.meterStream("bob", c1); conn != c1 {
+		t.Fatal("stream of a peer without quota was metered")
+	}
+	if s.quotaRejects("test", "alice") {
+		t.Fatal("stream rejected before the quota was used up")
+	}
+	for _, peer := range []string{"alice", "carol"} {
+		conn := s.meterStream(peer, c1)
+		go func() { _, _ = c2.Read(make([]byte, 64)) }()
+		if _, err := conn.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.quotaRejects("test", "alice") {
+		t.Fatal("stream accepted after the quota was used up")
+	}
+	if s.quotaRejects("test", "carol") {
+		t.Fatal("alert quota rejects streams")
+	}
+	var events strings.Builder
+	if err := s.recentEvents.Format(&events, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range []string{`"alice"`, `"carol"`} {
+		if !strings.Contains(events.String(), peer) {
+			t.Fatalf("recent events missing %s:\n%s", peer, events.String())
+		}
+	}
+
+	// Removing the quota on reload lets the peer in again.
+	if err := s.ReloadConfig(newTestConfig(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if s.quotaRejects("test", "alice") {
+		t.Fatal("stream rejected after the quota was removed")
+	}
+}
+
+func TestQuotaState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quota.json")
+	overrides := map[string]any{
+		"quotas":      map[string]any{"*": map[string]any{"bytes": 1 << 20}},
+		"quota_state": stateFile,
+	}
+	s := newTestServer(t, overrides)
+	cfg, _ := s.getConfig()
+	if err := s.loadQuotaState(cfg); err != nil {
+		t.Fatal("missing state file:", err)
+	}
+	s.quotaAccount("alice").add(100, 200, time.Now())
+	s.quotas.dirty.Store(true)
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("state file mode = %v, want 0600", info.Mode().Perm())
+	}
+	// Nothing changed, so the file is not rewritten.
+	if err := os.Remove(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveQuotaState(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile); err == nil {
+		t.Fatal("unchanged quota state was written")
+	}
+	s.quotas.dirty.Store(true)
+	if err := s.saveQuotaState(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestServer(t, overrides)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	cfg, _ = s.getConfig()
+	if err := s.loadQuotaState(cfg); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.QuotaStats()
+	if len(stats) != 1 || stats[0].Peer != "alice" || stats[0].Sent != 100 || stats[0].Received != 200 {
+		t.Fatalf("restored stats = %+v", stats)
+	}
+
+	if err := os.WriteFile(stateFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.loadQuotaState(cfg); err == nil {
+		t.Fatal("expected error for a corrupt state file")
+	}
+}
+
+func TestAPIQuota(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"quotas": map[string]any{"alice": map[string]any{"bytes": 1000, "window": "daily"}},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	s.quotaAccount("alice").add(100, 50, time.Now())
+
+	rec := httptest.NewRecorder()
+	(&apiQuotaHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota?peer=alice", nil))
+	var v QuotaStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("/quota?peer=alice: %v\n%s", err, rec.Body.String())
+	}
+	if v.Peer != "alice" || v.Window != "daily" || v.Remaining != 850 || v.Action != "reject" {
+		t.Fatalf("/quota?peer=alice = %+v", v)
+	}
+
+	rec = httptest.NewRecorder()
+	(&apiQuotaHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota?peer=bob", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("/quota?peer=bob status = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	(&apiQuotaHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota", nil))
+	var all []QuotaStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil || len(all) != 1 {
+		t.Fatalf("/quota = %s, %v", rec.Body.String(), err)
+	}
+
+	rec = httptest.NewRecorder()
+	(&apiStatsHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?nobanner=true", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "> Quotas") || !strings.Contains(body, "daily") {
+		t.Fatalf("stats missing quotas:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	newAPIMetricsHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`tlswrapper_quota_limit_bytes{identity="alice"} 1000`,
+		`tlswrapper_quota_used_bytes{direction="tx",identity="alice"} 100`,
+		`tlswrapper_quota_exhausted{identity="alice"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+// TestAPIQuotaReadOnly verifies that looking up a peer covered by "*" does
+// not start tracking it.
+func TestAPIQuotaReadOnly(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"quotas": map[string]any{"*": map[string]any{"bytes": 1000}},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	for range 3 {
+		rec := httptest.NewRecorder()
+		(&apiQuotaHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota?peer=mallory", nil))
+		var v QuotaStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Fatalf("/quota?peer=mallory: %v\n%s", err, rec.Body.String())
+		}
+		if v.Peer != "mallory" || v.Remaining != 1000 {
+			t.Fatalf("/quota?peer=mallory = %+v", v)
+		}
+	}
+	if stats := s.QuotaStats(); len(stats) != 0 {
+		t.Fatalf("QuotaStats() = %+v, want no tracked peers", stats)
+	}
+}
+
+// TestQuotaDatagram verifies that the datagrams of a UDP flow count against
+// the peer's quota.
+func TestQuotaDatagram(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"udp_connect": "127.0.0.1:9",
+		"quotas":      map[string]any{"alice": map[string]any{"bytes": 1000}},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	stream, peer := net.Pipe()
+	t.Cleanup(func() { _ = peer.Close() })
+	s.handleInboundStream(nil, "alice", &headerStream{Conn: stream, hdr: mux.StreamHeader{Datagram: true}})
+	if _, err := mux.NewFramedPacketConn(peer).Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		v, _ := s.PeerQuotaStats("alice")
+		return v.Received == 10
+	})
+}
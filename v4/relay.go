@@ -0,0 +1,99 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/hexian000/gosnippets/formats"
+	"github.com/hexian000/gosnippets/routines"
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+	"github.com/hexian000/tlswrapper/v4/forwarder"
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+var (
+	errRelayDenied   = errors.New("relay is not allowed")
+	errRelayHopLimit = errors.New("relay hop limit exceeded")
+	errRelayDatagram = errors.New("datagram flows cannot be relayed")
+)
+
+// openRelay opens the next leg of a stream that peerIdentity asked this node
+// to relay toward hdr.Relay, on the session to the next hop. The header is
+// passed on unchanged except for the hop count.
+func (s *Server) openRelay(cfg *config.File, peerIdentity string, hdr mux.StreamHeader) (net.Conn, error) {
+	switch {
+	case hdr.Datagram:
+		return nil, errRelayDatagram
+	case !cfg.RelayAllowed(peerIdentity, hdr.Relay):
+		return nil, errRelayDenied
+	case hdr.Hops >= cfg.MaxRelayHops():
+		return nil, errRelayHopLimit
+	}
+	next := cfg.NextHop(hdr.Relay)
+	if next == peerIdentity {
+		return nil, fmt.Errorf("relay loop: next hop %q is the opener", next)
+	}
+	t := s.findRelaySession(next)
+	if t == nil {
+		return nil, ErrNoSession
+	}
+	if s.quotaRejects(t.tagValue(), next) {
+		return nil, ErrQuotaExceeded
+	}
+	ctx := s.ctx.withTimeout()
+	if ctx == nil {
+		return nil, routines.ErrClosed
+	}
+	defer s.ctx.cancel(ctx)
+	hdr.Hops++
+	return t.OpenStream(ctx, hdr)
+}
+
+// relayStream splices stream onto its next leg toward hdr.Relay. Streams that
+// request a destination get a failure status when the relay cannot be opened;
+// on success the final peer's status passes through. It owns stream.
+func (s *Server) relayStream(cfg *config.File, tag, peerIdentity string, hdr mux.StreamHeader, stream net.Conn) {
+	dialed, err := s.openRelay(cfg, peerIdentity, hdr)
+	if err == nil {
+		stream = s.meterStream(peerIdentity, stream)
+		dialed = s.meterStream(cfg.NextHop(hdr.Relay), dialed)
+	}
+	if err != nil {
+		slog.Warningf("%s: relay to %q: %s", tag, hdr.Relay, formats.Error(err))
+		if hdr.Destination != "" {
+			_ = writeDestinationStatus(stream, err, cfg.ConnectTimeout())
+		}
+		ioClose(stream)
+		return
+	}
+	// Relayed data is received on one leg and sent on the other.
+	in, out := s.streamLimits(peerIdentity, ""), s.streamLimits(cfg.NextHop(hdr.Relay), "")
+	if err := s.f.StartLimited(stream, dialed, forwarder.HandlerFuncs{
+		WriteClosed: func(conn net.Conn, err error) {
+			if err != nil {
+				slog.Debugf("%s: half-close %v: %s", tag, conn.RemoteAddr(), formats.Error(err))
+			} else {
+				slog.Debugf("%s: half-close %v", tag, conn.RemoteAddr())
+			}
+		},
+		Closed: func() {
+			slog.Debugf("%s: relay to %q finished", tag, hdr.Relay)
+			s.stats.success.Add(1)
+		},
+	}, forwarder.Limits{
+		Forward: slices.Concat(in.receive, out.send),
+		Reverse: slices.Concat(out.receive, in.send),
+	}); err != nil {
+		slog.Errorf("%s: relay: %v", tag, err)
+		ioClose(stream)
+		ioClose(dialed)
+		return
+	}
+	slog.Debugf("%s: relay to %q established (hop %d)", tag, hdr.Relay, hdr.Hops+1)
+}
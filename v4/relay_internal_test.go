@@ -0,0 +1,48 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hexian000/tlswrapper/v4/mux"
+)
+
+func TestOpenRelayRejects(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"identity": map[string]any{
+			"claim":       "bob",
+			"routes":      map[string]any{"dave": "alice"},
+			"allow_relay": map[string]any{"alice": []string{"carol", "dave"}, "carol": []string{"*"}},
+			"max_hops":    2,
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	cfg, _ := s.getConfig()
+	for _, tc := range []struct {
+		name string
+		peer string
+		hdr  mux.StreamHeader
+		want error
+	}{
+		{"datagram", "alice", mux.StreamHeader{Relay: "carol", Datagram: true}, errRelayDatagram},
+		{"not-allowed-peer", "mallory", mux.StreamHeader{Relay: "carol"}, errRelayDenied},
+		{"not-allowed-dest", "alice", mux.StreamHeader{Relay: "erin"}, errRelayDenied},
+		{"hop-limit", "carol", mux.StreamHeader{Relay: "erin", Hops: 2}, errRelayHopLimit},
+		{"no-session", "alice", mux.StreamHeader{Relay: "carol", Hops: 1}, ErrNoSession},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := s.openRelay(cfg, tc.peer, tc.hdr); !errors.Is(err, tc.want) {
+				t.Fatalf("openRelay() error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+	t.Run("loop", func(t *testing.T) {
+		// dave is routed back through the opener.
+		if _, err := s.openRelay(cfg, "alice", mux.StreamHeader{Relay: "dave"}); err == nil {
+			t.Fatal("openRelay() relayed a stream back to its opener")
+		}
+	})
+}
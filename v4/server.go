@@ -6,13 +6,17 @@ package tlswrapper
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"net/netip"
+	"reflect"
 	"slices"
 	"sync"
 	"sync/atomic"
@@ -28,6 +32,7 @@ import (
 	"github.com/hexian000/tlswrapper/v4/mux"
 	"github.com/hexian000/tlswrapper/v4/mux/h2mux"
 	"github.com/hexian000/tlswrapper/v4/mux/h3mux"
+	"github.com/hexian000/tlswrapper/v4/mux/psk"
 )
 
 const network = "tcp"
@@ -48,26 +53,35 @@ const (
 )
 
 var (
-	ErrNoDialAddress  = errors.New("no dial address is configured")
-	ErrDialInProgress = errors.New("another dial is in progress")
-	ErrNoSession      = errors.New("no active session")
-	ErrTunnelStopped  = errors.New("tunnel is stopped")
+	ErrNoDialAddress     = errors.New("no dial address is configured")
+	ErrDialInProgress    = errors.New("another dial is in progress")
+	ErrNoSession         = errors.New("no active session")
+	ErrTunnelStopped     = errors.New("tunnel is stopped")
+	ErrDestinationDenied = errors.New("destination is not allowed")
+	ErrQuotaExceeded     = errors.New("traffic quota is exhausted")
+	ErrSourceRefused     = errors.New("source address is not allowed")
 )
 
 // Server owns listeners, config-driven tunnels, and active mux sessions.
 type Server struct {
 	cfg    *config.File
 	tlscfg *tls.Config
-	cfgMu  sync.RWMutex
+	// clientTLSCfg verifies servers on outbound handshakes (see
+	// config.File.NewClientTLSConfig).
+	clientTLSCfg *tls.Config
+	cfgMu        sync.RWMutex
 
-	// listenMu guards l, muxListener, and apiListener, which are swapped by
-	// config reloads while Stats() reads them from API handler goroutines.
-	listenMu    sync.Mutex
-	l           acceptStats  // accept counters of the active mux listener
-	muxListener mux.Listener // active mux listener (h2mux or h3mux)
-	apiListener net.Listener
+	// listenMu guards l, muxListener, apiListener, and enrollListener, which
+	// are swapped by config reloads while Stats() reads them from API handler
+	// goroutines.
+	listenMu       sync.Mutex
+	l              acceptStats  // accept counters of the active mux listener
+	muxListener    mux.Listener // active mux listener (h2mux or h3mux)
+	apiListener    net.Listener
+	enrollListener net.Listener
 
-	f forwarder.Forwarder
+	f  forwarder.Forwarder
+	pf forwarder.PacketForwarder
 
 	recentEvents eventlog.Recent
 
@@ -75,9 +89,14 @@ type Server struct {
 	mainTunnel      *tunnel                      // top-level cfg.MuxConnect tunnel
 	localListener   net.Listener                 // top-level cfg.Listen listener
 	localListenAddr string                       // address currently bound by localListener
-	identityTunnels []*tunnel                    // cfg.Identity.MuxConnect tunnels (one per entry)
+	identityTunnels []*tunnel                    // cfg.Identity.MuxConnect tunnels (one per connection of each entry)
 	identities      map[string]*identityListener // cfg.Identity.Listen[name] listeners
+	socks5Listeners map[string]*identityListener // SOCKS5 listeners keyed by peer ("" = top-level cfg.SOCKS5Listen)
+	udpListeners    map[string]*udpListener      // UDP listeners keyed by peer ("" = top-level cfg.UDPListen)
 	acceptedTunnels map[mux.Session]*tunnel      // inbound tunnels keyed by their mux session
+	pools           map[string]*backendPool      // cfg.Pools by name
+	peerStreams     peerStreams                  // streams each peer has open to us, for policy max_streams
+	nextTunnel      atomic.Uint64                // round-robin counter for findSession
 	ctx             contextMgr
 
 	dialer    net.Dialer
@@ -89,6 +108,14 @@ type Server struct {
 
 	started time.Time
 
+	sourceRejects sourceRejects
+	bandwidth     *bandwidth
+	quotas        quotas
+	enroll        enrollment
+	// certWarned maps the fingerprints of certificates reported by
+	// checkCertExpiry to whether they were reported as expired.
+	certWarned map[[sha256.Size]byte]bool
+
 	stats struct {
 		numSessions          atomic.Uint32
 		numSessionsCreated   atomic.Uint64
@@ -99,6 +126,8 @@ type Server struct {
 		authorized           atomic.Uint64
 		request              atomic.Uint64
 		success              atomic.Uint64
+		deniedInbound        atomic.Uint64 // streams from peers denied by policy
+		deniedOutbound       atomic.Uint64 // streams toward peers denied by policy
 		muxBytesReceived     atomic.Uint64 // cumulative mux wire bytes received from closed sessions
 		muxBytesSent         atomic.Uint64 // cumulative mux wire bytes sent from closed sessions
 		payloadBytesReceived atomic.Uint64 // cumulative gRPC Stream payload bytes received (TCP Traffic) from closed sessions
@@ -113,11 +142,16 @@ func NewServer(cfg *config.File) (*Server, error) {
 		cfg:             cfg,
 		identityTunnels: make([]*tunnel, 0),
 		identities:      make(map[string]*identityListener),
+		socks5Listeners: make(map[string]*identityListener),
+		udpListeners:    make(map[string]*udpListener),
 		acceptedTunnels: make(map[mux.Session]*tunnel),
+		pools:           make(map[string]*backendPool),
 		ctx: contextMgr{
 			contexts: make(map[context.Context]context.CancelFunc),
 		},
 		f:            forwarder.New(maxStreams(cfg), g),
+		pf:           forwarder.NewPacket(maxStreams(cfg), cfg.UDPIdleTimeout(), g),
+		bandwidth:    newBandwidth(&cfg.Bandwidth),
 		recentEvents: eventlog.NewRecent(recentEventsSize),
 		g:            g,
 	}
@@ -129,8 +163,12 @@ func NewServer(cfg *config.File) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	s.tlscfg = tlscfg
-	s.muxDialer = s.buildMuxDialer(cfg, tlscfg)
+	clientTLSCfg, err := cfg.NewClientTLSConfig(tlscfg)
+	if err != nil {
+		return nil, err
+	}
+	s.tlscfg, s.clientTLSCfg = tlscfg, clientTLSCfg
+	s.muxDialer = s.buildMuxDialer(cfg, clientTLSCfg)
 	return s, nil
 }
 
@@ -143,26 +181,87 @@ func maxStreams(cfg *config.File) int {
 
 // findSession returns the outbound tunnel whose active session has the given
 // peer identity. An empty peerIdentity returns the top-level mainTunnel.
-// When no session is active, it falls back to the tunnel that last reached
-// this identity so OpenStream can dial on demand.
+// When several tunnels have a session to the peer, cfg.Mux.Balance chooses
+// among them. When no session is active, it falls back to the tunnel that last
+// reached this identity so OpenStream can dial on demand.
 func (s *Server) findSession(peerIdentity string) *tunnel {
+	return s.lookupSession(peerIdentity, false)
+}
+
+// findRelaySession is findSession for the next leg of a relayed stream: it
+// also considers inbound tunnels accepted from the peer, so that a hub can
+// reach peers that dial it.
+func (s *Server) findRelaySession(peerIdentity string) *tunnel {
+	return s.lookupSession(peerIdentity, true)
+}
+
+func (s *Server) lookupSession(peerIdentity string, inbound bool) *tunnel {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if peerIdentity == "" {
 		return s.mainTunnel
 	}
+	var active []*tunnel
 	var fallback *tunnel
 	for _, t := range s.identityTunnels {
 		if sess := t.getSession(); sess != nil && sess.PeerIdentity() == peerIdentity {
-			return t
+			active = append(active, t)
+			continue
 		}
 		if fallback == nil && t.lastIdentityValue() == peerIdentity {
 			fallback = t
 		}
 	}
+	if inbound {
+		for _, t := range s.acceptedTunnels {
+			if sess := t.getSession(); sess != nil && sess.PeerIdentity() == peerIdentity {
+				active = append(active, t)
+			}
+		}
+	}
+	if len(active) > 0 {
+		cfg, _ := s.getConfig()
+		return s.pickTunnel(cfg.Mux.Balance, active)
+	}
 	return fallback
 }
 
+// pickTunnel chooses one of the tunnels in active, which all have a session to
+// the same peer, according to policy (see config.Mux.Balance).
+func (s *Server) pickTunnel(policy string, active []*tunnel) *tunnel {
+	if len(active) == 1 {
+		return active[0]
+	}
+	var load func(t *tunnel) int64
+	switch policy {
+	case "least-streams":
+		load = func(t *tunnel) int64 {
+			if sess := t.getSession(); sess != nil {
+				if m := sess.Stats(); m != nil {
+					return m.NumStreams.Load()
+				}
+			}
+			return 0
+		}
+	case "lowest-latency":
+		// Tunnels without samples yet count as fastest so they get measured.
+		load = func(t *tunnel) int64 {
+			p50, _, _, _, _ := t.streamLatency.Percentiles()
+			return int64(p50)
+		}
+	default:
+		n := s.nextTunnel.Add(1)
+		return active[n%uint64(len(active))]
+	}
+	best, bestLoad := active[0], load(active[0])
+	for _, t := range active[1:] {
+		if l := load(t); l < bestLoad {
+			best, bestLoad = t, l
+		}
+	}
+	return best
+}
+
 func (s *Server) getAllTunnels() []*tunnel {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -194,6 +293,43 @@ func (s *Server) markSessionsStale() {
 	}
 }
 
+// onlyCRLChanged reports whether cfg differs from old in tls.crl alone.
+func onlyCRLChanged(old, cfg *config.File) bool {
+	if old == nil || old.TLS == nil || cfg.TLS == nil {
+		return false
+	}
+	a, b := *old, *cfg
+	tlsA, tlsB := *old.TLS, *cfg.TLS
+	tlsA.CRL, tlsB.CRL = nil, nil
+	a.TLS, b.TLS = &tlsA, &tlsB
+	jsonA, errA := json.Marshal(&a)
+	jsonB, errB := json.Marshal(&b)
+	return errA == nil && errB == nil && bytes.Equal(jsonA, jsonB)
+}
+
+// closeRevokedSessions closes the sessions whose peer certificate chain is
+// revoked by the CRLs in cfg, leaving the others alone.
+func (s *Server) closeRevokedSessions(cfg *config.File) {
+	revocations, err := cfg.NewRevocations()
+	if err != nil || revocations == nil {
+		return
+	}
+	for _, t := range s.getAllTunnels() {
+		t.mu.RLock()
+		ss, tag := t.ss, t.tag
+		t.mu.RUnlock()
+		if ss == nil || ss.IsClosed() {
+			continue
+		}
+		if err := revocations.Check(mux.PeerCertificatesOf(ss)); err != nil {
+			msg := fmt.Sprintf("%s: %s, session closed", tag, formats.Error(err))
+			slog.Warning(msg)
+			s.recentEvents.Add(time.Now(), msg)
+			_ = ss.Close()
+		}
+	}
+}
+
 // flushSessionMetrics accumulates a closing session's gRPC byte counters into
 // the server-level totals so Mux/TCP Traffic survive session reconnects.
 func (s *Server) flushSessionMetrics(ss mux.Session) {
@@ -219,6 +355,8 @@ type ServerStats struct {
 	NumSessionsFinalized               uint64
 	NumHalfOpen                        uint32
 	NumStreamsHalfOpen                 uint32
+	NumFlows                           uint32
+	FlowBytesDropped                   uint64
 	StreamOpenActive                   uint64
 	StreamOpenPassive                  uint64
 	StreamLatency                      StreamLatencyStats
@@ -229,10 +367,18 @@ type ServerStats struct {
 	Authorized                         uint64
 	ReqTotal                           uint64
 	ReqSuccess                         uint64
+	PolicyDeniedInbound                uint64
+	PolicyDeniedOutbound               uint64
 	sessions                           []SessionStats
+	backends                           []BackendStats
+	sourceRejects                      []SourceRejectStats
+	bandwidth                          []BandwidthStats
+	quotas                             []QuotaStats
+	certs                              []CertExpiryStats
 }
 
-// Stats snapshots listener, traffic, and per-session metrics.
+// Stats snapshots listener, traffic, per-session, pool backend, source rule,
+// bandwidth, quota and certificate expiry metrics.
 func (s *Server) Stats() (stats ServerStats) {
 	s.listenMu.Lock()
 	l := s.l
@@ -279,10 +425,14 @@ func (s *Server) Stats() (stats ServerStats) {
 	}
 	stats.Authorized = s.stats.authorized.Load()
 	stats.ReqTotal, stats.ReqSuccess = s.stats.request.Load(), s.stats.success.Load()
+	stats.PolicyDeniedInbound = s.stats.deniedInbound.Load()
+	stats.PolicyDeniedOutbound = s.stats.deniedOutbound.Load()
 	stats.NumHalfOpen = s.stats.numHalfOpen.Load()
 	stats.NumSessionsCreated = s.stats.numSessionsCreated.Load()
 	stats.NumSessionsFinalized = s.stats.numSessionsFinalized.Load()
 	stats.NumStreamsHalfOpen = uint32(s.f.HalfOpenCount())
+	stats.NumFlows = uint32(s.pf.Count())
+	stats.FlowBytesDropped = s.pf.Dropped()
 	if len(latSamples) > 0 {
 		slices.Sort(latSamples)
 		n := len(latSamples)
@@ -298,6 +448,20 @@ func (s *Server) Stats() (stats ServerStats) {
 			Max: latSamples[n-1], Available: true,
 		}
 	}
+	s.mu.RLock()
+	names := make([]string, 0, len(s.pools))
+	for name := range s.pools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		stats.backends = append(stats.backends, s.pools[name].Stats(time.Now())...)
+	}
+	s.mu.RUnlock()
+	stats.sourceRejects = s.sourceRejects.snapshot()
+	stats.bandwidth = s.bandwidth.Stats()
+	stats.quotas = s.QuotaStats()
+	stats.certs = s.CertExpiry()
 	// Add cumulative bytes from already-closed sessions.
 	stats.BytesReceived += s.stats.payloadBytesReceived.Load()
 	stats.BytesSent += s.stats.payloadBytesSent.Load()
@@ -331,7 +495,8 @@ func (s *Server) buildH3MuxDialer(cfg *config.File, tlscfg *tls.Config) *h3mux.H
 		ServerName:                     cfg.ServerName(),
 		ALPN:                           cfg.ALPN(),
 		LocalID:                        cfg.Identity.Claim,
-		RejectInbound:                  cfg.Connect == "",
+		RejectInbound:                  !cfg.AcceptsInbound(),
+		VerifyPeerIdentity:             s.verifyPeerIdentity,
 		KeepAlivePeriod:                cfg.KeepAlive(),
 		HandshakeTimeout:               cfg.ConnectTimeout(),
 		MaxIdleTimeout:                 cfg.IdleTimeout(),
@@ -366,7 +531,8 @@ func (s *Server) startMuxListen(cfg *config.File, addr string) error {
 			ServerName:                     cfg.ServerName(),
 			ALPN:                           cfg.ALPN(),
 			LocalID:                        cfg.Identity.Claim,
-			RejectInbound:                  cfg.Connect == "",
+			RejectInbound:                  !cfg.AcceptsInbound(),
+			VerifyPeerIdentity:             s.verifyPeerIdentity,
 			KeepAlivePeriod:                cfg.KeepAlive(),
 			HandshakeTimeout:               cfg.ConnectTimeout(),
 			MaxIdleTimeout:                 cfg.IdleTimeout(),
@@ -375,6 +541,7 @@ func (s *Server) startMuxListen(cfg *config.File, addr string) error {
 			MaxConnectionReceiveWindow:     h3MaxConnReceiveWindow,
 			InitialStreamReceiveWindow:     uint64(cfg.Mux.StreamWindow),
 			MaxStreamReceiveWindow:         h3MaxStreamReceiveWindow,
+			AcceptSource:                   func(addr net.Addr) bool { return s.sourceAllowed(aclMuxListen, "", addr) },
 		})
 		if err != nil {
 			return err
@@ -395,7 +562,8 @@ func (s *Server) startMuxListen(cfg *config.File, addr string) error {
 		if err != nil {
 			return err
 		}
-		hl := hlistener.Wrap(l, &hlistener.Config{
+		// Refused sources are dropped before they count as startups.
+		hl := hlistener.Wrap(s.filterSources(l, aclMuxListen, ""), &hlistener.Config{
 			Start:       uint32(startupStart),
 			Full:        uint32(startupFull),
 			Rate:        float64(startupRate) / 100.0,
@@ -420,31 +588,36 @@ func (s *Server) startMuxListen(cfg *config.File, addr string) error {
 // buildH2MuxDialer constructs a new H2Mux dialer from cfg and tlscfg.
 func (s *Server) buildH2MuxDialer(cfg *config.File, tlscfg *tls.Config) *h2mux.H2Mux {
 	return h2mux.New(&h2mux.Config{
-		TLSConfig:     tlscfg,
-		ServerName:    cfg.ServerName(),
-		ALPN:          cfg.ALPN(),
-		LocalID:       cfg.Identity.Claim,
-		RejectInbound: cfg.Connect == "",
-		KeepAlive:     cfg.KeepAlive(),
-		PingTimeout:   cfg.PingTimeout(),
-		WriteTimeout:  cfg.SendTimeout(),
-		SessionWindow: int32(cfg.Mux.SessionWindow),
-		StreamWindow:  int32(cfg.Mux.StreamWindow),
-		Dialer:        s.dialer,
-		ConnSetup:     func(c net.Conn) { setTCPConnParams(cfg.Mux.TCP, c) },
+		TLSConfig:          tlscfg,
+		PSKConfig:          cfg.PSKConfig(),
+		ServerName:         cfg.ServerName(),
+		ALPN:               cfg.ALPN(),
+		LocalID:            cfg.Identity.Claim,
+		RejectInbound:      !cfg.AcceptsInbound(),
+		VerifyPeerIdentity: s.verifyPeerIdentity,
+		KeepAlive:          cfg.KeepAlive(),
+		PingTimeout:        cfg.PingTimeout(),
+		WriteTimeout:       cfg.SendTimeout(),
+		SessionWindow:      int32(cfg.Mux.SessionWindow),
+		StreamWindow:       int32(cfg.Mux.StreamWindow),
+		Dialer:             s.dialer,
+		ConnSetup:          func(c net.Conn) { setTCPConnParams(cfg.Mux.TCP, c) },
 	})
 }
 
 // buildH2MuxListener wraps l as a mux.Listener using the h2mux server-side
-// handshake.  TLS config is fetched per-connection via TLSConfigProvider so
-// that certificate rotation takes effect without restarting the listener.
+// handshake.  TLS and PSK configs are fetched per-connection via the
+// providers so that certificate and key rotation take effect without
+// restarting the listener.
 func (s *Server) buildH2MuxListener(l net.Listener, cfg *config.File) *h2mux.H2Listener {
 	return h2mux.NewListener(l, &h2mux.Config{
 		TLSConfigProvider:    func() *tls.Config { _, tlscfg := s.getConfig(); return tlscfg },
+		PSKConfigProvider:    func() *psk.Config { cfg, _ := s.getConfig(); return cfg.PSKConfig() },
 		ServerName:           cfg.ServerName(),
 		ALPN:                 cfg.ALPN(),
 		LocalID:              cfg.Identity.Claim,
-		RejectInbound:        cfg.Connect == "",
+		RejectInbound:        !cfg.AcceptsInbound(),
+		VerifyPeerIdentity:   s.verifyPeerIdentity,
 		WriteTimeout:         cfg.SendTimeout(),
 		SessionWindow:        int32(cfg.Mux.SessionWindow),
 		StreamWindow:         int32(cfg.Mux.StreamWindow),
@@ -454,6 +627,21 @@ func (s *Server) buildH2MuxListener(l net.Listener, cfg *config.File) *h2mux.H2L
 			cur, _ := s.getConfig()
 			setTCPConnParams(cur.Mux.TCP, c)
 		},
+		ConnPreface: func(ctx context.Context, c net.Conn) (net.Conn, error) {
+			cur, _ := s.getConfig()
+			if !cur.AcceptProxy.MuxListen {
+				return c, nil
+			}
+			deadline, _ := ctx.Deadline()
+			conn, err := acceptProxyHeader(cur, c, deadline)
+			if err != nil {
+				return nil, err
+			}
+			if !s.proxiedSourceAllowed(aclMuxListen, "", conn) {
+				return nil, fmt.Errorf("%v: %w", conn.RemoteAddr(), ErrSourceRefused)
+			}
+			return conn, nil
+		},
 	})
 }
 
@@ -612,7 +800,8 @@ func (s *Server) acceptInboundStreams(tn *tunnel, ss mux.Session) {
 	}
 }
 
-// handleInboundStream forwards one accepted server-side stream to the configured connect address.
+// handleInboundStream forwards one accepted server-side stream to the service
+// requested in its header, or to the configured connect address.
 func (s *Server) handleInboundStream(t *tunnel, peerIdentity string, stream net.Conn) {
 	started := false
 	defer func() {
@@ -629,22 +818,113 @@ func (s *Server) handleInboundStream(t *tunnel, peerIdentity string, stream net.
 		}
 	}
 	tag := formatStreamTag(false, cfg.Identity.Claim, peerIdentity, peerIdentityForTag, stream.LocalAddr(), stream.RemoteAddr(), stream)
-	dialAddr := cfg.Connect
-	if dialAddr == "" {
-		slog.Warningf("%s: no connect address configured", tag)
+	// The header may arrive in-band after the stream is accepted; bound the
+	// wait like any other connection setup step.
+	_ = stream.SetReadDeadline(time.Now().Add(cfg.ConnectTimeout()))
+	hdr, err := mux.HeaderOf(stream)
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Warningf("%s: stream header: %s", tag, formats.Error(err))
 		return
 	}
-	ctx := s.ctx.withTimeout()
-	if ctx == nil {
+	if s.quotaRejects(tag, peerIdentity) {
+		if hdr.Destination != "" {
+			_ = writeDestinationStatus(stream, ErrQuotaExceeded, cfg.ConnectTimeout())
+		}
 		return
 	}
-	defer s.ctx.cancel(ctx)
-	dialed, err := s.dialDirect(ctx, dialAddr)
-	if err != nil {
-		slog.Errorf("%s: %v", tag, err)
+	// Relayed streams are checked by allow_relay here and by the policy of
+	// the peer they are relayed to, but count toward max_streams like any
+	// other stream.
+	relay := hdr.Relay != "" && hdr.Relay != cfg.Identity.Claim
+	policy := cfg.PeerPolicy(peerIdentity, peerLeaf(t))
+	if !relay && !policyAllowsStream(&policy, hdr) {
+		s.policyDenied(tag, true, fmt.Sprintf("%q may not open %s", peerIdentity, streamRequest(hdr)))
+		if hdr.Destination != "" {
+			_ = writeDestinationStatus(stream, ErrDestinationDenied, cfg.ConnectTimeout())
+		}
 		return
 	}
-	if err := s.f.Start(stream, dialed, forwarder.HandlerFuncs{
+	release, ok := s.peerStreams.acquire(peerIdentity, policy.MaxStreams)
+	if !ok {
+		s.policyDenied(tag, true, fmt.Sprintf("%q exceeds %d concurrent streams", peerIdentity, policy.MaxStreams))
+		if hdr.Destination != "" {
+			_ = writeDestinationStatus(stream, ErrDestinationDenied, cfg.ConnectTimeout())
+		}
+		return
+	}
+	if hdr.Datagram && !relay {
+		// The flow frees the slot; stream must stay unwrapped until
+		// mux.AcceptPacket has seen it.
+		started = true
+		s.handleInboundPacket(cfg, tag, peerIdentity, hdr, stream, release)
+		return
+	}
+	// Closing the stream, by the forwarder or the deferred cleanup, frees the slot.
+	stream = &releaseConn{Conn: stream, release: release}
+	if relay {
+		started = true
+		s.relayStream(cfg, tag, peerIdentity, hdr, stream)
+		return
+	}
+	stream = s.meterStream(peerIdentity, stream)
+	var dialed net.Conn
+	if hdr.Destination != "" {
+		if hdr.Service != "" {
+			slog.Warningf("%s: both service %q and destination %q requested", tag, hdr.Service, hdr.Destination)
+			_ = writeDestinationStatus(stream, ErrDestinationDenied, cfg.ConnectTimeout())
+			return
+		}
+		ctx := s.ctx.withTimeout()
+		if ctx == nil {
+			return
+		}
+		defer s.ctx.cancel(ctx)
+		dialed, err = s.dialDestination(ctx, cfg, hdr.Destination)
+		if err != nil {
+			slog.Warningf("%s: destination %q: %s", tag, hdr.Destination, formats.Error(err))
+			_ = writeDestinationStatus(stream, err, cfg.ConnectTimeout())
+			return
+		}
+		if err := writeDestinationStatus(stream, nil, cfg.ConnectTimeout()); err != nil {
+			slog.Debugf("%s: destination status: %s", tag, formats.Error(err))
+			ioClose(dialed)
+			return
+		}
+	} else {
+		dialAddr, ok := cfg.FindService(peerIdentity, hdr.Service)
+		if !ok {
+			if hdr.Service != "" {
+				slog.Warningf("%s: unknown service %q", tag, hdr.Service)
+			} else {
+				slog.Warningf("%s: no connect address configured", tag)
+			}
+			return
+		}
+		ctx := s.ctx.withTimeout()
+		if ctx == nil {
+			return
+		}
+		defer s.ctx.cancel(ctx)
+		if p := s.getPool(dialAddr); p != nil {
+			dialed, err = p.dial(ctx, s, peerIdentity)
+		} else {
+			dialed, err = s.dialDirect(ctx, dialAddr)
+		}
+		if err != nil {
+			slog.Errorf("%s: %v", tag, err)
+			return
+		}
+		if cfg.ProxyProtocol != "" {
+			if err := s.sendProxyHeader(cfg, t, peerIdentity, hdr, dialed); err != nil {
+				slog.Errorf("%s: proxy protocol: %v", tag, err)
+				_ = dialed.Close()
+				return
+			}
+		}
+	}
+	limits := s.streamLimits(peerIdentity, "")
+	if err := s.f.StartLimited(stream, dialed, forwarder.HandlerFuncs{
 		WriteClosed: func(conn net.Conn, err error) {
 			if err != nil {
 				slog.Debugf("%s: half-close %v: %s", tag, conn.RemoteAddr(), formats.Error(err))
@@ -656,7 +936,7 @@ func (s *Server) handleInboundStream(t *tunnel, peerIdentity string, stream net.
 			slog.Debugf("%s: stream finished", tag)
 			s.stats.success.Add(1)
 		},
-	}); err != nil {
+	}, forwarder.Limits{Forward: limits.receive, Reverse: limits.send}); err != nil {
 		slog.Errorf("%s: forward: %v", tag, err)
 		_ = dialed.Close()
 		return
@@ -664,6 +944,73 @@ func (s *Server) handleInboundStream(t *tunnel, peerIdentity string, stream net.
 	started = true
 }
 
+// sendProxyHeader writes the configured PROXY protocol header to dialed,
+// announcing the client address the opener reported in hdr.Source.
+func (s *Server) sendProxyHeader(cfg *config.File, t *tunnel, peerIdentity string, hdr mux.StreamHeader, dialed net.Conn) error {
+	h := &proxyHeader{
+		dst:          addrPortOf(dialed.RemoteAddr()),
+		peerIdentity: peerIdentity,
+	}
+	if hdr.Source != "" {
+		src, err := netip.ParseAddrPort(hdr.Source)
+		if err != nil {
+			return fmt.Errorf("stream source %q: %w", hdr.Source, err)
+		}
+		h.src = src
+	}
+	if t != nil {
+		if ss := t.getSession(); ss != nil {
+			h.peerCerts = mux.PeerCertificatesOf(ss)
+		}
+	}
+	_ = dialed.SetWriteDeadline(time.Now().Add(cfg.ConnectTimeout()))
+	defer func() { _ = dialed.SetWriteDeadline(time.Time{}) }()
+	return writeProxyHeader(dialed, cfg.ProxyProtocol, h)
+}
+
+// handleInboundPacket forwards the datagram flow announced on stream to the
+// configured UDP connect address, metering it against the peer's quota. It
+// owns stream, and closing the flow calls release.
+func (s *Server) handleInboundPacket(cfg *config.File, tag, peerIdentity string, hdr mux.StreamHeader, stream net.Conn, release func()) {
+	flow := s.meterStream(peerIdentity, &releaseConn{Conn: mux.AcceptPacket(stream), release: release})
+	if hdr.Service != "" {
+		slog.Warningf("%s: unknown service %q", tag, hdr.Service)
+		ioClose(flow)
+		return
+	}
+	if cfg.UDPConnect == "" {
+		slog.Warningf("%s: no udp connect address configured", tag)
+		ioClose(flow)
+		return
+	}
+	ctx := s.ctx.withTimeout()
+	if ctx == nil {
+		ioClose(flow)
+		return
+	}
+	defer s.ctx.cancel(ctx)
+	slog.Verbose("forward udp to: ", cfg.UDPConnect)
+	dialed, err := s.dialer.DialContext(ctx, "udp", cfg.UDPConnect)
+	if err != nil {
+		slog.Errorf("%s: %v", tag, err)
+		ioClose(flow)
+		return
+	}
+	limits := s.streamLimits(peerIdentity, "")
+	if err := s.pf.StartLimited(flow, dialed, forwarder.HandlerFuncs{
+		Closed: func() {
+			slog.Debugf("%s: udp flow finished", tag)
+			s.stats.success.Add(1)
+		},
+	}, forwarder.Limits{Forward: limits.receive, Reverse: limits.send}); err != nil {
+		slog.Errorf("%s: forward: %v", tag, err)
+		ioClose(flow)
+		ioClose(dialed)
+		return
+	}
+	slog.Debugf("%s: udp flow established", tag)
+}
+
 // Listen binds a TCP listener and logs the bound address.
 func (s *Server) Listen(addr string) (net.Listener, error) {
 	listener, err := net.Listen(network, addr)
@@ -675,7 +1022,19 @@ func (s *Server) Listen(addr string) (net.Listener, error) {
 	return listener, err
 }
 
-// loadTunnels reconciles identity listeners and outbound tunnels with cfg.
+// ListenPacket binds a UDP socket and logs the bound address.
+func (s *Server) ListenPacket(addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		slog.Errorf("listen udp %s: %s", addr, formats.Error(err))
+		return pc, err
+	}
+	slog.Infof("listen udp: %v", pc.LocalAddr())
+	return pc, err
+}
+
+// loadTunnels reconciles identity listeners, outbound tunnels and backend pools
+// with cfg.
 func (s *Server) loadTunnels(cfg *config.File) error {
 	var errs []error
 
@@ -714,8 +1073,8 @@ func (s *Server) loadTunnels(cfg *config.File) error {
 			if err != nil {
 				errs = append(errs, fmt.Errorf("listen %s: %w", cfg.Listen, err))
 			} else {
-				h := &LocalHandler{s: s, id: ""}
-				if err := s.g.Go(func() { s.Serve(l, h) }); err != nil {
+				h := &LocalHandler{s: s, id: "", addr: cfg.Listen}
+				if err := s.g.Go(func() { s.Serve(s.filterSources(l, aclListen, cfg.Listen), h) }); err != nil {
 					slog.Errorf("local listen goroutine: %s", formats.Error(err))
 					errs = append(errs, fmt.Errorf("local listen goroutine: %w", err))
 					ioClose(l)
@@ -728,45 +1087,59 @@ func (s *Server) loadTunnels(cfg *config.File) error {
 	}
 
 	// === Part 1: Reconcile identity listeners (cfg.Identity.Listen) ===
-	activeListens := make(map[string]string)
-	for name, addr := range cfg.Identity.Listen {
-		activeListens[name] = addr
-	}
-	// Stop identity listeners that were removed or whose address changed.
-	for id, il := range s.identities {
-		if addr, ok := activeListens[id]; ok && addr == il.addr {
-			delete(activeListens, id) // unchanged, retain
+	errs = append(errs, s.reconcileListeners(s.identities, cfg.Identity.Listen, proxyNone, "identity")...)
+
+	// === Part 1a: Reconcile SOCKS5 listeners (cfg.SOCKS5Listen, cfg.Identity.SOCKS5Listen) ===
+	activeSOCKS5 := make(map[string]string)
+	if cfg.SOCKS5Listen != "" {
+		activeSOCKS5[""] = cfg.SOCKS5Listen
+	}
+	for name, addr := range cfg.Identity.SOCKS5Listen {
+		activeSOCKS5[name] = addr
+	}
+	errs = append(errs, s.reconcileListeners(s.socks5Listeners, activeSOCKS5, proxySOCKS5, "socks5")...)
+
+	// === Part 1b: Reconcile UDP listeners (cfg.UDPListen, cfg.Identity.UDPListen) ===
+	activeUDP := make(map[string]string)
+	if cfg.UDPListen != "" {
+		activeUDP[""] = cfg.UDPListen
+	}
+	for name, addr := range cfg.Identity.UDPListen {
+		activeUDP[name] = addr
+	}
+	for id, ul := range s.udpListeners {
+		if addr, ok := activeUDP[id]; ok && addr == ul.addr {
+			delete(activeUDP, id) // unchanged, retain
 		} else {
-			delete(s.identities, id)
-			il.stop()
+			delete(s.udpListeners, id)
+			ul.stop()
 		}
 	}
-	// Create new identity listeners.
-	for id, listenAddr := range activeListens {
-		l, err := s.Listen(listenAddr)
+	for id, listenAddr := range activeUDP {
+		pc, err := s.ListenPacket(listenAddr)
 		if err != nil {
-			slog.Errorf("identity %q: listen: %s", id, formats.Error(err))
-			errs = append(errs, fmt.Errorf("identity %q: listen: %w", id, err))
+			errs = append(errs, fmt.Errorf("udp listen %s: %w", listenAddr, err))
 			continue
 		}
-		il := &identityListener{id: id, addr: listenAddr, l: l}
-		if err := il.start(s); err != nil {
-			slog.Errorf("identity %q: start: %s", id, formats.Error(err))
-			errs = append(errs, fmt.Errorf("identity %q: start: %w", id, err))
-			ioClose(l)
+		ul := &udpListener{id: id, addr: listenAddr, pc: pc}
+		if err := ul.start(s); err != nil {
+			slog.Errorf("udp listen %s: start: %s", listenAddr, formats.Error(err))
+			errs = append(errs, fmt.Errorf("udp listen %s: start: %w", listenAddr, err))
+			ioClose(pc)
 			continue
 		}
-		s.identities[id] = il
+		s.udpListeners[id] = ul
 	}
 
 	// === Part 2: Reconcile identityTunnels by address multiset (cfg.Identity.MuxConnect) ===
-	// Tunnels whose dial address is still configured survive the reload with
-	// their sessions intact; only removed addresses are stopped and added
-	// addresses started, so reordering or inserting entries does not disturb
-	// unrelated tunnels.
+	// Each entry contributes one tunnel per connection. Tunnels whose dial
+	// address is still configured survive the reload with their sessions
+	// intact; only removed addresses (or lowered connection counts) are stopped
+	// and added ones started, so reordering or inserting entries does not
+	// disturb unrelated tunnels.
 	desired := make(map[string]int, len(cfg.Identity.MuxConnect))
-	for _, addr := range cfg.Identity.MuxConnect {
-		desired[addr]++
+	for _, target := range cfg.Identity.MuxConnect {
+		desired[target.Addr] += target.NumConnections()
 	}
 	kept := s.identityTunnels[:0]
 	for _, t := range s.identityTunnels {
@@ -782,23 +1155,89 @@ func (s *Server) loadTunnels(cfg *config.File) error {
 	}
 	s.identityTunnels = kept
 	// Create tunnels for the remaining (added) addresses in config order.
-	for _, addr := range cfg.Identity.MuxConnect {
-		if desired[addr] <= 0 {
+	for _, target := range cfg.Identity.MuxConnect {
+		for ; desired[target.Addr] > 0; desired[target.Addr]-- {
+			t := newTunnel(target.Addr, s)
+			t.tag = t.buildTunnelTag(nil, nil)
+			s.identityTunnels = append(s.identityTunnels, t)
+			if err := t.Start(); err != nil {
+				tag := t.tagValue()
+				slog.Errorf("%s: start: %s", tag, formats.Error(err))
+				errs = append(errs, fmt.Errorf("start %s: %w", tag, err))
+			}
+		}
+	}
+
+	// === Part 3: Reconcile backend pools (cfg.Pools) ===
+	// Unchanged pools keep their health and ejection state; changed ones are
+	// rebuilt from scratch.
+	for name, p := range s.pools {
+		if next, ok := cfg.Pools[name]; !ok || !reflect.DeepEqual(p.cfg, next) {
+			p.stop()
+			delete(s.pools, name)
+		}
+	}
+	for name, poolCfg := range cfg.Pools {
+		if _, ok := s.pools[name]; ok {
 			continue
 		}
-		desired[addr]--
-		t := newTunnel(addr, s)
-		t.tag = t.buildTunnelTag(nil, nil)
-		s.identityTunnels = append(s.identityTunnels, t)
-		if err := t.Start(); err != nil {
-			tag := t.tagValue()
-			slog.Errorf("%s: start: %s", tag, formats.Error(err))
-			errs = append(errs, fmt.Errorf("start %s: %w", tag, err))
+		p := newBackendPool(name, poolCfg)
+		if err := p.start(s); err != nil {
+			slog.Errorf("pool %q: start: %s", name, formats.Error(err))
+			errs = append(errs, fmt.Errorf("start pool %q: %w", name, err))
 		}
+		s.pools[name] = p
 	}
 	return errors.Join(errs...)
 }
 
+// getPool returns the backend pool named by a forwarding target, or nil when
+// the target is a plain address.
+func (s *Server) getPool(target string) *backendPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pools[target]
+}
+
+// reconcileListeners stops the listeners in current that are no longer in
+// desired (name to address) or whose address changed, and starts the missing
+// ones, serving mode. kind prefixes log and error messages. The caller holds
+// s.mu.
+func (s *Server) reconcileListeners(current map[string]*identityListener, desired map[string]string, mode proxyMode, kind string) []error {
+	var errs []error
+	active := make(map[string]string, len(desired))
+	for name, addr := range desired {
+		active[name] = addr
+	}
+	// Stop listeners that were removed or whose address changed.
+	for id, il := range current {
+		if addr, ok := active[id]; ok && addr == il.addr {
+			delete(active, id) // unchanged, retain
+		} else {
+			delete(current, id)
+			il.stop()
+		}
+	}
+	// Create new listeners.
+	for id, listenAddr := range active {
+		l, err := s.Listen(listenAddr)
+		if err != nil {
+			slog.Errorf("%s %q: listen: %s", kind, id, formats.Error(err))
+			errs = append(errs, fmt.Errorf("%s %q: listen: %w", kind, id, err))
+			continue
+		}
+		il := &identityListener{id: id, addr: listenAddr, l: l, mode: mode}
+		if err := il.start(s); err != nil {
+			slog.Errorf("%s %q: start: %s", kind, id, formats.Error(err))
+			errs = append(errs, fmt.Errorf("%s %q: start: %w", kind, id, err))
+			ioClose(l)
+			continue
+		}
+		current[id] = il
+	}
+	return errs
+}
+
 // reloadMuxListen restarts the MuxListen listener when its configuration
 // changed from old to cfg. Errors are logged; the reload continues regardless.
 // The mux listener captures its tunables (windows, timeouts, stream limits,
@@ -811,7 +1250,8 @@ func (s *Server) reloadMuxListen(old, cfg *config.File) error {
 		cfg.MaxStartups == old.MaxStartups &&
 		cfg.Mux == old.Mux &&
 		cfg.Identity.Claim == old.Identity.Claim &&
-		cfg.Connect == old.Connect {
+		cfg.Connect == old.Connect &&
+		cfg.AcceptsInbound() == old.AcceptsInbound() {
 		return nil
 	}
 	s.listenMu.Lock()
@@ -855,7 +1295,7 @@ func (s *Server) reloadAPIListen(old, cfg *config.File) error {
 	}
 	slog.Noticef("http listen: %v", l.Addr())
 	if err := s.g.Go(func() {
-		if err := RunHTTPServer(l, s); err != nil && !errors.Is(err, net.ErrClosed) {
+		if err := RunHTTPServer(s.filterSources(l, aclAPIListen, ""), s); err != nil && !errors.Is(err, net.ErrClosed) {
 			slog.Error(formats.Error(err))
 		}
 	}); err != nil {
@@ -882,6 +1322,7 @@ func (s *Server) timeoutAllSessions() {
 
 // maintenanceLoop runs server-level housekeeping on a 10-second ticker:
 //   - Drains one object from each sync.Pool to slowly return memory under low load.
+//   - Writes quota usage to the quota state file when it changed.
 //   - Detects device sleep (wall-clock advancing far beyond the expected interval,
 //     as can happen on Android) and force-closes all sessions so they re-handshake
 //     with fresh state.
@@ -890,6 +1331,7 @@ func (s *Server) maintenanceLoop() {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	lastTick := time.Now()
+	s.checkCertExpiry(lastTick)
 	for {
 		select {
 		case now := <-ticker.C:
@@ -897,11 +1339,15 @@ func (s *Server) maintenanceLoop() {
 			lastTick = now
 			// Slowly release pooled objects so the GC can reclaim idle memory.
 			forwarder.DrainPool()
+			cfg, _ := s.getConfig()
+			if err := s.saveQuotaState(cfg); err != nil {
+				slog.Errorf("%s", formats.Error(err))
+			}
+			s.checkCertExpiry(now)
 			// If the wall clock advanced more than the ping timeout the device
 			// almost certainly slept (common on Android). The peer would already
 			// have declared the session dead via keepalive, so force-close all
 			// sessions to trigger a clean re-handshake.
-			cfg, _ := s.getConfig()
 			if elapsed > cfg.PingTimeout() {
 				slog.Warningf("system sleep detected (elapsed: %v), closing all sessions", elapsed)
 				s.timeoutAllSessions()
@@ -912,7 +1358,8 @@ func (s *Server) maintenanceLoop() {
 	}
 }
 
-// Start brings up listeners, maintenance, and config-driven tunnels.
+// Start brings up listeners, maintenance, certificate file watching, and
+// config-driven tunnels.
 func (s *Server) Start() error {
 	// Set before any serving goroutine starts; read concurrently by API handlers.
 	s.started = time.Now()
@@ -929,7 +1376,7 @@ func (s *Server) Start() error {
 		}
 		slog.Noticef("http listen: %v", l.Addr())
 		if err := s.g.Go(func() {
-			if err := RunHTTPServer(l, s); err != nil && !errors.Is(err, net.ErrClosed) {
+			if err := RunHTTPServer(s.filterSources(l, aclAPIListen, ""), s); err != nil && !errors.Is(err, net.ErrClosed) {
 				slog.Error(formats.Error(err))
 			}
 		}); err != nil {
@@ -940,9 +1387,20 @@ func (s *Server) Start() error {
 		s.apiListener = l
 		s.listenMu.Unlock()
 	}
+	if s.cfg.Enroll != nil {
+		if err := s.startEnrollListen(s.cfg.Enroll.Listen); err != nil {
+			return err
+		}
+	}
+	if err := s.loadQuotaState(s.cfg); err != nil {
+		return err
+	}
 	if err := s.loadTunnels(s.cfg); err != nil {
 		return err
 	}
+	if err := s.g.Go(s.certWatchLoop); err != nil {
+		return err
+	}
 	if err := s.g.Go(s.maintenanceLoop); err != nil {
 		return err
 	}
@@ -952,8 +1410,8 @@ func (s *Server) Start() error {
 // Shutdown stops listeners, tunnels, sessions, and forwarders in that order.
 func (s *Server) Shutdown() error {
 	s.listenMu.Lock()
-	ml, al := s.muxListener, s.apiListener
-	s.muxListener, s.l, s.apiListener = nil, nil, nil
+	ml, al, el := s.muxListener, s.apiListener, s.enrollListener
+	s.muxListener, s.l, s.apiListener, s.enrollListener = nil, nil, nil, nil
 	s.listenMu.Unlock()
 	if ml != nil {
 		ioClose(ml)
@@ -961,16 +1419,30 @@ func (s *Server) Shutdown() error {
 	if al != nil {
 		ioClose(al)
 	}
+	if el != nil {
+		ioClose(el)
+	}
 	// Snapshot all listeners and tunnels before stopping.
 	s.mu.RLock()
 	localL := s.localListener
-	listeners := make([]*identityListener, 0, len(s.identities))
+	listeners := make([]*identityListener, 0, len(s.identities)+len(s.socks5Listeners))
 	for _, il := range s.identities {
 		listeners = append(listeners, il)
 	}
+	for _, il := range s.socks5Listeners {
+		listeners = append(listeners, il)
+	}
+	udpListeners := make([]*udpListener, 0, len(s.udpListeners))
+	for _, ul := range s.udpListeners {
+		udpListeners = append(udpListeners, ul)
+	}
 	main := s.mainTunnel
 	identity := make([]*tunnel, len(s.identityTunnels))
 	copy(identity, s.identityTunnels)
+	pools := make([]*backendPool, 0, len(s.pools))
+	for _, p := range s.pools {
+		pools = append(pools, p)
+	}
 	s.mu.RUnlock()
 	// Close local listener so its Accept loop exits.
 	if localL != nil {
@@ -980,6 +1452,12 @@ func (s *Server) Shutdown() error {
 	for _, il := range listeners {
 		il.stop()
 	}
+	for _, ul := range udpListeners {
+		ul.stop()
+	}
+	for _, p := range pools {
+		p.stop()
+	}
 	// Stop config-driven tunnels.
 	if main != nil {
 		if err := main.Stop(); err != nil {
@@ -1004,6 +1482,7 @@ func (s *Server) Shutdown() error {
 	}
 	s.g.Close()
 	s.f.Close()
+	s.pf.Close()
 	slog.Info("waiting for unfinished connections")
 	waitDone := make(chan struct{})
 	go func() { s.g.Wait(); close(waitDone) }()
@@ -1013,7 +1492,8 @@ func (s *Server) Shutdown() error {
 		slog.Warning("graceful shutdown timed out, forcing exit")
 		return errors.New("graceful shutdown timed out")
 	}
-	return nil
+	cfg, _ := s.getConfig()
+	return s.saveQuotaState(cfg)
 }
 
 // ReloadConfig reloads the configuration file.
@@ -1036,6 +1516,10 @@ func (s *Server) ReloadConfig(cfg *config.File) error {
 	var errs []error
 	// 1. Build new TLS config; retain old one on failure.
 	newTLSCfg, err := cfg.NewTLSConfig()
+	var newClientTLSCfg *tls.Config
+	if err == nil {
+		newClientTLSCfg, err = cfg.NewClientTLSConfig(newTLSCfg)
+	}
 	if err != nil {
 		slog.Errorf("reload: TLS config: %s", formats.Error(err))
 		newTLSCfg = nil
@@ -1048,13 +1532,21 @@ func (s *Server) ReloadConfig(cfg *config.File) error {
 	old := s.cfg
 	s.cfg = cfg
 	if newTLSCfg != nil {
-		s.tlscfg = newTLSCfg
+		s.tlscfg, s.clientTLSCfg = newTLSCfg, newClientTLSCfg
 	}
-	s.muxDialer = s.buildMuxDialer(cfg, s.tlscfg)
+	s.muxDialer = s.buildMuxDialer(cfg, s.clientTLSCfg)
 	s.cfgMu.Unlock()
 	s.f.SetLimit(maxStreams(cfg))
-	// 3. Mark all existing sessions as stale so they age out when idle.
-	s.markSessionsStale()
+	s.pf.SetLimit(maxStreams(cfg))
+	s.pf.SetIdleTimeout(cfg.UDPIdleTimeout())
+	s.bandwidth.reload(&cfg.Bandwidth)
+	s.reloadQuotas(cfg)
+	// 3. Mark all existing sessions as stale so they age out when idle. An
+	// update of the CRLs alone only closes the sessions of revoked peers.
+	if !onlyCRLChanged(old, cfg) {
+		s.markSessionsStale()
+	}
+	s.closeRevokedSessions(cfg)
 	// 4. Reload listeners when addresses/limits change.
 	if err := s.reloadMuxListen(old, cfg); err != nil {
 		errs = append(errs, err)
@@ -1062,6 +1554,9 @@ func (s *Server) ReloadConfig(cfg *config.File) error {
 	if err := s.reloadAPIListen(old, cfg); err != nil {
 		errs = append(errs, err)
 	}
+	if err := s.reloadEnrollListen(old, cfg); err != nil {
+		errs = append(errs, err)
+	}
 	// 5. Sync config-driven tunnels.
 	if err := s.loadTunnels(cfg); err != nil {
 		errs = append(errs, err)
@@ -1085,3 +1580,11 @@ func (s *Server) getConfig() (*config.File, *tls.Config) {
 	defer s.cfgMu.RUnlock()
 	return s.cfg, s.tlscfg
 }
+
+// verifyPeerIdentity checks a peer's handshake identity claim against its
+// certificate using the current config, so reloads apply to new sessions
+// without restarting listeners.
+func (s *Server) verifyPeerIdentity(identity string, certs []*x509.Certificate) error {
+	cfg, _ := s.getConfig()
+	return cfg.VerifyPeerIdentity(identity, certs)
+}
@@ -9,10 +9,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/hexian000/tlswrapper/v4/mux"
 	"github.com/hexian000/tlswrapper/v4/mux/h2mux"
 )
 
@@ -91,7 +93,7 @@ func TestServerRejectInboundWiring(t *testing.T) {
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
-		return tn.OpenStream(ctx)
+		return tn.OpenStream(ctx, mux.StreamHeader{})
 	}
 
 	t.Run("no-connect-rejects", func(t *testing.T) {
@@ -150,6 +152,44 @@ func TestServerReloadConfigAddsAndRemovesTunnels(t *testing.T) {
 	}
 }
 
+// TestServerReloadMuxConnectConnections verifies that an identity.mux_connect
+// entry keeps one tunnel per connection and that changing the count only
+// starts or stops the difference.
+func TestServerReloadMuxConnectConnections(t *testing.T) {
+	addr := freePort(t)
+	s := newTestServer(t, nil)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	reload := func(target any) []*tunnel {
+		t.Helper()
+		if err := s.ReloadConfig(newTestConfig(t, map[string]any{
+			"no_redial": true,
+			"identity":  map[string]any{"mux_connect": []any{target}},
+		})); err != nil {
+			t.Fatal(err)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for _, tn := range s.identityTunnels {
+			if tn.dialAddr != addr {
+				t.Fatalf("tunnel dials %q, want %q", tn.dialAddr, addr)
+			}
+		}
+		return slices.Clone(s.identityTunnels)
+	}
+
+	three := reload(map[string]any{"addr": addr, "connections": 3})
+	if len(three) != 3 {
+		t.Fatalf("got %d tunnels, want 3", len(three))
+	}
+	two := reload(map[string]any{"addr": addr, "connections": 2})
+	if len(two) != 2 || two[0] != three[0] || two[1] != three[1] {
+		t.Fatal("lowering connections did not keep the existing tunnels")
+	}
+	if one := reload(addr); len(one) != 1 || one[0] != three[0] {
+		t.Fatal("a plain address did not keep exactly one tunnel")
+	}
+}
+
 func TestServerReloadIdentityListenAddrChange(t *testing.T) {
 	oldAddr := freePort(t)
 	newAddr := freePort(t)
@@ -293,6 +333,119 @@ func TestFindSessionLastIdentityFallback(t *testing.T) {
 	}
 }
 
+// balanceSession is a fake session to "peer-b" with a settable stream count.
+type balanceSession struct {
+	fakeMuxSession
+	metrics mux.SessionMetrics
+}
+
+func (s *balanceSession) PeerIdentity() string       { return "peer-b" }
+func (s *balanceSession) Stats() *mux.SessionMetrics { return &s.metrics }
+
+// TestFindSessionInbound verifies that only relayed streams use a session
+// accepted from a peer: a client that claims an outbound peer's identity must
+// not receive traffic meant for that peer.
+func TestFindSessionInbound(t *testing.T) {
+	s := newTestServer(t, nil)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	ss := &balanceSession{}
+	inbound := newTunnel("", s)
+	inbound.ss = ss
+	s.mu.Lock()
+	s.acceptedTunnels[ss] = inbound
+	s.mu.Unlock()
+	if got := s.findSession("peer-b"); got != nil {
+		t.Fatalf("findSession(peer-b) = %v, want nil", got)
+	}
+	if got := s.findRelaySession("peer-b"); got != inbound {
+		t.Fatalf("findRelaySession(peer-b) = %v, want the inbound tunnel", got)
+	}
+	if got := s.findRelaySession("peer-x"); got != nil {
+		t.Fatalf("findRelaySession(peer-x) = %v, want nil", got)
+	}
+
+	// An outbound tunnel that last reached peer-b and is reconnecting.
+	outbound := newTunnel("", s)
+	outbound.lastIdentity = "peer-b"
+	s.mu.Lock()
+	s.identityTunnels = append(s.identityTunnels, outbound)
+	s.mu.Unlock()
+	for range 4 {
+		if got := s.findSession("peer-b"); got != outbound {
+			t.Fatalf("findSession(peer-b) = %v, want the outbound tunnel", got)
+		}
+	}
+	// Once it is connected, the impostor is still never chosen.
+	outbound.ss = &balanceSession{}
+	for range 4 {
+		if got := s.findSession("peer-b"); got != outbound {
+			t.Fatalf("findSession(peer-b) = %v, want the outbound tunnel", got)
+		}
+	}
+}
+
+// TestFindSessionBalance verifies that findSession spreads streams over
+// parallel sessions to one peer according to mux.balance.
+func TestFindSessionBalance(t *testing.T) {
+	newBalancedServer := func(t *testing.T, policy string) (*Server, []*tunnel) {
+		s := newTestServer(t, map[string]any{"mux": map[string]any{"balance": policy}})
+		t.Cleanup(func() { _ = s.Shutdown() })
+		tunnels := make([]*tunnel, 3)
+		for i := range tunnels {
+			tunnels[i] = newTunnel("", s)
+			tunnels[i].ss = &balanceSession{}
+		}
+		s.mu.Lock()
+		s.identityTunnels = append(s.identityTunnels, tunnels...)
+		s.mu.Unlock()
+		return s, tunnels
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		s, tunnels := newBalancedServer(t, "round-robin")
+		picked := make(map[*tunnel]int)
+		for range 3 * len(tunnels) {
+			picked[s.findSession("peer-b")]++
+		}
+		for i, tn := range tunnels {
+			if picked[tn] != 3 {
+				t.Fatalf("tunnel #%d picked %d times, want 3", i, picked[tn])
+			}
+		}
+	})
+
+	t.Run("least-streams", func(t *testing.T) {
+		s, tunnels := newBalancedServer(t, "least-streams")
+		for i, n := range []int64{5, 1, 3} {
+			tunnels[i].ss.(*balanceSession).metrics.NumStreams.Store(n)
+		}
+		if got := s.findSession("peer-b"); got != tunnels[1] {
+			t.Fatal("findSession did not pick the tunnel with the fewest streams")
+		}
+	})
+
+	t.Run("lowest-latency", func(t *testing.T) {
+		s, tunnels := newBalancedServer(t, "lowest-latency")
+		for i, d := range []time.Duration{30, 10, 20} {
+			tunnels[i].streamLatency.Record(d * time.Millisecond)
+		}
+		if got := s.findSession("peer-b"); got != tunnels[1] {
+			t.Fatal("findSession did not pick the tunnel with the lowest latency")
+		}
+	})
+
+	t.Run("skips-closed", func(t *testing.T) {
+		s, tunnels := newBalancedServer(t, "round-robin")
+		_ = tunnels[0].ss.Close()
+		_ = tunnels[2].ss.Close()
+		for range 3 {
+			if got := s.findSession("peer-b"); got != tunnels[1] {
+				t.Fatal("findSession picked a tunnel without an active session")
+			}
+		}
+	})
+}
+
 // TestTimeoutAllSessions verifies that timeoutAllSessions closes every active
 // session across all tunnels without removing the tunnels themselves.
 func TestTimeoutAllSessions(t *testing.T) {
@@ -539,7 +692,7 @@ func TestServerAcceptInboundStreams(t *testing.T) {
 	defer cancel()
 
 	// srv.Open triggers cli.Accept inside acceptInboundStreams.
-	srvConn, err := srv.Open(ctx)
+	srvConn, err := srv.Open(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("srv.Open:", err)
 	}
@@ -579,3 +732,19 @@ func TestServerStatsWithListener(t *testing.T) {
 	// Stats() must not panic; Accepted and Served are populated from s.l.
 	_ = s.Stats()
 }
+
+func TestOnlyCRLChanged(t *testing.T) {
+	base := map[string]any{"tls": map[string]any{"cert": "c", "key": "k", "authcerts": []string{"a"}}}
+	withCRL := map[string]any{"tls": map[string]any{"cert": "c", "key": "k", "authcerts": []string{"a"}, "crl": []string{"r"}}}
+	withCert := map[string]any{"tls": map[string]any{"cert": "c2", "key": "k", "authcerts": []string{"a"}, "crl": []string{"r"}}}
+	old := newTestConfig(t, base)
+	if !onlyCRLChanged(old, newTestConfig(t, withCRL)) {
+		t.Fatal("a CRL update is not recognized")
+	}
+	if onlyCRLChanged(old, newTestConfig(t, withCert)) {
+		t.Fatal("a certificate update is taken for a CRL update")
+	}
+	if onlyCRLChanged(newTestConfig(t, nil), newTestConfig(t, nil)) {
+		t.Fatal("a plaintext reload is taken for a CRL update")
+	}
+}
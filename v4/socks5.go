@@ -0,0 +1,113 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+// SOCKS5 protocol constants (RFC 1928).
+const (
+	socks5Version      = 0x05
+	socks5MethodNoAuth = 0x00
+	socks5NoMethods    = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded            = 0x00
+	socks5GeneralFailure       = 0x01
+	socks5NotAllowed           = 0x02
+	socks5HostUnreachable      = 0x04
+	socks5CommandNotSupported  = 0x07
+	socks5AddrTypeNotSupported = 0x08
+)
+
+var errSOCKS5 = errors.New("socks5")
+
+// readSOCKS5Request performs the SOCKS5 method negotiation (no authentication
+// only) and reads a CONNECT request from conn. It returns the requested
+// destination as "host:port". Unsupported requests are answered with the
+// matching reply before an error is returned.
+func readSOCKS5Request(conn io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("%w: unsupported version %#x", errSOCKS5, hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if !slices.Contains(methods, socks5MethodNoAuth) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoMethods})
+		return "", fmt.Errorf("%w: no acceptable authentication method", errSOCKS5)
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+		return "", err
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("%w: unsupported version %#x", errSOCKS5, req[0])
+	}
+	if req[1] != socks5CmdConnect {
+		_ = writeSOCKS5Reply(conn, socks5CommandNotSupported)
+		return "", fmt.Errorf("%w: unsupported command %#x", errSOCKS5, req[1])
+	}
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom4(b).String()
+	case socks5AtypIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom16(b).String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		_ = writeSOCKS5Reply(conn, socks5AddrTypeNotSupported)
+		return "", fmt.Errorf("%w: unsupported address type %#x", errSOCKS5, req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKS5Reply sends a reply with code rep. The bound address is not
+// meaningful for a tunneled connection and is reported as 0.0.0.0:0.
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
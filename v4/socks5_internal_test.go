@@ -0,0 +1,80 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// socks5Conn replays a scripted client request and records the replies.
+type socks5Conn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func newSOCKS5Conn(req ...byte) *socks5Conn {
+	return &socks5Conn{Reader: bytes.NewReader(req)}
+}
+
+func (c *socks5Conn) Read(b []byte) (int, error) { return c.Reader.Read(b) }
+
+func TestReadSOCKS5Request(t *testing.T) {
+	greeting := []byte{socks5Version, 1, socks5MethodNoAuth}
+	tests := []struct {
+		name string
+		req  []byte
+		want string
+	}{
+		{"ipv4", []byte{5, 1, 0, socks5AtypIPv4, 127, 0, 0, 1, 0x1f, 0x90}, "127.0.0.1:8080"},
+		{"ipv6", append(append([]byte{5, 1, 0, socks5AtypIPv6}, make([]byte, 15)...), 1, 0, 22), "[::1]:22"},
+		{"domain", append([]byte{5, 1, 0, socks5AtypDomain, 11}, "example.com\x01\xbb"...), "example.com:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newSOCKS5Conn(append(greeting, tt.req...)...)
+			got, err := readSOCKS5Request(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("readSOCKS5Request() = %q, want %q", got, tt.want)
+			}
+			if reply := conn.Bytes(); !bytes.Equal(reply, []byte{socks5Version, socks5MethodNoAuth}) {
+				t.Fatalf("method reply = %v", reply)
+			}
+		})
+	}
+
+	t.Run("no-acceptable-method", func(t *testing.T) {
+		conn := newSOCKS5Conn(socks5Version, 1, 0x02)
+		if _, err := readSOCKS5Request(conn); !errors.Is(err, errSOCKS5) {
+			t.Fatalf("readSOCKS5Request() error = %v, want %v", err, errSOCKS5)
+		}
+		if reply := conn.Bytes(); !bytes.Equal(reply, []byte{socks5Version, socks5NoMethods}) {
+			t.Fatalf("method reply = %v", reply)
+		}
+	})
+
+	t.Run("unsupported-command", func(t *testing.T) {
+		// UDP ASSOCIATE
+		conn := newSOCKS5Conn(append(greeting, 5, 3, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0)...)
+		if _, err := readSOCKS5Request(conn); !errors.Is(err, errSOCKS5) {
+			t.Fatalf("readSOCKS5Request() error = %v, want %v", err, errSOCKS5)
+		}
+		// The request reply follows the 2-byte method reply.
+		if reply := conn.Bytes(); len(reply) < 4 || reply[3] != socks5CommandNotSupported {
+			t.Fatalf("reply = %v, want command not supported", reply)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		conn := newSOCKS5Conn(append(greeting, 5, 1, 0, socks5AtypIPv4, 127)...)
+		if _, err := readSOCKS5Request(conn); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("readSOCKS5Request() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+}
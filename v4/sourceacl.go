@@ -0,0 +1,152 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"cmp"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/hexian000/gosnippets/slog"
+	"github.com/hexian000/tlswrapper/v4/config"
+)
+
+// Listener kinds of config.SourceACL.
+const (
+	aclListen       = "listen"
+	aclMuxListen    = "mux_listen"
+	aclAPIListen    = "api_listen"
+	aclEnrollListen = "enroll_listen"
+)
+
+// sourceRejectKey identifies a rule of config.SourceACL.
+type sourceRejectKey struct {
+	listener string
+	rule     string
+}
+
+// sourceRejects counts the connections refused by each source rule.
+type sourceRejects struct {
+	mu     sync.Mutex
+	counts map[sourceRejectKey]uint64
+}
+
+func (r *sourceRejects) add(listener, rule string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counts == nil {
+		r.counts = make(map[sourceRejectKey]uint64)
+	}
+	r.counts[sourceRejectKey{listener, rule}]++
+}
+
+// SourceRejectStats is the number of connections a source rule refused.
+type SourceRejectStats struct {
+	Listener string
+	Rule     string // the Deny entry, or "default" for sources outside Allow
+	Rejected uint64
+}
+
+// snapshot returns the counters sorted by listener and rule.
+func (r *sourceRejects) snapshot() []SourceRejectStats {
+	r.mu.Lock()
+	stats := make([]SourceRejectStats, 0, len(r.counts))
+	for k, n := range r.counts {
+		stats = append(stats, SourceRejectStats{Listener: k.listener, Rule: k.rule, Rejected: n})
+	}
+	r.mu.Unlock()
+	slices.SortFunc(stats, func(a, b SourceRejectStats) int {
+		return cmp.Or(cmp.Compare(a.Listener, b.Listener), cmp.Compare(a.Rule, b.Rule))
+	})
+	return stats
+}
+
+// sourceAllowed checks addr against the live source rules of listener, so
+// that reloaded rules apply without rebinding. listenAddr is the configured
+// address of a local TCP or UDP listener, which may have rules of its own.
+// Refusals are counted per rule. Sources without an IP address are only
+// accepted when no rules are set.
+func (s *Server) sourceAllowed(listener, listenAddr string, addr net.Addr) bool {
+	cfg, _ := s.getConfig()
+	listener, rules := cfg.SourceACL.Rules(listener, listenAddr)
+	if rules.Empty() {
+		return true
+	}
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = a.AddrPort().Addr()
+	}
+	rule, ok := "default", false
+	if ip.IsValid() {
+		rule, ok = rules.Check(ip)
+	}
+	if !ok {
+		s.sourceRejects.add(listener, rule)
+		slog.Debugf("%s: %v refused by source rule %q", listener, addr, rule)
+	}
+	return ok
+}
+
+// proxiedSourceAllowed checks the client address announced by the trusted
+// PROXY header that conn was read from, see acceptProxyHeader. Connections
+// without a header were checked on accept.
+func (s *Server) proxiedSourceAllowed(listener, listenAddr string, conn net.Conn) bool {
+	if _, ok := conn.(*proxiedConn); !ok {
+		return true
+	}
+	return s.sourceAllowed(listener, listenAddr, conn.RemoteAddr())
+}
+
+// proxyDeferred reports whether a listener of kind reads a PROXY header from
+// addr. Such a load balancer is not checked on accept: the rules apply to the
+// client address in its header instead, see proxiedSourceAllowed.
+func proxyDeferred(cfg *config.File, kind string, addr net.Addr) bool {
+	switch kind {
+	case aclListen:
+		if !cfg.AcceptProxy.Listen {
+			return false
+		}
+	case aclMuxListen:
+		if !cfg.AcceptProxy.MuxListen {
+			return false
+		}
+	default:
+		return false
+	}
+	src := addrPortOf(addr)
+	return src.IsValid() && cfg.ProxySourceTrusted(src.Addr())
+}
+
+// sourceFilterListener closes connections refused by the source rules of its
+// listener kind as soon as they are accepted.
+type sourceFilterListener struct {
+	net.Listener
+	s    *Server
+	kind string
+	addr string // configured listen address, see sourceAllowed
+}
+
+func (s *Server) filterSources(l net.Listener, kind, listenAddr string) net.Listener {
+	return &sourceFilterListener{Listener: l, s: s, kind: kind, addr: listenAddr}
+}
+
+func (l *sourceFilterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		cfg, _ := l.s.getConfig()
+		if proxyDeferred(cfg, l.kind, conn.RemoteAddr()) ||
+			l.s.sourceAllowed(l.kind, l.addr, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,282 @@
+// tlswrapper (c) 2021-2026 He Xian <hexian000@outlook.com>
+// This code is licensed under MIT license (see LICENSE for details)
+
+package tlswrapper
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func denyLoopback(listener string) map[string]any {
+	return map[string]any{
+		"source_acl": map[string]any{
+			listener: map[string]any{"deny": []string{"127.0.0.0/8"}},
+		},
+	}
+}
+
+// expectRefused dials addr and checks that the server closes the connection
+// without sending anything.
+func expectRefused(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || (err != io.EOF && !isConnReset(err)) {
+		t.Fatalf("read from %s = %d, %v; want the connection closed", addr, n, err)
+	}
+}
+
+func isConnReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+func TestSourceFilterListener(t *testing.T) {
+	s := newTestServer(t, denyLoopback("listen"))
+	t.Cleanup(func() { _ = s.Shutdown() })
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := s.filterSources(raw, aclListen, "")
+	t.Cleanup(func() { _ = l.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	expectRefused(t, raw.Addr().String())
+	select {
+	case <-accepted:
+		t.Fatal("refused connection was accepted")
+	default:
+	}
+	stats := s.Stats().sourceRejects
+	if len(stats) != 1 || stats[0] != (SourceRejectStats{Listener: "listen", Rule: "127.0.0.0/8", Rejected: 1}) {
+		t.Fatalf("source rejects = %+v, want one refusal by the deny rule", stats)
+	}
+
+	// Reloaded rules apply to the same listener.
+	if err := s.ReloadConfig(newTestConfig(t, map[string]any{
+		"source_acl": map[string]any{
+			"listen": map[string]any{"allow": []string{"127.0.0.1"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	select {
+	case c := <-accepted:
+		_ = c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed connection was not accepted")
+	}
+}
+
+func TestSourceFilterListenerByAddress(t *testing.T) {
+	listen := freePort(t)
+	s := newTestServer(t, map[string]any{
+		"listen": listen,
+		"source_acl": map[string]any{
+			"listeners": map[string]any{
+				listen: map[string]any{"deny": []string{"127.0.0.0/8"}},
+			},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	accept := func(listenAddr string) <-chan net.Conn {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := s.filterSources(raw, aclListen, listenAddr)
+		t.Cleanup(func() { _ = l.Close() })
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+		conn, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return accepted
+	}
+
+	// The rules of the listen address do not apply to other listeners.
+	select {
+	case c := <-accept("127.0.0.1:1"):
+		_ = c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to a listener without rules was not accepted")
+	}
+	select {
+	case c := <-accept(listen):
+		_ = c.Close()
+		t.Fatal("refused connection was accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	stats := s.Stats().sourceRejects
+	if len(stats) != 1 || stats[0] != (SourceRejectStats{Listener: "listen " + listen, Rule: "127.0.0.0/8", Rejected: 1}) {
+		t.Fatalf("source rejects = %+v, want one refusal on %s", stats, listen)
+	}
+}
+
+func TestLocalPacketHandlerSourceACL(t *testing.T) {
+	listen := freePort(t)
+	s := newTestServer(t, map[string]any{
+		"udp_listen": listen,
+		"source_acl": map[string]any{
+			"listeners": map[string]any{
+				listen: map[string]any{"deny": []string{"127.0.0.0/8"}},
+			},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	h := &LocalPacketHandler{s: s, addr: listen}
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	if _, _, err := h.dial(src); !errors.Is(err, ErrSourceRefused) {
+		t.Fatalf("dial(%v) = %v, want %v", src, err, ErrSourceRefused)
+	}
+	// Other sources get as far as looking up the session.
+	src = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	if _, _, err := h.dial(src); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("dial(%v) = %v, want %v", src, err, ErrNoSession)
+	}
+	stats := s.Stats().sourceRejects
+	if len(stats) != 1 || stats[0] != (SourceRejectStats{Listener: "listen " + listen, Rule: "127.0.0.0/8", Rejected: 1}) {
+		t.Fatalf("source rejects = %+v, want one refusal on %s", stats, listen)
+	}
+}
+
+func TestSourceFilterListenerProxied(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"accept_proxy": map[string]any{"listen": true, "trusted": []string{"127.0.0.1"}},
+		"source_acl": map[string]any{
+			"listen": map[string]any{"allow": []string{"203.0.113.0/24"}},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := s.filterSources(raw, aclListen, "")
+	t.Cleanup(func() { _ = l.Close() })
+	cfg, _ := s.getConfig()
+	for _, tc := range []struct {
+		client string
+		ok     bool
+	}{
+		{"203.0.113.7", true},
+		{"198.51.100.9", false},
+	} {
+		client, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		if _, err := io.WriteString(client, "PROXY TCP4 "+tc.client+" 127.0.0.1 4242 80\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		// The load balancer is outside allow, but its header is read.
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		conn, err = acceptProxyHeader(cfg, conn, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := s.proxiedSourceAllowed(aclListen, "", conn); ok != tc.ok {
+			t.Errorf("client %s: proxiedSourceAllowed() = %v, want %v", tc.client, ok, tc.ok)
+		}
+	}
+	stats := s.Stats().sourceRejects
+	if len(stats) != 1 || stats[0] != (SourceRejectStats{Listener: "listen", Rule: "default", Rejected: 1}) {
+		t.Fatalf("source rejects = %+v, want one refusal of the client outside allow", stats)
+	}
+}
+
+func TestServerSourceACL(t *testing.T) {
+	s := newTestServer(t, map[string]any{
+		"mux_listen": freePort(t),
+		"api_listen": freePort(t),
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := s.getConfig()
+	s.listenMu.Lock()
+	ml, al := s.muxListener, s.apiListener
+	s.listenMu.Unlock()
+
+	overrides := denyLoopback("mux_listen")
+	overrides["source_acl"].(map[string]any)["api_listen"] = map[string]any{"allow": []string{"192.0.2.0/24"}}
+	overrides["mux_listen"], overrides["api_listen"] = cfg.MuxListen, cfg.APIListen
+	if err := s.ReloadConfig(newTestConfig(t, overrides)); err != nil {
+		t.Fatal(err)
+	}
+	s.listenMu.Lock()
+	if s.muxListener != ml || s.apiListener != al {
+		t.Error("reloading source rules rebound a listener")
+	}
+	s.listenMu.Unlock()
+
+	expectRefused(t, cfg.MuxListen)
+	if _, err := http.Get("http://" + cfg.APIListen + "/healthy"); err == nil {
+		t.Fatal("API request from a refused source succeeded")
+	}
+	if got := s.Stats().Accepted; got != 0 {
+		t.Fatalf("Accepted = %d, want refused sources not to count", got)
+	}
+
+	rec := httptest.NewRecorder()
+	(&apiStatsHandler{s: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?nobanner=true", nil))
+	body := rec.Body.String()
+	for _, want := range []string{"> Source Rejects", "api_listen          : default 1", "mux_listen          : 127.0.0.0/8 1"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("stats missing %q:\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	newAPIMetricsHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		`tlswrapper_source_rejected_total{listener="api_listen",rule="default"} 1`,
+		`tlswrapper_source_rejected_total{listener="mux_listen",rule="127.0.0.0/8"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
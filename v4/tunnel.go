@@ -35,6 +35,8 @@ type tunnel struct {
 	stale         bool      // marked after config reload; evicted when idle
 	idleEvicted   bool      // last close was an intentional idle eviction; skip auto-redial
 	lastIdentity  string    // peer identity of the most recent session (kept after close)
+	sessionAddr   string    // address the current outbound session was dialed to
+	fallbackAt    time.Time // next attempt to move back to dialAddr (zero = none due)
 	closeSig      chan struct{}
 	stopOnce      sync.Once
 	redialSig     chan struct{}
@@ -248,6 +250,43 @@ func (t *tunnel) maintenance() {
 		}
 		return
 	}
+	t.fallback()
+}
+
+// fallback redials the preferred address (dialAddr) once it is due while the
+// session runs over a failover address. On success the new session takes over
+// and the old one is closed when its streams finish (see watchIdleSession).
+func (t *tunnel) fallback() {
+	cfg, _ := t.getConfig()
+	t.mu.RLock()
+	at := t.fallbackAt
+	t.mu.RUnlock()
+	if cfg.NoRedial || at.IsZero() || time.Now().Before(at) {
+		return
+	}
+	ctx := t.s.ctx.withTimeout()
+	if ctx == nil {
+		return
+	}
+	defer t.s.ctx.cancel(ctx)
+	if !t.dialMu.TryLock() {
+		return
+	}
+	defer t.dialMu.Unlock()
+	start := time.Now()
+	ss, err := t.s.getMuxDialer().Dial(ctx, t.dialAddr)
+	if err != nil {
+		t.mu.Lock()
+		t.fallbackAt = time.Now().Add(cfg.FindMuxTarget(t.dialAddr).FallbackDelay())
+		tag := t.tag
+		t.mu.Unlock()
+		slog.Debugf("%s: fallback to %s: %s", tag, t.dialAddr, formats.Error(err))
+		return
+	}
+	slog.Infof("%s: falling back to %s", t.tagValue(), t.dialAddr)
+	if _, err := t.startSession(ss, t.dialAddr, time.Since(start)); err != nil {
+		slog.Errorf("%s: fallback to %s: %s", t.tagValue(), t.dialAddr, formats.Error(err))
+	}
 }
 
 func (t *tunnel) schedule() <-chan time.Time {
@@ -255,8 +294,14 @@ func (t *tunnel) schedule() <-chan time.Time {
 	if cfg.NoRedial || t.dialAddr == "" || t.redialCount < 1 {
 		// Connected (or no redial needed): sleep until an event wakes the loop.
 		// maintenanceLoop handles idle eviction; run() only needs to react to
-		// redialSig, closeSig, or group shutdown.
-		return nil
+		// redialSig, closeSig, or group shutdown, plus a due fallback.
+		t.mu.RLock()
+		at := t.fallbackAt
+		t.mu.RUnlock()
+		if cfg.NoRedial || at.IsZero() {
+			return nil
+		}
+		return time.After(time.Until(at))
 	}
 	n := t.redialCount - 1
 	var waitTimeConst = [...]time.Duration{
@@ -334,6 +379,11 @@ func (t *tunnel) watchIdleSession(ss mux.Session) {
 			}
 		}
 
+		// A session replaced by a fallback dial is closed once it drains.
+		if t.getSession() != ss {
+			_ = ss.Close()
+			return
+		}
 		// Immediate check handles stale eviction (config reload case).
 		t.checkIdle()
 		idle = false
@@ -371,12 +421,13 @@ func (t *tunnel) watchIdleSession(ss mux.Session) {
 	}
 }
 
-// addSession installs ss as the tunnel's active session and registers the
-// idle watcher.  It returns false (closing nothing) when the tunnel has been
-// stopped, in which case the caller must close ss itself.  Every session
-// accepted here is finalized exactly once by finalizeSession.
-func (t *tunnel) addSession(ss mux.Session, setupDur time.Duration) bool {
+// addSession installs ss, dialed to addr, as the tunnel's active session and
+// registers the idle watcher.  It returns false (closing nothing) when the
+// tunnel has been stopped, in which case the caller must close ss itself.
+// Every session accepted here is finalized exactly once by finalizeSession.
+func (t *tunnel) addSession(ss mux.Session, addr string, setupDur time.Duration) bool {
 	now := time.Now()
+	cfg, _ := t.getConfig()
 	t.mu.Lock()
 	select {
 	case <-t.closeSig:
@@ -385,9 +436,11 @@ func (t *tunnel) addSession(ss mux.Session, setupDur time.Duration) bool {
 		return false
 	default:
 	}
+	// Only a fallback dial replaces a live session; the old one keeps its
+	// streams and its watcher closes it once they finish.
+	var replaced mux.Session
 	if t.ss != nil && !t.ss.IsClosed() {
-		// Should not happen (dials are serialized); let its watcher finalize it.
-		_ = t.ss.Close()
+		replaced = t.ss
 	}
 	t.ss = ss
 	t.updateTagLocked(ss, nil)
@@ -397,7 +450,17 @@ func (t *tunnel) addSession(ss mux.Session, setupDur time.Duration) bool {
 	t.idleSince = time.Time{}
 	t.lastIdentity = ss.PeerIdentity()
 	t.lastChanged = now
+	t.sessionAddr = addr
+	t.fallbackAt = time.Time{}
+	if addr != t.dialAddr {
+		t.fallbackAt = now.Add(cfg.FindMuxTarget(t.dialAddr).FallbackDelay())
+	}
 	t.mu.Unlock()
+	if replaced != nil {
+		if m := replaced.Stats(); m == nil || m.NumStreams.Load() == 0 {
+			_ = replaced.Close()
+		}
+	}
 	t.s.stats.numSessions.Add(1)
 	t.s.stats.numSessionsCreated.Add(1)
 
@@ -422,6 +485,8 @@ func (t *tunnel) finalizeSession(ss mux.Session) {
 		t.idleSince = time.Time{}
 		t.idleEvicted = false
 		t.lastChanged = now
+		t.sessionAddr = ""
+		t.fallbackAt = time.Time{}
 	}
 	tag := t.tag
 	if current && !idleEvicted && t.dialAddr != "" {
@@ -449,11 +514,27 @@ func (t *tunnel) getSession() mux.Session {
 	return t.ss
 }
 
-// OpenStream opens a stream over the active session.  When no session is
-// active (e.g. after an idle eviction or before the redial loop reconnects),
-// it dials a new session on demand.  Dial-on-demand applies regardless of
-// NoRedial, which only disables the background redial loop.
-func (t *tunnel) OpenStream(ctx context.Context) (net.Conn, error) {
+// OpenStream opens a stream over the active session, sending hdr to the peer.
+// When no session is active (e.g. after an idle eviction or before the redial
+// loop reconnects), it dials a new session on demand.  Dial-on-demand applies
+// regardless of NoRedial, which only disables the background redial loop.
+func (t *tunnel) OpenStream(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
+	return t.open(ctx, func(ss mux.Session) (net.Conn, error) {
+		return ss.Open(ctx, hdr)
+	})
+}
+
+// OpenPacket opens a datagram flow over the tunnel's session (see
+// mux.OpenPacket), dialing a new session on demand like OpenStream.
+func (t *tunnel) OpenPacket(ctx context.Context, hdr mux.StreamHeader) (net.Conn, error) {
+	return t.open(ctx, func(ss mux.Session) (net.Conn, error) {
+		return mux.OpenPacket(ctx, ss, hdr)
+	})
+}
+
+// open runs openFn on the active session, dialing one first if needed, and
+// records the open latency.
+func (t *tunnel) open(ctx context.Context, openFn func(mux.Session) (net.Conn, error)) (net.Conn, error) {
 	ss := t.getSession()
 	if ss == nil {
 		if t.dialAddr == "" {
@@ -465,7 +546,7 @@ func (t *tunnel) OpenStream(ctx context.Context) (net.Conn, error) {
 		}
 	}
 	start := time.Now()
-	conn, err := ss.Open(ctx)
+	conn, err := openFn(ss)
 	if err != nil {
 		return nil, err
 	}
@@ -473,9 +554,11 @@ func (t *tunnel) OpenStream(ctx context.Context) (net.Conn, error) {
 	return conn, nil
 }
 
-// dial establishes a new outbound mux session.
+// dial establishes a new outbound mux session to dialAddr or, when it is an
+// Identity.MuxConnect entry with failover addresses, to the first of them
+// that answers.
 func (t *tunnel) dial(ctx context.Context) (mux.Session, error) {
-	_, tlscfg := t.getConfig()
+	cfg, tlscfg := t.getConfig()
 	if t.dialAddr == "" {
 		return nil, ErrNoDialAddress
 	}
@@ -486,12 +569,115 @@ func (t *tunnel) dial(ctx context.Context) (mux.Session, error) {
 	if tlscfg == nil {
 		slog.Warningf("%s: connection is not encrypted", t.tagValue())
 	}
+	target := cfg.FindMuxTarget(t.dialAddr)
 	start := time.Now()
-	ss, err := t.s.getMuxDialer().Dial(ctx, t.dialAddr)
+	var ss mux.Session
+	var addr string
+	var err error
+	if target.Dial == "parallel" {
+		ss, addr, err = t.dialParallel(ctx, target.DialAddrs())
+	} else {
+		ss, addr, err = t.dialOrdered(ctx, target.DialAddrs())
+	}
 	if err != nil {
 		return nil, err
 	}
-	if !t.addSession(ss, time.Since(start)) {
+	return t.startSession(ss, addr, time.Since(start))
+}
+
+// dialOrdered tries addrs one at a time, giving each attempt an equal share of
+// the time left before ctx's deadline.
+func (t *tunnel) dialOrdered(ctx context.Context, addrs []string) (mux.Session, string, error) {
+	d := t.s.getMuxDialer()
+	if len(addrs) == 1 {
+		ss, err := d.Dial(ctx, addrs[0])
+		return ss, addrs[0], err
+	}
+	var errs []error
+	for i, addr := range addrs {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		}
+		ss, err := d.Dial(attemptCtx, addr)
+		cancel()
+		if err == nil {
+			return ss, addr, nil
+		}
+		slog.Debugf("%s: dial %s: %s", t.tagValue(), addr, formats.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// happyEyeballsDelay is how long a parallel dial waits for one address before
+// also trying the next (RFC 8305 recommends 250 ms).
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialParallel starts dialing addrs in order, each happyEyeballsDelay after the
+// previous one or as soon as it fails, and returns the first session
+// established. Sessions that complete later are closed.
+func (t *tunnel) dialParallel(ctx context.Context, addrs []string) (mux.Session, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		ss   mux.Session
+		addr string
+		err  error
+	}
+	d := t.s.getMuxDialer()
+	results := make(chan result, len(addrs))
+	started, pending := 0, 0
+	startNext := func() {
+		addr := addrs[started]
+		started++
+		pending++
+		go func() {
+			ss, err := d.Dial(ctx, addr)
+			results <- result{ss: ss, addr: addr, err: err}
+		}()
+	}
+	startNext()
+	next := time.NewTimer(happyEyeballsDelay)
+	defer next.Stop()
+	var errs []error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for range n {
+						if r := <-results; r.ss != nil {
+							_ = r.ss.Close()
+						}
+					}
+				}(pending)
+				return r.ss, r.addr, nil
+			}
+			slog.Debugf("%s: dial %s: %s", t.tagValue(), r.addr, formats.Error(r.err))
+			errs = append(errs, fmt.Errorf("%s: %w", r.addr, r.err))
+			if started < len(addrs) {
+				next.Reset(0)
+			} else if pending == 0 {
+				return nil, "", errors.Join(errs...)
+			}
+		case <-next.C:
+			if started < len(addrs) {
+				startNext()
+				next.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+}
+
+// startSession installs ss, dialed to addr, and starts its goroutines.
+// The caller holds dialMu.
+func (t *tunnel) startSession(ss mux.Session, addr string, setupDur time.Duration) (mux.Session, error) {
+	if !t.addSession(ss, addr, setupDur) {
 		_ = ss.Close()
 		return nil, ErrTunnelStopped
 	}
@@ -547,6 +733,9 @@ type SessionStats struct {
 	// StreamLatency holds pre-computed percentiles of this tunnel's
 	// stream-open latency ring.
 	StreamLatency StreamLatencyStats
+	// CertNotAfter is the expiry of the peer's leaf certificate; zero in
+	// plaintext mode.
+	CertNotAfter time.Time
 }
 
 // Stats snapshots the current session state.
@@ -557,8 +746,12 @@ func (t *tunnel) Stats() SessionStats {
 	var peerIdentity string
 	var streamsOpened, streamsAccepted, streamsSucceeded, streamsFailed, bytesSent, bytesReceived, wireLengthSent, wireLengthReceived uint64
 	var numStreams uint32
+	var certNotAfter time.Time
 	if active {
 		peerIdentity = t.ss.PeerIdentity()
+		if certs := mux.PeerCertificatesOf(t.ss); len(certs) > 0 {
+			certNotAfter = certs[0].NotAfter
+		}
 		if m := t.ss.Stats(); m != nil {
 			streamsOpened = uint64(m.StreamsOpened.Load())
 			streamsAccepted = uint64(m.StreamsAccepted.Load())
@@ -586,5 +779,6 @@ func (t *tunnel) Stats() SessionStats {
 		WireLengthSent:     wireLengthSent,
 		WireLengthReceived: wireLengthReceived,
 		StreamLatency:      StreamLatencyStats{P50: p50, P90: p90, P99: p99, Max: pmax, Available: latOk},
+		CertNotAfter:       certNotAfter,
 	}
 }
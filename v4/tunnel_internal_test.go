@@ -49,8 +49,13 @@ func TestTunnelCheckIdle(t *testing.T) {
 // startMuxAcceptor runs an h2mux server that accepts any number of sessions
 // (and drains their inbound streams) until the listener closes.
 func startMuxAcceptor(t *testing.T) string {
+	return startMuxAcceptorOn(t, "127.0.0.1:0")
+}
+
+// startMuxAcceptorOn is startMuxAcceptor listening on addr.
+func startMuxAcceptorOn(t *testing.T, addr string) string {
 	t.Helper()
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,7 +135,7 @@ func TestTunnelIdleEvictionAndDialOnDemand(t *testing.T) {
 	// OpenStream reconnects on demand.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	conn, err := tn.OpenStream(ctx)
+	conn, err := tn.OpenStream(ctx, mux.StreamHeader{})
 	if err != nil {
 		t.Fatal("OpenStream:", err)
 	}
@@ -224,3 +229,133 @@ func TestTunnelRedialSuccessAndFinalizeSession(t *testing.T) {
 	}
 	_ = remote.Close()
 }
+
+// newFailoverServer returns a Server whose identity.mux_connect entry dials
+// primary with the given failover addresses and dial mode.
+func newFailoverServer(t *testing.T, primary string, failover []string, mode string) *Server {
+	t.Helper()
+	s := newTestServer(t, map[string]any{
+		"identity": map[string]any{
+			"claim": "local",
+			"mux_connect": []any{map[string]any{
+				"addr": primary, "failover": failover, "dial": mode, "fallback_interval": 1,
+			}},
+		},
+	})
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return s
+}
+
+func TestTunnelDialFailover(t *testing.T) {
+	t.Run("ordered", func(t *testing.T) {
+		primary, backup := freePort(t), startMuxAcceptor(t)
+		tn := newTunnel(primary, newFailoverServer(t, primary, []string{backup}, "ordered"))
+		tn.redial()
+		if tn.getSession() == nil {
+			t.Fatal("expected active session after redial")
+		}
+		tn.mu.RLock()
+		addr, at := tn.sessionAddr, tn.fallbackAt
+		tn.mu.RUnlock()
+		if addr != backup {
+			t.Fatalf("sessionAddr = %q, want %q", addr, backup)
+		}
+		if at.IsZero() {
+			t.Fatal("expected a fallback attempt to be scheduled")
+		}
+		if tn.schedule() == nil {
+			t.Fatal("expected schedule to wake the loop for the fallback")
+		}
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		// The primary accepts TCP but never completes the mux handshake.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { _ = conn.Close() })
+			}
+		}()
+		primary, backup := l.Addr().String(), startMuxAcceptor(t)
+		tn := newTunnel(primary, newFailoverServer(t, primary, []string{backup}, "parallel"))
+		start := time.Now()
+		tn.redial()
+		if tn.getSession() == nil {
+			t.Fatal("expected active session after redial")
+		}
+		// An ordered dial would wait for half of the 10s connect timeout.
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("parallel dial took %v", elapsed)
+		}
+		if tn.sessionAddr != backup {
+			t.Fatalf("sessionAddr = %q, want %q", tn.sessionAddr, backup)
+		}
+	})
+
+	t.Run("all-fail", func(t *testing.T) {
+		primary, backup := freePort(t), freePort(t)
+		tn := newTunnel(primary, newFailoverServer(t, primary, []string{backup}, "parallel"))
+		tn.redial()
+		if tn.getSession() != nil || tn.redialCount != 1 {
+			t.Fatalf("session = %v, redialCount = %d; want none, 1", tn.getSession(), tn.redialCount)
+		}
+	})
+}
+
+// TestTunnelFallback verifies that a session on a failover address is replaced
+// by one to the preferred address once it answers, and that the replaced
+// session is closed only after its streams finish.
+func TestTunnelFallback(t *testing.T) {
+	primary, backup := freePort(t), startMuxAcceptor(t)
+	s := newFailoverServer(t, primary, []string{backup}, "ordered")
+	tn := newTunnel(primary, s)
+	tn.redial()
+	old := tn.getSession()
+	if old == nil {
+		t.Fatal("expected active session after redial")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := tn.OpenStream(ctx, mux.StreamHeader{})
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+
+	// Not due yet: nothing happens.
+	tn.fallback()
+	if tn.getSession() != old {
+		t.Fatal("fallback ran before it was due")
+	}
+
+	startMuxAcceptorOn(t, primary)
+	tn.mu.Lock()
+	tn.fallbackAt = time.Now()
+	tn.mu.Unlock()
+	tn.fallback()
+	ss := tn.getSession()
+	if ss == nil || ss == old {
+		t.Fatal("expected a new session after fallback")
+	}
+	tn.mu.RLock()
+	addr, at := tn.sessionAddr, tn.fallbackAt
+	tn.mu.RUnlock()
+	if addr != primary || !at.IsZero() {
+		t.Fatalf("sessionAddr = %q, fallbackAt = %v; want %q, zero", addr, at, primary)
+	}
+	if old.IsClosed() {
+		t.Fatal("replaced session closed while a stream was open")
+	}
+	_ = stream.Close()
+	waitFor(t, 2*time.Second, old.IsClosed)
+	if got := s.stats.numSessions.Load(); got != 1 {
+		t.Fatalf("numSessions = %d, want 1", got)
+	}
+}
@@ -118,3 +118,23 @@ func (r *latencyRing) Percentiles() (p50, p90, p99, pmax time.Duration, ok bool)
 	pmax = time.Duration(tmp[n-1])
 	return
 }
+
+// releaseConn calls release once when the conn is first closed. It keeps
+// CloseWrite so the forwarder can still half-close.
+type releaseConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *releaseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *releaseConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}